@@ -0,0 +1,35 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// newAdminServer creates the server for the profiling and runtime debug
+// endpoints. It listens on its own address so they are never exposed on
+// the public port. Responses have no time limit, since profiles take as
+// long as they are asked to, but headers must arrive within
+// readHeaderTimeout.
+func newAdminServer(addr string, readHeaderTimeout time.Duration) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: readHeaderTimeout}
+}
+
+// startAdminServer serves the admin endpoints in the background.
+func startAdminServer(srv *http.Server) {
+	go func() {
+		slog.Info("Serving debug endpoints", "addr", srv.Addr)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			slog.Error("Admin server stopped", "err", err)
+		}
+	}()
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Returned by a ReceiptStore when no API key matches.
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// An API key a client sends in the X-API-Key header. Only a hash of the
+// key is stored; the key itself is shown once, when it is created.
+type APIKey struct {
+	ID        string     `json:"id"`
+	Name      string     `json:"name"`
+	Tenant    string     `json:"tenant,omitempty"`
+	Hash      string     `json:"-"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Request body for POST /admin/keys. Requests made with the key act for
+// its tenant, or the default tenant when it is empty.
+type CreateAPIKeyRequest struct {
+	Name   string `json:"name"`
+	Tenant string `json:"tenant"`
+}
+
+// Response for POST /admin/keys
+type CreateAPIKeyResponse struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+// Response for GET /admin/keys
+type ListAPIKeysResponse struct {
+	Keys []APIKey `json:"keys"`
+}
+
+// hashAPIKey returns the hex SHA-256 of a key, which is how keys are
+// looked up in the store.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// When set, a key created without a tenant gets a tenant of its own, so
+// it only sees the receipts made with it. Set from TENANT_PER_API_KEY.
+var tenantPerAPIKey bool
+
+type apiKeyIDKey struct{}
+
+// apiKeyID returns the ID of the API key the request was made with, or ""
+// when API keys are not required.
+func apiKeyID(ctx context.Context) string {
+	id, _ := ctx.Value(apiKeyIDKey{}).(string)
+	return id
+}
+
+// requireAPIKey is router middleware that turns away requests without a
+// valid X-API-Key. Probes, metrics and the admin API, which has its own
+// token, don't need a key.
+func requireAPIKey(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probePaths[r.URL.Path] || isAdminRoute(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			writeProblem(w, newProblem(http.StatusUnauthorized, codeUnauthorized, "X-API-Key header is required"))
+			return
+		}
+		k, err := lookupAPIKey(r.Context(), key)
+		if err != nil && !errors.Is(err, ErrAPIKeyNotFound) {
+			requestLogger(r).Error("Error checking API key", "err", err)
+			writeProblem(w, storeFailure(err, "Error checking API key"))
+			return
+		}
+		if err != nil {
+			writeProblem(w, newProblem(http.StatusUnauthorized, codeUnauthorized, "Invalid API key"))
+			return
+		}
+		ctx := context.WithValue(r.Context(), apiKeyIDKey{}, k.ID)
+		h.ServeHTTP(w, r.WithContext(withTenant(ctx, k.Tenant)))
+	})
+}
+
+// lookupAPIKey finds the key a client sent. Unknown and revoked keys are
+// both ErrAPIKeyNotFound.
+func lookupAPIKey(ctx context.Context, key string) (APIKey, error) {
+	k, err := store.GetAPIKeyByHash(ctx, hashAPIKey(key))
+	if err == nil && k.RevokedAt != nil {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return k, err
+}
+
+// isAdminRoute reports whether the request matched one of the /admin routes.
+func isAdminRoute(r *http.Request) bool {
+	return strings.HasPrefix(routeTemplate(r), "/admin/")
+}
+
+// requireAdminToken lets a request through only with the operator's token
+// in the X-Admin-Token header.
+func requireAdminToken(token string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(token)) != 1 {
+			writeProblem(w, newProblem(http.StatusUnauthorized, codeUnauthorized, "Invalid admin token"))
+			return
+		}
+		h(w, r)
+	}
+}
+
+// registerAdminRoutes adds the admin endpoints to r, with the deadlines of
+// timeouts.
+func registerAdminRoutes(r *router, token string, timeouts RouteTimeouts) {
+	r.HandleFunc("POST", "/admin/keys", requireAdminToken(token, createAPIKeyHandler))
+	r.HandleFunc("GET", "/admin/keys", requireAdminToken(token, listAPIKeysHandler))
+	r.HandleFunc("DELETE", "/admin/keys/{id}", requireAdminToken(token, revokeAPIKeyHandler))
+	r.HandleFunc("POST", "/admin/webhooks", requireAdminToken(token, createWebhookHandler))
+	r.HandleFunc("GET", "/admin/webhooks", requireAdminToken(token, listWebhooksHandler))
+	r.HandleFunc("DELETE", "/admin/webhooks/{id}", requireAdminToken(token, deleteWebhookHandler))
+	r.HandleFunc("POST", "/admin/receipts/{id}/flags/review", requireAdminToken(token, reviewFlagsHandler))
+	r.HandleFunc("POST", "/admin/recalculate", requireAdminToken(token, recalculateHandler(timeouts.Recalculate)))
+	if receiptEvents != nil {
+		r.HandleFunc("GET", "/admin/events", requireAdminToken(token, eventsHandler(timeouts.Export)))
+	}
+}
+
+// createAPIKeyHandler handles POST /admin/keys
+// The new key is only ever returned in this response.
+func createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateAPIKeyRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		writeProblem(w, unreadableBody(err))
+		return
+	}
+	if err != nil || req.Name == "" {
+		p := newProblem(http.StatusBadRequest, codeInvalidParameter, "A name for the key is required")
+		p.Field = "name"
+		writeProblem(w, p)
+		return
+	}
+	if req.Tenant != "" && !tenantPattern.MatchString(req.Tenant) {
+		p := newProblem(http.StatusBadRequest, codeInvalidParameter, "tenant may only contain letters, digits, '-' and '_'")
+		p.Field = "tenant"
+		writeProblem(w, p)
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		requestLogger(r).Error("Error generating API key", "err", err)
+		writeProblem(w, newProblem(http.StatusInternalServerError, codeInternal, "Error creating API key"))
+		return
+	}
+	key := "rk_" + base64.RawURLEncoding.EncodeToString(secret)
+	k := APIKey{ID: uuid.New().String(), Name: req.Name, Tenant: req.Tenant, Hash: hashAPIKey(key), CreatedAt: time.Now().UTC()}
+	if k.Tenant == "" && tenantPerAPIKey {
+		k.Tenant = "key-" + k.ID
+	}
+	if err := store.CreateAPIKey(r.Context(), k); err != nil {
+		requestLogger(r).Error("Error saving API key", "err", err)
+		writeProblem(w, newProblem(http.StatusInternalServerError, codeInternal, "Error creating API key"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateAPIKeyResponse{APIKey: k, Key: key})
+}
+
+// listAPIKeysHandler handles GET /admin/keys
+func listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := store.ListAPIKeys(r.Context())
+	if err != nil {
+		requestLogger(r).Error("Error listing API keys", "err", err)
+		writeProblem(w, storeFailure(err, "Error listing API keys"))
+		return
+	}
+	if keys == nil {
+		keys = []APIKey{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ListAPIKeysResponse{Keys: keys})
+}
+
+// revokeAPIKeyHandler handles DELETE /admin/keys/{id}
+// The key stops working at once but stays listed, with its revokedAt.
+func revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	err := store.RevokeAPIKey(r.Context(), id, time.Now().UTC())
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		writeProblem(w, newProblem(http.StatusNotFound, codeNotFound, "API key not found"))
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Error revoking API key", "key_id", id, "err", err)
+		writeProblem(w, storeFailure(err, "Error revoking API key"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
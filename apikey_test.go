@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTenantPerAPIKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		perKey      bool
+		tenantB     string
+		wantStatusB int
+		wantTenantB string
+	}{
+		{name: "keys share the default tenant", wantStatusB: http.StatusOK},
+		{name: "tenant per key", perKey: true, wantStatusB: http.StatusNotFound},
+		{name: "tenant per key, tenant given", perKey: true, tenantB: "acme", wantStatusB: http.StatusNotFound, wantTenantB: "acme"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestAPI(t)
+			defer func(v bool) { tenantPerAPIKey = v }(tenantPerAPIKey)
+			tenantPerAPIKey = tt.perKey
+			defer func(public bool) { pointsCachePublic = public }(pointsCachePublic)
+			r, err := newRouter("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			useMiddleware(r, Config{RequestTimeout: time.Second, RequireAPIKey: true}, nil)
+			registerRoutes(r, "", defaultRouteTimeouts)
+			registerAdminRoutes(r, "admin", defaultRouteTimeouts)
+			do := func(method, path, apiKey, body string) *httptest.ResponseRecorder {
+				t.Helper()
+				req := httptest.NewRequest(method, path, strings.NewReader(body))
+				if apiKey != "" {
+					req.Header.Set("X-API-Key", apiKey)
+				} else {
+					req.Header.Set("X-Admin-Token", "admin")
+				}
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, req)
+				return rec
+			}
+			createKey := func(name, tenant string) CreateAPIKeyResponse {
+				t.Helper()
+				body, _ := json.Marshal(CreateAPIKeyRequest{Name: name, Tenant: tenant})
+				rec := do("POST", "/admin/keys", "", string(body))
+				var resp CreateAPIKeyResponse
+				if rec.Code != http.StatusCreated || json.Unmarshal(rec.Body.Bytes(), &resp) != nil {
+					t.Fatalf("creating key: status %d: %s", rec.Code, rec.Body)
+				}
+				return resp
+			}
+
+			a, b := createKey("a", ""), createKey("b", tt.tenantB)
+			if tt.wantTenantB != "" && b.Tenant != tt.wantTenantB {
+				t.Errorf("key b has tenant %q, want %q", b.Tenant, tt.wantTenantB)
+			}
+			if tt.perKey && (a.Tenant == "" || a.Tenant == b.Tenant) {
+				t.Errorf("tenants %q and %q, want one for each key", a.Tenant, b.Tenant)
+			}
+			rec := do("POST", "/receipts/process", a.Key, targetReceipt)
+			var resp ProcessResponse
+			if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil {
+				t.Fatalf("process: status %d: %s", rec.Code, rec.Body)
+			}
+			if rec := do("GET", "/receipts/"+resp.ID+"/points", a.Key, ""); rec.Code != http.StatusOK {
+				t.Errorf("own receipt: status %d, want 200", rec.Code)
+			}
+			if rec := do("GET", "/receipts/"+resp.ID+"/points", b.Key, ""); rec.Code != tt.wantStatusB {
+				t.Errorf("other key's receipt: status %d, want %d", rec.Code, tt.wantStatusB)
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Most receipt IDs accepted by one call to POST /receipts/points:batchGet,
+// set from MAX_POINTS_BATCH_SIZE.
+var maxPointsBatchSize = 100
+
+// Request for POST /receipts/points:batchGet
+type BatchPointsRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// Response for POST /receipts/points:batchGet, with a result for each ID
+// in the order they were asked for.
+type BatchPointsResponse struct {
+	Results []BatchPointsResult `json:"results"`
+}
+
+// The points of one receipt, or, when it wasn't found, the Code not_found
+// and an Error.
+type BatchPointsResult struct {
+	ID     string `json:"id"`
+	Points *int   `json:"points,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Code   string `json:"code,omitempty"`
+}
+
+// PointsBatchGetter is implemented by stores that can look up the points
+// of many receipts at once more cheaply than one at a time.
+type PointsBatchGetter interface {
+	// GetPointsBatch returns the points of the tenant's receipts with the
+	// IDs given, by ID. Receipts that don't exist are left out.
+	GetPointsBatch(ctx context.Context, tenant string, ids []string) (map[string]int, error)
+}
+
+// getPointsBatch looks up the points of many receipts in one go when the
+// store supports it.
+func getPointsBatch(ctx context.Context, s ReceiptStore, tenant string, ids []string) (map[string]int, error) {
+	if bg, ok := s.(PointsBatchGetter); ok {
+		return bg.GetPointsBatch(ctx, tenant, ids)
+	}
+	points := make(map[string]int, len(ids))
+	for _, id := range ids {
+		n, err := s.GetPoints(ctx, tenant, id)
+		if errors.Is(err, ErrReceiptNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		points[id] = n
+	}
+	return points, nil
+}
+
+// batchGetPointsHandler handles POST /receipts/points:batchGet
+// It returns the points of up to MAX_POINTS_BATCH_SIZE receipts, so a
+// page listing many of them needs one request rather than one for each.
+// A receipt that doesn't exist gets a not_found result instead of failing
+// the whole request.
+func batchGetPointsHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeProblem(w, unreadableBody(err))
+		return
+	}
+	body, p := requestJSON(r, body)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+	var req BatchPointsRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, codeInvalidJSON, "Invalid JSON payload: expected {\"ids\": [...]}"))
+		return
+	}
+	if len(req.IDs) == 0 {
+		p := newProblem(http.StatusBadRequest, codeInvalidParameter, "ids must list at least one receipt ID")
+		p.Field = "ids"
+		writeProblem(w, p)
+		return
+	}
+	if len(req.IDs) > maxPointsBatchSize {
+		writeProblem(w, newProblem(http.StatusBadRequest, codeBatchTooLarge, fmt.Sprintf("Batch too large: at most %d receipt IDs", maxPointsBatchSize)))
+		return
+	}
+
+	points, err := getPointsBatch(r.Context(), store, tenantFrom(r.Context()), req.IDs)
+	if err != nil {
+		requestLogger(r).Error("Error loading receipts", "err", err)
+		writeProblem(w, storeFailure(err, "Error loading receipts"))
+		return
+	}
+
+	resp := BatchPointsResponse{Results: make([]BatchPointsResult, len(req.IDs))}
+	for i, id := range req.IDs {
+		resp.Results[i].ID = id
+		if n, ok := points[id]; ok {
+			resp.Results[i].Points = &n
+		} else {
+			resp.Results[i].Error = "Receipt not found"
+			resp.Results[i].Code = codeNotFound
+		}
+	}
+	writeResponse(w, r, resp, nil)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The built-in rules in the order they are applied. Each is built from the
+// rule set and may return nil when the rule set turns it off.
+var builtinRules = []ruleFactory{
+	func(rs *RuleSet) Rule {
+		return retailerNameRule{pointsPerChar: rs.RetailerCharPoints, unicode: rs.RetailerCharMode == "unicode"}
+	},
+	func(rs *RuleSet) Rule { return roundDollarRule{points: rs.RoundDollarPoints} },
+	func(rs *RuleSet) Rule { return quarterMultipleRule{points: rs.QuarterMultiplePoints} },
+	func(rs *RuleSet) Rule { return itemPairsRule{points: rs.ItemPairPoints} },
+	func(rs *RuleSet) Rule {
+		if rs.SamePriceRunPoints == 0 {
+			return nil
+		}
+		return samePriceRunsRule{points: rs.SamePriceRunPoints}
+	},
+	func(rs *RuleSet) Rule {
+		return itemDescriptionRule{
+			lengthMultiple: rs.DescriptionLengthMultiple,
+			multiplier:     rs.descriptionMultiplier,
+			minPrice:       rs.minDescriptionItemPrice,
+		}
+	},
+	func(rs *RuleSet) Rule {
+		if len(rs.patterns) == 0 {
+			return nil
+		}
+		return descriptionPatternRule{patterns: rs.patterns, points: rs.DescriptionPatterns}
+	},
+	func(rs *RuleSet) Rule { return oddDayRule{points: rs.OddDayPoints} },
+	func(rs *RuleSet) Rule {
+		return afternoonRule{
+			start:  rs.afternoonStart.Hour()*60 + rs.afternoonStart.Minute(),
+			end:    rs.afternoonEnd.Hour()*60 + rs.afternoonEnd.Minute(),
+			points: rs.AfternoonPoints,
+		}
+	},
+	func(rs *RuleSet) Rule {
+		if len(rs.HourPoints) == 0 {
+			return nil
+		}
+		return purchaseHourRule{hourPoints: rs.HourPoints}
+	},
+}
+
+// One point for every alphanumeric character in the retailer name: A-Z,
+// a-z and 0-9, or with unicode any letter or digit, so "Übermarkt" has 9
+// rather than 8 and "東京ストア" has 5 rather than none.
+type retailerNameRule struct {
+	pointsPerChar int
+	unicode       bool
+}
+
+func (retailerNameRule) Name() string { return "retailerName" }
+
+func (r retailerNameRule) Apply(receipt Receipt) int {
+	chars := 0
+	for _, c := range receipt.Retailer {
+		if c >= utf8.RuneSelf && !r.unicode {
+			continue
+		}
+		if unicode.IsLetter(c) || unicode.IsDigit(c) {
+			chars++
+		}
+	}
+	return chars * r.pointsPerChar
+}
+
+// 50 points if the total is a round dollar amount with no cents.
+type roundDollarRule struct{ points int }
+
+func (roundDollarRule) Name() string { return "roundDollar" }
+
+func (r roundDollarRule) Apply(receipt Receipt) int {
+	total, _ := parseCents(receipt.Total)
+	if total%100 == 0 {
+		return r.points
+	}
+	return 0
+}
+
+func (r roundDollarRule) Hint(receipt Receipt) string {
+	return missedMultipleHint(receipt, 100, "a round dollar amount")
+}
+
+// 25 points if the total is a multiple of 0.25.
+type quarterMultipleRule struct{ points int }
+
+func (quarterMultipleRule) Name() string { return "quarterMultiple" }
+
+func (r quarterMultipleRule) Apply(receipt Receipt) int {
+	total, _ := parseCents(receipt.Total)
+	if total%25 == 0 {
+		return r.points
+	}
+	return 0
+}
+
+func (r quarterMultipleRule) Hint(receipt Receipt) string {
+	return missedMultipleHint(receipt, 25, "a multiple of 0.25")
+}
+
+// missedMultipleHint says how far the total was below the next multiple
+// of cents, which is what it missed.
+func missedMultipleHint(receipt Receipt, cents int64, what string) string {
+	total, _ := parseCents(receipt.Total)
+	if total%cents == 0 {
+		return ""
+	}
+	short := cents - total%cents
+	return fmt.Sprintf("total %s missed %s by %d.%02d", receipt.Total, what, short/100, short%100)
+}
+
+// 5 points for every two items on the receipt.
+type itemPairsRule struct{ points int }
+
+func (itemPairsRule) Name() string { return "itemPairs" }
+
+func (r itemPairsRule) Apply(receipt Receipt) int {
+	return (len(receipt.Items) / 2) * r.points
+}
+
+// Points for each run of consecutive items sharing a price.
+type samePriceRunsRule struct{ points int }
+
+func (samePriceRunsRule) Name() string { return "samePriceRuns" }
+
+func (r samePriceRunsRule) Apply(receipt Receipt) int {
+	runs, _ := countSamePriceRuns(receipt.Items)
+	return runs * r.points
+}
+
+// If the trimmed length of an item description is a multiple of 3, the
+// item earns its price times 0.2, rounded up. Items cheaper than minPrice
+// are skipped so the bonus can't be farmed. The multiplier is in
+// millionths and minPrice in cents, so a price of 15.00 earns exactly 3
+// points rather than the 4 that 15.0*0.2 rounds up to in floating point.
+type itemDescriptionRule struct {
+	lengthMultiple int
+	multiplier     int64
+	minPrice       int64
+}
+
+func (itemDescriptionRule) Name() string { return "itemDescription" }
+
+func (r itemDescriptionRule) Apply(receipt Receipt) int {
+	points, _ := r.ApplyItems(receipt)
+	return points
+}
+
+func (r itemDescriptionRule) ApplyItems(receipt Receipt) (points, items int) {
+	for _, item := range receipt.Items {
+		desc := strings.TrimSpace(item.ShortDescription)
+		if len(desc)%r.lengthMultiple != 0 {
+			continue
+		}
+		price, _ := parseCents(item.Price)
+		if price < r.minPrice {
+			continue
+		}
+		points += int(ceilDiv(price, r.multiplier, 100*multiplierScale))
+		items++
+	}
+	return points, items
+}
+
+// Configured points for every pattern an item description matches.
+// patterns[i] is the compiled form of points[i].Pattern.
+type descriptionPatternRule struct {
+	patterns []*regexp.Regexp
+	points   []PatternPoints
+}
+
+func (descriptionPatternRule) Name() string { return "descriptionPattern" }
+
+func (r descriptionPatternRule) Apply(receipt Receipt) int {
+	points := 0
+	for _, item := range receipt.Items {
+		desc := strings.TrimSpace(item.ShortDescription)
+		for i, re := range r.patterns {
+			if re.MatchString(desc) {
+				points += r.points[i].Points
+			}
+		}
+	}
+	return points
+}
+
+// 6 points if the day in the purchase date is odd.
+type oddDayRule struct{ points int }
+
+func (oddDayRule) Name() string { return "oddDay" }
+
+func (r oddDayRule) Apply(receipt Receipt) int {
+	if purchaseDay(receipt.PurchaseDate)%2 == 1 {
+		return r.points
+	}
+	return 0
+}
+
+// 10 points if the time of purchase is after 2:00pm and before 4:00pm.
+// start and end are in minutes after midnight.
+type afternoonRule struct {
+	start, end int
+	points     int
+}
+
+func (afternoonRule) Name() string { return "afternoon" }
+
+func (r afternoonRule) Apply(receipt Receipt) int {
+	hour, minute := purchaseClock(receipt.PurchaseTime)
+	if t := hour*60 + minute; t > r.start && t < r.end {
+		return r.points
+	}
+	return 0
+}
+
+// afternoonHintMinutes is how close to the afternoon window a purchase
+// must be for a hint.
+const afternoonHintMinutes = 60
+
+func (r afternoonRule) Hint(receipt Receipt) string {
+	hour, minute := purchaseClock(receipt.PurchaseTime)
+	t := hour*60 + minute
+	clock := func(m int) string { return fmt.Sprintf("%02d:%02d", m/60, m%60) }
+	switch {
+	case t <= r.start && r.start-t <= afternoonHintMinutes:
+		return fmt.Sprintf("purchase at %s was %d minutes before the afternoon window, which starts after %s", receipt.PurchaseTime, r.start-t, clock(r.start))
+	case t >= r.end && t-r.end <= afternoonHintMinutes:
+		return fmt.Sprintf("purchase at %s was %d minutes after the afternoon window, which ends before %s", receipt.PurchaseTime, t-r.end, clock(r.end))
+	}
+	return ""
+}
+
+// Configured points for the hour the purchase was made in.
+type purchaseHourRule struct{ hourPoints map[int]int }
+
+func (purchaseHourRule) Name() string { return "purchaseHour" }
+
+func (r purchaseHourRule) Apply(receipt Receipt) int {
+	hour, _ := purchaseClock(receipt.PurchaseTime)
+	return r.hourPoints[hour]
+}
+
+// ceilDiv returns a*b/c rounded up, for non-negative a and b and positive
+// c, without overflowing on the way.
+func ceilDiv(a, b, c int64) int64 {
+	hi, lo := bits.Mul64(uint64(a), uint64(b))
+	q, r := bits.Div64(hi, lo, uint64(c))
+	if r != 0 {
+		q++
+	}
+	return int64(q)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    Rule
+		receipt Receipt
+		want    int
+	}{
+		{name: "retailer name", rule: retailerNameRule{pointsPerChar: 1}, receipt: Receipt{Retailer: "M&M Corner Market"}, want: 14},
+		{name: "retailer name per char", rule: retailerNameRule{pointsPerChar: 2}, receipt: Receipt{Retailer: "Target"}, want: 12},
+		{name: "round dollar", rule: roundDollarRule{points: 50}, receipt: Receipt{Total: "9.00"}, want: 50},
+		{name: "not round dollar", rule: roundDollarRule{points: 50}, receipt: Receipt{Total: "9.01"}, want: 0},
+		{name: "quarter multiple", rule: quarterMultipleRule{points: 25}, receipt: Receipt{Total: "9.75"}, want: 25},
+		{name: "not quarter multiple", rule: quarterMultipleRule{points: 25}, receipt: Receipt{Total: "9.10"}, want: 0},
+		{name: "item pairs", rule: itemPairsRule{points: 5}, receipt: Receipt{Items: make([]Item, 5)}, want: 10},
+		{
+			name:    "item description",
+			rule:    itemDescriptionRule{lengthMultiple: 3, multiplier: 200_000},
+			receipt: Receipt{Items: []Item{{ShortDescription: "Emils Cheese Pizza", Price: "12.25"}, {ShortDescription: "Bread", Price: "9.00"}}},
+			want:    3,
+		},
+		{
+			name:    "item description exact",
+			rule:    itemDescriptionRule{lengthMultiple: 3, multiplier: 200_000},
+			receipt: Receipt{Items: []Item{{ShortDescription: "Pie", Price: "15.00"}}},
+			want:    3,
+		},
+		{name: "odd day", rule: oddDayRule{points: 6}, receipt: Receipt{PurchaseDate: "2022-01-01"}, want: 6},
+		{name: "even day", rule: oddDayRule{points: 6}, receipt: Receipt{PurchaseDate: "2022-01-02"}, want: 0},
+		{name: "afternoon", rule: afternoonRule{start: 14 * 60, end: 16 * 60, points: 10}, receipt: Receipt{PurchaseTime: "14:33"}, want: 10},
+		{name: "afternoon start excluded", rule: afternoonRule{start: 14 * 60, end: 16 * 60, points: 10}, receipt: Receipt{PurchaseTime: "14:00"}, want: 0},
+		{name: "afternoon end excluded", rule: afternoonRule{start: 14 * 60, end: 16 * 60, points: 10}, receipt: Receipt{PurchaseTime: "16:00"}, want: 0},
+		{name: "purchase hour", rule: purchaseHourRule{hourPoints: map[int]int{9: 2}}, receipt: Receipt{PurchaseTime: "09:30"}, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule.Apply(tt.receipt); got != tt.want {
+				t.Errorf("%s = %d, want %d", tt.rule.Name(), got, tt.want)
+			}
+		})
+	}
+}
+
+// A retailer-specific bonus, the kind of rule registerRule is for
+type retailerBonusRule struct{ retailer string }
+
+func (retailerBonusRule) Name() string { return "retailerBonus" }
+
+func (r retailerBonusRule) Apply(receipt Receipt) int {
+	if strings.EqualFold(receipt.Retailer, r.retailer) {
+		return 100
+	}
+	return 0
+}
+
+func TestRegisterRule(t *testing.T) {
+	defer func(prev []ruleFactory) { customRules = prev }(customRules)
+	registerRule(func(rs *RuleSet) Rule { return retailerBonusRule{retailer: "Target"} })
+	registerRule(func(rs *RuleSet) Rule { return nil })
+	withRules(t, defaultRules())
+
+	tests := []struct {
+		retailer string
+		want     int
+	}{
+		{retailer: "Target", want: 100},
+		{retailer: "Walgreens", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.retailer, func(t *testing.T) {
+			receipt := Receipt{Retailer: tt.retailer, PurchaseDate: "2022-01-02", PurchaseTime: "10:00", Total: "1.01"}
+			b, err := calculatePoints(context.Background(), receipt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last := b.Rules[len(b.Rules)-1]; last.Rule != "retailerBonus" || last.Points != tt.want {
+				t.Errorf("last rule %s gave %d, want retailerBonus giving %d", last.Rule, last.Points, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetailerNameUnicode(t *testing.T) {
+	tests := []struct {
+		retailer    string
+		wantASCII   int
+		wantUnicode int
+	}{
+		{retailer: "Target", wantASCII: 6, wantUnicode: 6},
+		{retailer: "Übermarkt", wantASCII: 8, wantUnicode: 9},
+		{retailer: "東京ストア", wantASCII: 0, wantUnicode: 5},
+		{retailer: "Café 24", wantASCII: 5, wantUnicode: 6},
+		{retailer: "Ｔａｒｇｅｔ", wantASCII: 0, wantUnicode: 6},
+		{retailer: "٣ Kebab", wantASCII: 5, wantUnicode: 6},
+		{retailer: "M&M 🛒", wantASCII: 2, wantUnicode: 2},
+		{retailer: "", wantASCII: 0, wantUnicode: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.retailer, func(t *testing.T) {
+			receipt := Receipt{Retailer: tt.retailer}
+			if got := (retailerNameRule{pointsPerChar: 1}).Apply(receipt); got != tt.wantASCII {
+				t.Errorf("ascii = %d, want %d", got, tt.wantASCII)
+			}
+			if got := (retailerNameRule{pointsPerChar: 1, unicode: true}).Apply(receipt); got != tt.wantUnicode {
+				t.Errorf("unicode = %d, want %d", got, tt.wantUnicode)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+// Package client calls the receipt processor's HTTP API.
+//
+//	c := client.New("https://receipts.example.com", client.WithAPIKey(key))
+//	id, err := c.ProcessReceipt(ctx, receipt)
+//	points, err := c.GetPoints(ctx, id)
+//
+// Failed calls are retried with exponential backoff when the server is
+// overloaded or unreachable. Submitting a receipt sends an Idempotency-Key,
+// so a retried submission never stores the receipt twice.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A receipt as the API accepts it. Amounts are strings such as "6.49".
+type Receipt struct {
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime"`
+	Total        string `json:"total"`
+	Items        []Item `json:"items"`
+	// ISO 4217 code of the currency the amounts are in, USD when empty.
+	Currency string `json:"currency,omitempty"`
+	// IANA time zone of the purchase, such as America/Chicago. When set,
+	// purchaseDate and purchaseTime are in UTC.
+	Timezone string `json:"timezone,omitempty"`
+	// The loyalty member the points go to, if any.
+	UserID string `json:"userId,omitempty"`
+}
+
+// A single item in the receipt
+type Item struct {
+	ShortDescription string `json:"shortDescription"`
+	Price            string `json:"price"`
+}
+
+// Error is returned when the API answers with an error. The fields come
+// from the problem details body; Code tells the errors apart, such as
+// "invalid_receipt" or "not_found", and Field names the offending field.
+type Error struct {
+	StatusCode int    `json:"status"`
+	Title      string `json:"title"`
+	Code       string `json:"code"`
+	Detail     string `json:"detail"`
+	Field      string `json:"field"`
+}
+
+func (e *Error) Error() string {
+	if e.Detail == "" {
+		return fmt.Sprintf("receipts API: %d %s", e.StatusCode, e.Title)
+	}
+	return fmt.Sprintf("receipts API: %d %s", e.StatusCode, e.Detail)
+}
+
+// Client calls the API at one base URL. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	apiKey     string
+	token      string
+	tenant     string
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// An Option changes how a Client is set up.
+type Option func(*Client)
+
+// WithHTTPClient sends requests with hc instead of a client with a 30
+// second timeout.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithAPIKey sends key in the X-API-Key header.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithBearerToken sends token in the Authorization header.
+func WithBearerToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithTenant sends tenant in the X-Tenant-ID header. It has no effect when
+// the API key or token decides the tenant.
+func WithTenant(tenant string) Option {
+	return func(c *Client) { c.tenant = tenant }
+}
+
+// WithRetries retries a failed call up to n times, waiting min before the
+// first retry and doubling up to max. The default is 3 retries from 200ms
+// up to 5s; n of 0 turns retries off.
+func WithRetries(n int, min, max time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = n
+		c.minBackoff = min
+		c.maxBackoff = max
+	}
+}
+
+// New returns a Client for the API at baseURL, such as
+// "http://localhost:8080".
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: &http.Client{Timeout: 30 * time.Second},
+		maxRetries: 3,
+		minBackoff: 200 * time.Millisecond,
+		maxBackoff: 5 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ProcessReceipt submits a receipt and returns its ID.
+func (c *Client) ProcessReceipt(ctx context.Context, receipt Receipt) (string, error) {
+	body, err := json.Marshal(receipt)
+	if err != nil {
+		return "", err
+	}
+	key, err := newIdempotencyKey()
+	if err != nil {
+		return "", err
+	}
+	var resp struct {
+		ID string `json:"id"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/receipts/process", body, key, &resp); err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+// GetPoints returns the points the receipt with the given ID was awarded.
+// A receipt that doesn't exist is an *Error with StatusCode 404.
+func (c *Client) GetPoints(ctx context.Context, id string) (int, error) {
+	var resp struct {
+		Points int `json:"points"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/receipts/"+url.PathEscape(id)+"/points", nil, "", &resp); err != nil {
+		return 0, err
+	}
+	return resp.Points, nil
+}
+
+// GetPointsBatch returns the points of the receipts with the given IDs,
+// by ID, in one request. Receipts that don't exist are left out. The
+// server accepts up to 100 IDs by default.
+func (c *Client) GetPointsBatch(ctx context.Context, ids []string) (map[string]int, error) {
+	body, err := json.Marshal(map[string][]string{"ids": ids})
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Results []struct {
+			ID     string `json:"id"`
+			Points *int   `json:"points"`
+		} `json:"results"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/v1/receipts/points:batchGet", body, "", &resp); err != nil {
+		return nil, err
+	}
+	points := make(map[string]int, len(resp.Results))
+	for _, r := range resp.Results {
+		if r.Points != nil {
+			points[r.ID] = *r.Points
+		}
+	}
+	return points, nil
+}
+
+// do sends a request, retrying it while the failure looks temporary, and
+// decodes a successful JSON response into out.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, idempotencyKey string, out any) error {
+	for attempt := 0; ; attempt++ {
+		retryAfter, err := c.try(ctx, method, path, body, idempotencyKey, out)
+		if err == nil || retryAfter < 0 || attempt >= c.maxRetries {
+			return err
+		}
+		wait := c.backoff(attempt)
+		if retryAfter > wait {
+			wait = retryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// try sends the request once. When it fails in a way worth retrying,
+// retryAfter is how long the server asked to wait, or 0; it is -1 when
+// the call must not be retried.
+func (c *Client) try(ctx context.Context, method, path string, body []byte, idempotencyKey string, out any) (retryAfter time.Duration, err error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	if c.tenant != "" {
+		req.Header.Set("X-Tenant-ID", c.tenant)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		apiErr := &Error{StatusCode: resp.StatusCode, Title: http.StatusText(resp.StatusCode)}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		json.Unmarshal(data, apiErr)
+		apiErr.StatusCode = resp.StatusCode
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			secs, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			return time.Duration(secs) * time.Second, apiErr
+		}
+		return -1, apiErr
+	}
+	if out == nil {
+		return 0, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return -1, fmt.Errorf("decoding response: %w", err)
+	}
+	return 0, nil
+}
+
+// backoff is the wait before retry attempt+1: doubling from minBackoff up
+// to maxBackoff, with up to half of it taken off at random so clients that
+// failed together don't retry together.
+func (c *Client) backoff(attempt int) time.Duration {
+	d := c.minBackoff << attempt
+	if d > c.maxBackoff || d <= 0 {
+		d = c.maxBackoff
+	}
+	if half := int64(d / 2); half > 0 {
+		if n, err := rand.Int(rand.Reader, big.NewInt(half)); err == nil {
+			d -= time.Duration(n.Int64())
+		}
+	}
+	return d
+}
+
+// newIdempotencyKey returns a random key for one receipt submission.
+func newIdempotencyKey() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
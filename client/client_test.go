@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProcessReceipt(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		wantErr  string
+		wantKeys int
+	}{
+		{name: "accepted", statuses: []int{http.StatusOK}, wantKeys: 1},
+		{name: "retried while unavailable", statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}, wantKeys: 3},
+		{name: "gives up after the retries", statuses: []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable}, wantErr: "timeout", wantKeys: 4},
+		{name: "invalid receipt not retried", statuses: []int{http.StatusBadRequest}, wantErr: "invalid_receipt", wantKeys: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var keys []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/v1/receipts/process" {
+					t.Errorf("request %s %s", r.Method, r.URL.Path)
+				}
+				keys = append(keys, r.Header.Get("Idempotency-Key"))
+				switch status := tt.statuses[len(keys)-1]; status {
+				case http.StatusOK:
+					w.Write([]byte(`{"id": "abc"}`))
+				case http.StatusBadRequest:
+					w.WriteHeader(status)
+					w.Write([]byte(`{"status": 400, "code": "invalid_receipt", "field": "total"}`))
+				default:
+					w.WriteHeader(status)
+					w.Write([]byte(`{"code": "timeout"}`))
+				}
+			}))
+			defer srv.Close()
+
+			c := New(srv.URL, WithRetries(3, time.Millisecond, time.Millisecond))
+			id, err := c.ProcessReceipt(context.Background(), Receipt{Retailer: "Target"})
+			var apiErr *Error
+			switch {
+			case tt.wantErr == "" && (err != nil || id != "abc"):
+				t.Errorf("ProcessReceipt = %q, %v, want abc", id, err)
+			case tt.wantErr != "" && (!errors.As(err, &apiErr) || apiErr.Code != tt.wantErr):
+				t.Errorf("ProcessReceipt error %v, want code %s", err, tt.wantErr)
+			}
+			if len(keys) != tt.wantKeys {
+				t.Fatalf("%d requests, want %d", len(keys), tt.wantKeys)
+			}
+			for _, key := range keys {
+				if key == "" || key != keys[0] {
+					t.Errorf("Idempotency-Keys %q, want one key for every attempt", keys)
+				}
+			}
+		})
+	}
+}
+
+func TestGetPointsContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	c := New(srv.URL, WithRetries(10, time.Second, time.Second))
+	if _, err := c.GetPoints(ctx, "abc"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetPoints error %v, want the context's deadline", err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/EnochQin1/FetchReceiptProcessor/client"
+)
+
+// The columns a receipts CSV must have, in any order, named in its header
+// row. items lists "description:price" pairs separated by "|", such as
+// "Gatorade:2.25|Doritos Nacho Cheese:3.35". A currency column may be
+// added too.
+var csvColumns = []string{"retailer", "purchaseDate", "purchaseTime", "total", "items"}
+
+// readCSV reads one receipt per row. A row that can't be read becomes a
+// source with an error, so the rest of the file is still submitted.
+func readCSV(name string, r io.Reader) ([]source, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading header: %w", err)
+	}
+	col := map[string]int{}
+	for i, h := range header {
+		col[strings.TrimSpace(h)] = i
+	}
+	for _, c := range csvColumns {
+		if _, ok := col[c]; !ok {
+			return nil, fmt.Errorf("missing column %q", c)
+		}
+	}
+
+	var srcs []source
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return srcs, nil
+		}
+		if err != nil {
+			var pe *csv.ParseError
+			if !errors.As(err, &pe) {
+				return nil, err
+			}
+			srcs = append(srcs, source{name: fmt.Sprintf("%s:%d", name, pe.StartLine), err: err})
+			continue
+		}
+		line, _ := cr.FieldPos(0)
+		src := source{name: fmt.Sprintf("%s:%d", name, line)}
+		field := func(c string) string {
+			if i, ok := col[c]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+		src.receipt = client.Receipt{
+			Retailer:     field("retailer"),
+			PurchaseDate: field("purchaseDate"),
+			PurchaseTime: field("purchaseTime"),
+			Total:        field("total"),
+			Currency:     field("currency"),
+		}
+		src.receipt.Items, src.err = parseCSVItems(field("items"))
+		srcs = append(srcs, src)
+	}
+}
+
+// parseCSVItems parses the items column. The price follows the last ':',
+// so descriptions may contain colons.
+func parseCSVItems(s string) ([]client.Item, error) {
+	items := []client.Item{}
+	if strings.TrimSpace(s) == "" {
+		return items, nil
+	}
+	for _, part := range strings.Split(s, "|") {
+		i := strings.LastIndex(part, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("item %q is not description:price", part)
+		}
+		items = append(items, client.Item{ShortDescription: part[:i], Price: strings.TrimSpace(part[i+1:])})
+	}
+	return items, nil
+}
@@ -0,0 +1,197 @@
+// Command receiptctl submits receipts to the receipt processor and looks
+// up their points. It is meant for support staff and smoke tests.
+//
+//	receiptctl submit receipt.json receipts/ export.csv
+//	receiptctl points 7fb1377b-b223-49d9-a31a-5a02701dd310
+//
+// submit takes JSON files, directories of JSON files and CSV files, and
+// prints the source, ID and points of every receipt. The server and
+// credentials come from flags or RECEIPTS_URL, RECEIPTS_API_KEY,
+// RECEIPTS_TOKEN and RECEIPTS_TENANT.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/EnochQin1/FetchReceiptProcessor/client"
+)
+
+func main() {
+	fs := flag.NewFlagSet("receiptctl", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: receiptctl [flags] submit FILE|DIR...\n       receiptctl [flags] points ID...\n\nflags:\n")
+		fs.PrintDefaults()
+	}
+	baseURL := fs.String("url", envString("RECEIPTS_URL", "http://localhost:8080"), "address of the receipt processor (RECEIPTS_URL)")
+	apiKey := fs.String("api-key", os.Getenv("RECEIPTS_API_KEY"), "API key to send (RECEIPTS_API_KEY)")
+	token := fs.String("token", os.Getenv("RECEIPTS_TOKEN"), "bearer token to send (RECEIPTS_TOKEN)")
+	tenant := fs.String("tenant", os.Getenv("RECEIPTS_TENANT"), "tenant to act for (RECEIPTS_TENANT)")
+	timeout := fs.Duration("timeout", 30*time.Second, "time allowed for each receipt")
+	fs.Parse(os.Args[1:])
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	opts := []client.Option{client.WithHTTPClient(&http.Client{Timeout: *timeout})}
+	if *apiKey != "" {
+		opts = append(opts, client.WithAPIKey(*apiKey))
+	}
+	if *token != "" {
+		opts = append(opts, client.WithBearerToken(*token))
+	}
+	if *tenant != "" {
+		opts = append(opts, client.WithTenant(*tenant))
+	}
+	c := client.New(*baseURL, opts...)
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	var ok bool
+	switch cmd, args := fs.Arg(0), fs.Args()[1:]; cmd {
+	case "submit":
+		ok = submit(c, out, args, *timeout)
+	case "points":
+		ok = points(c, out, args, *timeout)
+	default:
+		fmt.Fprintf(os.Stderr, "receiptctl: unknown command %q\n", cmd)
+		fs.Usage()
+		os.Exit(2)
+	}
+	out.Flush()
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// A receipt read from a file, with where it came from, such as
+// "export.csv:3" for the third line of a CSV.
+type source struct {
+	name    string
+	receipt client.Receipt
+	err     error
+}
+
+// submit sends every receipt found in paths and prints its ID and points.
+// It reports whether all of them were accepted.
+func submit(c *client.Client, out io.Writer, paths []string, timeout time.Duration) bool {
+	fmt.Fprintln(out, "SOURCE\tID\tPOINTS")
+	ok := true
+	for _, path := range paths {
+		srcs, err := readReceipts(path)
+		if err != nil {
+			fmt.Fprintf(out, "%s\t-\terror: %v\n", path, err)
+			ok = false
+			continue
+		}
+		for _, src := range srcs {
+			if src.err != nil {
+				fmt.Fprintf(out, "%s\t-\terror: %v\n", src.name, src.err)
+				ok = false
+				continue
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			id, err := c.ProcessReceipt(ctx, src.receipt)
+			var pts int
+			if err == nil {
+				pts, err = c.GetPoints(ctx, id)
+			}
+			cancel()
+			if err != nil {
+				fmt.Fprintf(out, "%s\t%s\terror: %v\n", src.name, orDash(id), err)
+				ok = false
+				continue
+			}
+			fmt.Fprintf(out, "%s\t%s\t%d\n", src.name, id, pts)
+		}
+	}
+	return ok
+}
+
+// points prints the points of each receipt ID. It reports whether all of
+// them were found.
+func points(c *client.Client, out io.Writer, ids []string, timeout time.Duration) bool {
+	fmt.Fprintln(out, "ID\tPOINTS")
+	ok := true
+	for _, id := range ids {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		pts, err := c.GetPoints(ctx, id)
+		cancel()
+		var apiErr *client.Error
+		switch {
+		case errors.As(err, &apiErr) && apiErr.StatusCode == 404:
+			fmt.Fprintf(out, "%s\tnot found\n", id)
+			ok = false
+		case err != nil:
+			fmt.Fprintf(out, "%s\terror: %v\n", id, err)
+			ok = false
+		default:
+			fmt.Fprintf(out, "%s\t%d\n", id, pts)
+		}
+	}
+	return ok
+}
+
+// readReceipts reads the receipts in a JSON file, a CSV file or a directory
+// of JSON files.
+func readReceipts(path string) ([]source, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		files, err := filepath.Glob(filepath.Join(path, "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		var srcs []source
+		for _, f := range files {
+			srcs = append(srcs, readJSON(f))
+		}
+		return srcs, nil
+	}
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return readCSV(path, f)
+	}
+	return []source{readJSON(path)}, nil
+}
+
+func readJSON(path string) source {
+	src := source{name: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		src.err = err
+		return src
+	}
+	src.err = json.Unmarshal(data, &src.receipt)
+	return src
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+// Media type of MessagePack bodies. application/x-msgpack and
+// application/vnd.msgpack are understood too.
+const msgpackType = "application/msgpack"
+
+// A wire format for request and response bodies besides JSON. Handlers
+// read and write JSON as always; bodies in another format are converted
+// on the way in and out, so they hold exactly what the JSON would.
+type codec struct {
+	mediaType string
+	// The Problem code of a body that can't be decoded
+	invalidCode string
+	// decode reads a body into the values encoding/json decodes into any.
+	decode func(body []byte) (any, error)
+	// encode writes such values as a body.
+	encode func(v any) ([]byte, error)
+}
+
+// The wire formats besides JSON, by the media types that select them
+var codecs = map[string]codec{
+	msgpackType:               msgpackCodec,
+	"application/x-msgpack":   msgpackCodec,
+	"application/vnd.msgpack": msgpackCodec,
+}
+
+var msgpackCodec = codec{
+	mediaType:   msgpackType,
+	invalidCode: codeInvalidMsgpack,
+	decode: func(body []byte) (any, error) {
+		var v any
+		err := msgpack.Unmarshal(body, &v)
+		return v, err
+	},
+	encode: func(v any) ([]byte, error) {
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		// Sorted, so the same response has the same ETag.
+		enc.SetSortMapKeys(true)
+		err := enc.Encode(v)
+		return buf.Bytes(), err
+	},
+}
+
+// receiptPayload returns a submitted receipt as JSON: a ReceiptBody when
+// it is protobuf, a <receipt> element when it is XML, and otherwise
+// whatever requestJSON makes of it.
+func receiptPayload(r *http.Request, body []byte) ([]byte, *Problem) {
+	switch {
+	case sentProtobuf(r):
+		return protobufReceipt(body)
+	case sentXML(r):
+		return xmlReceipt(body)
+	}
+	return requestJSON(r, body)
+}
+
+// requestJSON returns a request body as JSON, converting it from the
+// format its Content-Type names. Bodies that aren't in a format of codecs
+// are taken to be JSON.
+func requestJSON(r *http.Request, body []byte) ([]byte, *Problem) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	c, ok := codecs[mediaType]
+	if !ok {
+		return body, nil
+	}
+	v, err := c.decode(body)
+	if err == nil {
+		body, err = json.Marshal(v)
+	}
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, c.invalidCode, "Invalid "+c.mediaType+" payload")
+	}
+	return body, nil
+}
+
+// responseType returns the media type to answer r in: whichever of JSON,
+// protobuf and the formats of codecs the client prefers in Accept, going by
+// q and then the order they are listed, or JSON when it names none.
+func responseType(r *http.Request) string {
+	best, bestQ := "application/json", 0.0
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err != nil {
+				continue
+			}
+			if c, ok := codecs[mediaType]; ok {
+				mediaType = c.mediaType
+			} else if mediaType != "application/json" && mediaType != protobufType {
+				continue
+			}
+			q := 1.0
+			if v, ok := params["q"]; ok {
+				if q, err = strconv.ParseFloat(v, 64); err != nil {
+					continue
+				}
+			}
+			if q > bestQ {
+				best, bestQ = mediaType, q
+			}
+		}
+	}
+	return best
+}
+
+// encodeResponse returns v as a body in the format the client asked for,
+// and its media type: pb as protobuf when there is a message for the
+// response in receipts.proto, otherwise v as JSON converted to that
+// format. Without a format it can give, v is JSON.
+func encodeResponse(r *http.Request, v any, pb proto.Message) (body []byte, mediaType string, err error) {
+	mediaType = responseType(r)
+	if mediaType == protobufType && pb != nil {
+		body, err = protobufMarshal.Marshal(pb)
+		return body, mediaType, err
+	}
+	body, err = json.Marshal(v)
+	if err != nil {
+		return nil, "", err
+	}
+	c, ok := codecs[mediaType]
+	if !ok {
+		return append(body, '\n'), "application/json", nil
+	}
+	tree, err := jsonValues(body)
+	if err != nil {
+		return nil, "", err
+	}
+	body, err = c.encode(tree)
+	return body, c.mediaType, err
+}
+
+// jsonValues decodes JSON into the values encoding/json decodes into any,
+// except that whole numbers are int64 rather than float64, so they stay
+// integers in other formats.
+func jsonValues(data []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return withoutJSONNumbers(v), nil
+}
+
+func withoutJSONNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case []any:
+		for i := range v {
+			v[i] = withoutJSONNumbers(v[i])
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = withoutJSONNumbers(v[k])
+		}
+	}
+	return v
+}
+
+// writeResponse answers with v in the format the client asked for, as
+// encodeResponse picks it. Problems are always JSON.
+func writeResponse(w http.ResponseWriter, r *http.Request, v any, pb proto.Message) {
+	writeResponseStatus(w, r, http.StatusOK, v, pb)
+}
+
+// writeResponseStatus is writeResponse with a status other than 200.
+func writeResponseStatus(w http.ResponseWriter, r *http.Request, status int, v any, pb proto.Message) {
+	body, mediaType, err := encodeResponse(r, v, pb)
+	if err != nil {
+		writeProblem(w, newProblem(http.StatusInternalServerError, codeInternal, "Error encoding response"))
+		return
+	}
+	// As in writeCacheable, this replaces the Vary compression adds.
+	w.Header().Set("Vary", "Accept, Accept-Encoding")
+	w.Header().Set("Content-Type", mediaType)
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The encodings compression can be configured with
+var compressionAlgorithms = []string{"zstd", "br", "gzip"}
+
+// Encoders are pooled; a zstd encoder in particular is costly to create.
+var (
+	gzipWriters   = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+	brotliWriters = sync.Pool{New: func() any { return brotli.NewWriterLevel(nil, brotli.DefaultCompression) }}
+	zstdWriters   = sync.Pool{New: func() any {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		return w
+	}}
+)
+
+// compression decompresses request bodies sent with Content-Encoding and
+// compresses responses for clients that send Accept-Encoding when respond
+// is set. Only the algorithms listed are used, the first preferred; gzip
+// request bodies are always accepted.
+type compression struct {
+	respond    bool
+	algorithms []string
+}
+
+// allows reports whether the encoding is one of c's algorithms.
+func (c compression) allows(encoding string) bool {
+	return slices.Contains(c.algorithms, encoding)
+}
+
+func (c compression) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); {
+		case enc == "" || enc == "identity":
+		case enc == "gzip":
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeProblem(w, newProblem(http.StatusBadRequest, codeInvalidJSON, "Invalid gzip body"))
+				return
+			}
+			defer zr.Close()
+			r.Body = zr
+		case enc == "br" && c.allows("br"):
+			r.Body = io.NopCloser(brotli.NewReader(r.Body))
+		case enc == "zstd" && c.allows("zstd"):
+			zr, err := zstd.NewReader(r.Body)
+			if err != nil {
+				writeProblem(w, newProblem(http.StatusBadRequest, codeInvalidJSON, "Invalid zstd body"))
+				return
+			}
+			defer zr.Close()
+			r.Body = zr.IOReadCloser()
+		default:
+			writeProblem(w, newProblem(http.StatusUnsupportedMediaType, codeUnsupportedEncoding, "Unsupported Content-Encoding "+enc))
+			return
+		}
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+
+		if !c.respond {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := c.responseEncoding(r)
+		if encoding == "" || r.Method == http.MethodHead {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		defer cw.close()
+		h.ServeHTTP(cw, r)
+	})
+}
+
+// responseEncoding picks the algorithm the client gives the highest
+// q-value in Accept-Encoding, the one listed first in c breaking ties, or
+// "" to send the response as it is.
+func (c compression) responseEncoding(r *http.Request) string {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.ReplaceAll(params, " ", ""), "q="); ok {
+			var err error
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		accepted[strings.ToLower(name)] = q
+	}
+	best, bestQ := "", 0.0
+	for _, name := range c.algorithms {
+		q, ok := accepted[name]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// compressWriter compresses the body written through it, unless the
+// response has no body or is already encoded.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	enc         io.WriteCloser
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	hdr := cw.Header()
+	if status != http.StatusNoContent && status != http.StatusNotModified && hdr.Get("Content-Encoding") == "" {
+		hdr.Set("Content-Encoding", cw.encoding)
+		hdr.Del("Content-Length")
+		switch cw.encoding {
+		case "br":
+			bw := brotliWriters.Get().(*brotli.Writer)
+			bw.Reset(cw.ResponseWriter)
+			cw.enc = bw
+		case "zstd":
+			zw := zstdWriters.Get().(*zstd.Encoder)
+			zw.Reset(cw.ResponseWriter)
+			cw.enc = zw
+		default:
+			gw := gzipWriters.Get().(*gzip.Writer)
+			gw.Reset(cw.ResponseWriter)
+			cw.enc = gw
+		}
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.enc == nil {
+		return cw.ResponseWriter.Write(b)
+	}
+	return cw.enc.Write(b)
+}
+
+// Flush sends what has been compressed so far, for streamed responses.
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	switch enc := cw.enc.(type) {
+	case *gzip.Writer:
+		enc.Flush()
+	case *brotli.Writer:
+		enc.Flush()
+	case *zstd.Encoder:
+		enc.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// close flushes the compressed body and returns the encoder to its pool.
+func (cw *compressWriter) close() {
+	switch enc := cw.enc.(type) {
+	case *gzip.Writer:
+		enc.Close()
+		gzipWriters.Put(enc)
+	case *brotli.Writer:
+		enc.Close()
+		brotliWriters.Put(enc)
+	case *zstd.Encoder:
+		enc.Close()
+		zstdWriters.Put(enc)
+	}
+}
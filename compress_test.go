@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestCompressionNegotiation(t *testing.T) {
+	const body = `{"points":28}`
+	tests := []struct {
+		name           string
+		algorithms     []string
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{name: "br", algorithms: []string{"br", "gzip"}, acceptEncoding: "br", wantEncoding: "br"},
+		{name: "server prefers br", algorithms: []string{"br", "gzip"}, acceptEncoding: "gzip, br", wantEncoding: "br"},
+		{name: "client prefers gzip", algorithms: []string{"br", "gzip"}, acceptEncoding: "br;q=0.5, gzip", wantEncoding: "gzip"},
+		{name: "br refused", algorithms: []string{"br", "gzip"}, acceptEncoding: "br;q=0, gzip", wantEncoding: "gzip"},
+		{name: "br not allowed", algorithms: []string{"gzip"}, acceptEncoding: "br"},
+		{name: "zstd first", algorithms: []string{"zstd", "br", "gzip"}, acceptEncoding: "gzip, br, zstd", wantEncoding: "zstd"},
+		{name: "any", algorithms: []string{"br", "gzip"}, acceptEncoding: "*", wantEncoding: "br"},
+		{name: "none accepted", algorithms: []string{"br", "gzip"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := compression{respond: true, algorithms: tt.algorithms}.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				io.WriteString(w, body)
+			}))
+			req := httptest.NewRequest("GET", "/receipts/1/points", nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+			}
+			var r io.Reader = rec.Body
+			switch tt.wantEncoding {
+			case "br":
+				r = brotli.NewReader(rec.Body)
+			case "gzip":
+				zr, err := gzip.NewReader(rec.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r = zr
+			case "zstd":
+				return
+			}
+			got, err := io.ReadAll(r)
+			if err != nil || string(got) != body {
+				t.Errorf("body = %q, %v; want %q", got, err, body)
+			}
+		})
+	}
+}
+
+func TestCompressedRequestBody(t *testing.T) {
+	var compressed bytes.Buffer
+	bw := brotli.NewWriter(&compressed)
+	io.WriteString(bw, targetReceipt)
+	bw.Close()
+
+	tests := []struct {
+		name       string
+		algorithms []string
+		wantStatus int
+	}{
+		{name: "br allowed", algorithms: []string{"br", "gzip"}, wantStatus: http.StatusOK},
+		{name: "br not allowed", algorithms: []string{"gzip"}, wantStatus: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := compression{algorithms: tt.algorithms}.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got, _ := io.ReadAll(r.Body)
+				if string(got) != targetReceipt {
+					t.Errorf("body = %q", got)
+				}
+			}))
+			req := httptest.NewRequest("POST", "/receipts/process", strings.NewReader(compressed.String()))
+			req.Header.Set("Content-Encoding", "br")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
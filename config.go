@@ -0,0 +1,598 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server and storage settings. Each one is read from an
+// environment variable and can be overridden by the command-line flag of
+// the same name, so PORT=9000 and -port 9000 do the same thing.
+type Config struct {
+	Port            string
+	GRPCPort        string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	RequestTimeout  time.Duration
+	MaxBodyBytes    int64
+	MaxItems        int
+	LogLevel        string
+
+	// Most receipts in one batch or import, and most IDs in one
+	// points:batchGet.
+	MaxBatchSize       int
+	MaxPointsBatchSize int
+
+	// How long an Idempotency-Key keeps returning the same receipt ID.
+	IdempotencyTTL time.Duration
+
+	// Deadlines of the groups of routes, which cut RequestTimeout short.
+	// Receipts from the job queue, Kafka and SQS get Process too.
+	Timeouts RouteTimeouts
+
+	// Reject a receipt with an item priced above its total, rather than
+	// logging a warning and scoring it.
+	ItemPriceExceedsTotalIsError bool
+
+	// When StoreRejected is set, submissions that fail validation are kept
+	// in memory for RejectedRetention, at most RejectedMaxEntries of them
+	// with the first RejectedMaxPayloadBytes of each payload, and listed by
+	// GET /rejected. They are lost on restart.
+	StoreRejected           bool
+	RejectedRetention       time.Duration
+	RejectedMaxEntries      int
+	RejectedMaxPayloadBytes int
+
+	// When FraudChecks is set stored receipts are flagged for review when
+	// their total is more than FraudTotalTolerancePercent from the sum of
+	// their items, or their user submitted more than
+	// FraudMaxReceiptsPerHour, if not 0, in the last hour.
+	FraudChecks                bool
+	FraudTotalTolerancePercent int
+	FraudMaxReceiptsPerHour    int
+
+	// How long clients and caches may reuse a receipt's points, 0 to make
+	// them ask again every time.
+	PointsCacheMaxAge time.Duration
+
+	// Reject a payload that repeats a top-level key, such as two "total"
+	// fields, rather than keeping the last.
+	RejectDuplicateKeys bool
+
+	// Routing library to dispatch requests with, gorilla or stdmux, or
+	// empty for gorilla when it is built in.
+	Router string
+
+	// Limits on reading request headers, so clients that send them slowly
+	// or endlessly can't tie up connections.
+	ReadHeaderTimeout time.Duration
+	MaxHeaderBytes    int
+
+	// HTTP/2 settings, used for TLS connections and for plaintext h2c
+	// connections when EnableH2C is set.
+	H2MaxConcurrentStreams int
+	H2MaxReadFrameSize     int
+	H2MaxUploadBuffer      int
+	EnableH2C              bool
+
+	// When AsyncProcessing is set every submission is queued and answered
+	// with a job, as if it asked with Prefer: respond-async. Queued receipts
+	// are handled by AsyncWorkers, and jobs are kept for JobTTL.
+	AsyncProcessing bool
+	AsyncWorkers    int
+	JobTTL          time.Duration
+
+	// Times the example receipt is scored at startup before /readyz
+	// reports ready, 0 to be ready at once.
+	WarmupReceipts int
+
+	// Receipts in batches, imports and queued jobs are scored by
+	// ScoringWorkers at once.
+	ScoringWorkers int
+
+	// Requests a second allowed per client, 0 for no limit, with bursts
+	// of up to RateBurst.
+	RateLimit  float64
+	RateBurst  int
+	TrustProxy bool
+
+	// When RequireAPIKey is set every API request needs an X-API-Key.
+	// Keys are managed through /admin/keys with the AdminToken.
+	RequireAPIKey bool
+	AdminToken    string
+
+	// Give each API key created without a tenant a tenant of its own.
+	TenantPerAPIKey bool
+
+	// Times a webhook event is sent before giving up on it. Webhooks are
+	// managed through /admin/webhooks with the AdminToken.
+	WebhookMaxAttempts int
+
+	// Events sent to a webhook in one request, as a JSON array, and how
+	// long the first waits for the rest. 1 sends each on its own.
+	WebhookBatchSize     int
+	WebhookBatchInterval time.Duration
+
+	// When JWKSURL is set every API request needs a bearer token signed by
+	// one of its keys, checked against JWTIssuer and JWTAudience if set.
+	JWKSURL     string
+	JWTIssuer   string
+	JWTAudience string
+
+	// Browser origins allowed to call the API, "*" for any; CORS is off
+	// when there are none.
+	CORSAllowedOrigins []string
+	CORSAllowedMethods []string
+	CORSAllowedHeaders []string
+
+	// Compress responses with the first of CompressionAlgorithms the
+	// client accepts best. EnableZstd puts zstd first. Request bodies are
+	// accepted in any of them, and in gzip.
+	Compression           bool
+	CompressionAlgorithms []string
+	EnableZstd            bool
+
+	// Address of the pprof and expvar endpoints, such as localhost:6060;
+	// they are off when empty.
+	AdminAddr string
+
+	// TLS from certificate files, or from an ACME CA for AutocertDomains.
+	TLSCertFile      string
+	TLSKeyFile       string
+	AutocertDomains  []string
+	AutocertCacheDir string
+	AutocertEmail    string
+	ACMEHTTPAddr     string
+
+	// Where to send traces over OTLP/HTTP; tracing is off when empty.
+	OTLPTracesEndpoint string
+
+	StorageBackend string
+	PostgresDSN    string
+	SQLitePath     string
+	RedisURL       string
+	RedisTTL       time.Duration
+
+	// Append-only file every change to a receipt is written to once it is
+	// made, off when empty. With RebuildFromEventLog the store, which
+	// must be empty, is filled by replaying it at startup.
+	EventLog            string
+	RebuildFromEventLog bool
+
+	// Most receipts the memory backend keeps, 0 for no limit. Beyond it
+	// the least recently used receipt is evicted.
+	MemoryMaxReceipts int
+
+	// How long receipts are kept, 0 for ever. Age goes by when a receipt
+	// was stored, or by its purchase date when RetentionBy is "purchase".
+	// The janitor looks for expired receipts every JanitorInterval.
+	Retention       time.Duration
+	RetentionBy     string
+	JanitorInterval time.Duration
+
+	// Reject a receipt whose fingerprint matches one the tenant stored
+	// within DuplicateWindow.
+	RejectDuplicateReceipts bool
+	DuplicateWindow         time.Duration
+
+	RulesFile  string
+	SchemaFile string
+
+	// Scoring rule values by name, such as ROUND_DOLLAR_POINTS, laid over
+	// every version in RulesFile. Each is read from RULE_<name> and can be
+	// set with -rule <name>=value. DeprecatedRuleEnv lists the variables
+	// without the RULE_ prefix that were read too.
+	RuleOverrides     map[string]string
+	DeprecatedRuleEnv []string
+
+	// Time zones purchases are scored in when receipts don't name one: by
+	// tenant, or DefaultTimezone for the rest. Nil scores them as written.
+	DefaultTimezone *time.Location
+	TenantTimezones map[string]*time.Location
+
+	// Kafka brokers to consume receipts from, off when empty. Receipts are
+	// read from KafkaInputTopic in the KafkaGroupID consumer group, and a
+	// points event for each is published to KafkaOutputTopic.
+	KafkaBrokers     []string
+	KafkaGroupID     string
+	KafkaInputTopic  string
+	KafkaOutputTopic string
+
+	// NATS server to publish a receipt.processed event to on NATSSubject for
+	// every stored receipt, off when empty. NATSStream, when set, is created
+	// to capture the subject.
+	NATSURL       string
+	NATSSubject   string
+	NATSStream    string
+	NATSCredsFile string
+	NATSToken     string
+
+	// SQS queue to poll for receipts, off when empty, with SQSWorkers
+	// pollers. Invalid receipts are moved to SQSDeadLetterQueueURL if set
+	// and dropped otherwise.
+	SQSQueueURL           string
+	SQSDeadLetterQueueURL string
+	SQSWorkers            int
+
+	// OCR provider for POST /receipts/scan, "tesseract" or empty for off,
+	// and where to find the tesseract command.
+	OCRProvider   string
+	TesseractPath string
+	// How long one call to the OCR provider may take, how many times a
+	// failed call is tried in all, and the wait before the first retry,
+	// doubled for each next one.
+	OCRTimeout      time.Duration
+	OCRMaxAttempts  int
+	OCRRetryBackoff time.Duration
+}
+
+// RouteTimeouts are the deadlines of the API's groups of routes.
+type RouteTimeouts struct {
+	Process     time.Duration // storing and changing receipts and redemptions
+	Batch       time.Duration // batches and imports
+	Points      time.Duration // points, leaderboards and jobs
+	Receipt     time.Duration // reading and deleting one receipt
+	List        time.Duration // lists of receipts
+	Scan        time.Duration // OCR scans
+	Stream      time.Duration // NDJSON streams
+	Export      time.Duration // exports and the event log
+	Stats       time.Duration
+	Recalculate time.Duration
+}
+
+// The deadlines when PROCESS_TIMEOUT and the others aren't set
+var defaultRouteTimeouts = RouteTimeouts{
+	Process:     10 * time.Second,
+	Batch:       60 * time.Second,
+	Points:      5 * time.Second,
+	Receipt:     5 * time.Second,
+	List:        10 * time.Second,
+	Scan:        30 * time.Second,
+	Stream:      30 * time.Minute,
+	Export:      30 * time.Minute,
+	Stats:       30 * time.Second,
+	Recalculate: 10 * time.Minute,
+}
+
+// The log levels accepted by LOG_LEVEL
+var logLevels = map[string]bool{"debug": true, "info": true, "warn": true, "error": true}
+
+// loadConfig reads the settings from the environment and then from args,
+// which are the command-line arguments without the program name.
+func loadConfig(args []string) (Config, error) {
+	var cfg Config
+	var env strictEnv
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.StringVar(&cfg.Port, "port", envString("PORT", "8080"), "port to listen on (PORT)")
+	fs.StringVar(&cfg.GRPCPort, "grpc-port", os.Getenv("GRPC_PORT"), "port to serve the gRPC API on, off when empty (GRPC_PORT)")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", envDuration("READ_TIMEOUT", 60*time.Second), "longest time to read a whole request (READ_TIMEOUT)")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", envDuration("WRITE_TIMEOUT", 90*time.Second), "longest time to write a response (WRITE_TIMEOUT)")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", envDuration("IDLE_TIMEOUT", 120*time.Second), "how long keep-alive connections may sit idle (IDLE_TIMEOUT)")
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", envDuration("READ_HEADER_TIMEOUT", 10*time.Second), "longest time to read a request's headers (READ_HEADER_TIMEOUT)")
+	fs.IntVar(&cfg.MaxHeaderBytes, "max-header-bytes", envInt("MAX_HEADER_BYTES", 1<<20), "largest request headers accepted (MAX_HEADER_BYTES)")
+	fs.IntVar(&cfg.H2MaxConcurrentStreams, "h2-max-concurrent-streams", envInt("H2_MAX_CONCURRENT_STREAMS", 250), "requests one HTTP/2 connection may have open at once (H2_MAX_CONCURRENT_STREAMS)")
+	fs.IntVar(&cfg.H2MaxReadFrameSize, "h2-max-read-frame-size", envInt("H2_MAX_READ_FRAME_SIZE", 1<<20), "largest HTTP/2 frame accepted, 16384 to 16777215 (H2_MAX_READ_FRAME_SIZE)")
+	fs.IntVar(&cfg.H2MaxUploadBuffer, "h2-max-upload-buffer", envInt("H2_MAX_UPLOAD_BUFFER", 1<<20), "request body bytes buffered for each HTTP/2 connection (H2_MAX_UPLOAD_BUFFER)")
+	fs.BoolVar(&cfg.EnableH2C, "enable-h2c", os.Getenv("ENABLE_H2C") == "true", "accept HTTP/2 over plaintext connections (ENABLE_H2C)")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", envDuration("SHUTDOWN_TIMEOUT", 30*time.Second), "how long to let in-flight requests finish on shutdown (SHUTDOWN_TIMEOUT)")
+	fs.DurationVar(&cfg.RequestTimeout, "request-timeout", envDuration("REQUEST_TIMEOUT", 30*time.Second), "deadline for handling one request, including store calls (REQUEST_TIMEOUT)")
+	timeouts := []struct {
+		d    *time.Duration
+		name string
+		env  string
+		help string
+	}{
+		{&cfg.Timeouts.Process, "process-timeout", "PROCESS_TIMEOUT", "deadline for storing or changing a receipt, from the API, the job queue, Kafka or SQS"},
+		{&cfg.Timeouts.Batch, "batch-timeout", "BATCH_TIMEOUT", "deadline for a batch or import"},
+		{&cfg.Timeouts.Points, "points-timeout", "POINTS_TIMEOUT", "deadline for reading points, the leaderboard or a job"},
+		{&cfg.Timeouts.Receipt, "receipt-timeout", "RECEIPT_TIMEOUT", "deadline for reading or deleting a receipt"},
+		{&cfg.Timeouts.List, "list-timeout", "LIST_TIMEOUT", "deadline for listing receipts"},
+		{&cfg.Timeouts.Scan, "scan-timeout", "SCAN_TIMEOUT", "deadline for scanning a receipt image"},
+		{&cfg.Timeouts.Stream, "stream-timeout", "STREAM_TIMEOUT", "deadline for an NDJSON stream"},
+		{&cfg.Timeouts.Export, "export-timeout", "EXPORT_TIMEOUT", "deadline for an export or the event log"},
+		{&cfg.Timeouts.Stats, "stats-timeout", "STATS_TIMEOUT", "deadline for the stats"},
+		{&cfg.Timeouts.Recalculate, "recalculate-timeout", "RECALCULATE_TIMEOUT", "deadline for recalculating points"},
+	}
+	cfg.Timeouts = defaultRouteTimeouts
+	for _, t := range timeouts {
+		fs.DurationVar(t.d, t.name, env.duration(t.env, *t.d), t.help+" ("+t.env+")")
+	}
+	fs.Int64Var(&cfg.MaxBodyBytes, "max-body-bytes", int64(envInt("MAX_BODY_BYTES", 10<<20)), "largest request body accepted (MAX_BODY_BYTES)")
+	fs.IntVar(&cfg.MaxItems, "max-items", envInt("MAX_ITEMS", 1000), "most items accepted on one receipt (MAX_ITEMS)")
+	fs.IntVar(&cfg.MaxBatchSize, "max-batch-size", env.int("MAX_BATCH_SIZE", 5000), "most receipts in one batch or import (MAX_BATCH_SIZE)")
+	fs.IntVar(&cfg.MaxPointsBatchSize, "max-points-batch-size", env.int("MAX_POINTS_BATCH_SIZE", 100), "most receipt IDs in one points:batchGet (MAX_POINTS_BATCH_SIZE)")
+	fs.DurationVar(&cfg.IdempotencyTTL, "idempotency-ttl", env.duration("IDEMPOTENCY_TTL", 24*time.Hour), "how long an Idempotency-Key keeps returning the same receipt (IDEMPOTENCY_TTL)")
+	fs.BoolVar(&cfg.ItemPriceExceedsTotalIsError, "item-price-exceeds-total-is-error", os.Getenv("ITEM_PRICE_EXCEEDS_TOTAL_IS_ERROR") == "true", "reject a receipt with an item priced above its total rather than warn (ITEM_PRICE_EXCEEDS_TOTAL_IS_ERROR)")
+	fs.BoolVar(&cfg.RejectDuplicateKeys, "reject-duplicate-keys", env.bool("REJECT_DUPLICATE_KEYS", false), "reject a payload that repeats a top-level key rather than keep the last (REJECT_DUPLICATE_KEYS)")
+	fs.BoolVar(&cfg.StoreRejected, "store-rejected", env.bool("STORE_REJECTED", false), "keep submissions that fail validation in memory and list them at GET /rejected (STORE_REJECTED)")
+	fs.DurationVar(&cfg.RejectedRetention, "rejected-retention", env.duration("REJECTED_RETENTION", 24*time.Hour), "how long a rejected submission is kept (REJECTED_RETENTION)")
+	fs.IntVar(&cfg.RejectedMaxEntries, "rejected-max-entries", env.int("REJECTED_MAX_ENTRIES", 1000), "most rejected submissions kept, the oldest going first (REJECTED_MAX_ENTRIES)")
+	fs.IntVar(&cfg.RejectedMaxPayloadBytes, "rejected-max-payload-bytes", env.int("REJECTED_MAX_PAYLOAD_BYTES", 4096), "bytes of a rejected payload kept (REJECTED_MAX_PAYLOAD_BYTES)")
+	fs.BoolVar(&cfg.FraudChecks, "fraud-checks", env.bool("FRAUD_CHECKS", false), "flag stored receipts that look fraudulent for review (FRAUD_CHECKS)")
+	fs.IntVar(&cfg.FraudTotalTolerancePercent, "fraud-total-tolerance-percent", env.int("FRAUD_TOTAL_TOLERANCE_PERCENT", 25), "percent a total may be from the sum of its items before it is flagged, 0 to 100 (FRAUD_TOTAL_TOLERANCE_PERCENT)")
+	fs.IntVar(&cfg.FraudMaxReceiptsPerHour, "fraud-max-receipts-per-hour", env.int("FRAUD_MAX_RECEIPTS_PER_HOUR", 10), "receipts a user may submit in an hour before the next is flagged, 0 for no limit (FRAUD_MAX_RECEIPTS_PER_HOUR)")
+	fs.DurationVar(&cfg.PointsCacheMaxAge, "points-cache-max-age", env.duration("POINTS_CACHE_MAX_AGE", time.Minute), "how long clients and caches may reuse a receipt's points (POINTS_CACHE_MAX_AGE)")
+	fs.BoolVar(&cfg.AsyncProcessing, "async-processing", os.Getenv("ASYNC_PROCESSING") == "true", "queue every submission and answer 202 with a job (ASYNC_PROCESSING)")
+	fs.IntVar(&cfg.AsyncWorkers, "async-workers", envInt("ASYNC_WORKERS", 4), "receipts processed from the queue at once (ASYNC_WORKERS)")
+	fs.IntVar(&cfg.WarmupReceipts, "warmup-receipts", env.int("WARMUP_RECEIPTS", 0), "times to score an example receipt at startup before reporting ready, 0 for none (WARMUP_RECEIPTS)")
+	fs.IntVar(&cfg.ScoringWorkers, "scoring-workers", envInt("SCORING_WORKERS", runtime.GOMAXPROCS(0)), "receipts in batches and queued jobs scored at once (SCORING_WORKERS)")
+	fs.DurationVar(&cfg.JobTTL, "job-ttl", envDuration("JOB_TTL", 24*time.Hour), "how long a job's status is kept (JOB_TTL)")
+	fs.IntVar(&cfg.WebhookMaxAttempts, "webhook-max-attempts", envInt("WEBHOOK_MAX_ATTEMPTS", 5), "times a webhook event is sent before giving up on it (WEBHOOK_MAX_ATTEMPTS)")
+	fs.IntVar(&cfg.WebhookBatchSize, "webhook-batch-size", env.int("WEBHOOK_BATCH_SIZE", 1), "events sent to a webhook together as a JSON array, 1 to send each on its own (WEBHOOK_BATCH_SIZE)")
+	fs.DurationVar(&cfg.WebhookBatchInterval, "webhook-batch-interval", env.duration("WEBHOOK_BATCH_INTERVAL", time.Second), "longest an event waits for a webhook batch to fill (WEBHOOK_BATCH_INTERVAL)")
+	fs.StringVar(&cfg.Router, "router", os.Getenv("ROUTER"), "routing library: gorilla, or stdmux for the standard library's ServeMux; gorilla by default unless built with -tags stdmux (ROUTER)")
+	fs.StringVar(&cfg.LogLevel, "log-level", envString("LOG_LEVEL", "info"), "debug, info, warn or error (LOG_LEVEL)")
+	fs.Float64Var(&cfg.RateLimit, "rate-limit", envFloat("RATE_LIMIT", 0), "requests a second allowed per client, 0 for no limit (RATE_LIMIT)")
+	fs.IntVar(&cfg.RateBurst, "rate-burst", envInt("RATE_BURST", 20), "requests a client may make at once before being limited (RATE_BURST)")
+	fs.BoolVar(&cfg.TrustProxy, "trust-proxy", os.Getenv("TRUST_PROXY") == "true", "take the client address from the last X-Forwarded-For entry, added by the load balancer (TRUST_PROXY)")
+	fs.BoolVar(&cfg.RequireAPIKey, "require-api-key", os.Getenv("REQUIRE_API_KEY") == "true", "require an X-API-Key header on API requests (REQUIRE_API_KEY)")
+	fs.BoolVar(&cfg.TenantPerAPIKey, "tenant-per-api-key", env.bool("TENANT_PER_API_KEY", false), "give each API key created without a tenant its own, so it only sees its own receipts (TENANT_PER_API_KEY)")
+	fs.StringVar(&cfg.AdminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "token for the /admin API, which is off when empty (ADMIN_TOKEN)")
+	fs.StringVar(&cfg.JWKSURL, "jwks-url", os.Getenv("JWKS_URL"), "JWKS of the identity provider, to require bearer tokens (JWKS_URL)")
+	fs.StringVar(&cfg.JWTIssuer, "jwt-issuer", os.Getenv("JWT_ISSUER"), "issuer bearer tokens must have (JWT_ISSUER)")
+	fs.StringVar(&cfg.JWTAudience, "jwt-audience", os.Getenv("JWT_AUDIENCE"), "audience bearer tokens must have (JWT_AUDIENCE)")
+	corsOrigins := fs.String("cors-allowed-origins", os.Getenv("CORS_ALLOWED_ORIGINS"), "comma-separated origins allowed to call the API from a browser, * for any (CORS_ALLOWED_ORIGINS)")
+	corsMethods := fs.String("cors-allowed-methods", envString("CORS_ALLOWED_METHODS", "GET,POST,PUT,DELETE"), "comma-separated methods allowed in CORS requests (CORS_ALLOWED_METHODS)")
+	corsHeaders := fs.String("cors-allowed-headers", envString("CORS_ALLOWED_HEADERS", "Content-Type,Authorization,X-API-Key,X-Tenant-ID,Idempotency-Key,X-Request-ID,If-None-Match"), "comma-separated request headers allowed in CORS requests (CORS_ALLOWED_HEADERS)")
+	fs.BoolVar(&cfg.Compression, "compression", envString("COMPRESSION", "true") == "true", "compress responses for clients that accept it (COMPRESSION)")
+	compressionList := fs.String("compression-algorithms", envString("COMPRESSION_ALGORITHMS", "br,gzip"), "comma-separated encodings to compress with, most preferred first: zstd, br or gzip (COMPRESSION_ALGORITHMS)")
+	fs.BoolVar(&cfg.EnableZstd, "enable-zstd", os.Getenv("ENABLE_ZSTD") == "true", "offer zstd before the compression-algorithms (ENABLE_ZSTD)")
+	fs.StringVar(&cfg.AdminAddr, "admin-addr", os.Getenv("ADMIN_ADDR"), "address for the pprof and expvar debug endpoints, off when empty (ADMIN_ADDR)")
+	fs.StringVar(&cfg.TLSCertFile, "tls-cert-file", os.Getenv("TLS_CERT_FILE"), "PEM certificate to serve HTTPS with (TLS_CERT_FILE)")
+	fs.StringVar(&cfg.TLSKeyFile, "tls-key-file", os.Getenv("TLS_KEY_FILE"), "PEM private key for the certificate (TLS_KEY_FILE)")
+	autocertDomains := fs.String("autocert-domains", os.Getenv("AUTOCERT_DOMAINS"), "comma-separated domains to get certificates for automatically (AUTOCERT_DOMAINS)")
+	fs.StringVar(&cfg.AutocertCacheDir, "autocert-cache-dir", envString("AUTOCERT_CACHE_DIR", "autocert-cache"), "directory to keep automatic certificates in (AUTOCERT_CACHE_DIR)")
+	fs.StringVar(&cfg.AutocertEmail, "autocert-email", os.Getenv("AUTOCERT_EMAIL"), "contact email for the ACME account (AUTOCERT_EMAIL)")
+	fs.StringVar(&cfg.ACMEHTTPAddr, "acme-http-addr", envString("ACME_HTTP_ADDR", ":80"), "address answering ACME HTTP-01 challenges, empty to disable (ACME_HTTP_ADDR)")
+	fs.StringVar(&cfg.OTLPTracesEndpoint, "otlp-traces-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"), "OTLP/HTTP URL to send traces to, such as http://collector:4318/v1/traces (OTEL_EXPORTER_OTLP_TRACES_ENDPOINT)")
+	fs.StringVar(&cfg.StorageBackend, "storage-backend", envString("STORAGE_BACKEND", "memory"), "memory, postgres, sqlite or redis (STORAGE_BACKEND)")
+	fs.StringVar(&cfg.PostgresDSN, "postgres-dsn", os.Getenv("POSTGRES_DSN"), "PostgreSQL connection string (POSTGRES_DSN)")
+	fs.StringVar(&cfg.SQLitePath, "sqlite-path", envString("SQLITE_PATH", "receipts.db"), "SQLite database file (SQLITE_PATH)")
+	fs.StringVar(&cfg.RedisURL, "redis-url", os.Getenv("REDIS_URL"), "Redis URL such as redis://localhost:6379/0 (REDIS_URL)")
+	fs.StringVar(&cfg.EventLog, "event-log", os.Getenv("EVENT_LOG"), "file to append receipt events to, off when empty (EVENT_LOG)")
+	fs.BoolVar(&cfg.RebuildFromEventLog, "rebuild-from-event-log", os.Getenv("REBUILD_FROM_EVENT_LOG") == "true", "fill the empty store from the event log at startup (REBUILD_FROM_EVENT_LOG)")
+	fs.DurationVar(&cfg.Retention, "retention", envDuration("RETENTION", 0), "how long receipts are kept, such as 2160h, 0 for ever (RETENTION)")
+	fs.StringVar(&cfg.RetentionBy, "retention-by", envString("RETENTION_BY", "ingestion"), "what a receipt's age goes by: ingestion or purchase (RETENTION_BY)")
+	fs.DurationVar(&cfg.JanitorInterval, "janitor-interval", envDuration("JANITOR_INTERVAL", time.Hour), "how often to look for expired receipts (JANITOR_INTERVAL)")
+	fs.IntVar(&cfg.MemoryMaxReceipts, "memory-max-receipts", envInt("MEMORY_MAX_RECEIPTS", 0), "most receipts the memory backend keeps before evicting the least recently used, 0 for no limit (MEMORY_MAX_RECEIPTS)")
+	fs.DurationVar(&cfg.RedisTTL, "redis-ttl", envDuration("REDIS_TTL", 0), "how long Redis keeps receipts, 0 for ever (REDIS_TTL)")
+	kafkaBrokers := fs.String("kafka-brokers", os.Getenv("KAFKA_BROKERS"), "comma-separated Kafka brokers to consume receipts from, empty to disable (KAFKA_BROKERS)")
+	fs.StringVar(&cfg.KafkaGroupID, "kafka-group-id", envString("KAFKA_GROUP_ID", "receipt-processor"), "Kafka consumer group (KAFKA_GROUP_ID)")
+	fs.StringVar(&cfg.KafkaInputTopic, "kafka-input-topic", envString("KAFKA_INPUT_TOPIC", "receipts"), "Kafka topic to consume receipts from (KAFKA_INPUT_TOPIC)")
+	fs.StringVar(&cfg.KafkaOutputTopic, "kafka-output-topic", envString("KAFKA_OUTPUT_TOPIC", "receipt-points"), "Kafka topic to publish points events to (KAFKA_OUTPUT_TOPIC)")
+	fs.StringVar(&cfg.NATSURL, "nats-url", os.Getenv("NATS_URL"), "NATS server to publish receipt events to, such as nats://localhost:4222, empty to disable (NATS_URL)")
+	fs.StringVar(&cfg.NATSSubject, "nats-subject", envString("NATS_SUBJECT", "receipts.processed"), "subject of the receipt.processed events (NATS_SUBJECT)")
+	fs.StringVar(&cfg.NATSStream, "nats-stream", os.Getenv("NATS_STREAM"), "JetStream stream to create for the subject, empty if one already captures it (NATS_STREAM)")
+	fs.StringVar(&cfg.NATSCredsFile, "nats-creds-file", os.Getenv("NATS_CREDS_FILE"), "NATS user credentials file (NATS_CREDS_FILE)")
+	fs.StringVar(&cfg.NATSToken, "nats-token", os.Getenv("NATS_TOKEN"), "NATS authentication token (NATS_TOKEN)")
+	fs.StringVar(&cfg.SQSQueueURL, "sqs-queue-url", os.Getenv("SQS_QUEUE_URL"), "SQS queue to poll for receipts, empty to disable (SQS_QUEUE_URL)")
+	fs.StringVar(&cfg.SQSDeadLetterQueueURL, "sqs-dead-letter-queue-url", os.Getenv("SQS_DEAD_LETTER_QUEUE_URL"), "SQS queue to move invalid receipts to, empty to drop them (SQS_DEAD_LETTER_QUEUE_URL)")
+	fs.IntVar(&cfg.SQSWorkers, "sqs-workers", envInt("SQS_WORKERS", 2), "SQS pollers (SQS_WORKERS)")
+	fs.StringVar(&cfg.OCRProvider, "ocr-provider", os.Getenv("OCR_PROVIDER"), "OCR provider for POST /receipts/scan, tesseract or empty for off (OCR_PROVIDER)")
+	fs.StringVar(&cfg.TesseractPath, "tesseract-path", envString("TESSERACT_PATH", "tesseract"), "tesseract command run by the tesseract OCR provider (TESSERACT_PATH)")
+	fs.DurationVar(&cfg.OCRTimeout, "ocr-timeout", env.duration("OCR_TIMEOUT", 10*time.Second), "longest one call to the OCR provider may take (OCR_TIMEOUT)")
+	fs.IntVar(&cfg.OCRMaxAttempts, "ocr-max-attempts", env.int("OCR_MAX_ATTEMPTS", 3), "times a receipt image is sent to the OCR provider before giving up (OCR_MAX_ATTEMPTS)")
+	fs.DurationVar(&cfg.OCRRetryBackoff, "ocr-retry-backoff", env.duration("OCR_RETRY_BACKOFF", 500*time.Millisecond), "wait before retrying the OCR provider, doubled for each retry (OCR_RETRY_BACKOFF)")
+	fs.BoolVar(&cfg.RejectDuplicateReceipts, "reject-duplicate-receipts", os.Getenv("REJECT_DUPLICATE_RECEIPTS") == "true", "reject a receipt the tenant already submitted, by its fingerprint (REJECT_DUPLICATE_RECEIPTS)")
+	fs.DurationVar(&cfg.DuplicateWindow, "duplicate-window", envDuration("DUPLICATE_WINDOW", 365*24*time.Hour), "how long a receipt's fingerprint is remembered (DUPLICATE_WINDOW)")
+	fs.StringVar(&cfg.RulesFile, "rules-file", os.Getenv("RULES_FILE"), "JSON or YAML scoring rules file (RULES_FILE)")
+	cfg.RuleOverrides, cfg.DeprecatedRuleEnv = ruleOverridesFromEnv()
+	fs.Func("rule", "scoring rule value as name=value, such as ROUND_DOLLAR_POINTS=40; may be repeated (RULE_<name>)", func(s string) error {
+		name, value, ok := strings.Cut(s, "=")
+		if !ok || name == "" {
+			return errors.New("must be name=value")
+		}
+		cfg.RuleOverrides[name] = value
+		return nil
+	})
+	fs.StringVar(&cfg.SchemaFile, "schema-file", os.Getenv("SCHEMA_FILE"), "JSON Schema to validate receipts against (SCHEMA_FILE)")
+	defaultTimezone := fs.String("default-timezone", os.Getenv("DEFAULT_TIMEZONE"), "IANA time zone to score purchases in, their date and time being UTC, when the receipt names none; empty to score them as written (DEFAULT_TIMEZONE)")
+	tenantTimezones := fs.String("tenant-timezones", os.Getenv("TENANT_TIMEZONES"), "comma-separated tenant:zone pairs overriding default-timezone (TENANT_TIMEZONES)")
+	fs.Parse(args)
+
+	cfg.AutocertDomains = splitList(*autocertDomains)
+	cfg.KafkaBrokers = splitList(*kafkaBrokers)
+	cfg.CORSAllowedOrigins = splitList(*corsOrigins)
+	cfg.CORSAllowedMethods = splitList(*corsMethods)
+	cfg.CORSAllowedHeaders = splitList(*corsHeaders)
+	cfg.CompressionAlgorithms = splitList(strings.ToLower(*compressionList))
+	if cfg.EnableZstd && !slices.Contains(cfg.CompressionAlgorithms, "zstd") {
+		cfg.CompressionAlgorithms = append([]string{"zstd"}, cfg.CompressionAlgorithms...)
+	}
+
+	if env.err != nil {
+		return Config{}, env.err
+	}
+	if cfg.Port == "" {
+		return Config{}, errors.New("port must not be empty")
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		return Config{}, errors.New("max-body-bytes must be positive")
+	}
+	if cfg.RequestTimeout <= 0 {
+		return Config{}, errors.New("request-timeout must be positive")
+	}
+	for _, t := range timeouts {
+		if *t.d <= 0 {
+			return Config{}, fmt.Errorf("%s must be positive", t.name)
+		}
+	}
+	if cfg.Router != "" && routeMuxes[cfg.Router] == nil {
+		return Config{}, fmt.Errorf("router %q is not built in; built in: %s", cfg.Router, builtinRouteMuxes())
+	}
+	if cfg.ReadHeaderTimeout <= 0 || cfg.MaxHeaderBytes <= 0 {
+		return Config{}, errors.New("read-header-timeout and max-header-bytes must be positive")
+	}
+	if cfg.H2MaxConcurrentStreams <= 0 || cfg.H2MaxUploadBuffer <= 0 || cfg.H2MaxUploadBuffer > math.MaxInt32 {
+		return Config{}, errors.New("h2-max-concurrent-streams and h2-max-upload-buffer must be positive")
+	}
+	if cfg.H2MaxReadFrameSize < 16384 || cfg.H2MaxReadFrameSize > 1<<24-1 {
+		return Config{}, errors.New("h2-max-read-frame-size must be between 16384 and 16777215")
+	}
+	if cfg.MaxItems <= 0 {
+		return Config{}, errors.New("max-items must be positive")
+	}
+	if cfg.MaxBatchSize < 1 || cfg.MaxPointsBatchSize < 1 {
+		return Config{}, errors.New("max-batch-size and max-points-batch-size must be at least 1")
+	}
+	if cfg.IdempotencyTTL <= 0 {
+		return Config{}, errors.New("idempotency-ttl must be positive")
+	}
+	if cfg.RejectedRetention <= 0 || cfg.RejectedMaxEntries <= 0 || cfg.RejectedMaxPayloadBytes <= 0 {
+		return Config{}, errors.New("rejected-retention, rejected-max-entries and rejected-max-payload-bytes must be positive")
+	}
+	if cfg.FraudTotalTolerancePercent < 0 || cfg.FraudTotalTolerancePercent > 100 {
+		return Config{}, errors.New("fraud-total-tolerance-percent must be between 0 and 100")
+	}
+	if cfg.FraudMaxReceiptsPerHour < 0 {
+		return Config{}, errors.New("fraud-max-receipts-per-hour may not be negative")
+	}
+	if cfg.PointsCacheMaxAge < 0 {
+		return Config{}, errors.New("points-cache-max-age may not be negative")
+	}
+	if cfg.RetentionBy != "ingestion" && cfg.RetentionBy != "purchase" {
+		return Config{}, fmt.Errorf("retention-by must be ingestion or purchase, not %q", cfg.RetentionBy)
+	}
+	if cfg.Retention < 0 || cfg.JanitorInterval <= 0 {
+		return Config{}, errors.New("retention may not be negative and janitor-interval must be positive")
+	}
+	if cfg.DuplicateWindow <= 0 {
+		return Config{}, errors.New("duplicate-window must be positive")
+	}
+	if cfg.RebuildFromEventLog && cfg.EventLog == "" {
+		return Config{}, errors.New("rebuild-from-event-log needs an event-log")
+	}
+	if cfg.MemoryMaxReceipts < 0 {
+		return Config{}, errors.New("memory-max-receipts may not be negative")
+	}
+	if cfg.SQSWorkers <= 0 {
+		return Config{}, errors.New("sqs-workers must be positive")
+	}
+	if cfg.AsyncWorkers <= 0 {
+		return Config{}, errors.New("async-workers must be positive")
+	}
+	if cfg.WarmupReceipts < 0 {
+		return Config{}, errors.New("warmup-receipts may not be negative")
+	}
+	if cfg.ScoringWorkers <= 0 {
+		return Config{}, errors.New("scoring-workers must be positive")
+	}
+	if cfg.OCRTimeout <= 0 || cfg.OCRMaxAttempts <= 0 || cfg.OCRRetryBackoff < 0 {
+		return Config{}, errors.New("ocr-timeout and ocr-max-attempts must be positive and ocr-retry-backoff may not be negative")
+	}
+	if cfg.WebhookMaxAttempts <= 0 {
+		return Config{}, errors.New("webhook-max-attempts must be positive")
+	}
+	if cfg.WebhookBatchSize < 1 || cfg.WebhookBatchInterval <= 0 {
+		return Config{}, errors.New("webhook-batch-size must be at least 1 and webhook-batch-interval positive")
+	}
+	for _, name := range cfg.CompressionAlgorithms {
+		if !slices.Contains(compressionAlgorithms, name) {
+			return Config{}, fmt.Errorf("unknown compression algorithm %q; known: %s", name, strings.Join(compressionAlgorithms, ", "))
+		}
+	}
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return Config{}, errors.New("tls-cert-file and tls-key-file must be set together")
+	}
+	if cfg.TLSCertFile != "" && len(cfg.AutocertDomains) > 0 {
+		return Config{}, errors.New("use either tls-cert-file or autocert-domains, not both")
+	}
+	if cfg.RateLimit < 0 || cfg.RateBurst < 1 {
+		return Config{}, errors.New("rate-limit must not be negative and rate-burst must be at least 1")
+	}
+	if cfg.RequireAPIKey && cfg.JWKSURL != "" {
+		return Config{}, errors.New("use either require-api-key or jwks-url, not both")
+	}
+	if cfg.TenantPerAPIKey && !cfg.RequireAPIKey {
+		return Config{}, errors.New("tenant-per-api-key needs require-api-key")
+	}
+	if cfg.RequireAPIKey && cfg.AdminToken == "" {
+		return Config{}, errors.New("require-api-key needs an admin-token to manage keys with")
+	}
+	if *defaultTimezone != "" {
+		loc, err := loadTimezone(*defaultTimezone)
+		if err != nil {
+			return Config{}, fmt.Errorf("default-timezone: %w", err)
+		}
+		cfg.DefaultTimezone = loc
+	}
+	var err error
+	if cfg.TenantTimezones, err = parseTenantTimezones(*tenantTimezones); err != nil {
+		return Config{}, err
+	}
+	if !logLevels[cfg.LogLevel] {
+		return Config{}, fmt.Errorf("unknown log level %q", cfg.LogLevel)
+	}
+	return cfg, nil
+}
+
+// strictEnv reads settings from the environment like envInt and the
+// others, but keeps the first value it can't parse in err, so a typo
+// stops the server rather than quietly leaving the default in place.
+type strictEnv struct {
+	err error
+}
+
+// read calls parse with the value of key, if it is set.
+func (e *strictEnv) read(key string, parse func(string) error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return
+	}
+	if err := parse(v); err != nil && e.err == nil {
+		e.err = fmt.Errorf("%s: invalid value %q", key, v)
+	}
+}
+
+func (e *strictEnv) bool(key string, def bool) bool {
+	e.read(key, func(v string) (err error) {
+		def, err = strconv.ParseBool(v)
+		return err
+	})
+	return def
+}
+
+func (e *strictEnv) int(key string, def int) int {
+	e.read(key, func(v string) (err error) {
+		def, err = strconv.Atoi(v)
+		return err
+	})
+	return def
+}
+
+func (e *strictEnv) float(key string, def float64) float64 {
+	e.read(key, func(v string) (err error) {
+		def, err = strconv.ParseFloat(v, 64)
+		return err
+	})
+	return def
+}
+
+func (e *strictEnv) duration(key string, def time.Duration) time.Duration {
+	e.read(key, func(v string) (err error) {
+		def, err = time.ParseDuration(v)
+		return err
+	})
+	return def
+}
+
+// splitList splits a comma-separated setting, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfigEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		check   func(Config) bool
+		wantErr bool
+	}{
+		{name: "defaults", check: func(c Config) bool { return !c.RejectDuplicateKeys }},
+		{name: "reject duplicate keys", env: map[string]string{"REJECT_DUPLICATE_KEYS": "true"}, check: func(c Config) bool { return c.RejectDuplicateKeys }},
+		{name: "reject duplicate keys flag", args: []string{"-reject-duplicate-keys"}, check: func(c Config) bool { return c.RejectDuplicateKeys }},
+		{name: "malformed reject duplicate keys", env: map[string]string{"REJECT_DUPLICATE_KEYS": "yes please"}, wantErr: true},
+		{name: "default timeouts", check: func(c Config) bool { return c.Timeouts == defaultRouteTimeouts }},
+		{name: "process timeout", env: map[string]string{"PROCESS_TIMEOUT": "3s"}, check: func(c Config) bool { return c.Timeouts.Process == 3*time.Second }},
+		{name: "process timeout flag", env: map[string]string{"PROCESS_TIMEOUT": "3s"}, args: []string{"-process-timeout", "4s"}, check: func(c Config) bool { return c.Timeouts.Process == 4*time.Second }},
+		{name: "malformed timeout", env: map[string]string{"BATCH_TIMEOUT": "60"}, wantErr: true},
+		{name: "zero timeout", env: map[string]string{"EXPORT_TIMEOUT": "0s"}, wantErr: true},
+		{name: "store rejected", env: map[string]string{"STORE_REJECTED": "true", "REJECTED_MAX_ENTRIES": "10"}, check: func(c Config) bool { return c.StoreRejected && c.RejectedMaxEntries == 10 }},
+		{name: "no rejected entries", env: map[string]string{"REJECTED_MAX_ENTRIES": "0"}, wantErr: true},
+		{name: "malformed rejected retention", env: map[string]string{"REJECTED_RETENTION": "1d"}, wantErr: true},
+		{name: "fraud checks", env: map[string]string{"FRAUD_CHECKS": "true", "FRAUD_MAX_RECEIPTS_PER_HOUR": "0"}, check: func(c Config) bool { return c.FraudChecks && c.FraudMaxReceiptsPerHour == 0 }},
+		{name: "fraud tolerance over 100", env: map[string]string{"FRAUD_TOTAL_TOLERANCE_PERCENT": "150"}, wantErr: true},
+		{name: "malformed fraud tolerance", env: map[string]string{"FRAUD_TOTAL_TOLERANCE_PERCENT": "25%"}, wantErr: true},
+		{name: "points cache max age", env: map[string]string{"POINTS_CACHE_MAX_AGE": "0s"}, check: func(c Config) bool { return c.PointsCacheMaxAge == 0 }},
+		{name: "negative points cache max age", env: map[string]string{"POINTS_CACHE_MAX_AGE": "-1m"}, wantErr: true},
+		{name: "batch sizes", env: map[string]string{"MAX_BATCH_SIZE": "10", "MAX_POINTS_BATCH_SIZE": "1"}, check: func(c Config) bool { return c.MaxBatchSize == 10 && c.MaxPointsBatchSize == 1 }},
+		{name: "empty batches", env: map[string]string{"MAX_BATCH_SIZE": "0"}, wantErr: true},
+		{name: "empty points batches", args: []string{"-max-points-batch-size", "0"}, wantErr: true},
+		{name: "zero idempotency TTL", env: map[string]string{"IDEMPOTENCY_TTL": "0s"}, wantErr: true},
+		{name: "webhook batches", env: map[string]string{"WEBHOOK_BATCH_SIZE": "50", "WEBHOOK_BATCH_INTERVAL": "5s"}, check: func(c Config) bool { return c.WebhookBatchSize == 50 && c.WebhookBatchInterval == 5*time.Second }},
+		{name: "empty webhook batches", env: map[string]string{"WEBHOOK_BATCH_SIZE": "0"}, wantErr: true},
+		{name: "default compression", check: func(c Config) bool { return strings.Join(c.CompressionAlgorithms, ",") == "br,gzip" }},
+		{name: "zstd enabled", env: map[string]string{"ENABLE_ZSTD": "true"}, check: func(c Config) bool { return strings.Join(c.CompressionAlgorithms, ",") == "zstd,br,gzip" }},
+		{name: "gzip only", args: []string{"-compression-algorithms", "gzip"}, check: func(c Config) bool { return strings.Join(c.CompressionAlgorithms, ",") == "gzip" }},
+		{name: "unknown compression", env: map[string]string{"COMPRESSION_ALGORITHMS": "br,lzma"}, wantErr: true},
+		{name: "tenant per API key", env: map[string]string{"TENANT_PER_API_KEY": "true", "REQUIRE_API_KEY": "true", "ADMIN_TOKEN": "admin"}, check: func(c Config) bool { return c.TenantPerAPIKey }},
+		{name: "tenant per API key without keys", env: map[string]string{"TENANT_PER_API_KEY": "true"}, wantErr: true},
+		{name: "warmup", env: map[string]string{"WARMUP_RECEIPTS": "100"}, check: func(c Config) bool { return c.WarmupReceipts == 100 }},
+		{name: "negative warmup", env: map[string]string{"WARMUP_RECEIPTS": "-1"}, wantErr: true},
+		{name: "OCR retries", env: map[string]string{"OCR_TIMEOUT": "2s", "OCR_MAX_ATTEMPTS": "5", "OCR_RETRY_BACKOFF": "0s"}, check: func(c Config) bool {
+			return c.OCRTimeout == 2*time.Second && c.OCRMaxAttempts == 5 && c.OCRRetryBackoff == 0
+		}},
+		{name: "no OCR attempts", env: map[string]string{"OCR_MAX_ATTEMPTS": "0"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := loadConfig(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig: %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !tt.check(cfg) {
+				t.Errorf("loadConfig: unexpected %+v", cfg)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// The columns a receipts CSV must have, in any order, named in its header
+// row. items lists "description:price" pairs separated by "|", such as
+// "Gatorade:2.25|Doritos Nacho Cheese:3.35". receiptctl reads the same
+// format. A currency column may be added too.
+var csvColumns = []string{"retailer", "purchaseDate", "purchaseTime", "total", "items"}
+
+// Response for POST /receipts/import
+type ImportResponse struct {
+	Results []ImportResult `json:"results"`
+	Summary *BatchSummary  `json:"summary,omitempty"`
+}
+
+// The outcome for one CSV row. Row is its line number in the file, the
+// header being line 1.
+type ImportResult struct {
+	Row int `json:"row"`
+	BatchResult
+}
+
+// importReceiptsHandler handles POST /receipts/import
+// Each row of the CSV is a receipt, scored and stored like the receipts of
+// a batch: one bad row does not stop the others.
+func importReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	cr := csv.NewReader(r.Body)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err != nil {
+		writeProblem(w, csvProblem(err))
+		return
+	}
+	col := map[string]int{}
+	for i, h := range header {
+		col[strings.TrimSpace(h)] = i
+	}
+	for _, c := range csvColumns {
+		if _, ok := col[c]; !ok {
+			writeProblem(w, newProblem(http.StatusBadRequest, codeInvalidCSV, fmt.Sprintf("Invalid CSV: missing column %q", c)))
+			return
+		}
+	}
+
+	var (
+		rows     []ImportResult
+		payloads []json.RawMessage
+		// Where each payload's result goes in rows.
+		slots []int
+	)
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			rows = append(rows, ImportResult{Row: pe.StartLine, BatchResult: BatchResult{Error: "Invalid CSV row: " + pe.Err.Error(), Code: codeInvalidCSV}})
+			continue
+		}
+		if err != nil {
+			writeProblem(w, csvProblem(err))
+			return
+		}
+		if len(rows) == maxBatchSize {
+			writeProblem(w, newProblem(http.StatusBadRequest, codeBatchTooLarge, fmt.Sprintf("Import too large: at most %d rows", maxBatchSize)))
+			return
+		}
+
+		line, _ := cr.FieldPos(0)
+		field := func(c string) string {
+			if i, ok := col[c]; ok && i < len(record) {
+				return record[i]
+			}
+			return ""
+		}
+		receipt := Receipt{
+			Retailer:     field("retailer"),
+			PurchaseDate: field("purchaseDate"),
+			PurchaseTime: field("purchaseTime"),
+			Total:        field("total"),
+			Currency:     field("currency"),
+		}
+		receipt.Items, err = parseCSVItems(field("items"))
+		if err != nil {
+			p := invalidReceipt(err)
+			rows = append(rows, ImportResult{Row: line, BatchResult: BatchResult{Error: p.Detail, Code: p.Code, Field: p.Field}})
+			continue
+		}
+		payload, _ := json.Marshal(receipt)
+		rows = append(rows, ImportResult{Row: line})
+		payloads = append(payloads, payload)
+		slots = append(slots, len(rows)-1)
+	}
+
+	results, p := processPayloads(r, payloads)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+	for i, res := range results {
+		rows[slots[i]].BatchResult = res
+	}
+
+	resp := ImportResponse{Results: rows}
+	if resp.Results == nil {
+		resp.Results = []ImportResult{}
+	}
+	batch := make([]BatchResult, len(rows))
+	for i, row := range rows {
+		batch[i] = row.BatchResult
+	}
+	resp.Summary = summarizeBatch(r, batch)
+	writeResponse(w, r, resp, nil)
+}
+
+// parseCSVItems parses the items column. The price follows the last ':',
+// so descriptions may contain colons.
+func parseCSVItems(s string) ([]Item, error) {
+	items := []Item{}
+	if strings.TrimSpace(s) == "" {
+		return items, nil
+	}
+	for i, part := range strings.Split(s, "|") {
+		sep := strings.LastIndex(part, ":")
+		if sep < 0 {
+			return nil, &FieldError{fmt.Sprintf("items[%d]", i), "must be written as description:price"}
+		}
+		items = append(items, Item{ShortDescription: part[:sep], Price: strings.TrimSpace(part[sep+1:])})
+	}
+	return items, nil
+}
+
+// formatCSVItems writes items as parseCSVItems reads them.
+func formatCSVItems(items []Item) string {
+	parts := make([]string, len(items))
+	for i, item := range items {
+		parts[i] = item.ShortDescription + ":" + item.Price
+	}
+	return strings.Join(parts, "|")
+}
+
+// csvProblem turns an error reading the CSV as a whole into a Problem.
+func csvProblem(err error) *Problem {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return unreadableBody(err)
+	}
+	if err == io.EOF {
+		return newProblem(http.StatusBadRequest, codeInvalidCSV, "Invalid CSV: a header row is required")
+	}
+	return newProblem(http.StatusBadRequest, codeInvalidCSV, "Invalid CSV: "+err.Error())
+}
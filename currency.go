@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The currency receipts are assumed to be in when they don't name one, and
+// the one the rules score in.
+const baseCurrency = "USD"
+
+// The currencies a receipt may be in, with how many digits follow the
+// decimal point in their amounts: "6.49" in USD, "649" in JPY. Besides
+// USD, a receipt is only scored when the rule set has a rate for its
+// currency.
+var currencyDecimals = map[string]int{
+	"AUD": 2,
+	"CAD": 2,
+	"CHF": 2,
+	"CNY": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"INR": 2,
+	"JPY": 0,
+	"KRW": 0,
+	"MXN": 2,
+	"USD": 2,
+}
+
+// Matches a currency code in the form currencyDecimals uses
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// Matches an amount in any supported currency, for the generated schemas
+var anyAmountPattern = regexp.MustCompile(`^\d+(\.\d{2})?$`)
+
+// receiptCurrency returns the currency a receipt's amounts are in.
+func receiptCurrency(receipt Receipt) string {
+	if receipt.Currency == "" {
+		return baseCurrency
+	}
+	return receipt.Currency
+}
+
+// The most minor units an amount may have, 2^40-1
+const maxMinorUnits = 1<<40 - 1
+
+// currencyAmountExample returns an example of an amount in a currency for
+// error messages.
+func currencyAmountExample(currency string) string {
+	if currencyDecimals[currency] == 0 {
+		return "649"
+	}
+	return "6.49"
+}
+
+// isAmount reports whether s is an amount with exactly the given number
+// of decimals, such as 6.49 with 2 or 649 with none.
+func isAmount(s string, decimals int) bool {
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if hasFrac != (decimals > 0) || len(frac) != decimals {
+		return false
+	}
+	return isDigits(whole) && (decimals == 0 || isDigits(frac))
+}
+
+// isDigits reports whether s is one or more ASCII digits.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseMinorUnits parses an amount with the given number of decimals into
+// its minor units, so "35.35" with 2 decimals is 3535 and "1200" with none
+// is 1200.
+func parseMinorUnits(amount string, decimals int) (int64, error) {
+	whole, frac, hasFrac := strings.Cut(amount, ".")
+	if whole == "" || len(frac) > decimals || (hasFrac && frac == "") {
+		return 0, fmt.Errorf("invalid amount %q", amount)
+	}
+	// Digit by digit, padding frac with zeros, rather than joining the
+	// parts into a new string for strconv on every price scored.
+	var units int64
+	for i := 0; i < len(whole)+decimals; i++ {
+		c := byte('0')
+		if i < len(whole) {
+			c = whole[i]
+		} else if j := i - len(whole); j < len(frac) {
+			c = frac[j]
+		}
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("invalid amount %q", amount)
+		}
+		units = units*10 + int64(c-'0')
+		if units > maxMinorUnits {
+			return 0, fmt.Errorf("invalid amount %q", amount)
+		}
+	}
+	return units, nil
+}
+
+// inBaseCurrency returns the receipt with its total and prices converted to
+// USD at the rule set's rate, rounded to the nearest cent, so the rules
+// score what was spent rather than the figures printed. USD receipts are
+// returned as they are, with a rate of 1.
+func (rs *RuleSet) inBaseCurrency(receipt Receipt) (Receipt, float64, error) {
+	currency := receiptCurrency(receipt)
+	if currency == baseCurrency {
+		return receipt, 1, nil
+	}
+	rate, ok := rs.CurrencyRates[currency]
+	if !ok {
+		return Receipt{}, 0, fmt.Errorf("no exchange rate for %s", currency)
+	}
+	// Exactly the rate as written, 0.0067 rather than the float64 nearest
+	// to it, and cents per minor unit of the currency.
+	exact, _ := new(big.Rat).SetString(strconv.FormatFloat(rate, 'f', -1, 64))
+	perUnit := new(big.Rat).Mul(exact, new(big.Rat).SetFrac64(100, int64(math.Pow10(currencyDecimals[currency]))))
+	convert := func(amount string) (string, error) {
+		units, err := parseMinorUnits(amount, currencyDecimals[currency])
+		if err != nil {
+			return "", err
+		}
+		cents, ok := roundRat(new(big.Rat).Mul(new(big.Rat).SetInt64(units), perUnit))
+		if !ok || cents > maxMinorUnits {
+			return "", fmt.Errorf("amount %q is too large in %s", amount, baseCurrency)
+		}
+		return fmt.Sprintf("%d.%02d", cents/100, cents%100), nil
+	}
+
+	var err error
+	if receipt.Total, err = convert(receipt.Total); err != nil {
+		return Receipt{}, 0, fmt.Errorf("invalid total")
+	}
+	items := make([]Item, len(receipt.Items))
+	for i, item := range receipt.Items {
+		if item.Price, err = convert(item.Price); err != nil {
+			return Receipt{}, 0, fmt.Errorf("invalid item price")
+		}
+		items[i] = item
+	}
+	receipt.Items = items
+	receipt.Currency = baseCurrency
+	return receipt, rate, nil
+}
+
+// roundRat rounds a non-negative number to the nearest integer, halves
+// rounding up. ok is false if the result doesn't fit in an int64.
+func roundRat(r *big.Rat) (n int64, ok bool) {
+	i := new(big.Int).Mul(r.Num(), big.NewInt(2))
+	i.Add(i, r.Denom())
+	i.Quo(i, new(big.Int).Mul(r.Denom(), big.NewInt(2)))
+	if !i.IsInt64() {
+		return 0, false
+	}
+	return i.Int64(), true
+}
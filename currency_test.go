@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestInBaseCurrency(t *testing.T) {
+	rs := defaultRules()
+	rs.CurrencyRates = map[string]float64{"EUR": 1.08, "JPY": 0.0067, "KRW": 1_000_000}
+	if err := rs.compile(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		receipt   Receipt
+		wantTotal string
+		wantPrice string
+		wantErr   bool
+	}{
+		{
+			name:      "USD as is",
+			receipt:   Receipt{Total: "6.49", Items: []Item{{Price: "6.49"}}},
+			wantTotal: "6.49",
+			wantPrice: "6.49",
+		},
+		{
+			name:      "EUR",
+			receipt:   Receipt{Currency: "EUR", Total: "10.00", Items: []Item{{Price: "2.25"}}},
+			wantTotal: "10.80",
+			wantPrice: "2.43",
+		},
+		{
+			name:      "JPY rounds half up",
+			receipt:   Receipt{Currency: "JPY", Total: "1500", Items: []Item{{Price: "75"}}},
+			wantTotal: "10.05",
+			wantPrice: "0.50",
+		},
+		{
+			name:    "no rate",
+			receipt: Receipt{Currency: "GBP", Total: "1.00"},
+			wantErr: true,
+		},
+		{
+			name:    "too large once converted",
+			receipt: Receipt{Currency: "KRW", Total: "1099511627775"},
+			wantErr: true,
+		},
+		{
+			name:    "larger than scoring accepts once converted",
+			receipt: Receipt{Currency: "KRW", Total: "11000"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := rs.inBaseCurrency(tt.receipt)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("inBaseCurrency = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("inBaseCurrency: %v", err)
+			}
+			if got.Total != tt.wantTotal {
+				t.Errorf("total = %s, want %s", got.Total, tt.wantTotal)
+			}
+			if len(got.Items) > 0 && got.Items[0].Price != tt.wantPrice {
+				t.Errorf("price = %s, want %s", got.Items[0].Price, tt.wantPrice)
+			}
+		})
+	}
+}
+
+func TestRoundRat(t *testing.T) {
+	huge, _ := new(big.Rat).SetString("100000000000000000000")
+	tests := []struct {
+		r      *big.Rat
+		want   int64
+		wantOK bool
+	}{
+		{big.NewRat(0, 1), 0, true},
+		{big.NewRat(5, 2), 3, true},
+		{big.NewRat(249, 100), 2, true},
+		{big.NewRat(7, 1), 7, true},
+		{huge, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := roundRat(tt.r)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("roundRat(%s) = %d, %v, want %d, %v", tt.r, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestCurrencyRatesOverride(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	rules := `versions:
+  - version: v1
+    effectiveTo: "2000-01-01"
+    currencyRates: {EUR: 0.95}
+  - version: v2
+    effectiveFrom: "2000-01-01"
+    currencyRates: {EUR: 1.05}
+`
+	if err := os.WriteFile(path, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		rates   string
+		wantV1  float64
+		wantV2  float64
+		wantErr bool
+	}{
+		{name: "only the current version", rates: "EUR:1.08", wantV1: 0.95, wantV2: 1.08},
+		{name: "zero", rates: "EUR:0", wantErr: true},
+		{name: "too small", rates: "EUR:0.0000001", wantErr: true},
+		{name: "too large", rates: "EUR:1e7", wantErr: true},
+		{name: "infinite", rates: "EUR:+Inf", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versions, err := loadRules(path, map[string]string{"CURRENCY_RATES": tt.rates})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("loadRules succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadRules: %v", err)
+			}
+			if got := versions[0].CurrencyRates["EUR"]; got != tt.wantV1 {
+				t.Errorf("v1 EUR rate = %v, want %v", got, tt.wantV1)
+			}
+			if got := versions[1].CurrencyRates["EUR"]; got != tt.wantV2 {
+				t.Errorf("v2 EUR rate = %v, want %v", got, tt.wantV2)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Reject a receipt with the same fingerprint as one the tenant already
+// stored, so the same receipt can't earn points twice. Set from
+// REJECT_DUPLICATE_RECEIPTS.
+var rejectDuplicateReceipts bool
+
+// How long a receipt's fingerprint is remembered, set from
+// DUPLICATE_WINDOW.
+var duplicateWindow = 365 * 24 * time.Hour
+
+var duplicatesRejected = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "receipts_duplicates_rejected_total",
+	Help: "Receipts rejected for repeating one already stored.",
+})
+
+// receiptFingerprint identifies a receipt by what is printed on it: the
+// retailer, date, time, total and items, with their currency and time
+// zone. Case and runs of spaces are ignored and amounts compared by value,
+// so "Target" and "target ", or 6.5 and 6.50, make the same fingerprint.
+// The userId is left out, so one receipt can't be claimed by two users.
+func receiptFingerprint(receipt Receipt) string {
+	normalize := func(s string) string {
+		return strings.ToLower(strings.Join(strings.Fields(s), " "))
+	}
+	amount := func(s string) string {
+		if units, err := parseMinorUnits(s, currencyDecimals[receiptCurrency(receipt)]); err == nil {
+			return strconv.FormatInt(units, 10)
+		}
+		return s
+	}
+	fields := []string{
+		normalize(receipt.Retailer), receipt.PurchaseDate, receipt.PurchaseTime,
+		receiptCurrency(receipt), receipt.Timezone, amount(receipt.Total),
+	}
+	for _, item := range receipt.Items {
+		fields = append(fields, normalize(item.ShortDescription), amount(item.Price))
+	}
+	sum := sha256.Sum256([]byte(strings.Join(fields, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
+
+// saveReceipt stores a newly scored receipt, after claiming its
+// fingerprint with claimFingerprint. Errors are *Problem.
+func saveReceipt(ctx context.Context, rec StoredReceipt) error {
+	key, err := claimFingerprint(ctx, rec)
+	if err != nil {
+		return err
+	}
+	if err := store.Save(ctx, rec); err != nil {
+		slog.Error("Error saving receipt", "receipt_id", rec.ID, "err", err)
+		releaseFingerprints(ctx, key)
+		return storeFailure(err, "Error saving receipt")
+	}
+	return nil
+}
+
+// claimFingerprint is called before rec is stored. With
+// rejectDuplicateReceipts set, it links rec's fingerprint to it and
+// returns the key of the link, which the caller releases with
+// releaseFingerprints if rec can't be stored after all. When another of
+// the tenant's receipts already has the fingerprint, a 409 *Problem names
+// it and rec must not be stored. Claiming before storing means that of two
+// identical receipts submitted at once, only one is ever stored. The link
+// is kept for duplicateWindow whether or not that receipt is still
+// stored. Other errors are *Problem too.
+func claimFingerprint(ctx context.Context, rec StoredReceipt) (string, error) {
+	if !rejectDuplicateReceipts {
+		return "", nil
+	}
+	key := scopedKey(keySpaceFingerprint, rec.Tenant, receiptFingerprint(rec.Receipt))
+	originalID, err := store.ClaimIdempotencyKey(ctx, key, rec.ID, duplicateWindow)
+	if err != nil {
+		slog.Error("Error checking for duplicate receipt", "receipt_id", rec.ID, "err", err)
+		return "", storeFailure(err, "Error saving receipt")
+	}
+	if originalID != rec.ID {
+		duplicatesRejected.Inc()
+		p := newProblem(http.StatusConflict, codeDuplicateReceipt, "This receipt was already submitted")
+		p.OriginalID = originalID
+		return "", p
+	}
+	return key, nil
+}
+
+// releaseFingerprints removes the links claimFingerprint made for receipts
+// that weren't stored. Empty keys are skipped.
+func releaseFingerprints(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if err := store.ReleaseIdempotencyKey(ctx, key); err != nil {
+			slog.Error("Error releasing receipt fingerprint", "err", err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDuplicateReceipts(t *testing.T) {
+	var target Receipt
+	if err := json.Unmarshal([]byte(targetReceipt), &target); err != nil {
+		t.Fatal(err)
+	}
+	walgreens := strings.Replace(targetReceipt, "Target", "Walgreens", 1)
+
+	type submission struct {
+		payload string
+		key     string
+	}
+	tests := []struct {
+		name        string
+		submissions []submission
+		wantStatus  []int
+	}{
+		{
+			name:        "same receipt twice",
+			submissions: []submission{{payload: targetReceipt}, {payload: targetReceipt}},
+			wantStatus:  []int{http.StatusOK, http.StatusConflict},
+		},
+		{
+			name:        "different receipts",
+			submissions: []submission{{payload: targetReceipt}, {payload: walgreens}},
+			wantStatus:  []int{http.StatusOK, http.StatusOK},
+		},
+		{
+			name: "Idempotency-Key spelling a fingerprint",
+			submissions: []submission{
+				{payload: walgreens, key: "fingerprint:" + receiptFingerprint(target)},
+				{payload: targetReceipt},
+			},
+			wantStatus: []int{http.StatusOK, http.StatusOK},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(reject bool, window time.Duration) {
+				rejectDuplicateReceipts, duplicateWindow = reject, window
+			}(rejectDuplicateReceipts, duplicateWindow)
+			rejectDuplicateReceipts, duplicateWindow = true, time.Hour
+			api := newTestAPI(t)
+
+			for i, sub := range tt.submissions {
+				req := httptest.NewRequest("POST", "/receipts/process", strings.NewReader(sub.payload))
+				if sub.key != "" {
+					req.Header.Set("Idempotency-Key", sub.key)
+				}
+				rec := httptest.NewRecorder()
+				api.ServeHTTP(rec, req)
+				if rec.Code != tt.wantStatus[i] {
+					t.Errorf("submission %d: status %d, want %d: %s", i, rec.Code, tt.wantStatus[i], rec.Body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// How long clients and caches may reuse a receipt's points without asking
+// again. Set from POINTS_CACHE_MAX_AGE.
+var pointsCacheMaxAge = time.Minute
+
+// Whether shared caches such as CDNs may keep points responses. They are
+// only allowed to when requests aren't authenticated, since a shared cache
+// would otherwise hand one client's answer to another. Set up in main.
+var pointsCachePublic = true
+
+// writeCacheable answers a GET with v, or pb, in the format the client
+// asked for as writeResponse does, tagged with an ETag made from its
+// content. A receipt's points only change when it is updated or
+// recalculated, so a client that sends the ETag back in If-None-Match
+// gets 304 Not Modified until then. The ETag is weak because the body may
+// be compressed on the way out.
+func writeCacheable(w http.ResponseWriter, r *http.Request, v any, pb proto.Message) {
+	body, contentType, err := encodeResponse(r, v, pb)
+	if err != nil {
+		writeProblem(w, newProblem(http.StatusInternalServerError, codeInternal, "Error encoding response"))
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `W/"` + hex.EncodeToString(sum[:16]) + `"`
+
+	scope := "private"
+	if pointsCachePublic {
+		scope = "public"
+	}
+	h := w.Header()
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", fmt.Sprintf("%s, max-age=%d", scope, int(pointsCacheMaxAge.Seconds())))
+	// Headers set here replace those set outside withTimeout, so this
+	// repeats the Vary that compression adds.
+	h.Set("Vary", "Accept, Accept-Encoding, X-Tenant-ID")
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, or is
+// "*". Tags are compared weakly, ignoring any W/ prefix.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The events of a receipt's life, as written to the event log
+const (
+	// A receipt was submitted and stored, as of its CreatedAt.
+	eventSubmitted = "submitted"
+	// Its points were awarded. It always follows the receipt's submitted
+	// event, which holds the receipt.
+	eventScored = "scored"
+	// It was replaced or scored again, through PUT /receipts/{id} or a
+	// recalculation.
+	eventAdjusted = "adjusted"
+	// It was deleted, or with ExpiredBefore, every receipt that expired
+	// then was.
+	eventDeleted = "deleted"
+)
+
+var eventsLogged = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "receipt_events_logged_total",
+	Help: "Receipt events appended to the event log, by type.",
+}, []string{"type"})
+
+// One event in the event log. Seq numbers the events from 1 in the order
+// they were written. Only the fields of its Type are set.
+type ReceiptEvent struct {
+	Seq       int64            `json:"seq"`
+	Type      string           `json:"type"`
+	At        time.Time        `json:"at"`
+	Tenant    string           `json:"tenant,omitempty"`
+	ReceiptID string           `json:"receiptId,omitempty"`
+	Receipt   *Receipt         `json:"receipt,omitempty"`
+	Points    *int             `json:"points,omitempty"`
+	Breakdown *PointsBreakdown `json:"breakdown,omitempty"`
+
+	// For a deleted event of the janitor, the cutoff it removed receipts
+	// at and whether it went by purchase date
+	ExpiredBefore  *time.Time `json:"expiredBefore,omitempty"`
+	ByPurchaseDate bool       `json:"byPurchaseDate,omitempty"`
+}
+
+// eventLog is an append-only file of ReceiptEvents, one JSON object to a
+// line. Only one process may write to it at a time.
+type eventLog struct {
+	path string
+
+	mu  sync.Mutex
+	f   *os.File
+	seq int64 // of the last event written
+}
+
+// openEventLog opens the event log at path, creating it if needed. A last
+// line left incomplete by a crash is cut off, since its change was never
+// made.
+func openEventLog(path string) (*eventLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l := &eventLog{path: path, f: f}
+	var end int64
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		var ev ReceiptEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("event log %s: line after event %d: %w", path, l.seq, err)
+		}
+		l.seq = ev.Seq
+		end += int64(len(line))
+	}
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(end, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// append numbers the events and writes them to the log in one go, synced
+// to disk before it returns.
+func (l *eventLog) append(events ...ReceiptEvent) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range events {
+		events[i].Seq = l.seq + int64(i) + 1
+		if err := enc.Encode(events[i]); err != nil {
+			return err
+		}
+	}
+	if _, err := l.f.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.seq += int64(len(events))
+	for _, ev := range events {
+		eventsLogged.WithLabelValues(ev.Type).Inc()
+	}
+	return nil
+}
+
+// read calls fn with every event after the one numbered after, in order,
+// up to the last one written when it started.
+func (l *eventLog) read(ctx context.Context, after int64, fn func(ReceiptEvent) error) error {
+	l.mu.Lock()
+	last := l.seq
+	l.mu.Unlock()
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	for seq := int64(0); seq < last; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line, err := br.ReadBytes('\n')
+		if err != nil {
+			return err
+		}
+		var ev ReceiptEvent
+		if err := json.Unmarshal(line, &ev); err != nil {
+			return fmt.Errorf("decoding event after %d: %w", seq, err)
+		}
+		seq = ev.Seq
+		if seq > after {
+			if err := fn(ev); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (l *eventLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// eventLogStore wraps a ReceiptStore so every change to a receipt is
+// written to the event log once the store has made it. A change the store
+// fails or turns down is never logged, so the log holds what replaying it
+// into an empty store gives, and the store can be rebuilt from it with
+// rebuildFromEventLog. If the log can't be written after the change was
+// made, the error is returned and the log lacks that change; a request for
+// it fails rather than be answered for a change that isn't logged.
+type eventLogStore struct {
+	ReceiptStore
+	log *eventLog
+}
+
+// storedEvents returns the submitted and scored events of a new receipt.
+func storedEvents(rec StoredReceipt) []ReceiptEvent {
+	receipt, points, breakdown := rec.Receipt, rec.Points, rec.Breakdown
+	at := rec.CreatedAt.UTC()
+	return []ReceiptEvent{
+		{Type: eventSubmitted, At: at, Tenant: rec.Tenant, ReceiptID: rec.ID, Receipt: &receipt},
+		{Type: eventScored, At: at, Tenant: rec.Tenant, ReceiptID: rec.ID, Points: &points, Breakdown: &breakdown},
+	}
+}
+
+// logEvents appends events for a change the store has made.
+func (s eventLogStore) logEvents(events ...ReceiptEvent) error {
+	if err := s.log.append(events...); err != nil {
+		return fmt.Errorf("writing event log: %w", err)
+	}
+	return nil
+}
+
+func (s eventLogStore) Save(ctx context.Context, rec StoredReceipt) error {
+	if err := s.ReceiptStore.Save(ctx, rec); err != nil {
+		return err
+	}
+	return s.logEvents(storedEvents(rec)...)
+}
+
+func (s eventLogStore) SaveBatch(ctx context.Context, recs []StoredReceipt) error {
+	if err := saveBatch(ctx, s.ReceiptStore, recs); err != nil {
+		return err
+	}
+	events := make([]ReceiptEvent, 0, 2*len(recs))
+	for _, rec := range recs {
+		events = append(events, storedEvents(rec)...)
+	}
+	return s.logEvents(events...)
+}
+
+func (s eventLogStore) Update(ctx context.Context, rec StoredReceipt) (StoredReceipt, error) {
+	old, err := s.ReceiptStore.Update(ctx, rec)
+	if err != nil {
+		return StoredReceipt{}, err
+	}
+	receipt, points, breakdown := rec.Receipt, rec.Points, rec.Breakdown
+	return old, s.logEvents(ReceiptEvent{Type: eventAdjusted, At: time.Now().UTC(), Tenant: rec.Tenant, ReceiptID: rec.ID, Receipt: &receipt, Points: &points, Breakdown: &breakdown})
+}
+
+func (s eventLogStore) Delete(ctx context.Context, tenant, id string) error {
+	if err := s.ReceiptStore.Delete(ctx, tenant, id); err != nil {
+		return err
+	}
+	return s.logEvents(ReceiptEvent{Type: eventDeleted, At: time.Now().UTC(), Tenant: tenant, ReceiptID: id})
+}
+
+// DeleteExpired is only logged when receipts expired, so the janitor
+// doesn't add an event every run. Replaying it removes the same receipts.
+// If the process stops before it is logged, a store rebuilt from the log
+// has them back until the janitor's next run.
+func (s eventLogStore) DeleteExpired(ctx context.Context, cutoff time.Time, byPurchaseDate bool) ([]StoredReceipt, error) {
+	expired, err := s.ReceiptStore.DeleteExpired(ctx, cutoff, byPurchaseDate)
+	if len(expired) == 0 {
+		return expired, err
+	}
+	cutoff = cutoff.UTC()
+	ev := ReceiptEvent{Type: eventDeleted, At: time.Now().UTC(), ExpiredBefore: &cutoff, ByPurchaseDate: byPurchaseDate}
+	if logErr := s.logEvents(ev); logErr != nil && err == nil {
+		err = logErr
+	}
+	return expired, err
+}
+
+func (s eventLogStore) GetPointsBatch(ctx context.Context, tenant string, ids []string) (map[string]int, error) {
+	return getPointsBatch(ctx, s.ReceiptStore, tenant, ids)
+}
+
+func (s eventLogStore) Ping(ctx context.Context) error {
+	if p, ok := s.ReceiptStore.(Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (s eventLogStore) Close() error {
+	err := s.ReceiptStore.Close()
+	if logErr := s.log.Close(); err == nil {
+		err = logErr
+	}
+	return err
+}
+
+// Receipts saved at a time while rebuilding
+const rebuildBatchSize = 500
+
+// rebuildFromEventLog replays every event of the log into s, which must
+// be empty, and returns how many there were. Replaying the same log always
+// gives the same receipts. Logs written before changes were logged only
+// once made can hold some the store turned down, such as adjusting a
+// receipt deleted in the meantime; they are skipped again.
+func rebuildFromEventLog(ctx context.Context, l *eventLog, s ReceiptStore) (int, error) {
+	n, err := s.Count(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if n > 0 {
+		return 0, fmt.Errorf("the store already holds %d receipts; rebuild into an empty one", n)
+	}
+
+	// Submitted receipts waiting for their scored event
+	pending := make(map[string]StoredReceipt)
+	// Scored receipts not yet saved, and their IDs
+	var batch []StoredReceipt
+	inBatch := make(map[string]bool)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := saveBatch(ctx, s, batch)
+		batch = batch[:0]
+		clear(inBatch)
+		return err
+	}
+
+	events := 0
+	err = l.read(ctx, 0, func(ev ReceiptEvent) error {
+		events++
+		key := ev.Tenant + "/" + ev.ReceiptID
+		switch ev.Type {
+		case eventSubmitted:
+			if ev.Receipt == nil {
+				return fmt.Errorf("event %d: submitted without a receipt", ev.Seq)
+			}
+			pending[key] = StoredReceipt{ID: ev.ReceiptID, Tenant: ev.Tenant, Receipt: *ev.Receipt, CreatedAt: ev.At}
+		case eventScored:
+			rec, ok := pending[key]
+			if !ok || ev.Points == nil || ev.Breakdown == nil {
+				return fmt.Errorf("event %d: scored without a submitted receipt or points", ev.Seq)
+			}
+			delete(pending, key)
+			rec.Points, rec.Breakdown = *ev.Points, *ev.Breakdown
+			// A batch saves a receipt once, so a second save of it starts
+			// the next.
+			if inBatch[key] || len(batch) == rebuildBatchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+			batch = append(batch, rec)
+			inBatch[key] = true
+		case eventAdjusted:
+			if ev.Receipt == nil || ev.Points == nil || ev.Breakdown == nil {
+				return fmt.Errorf("event %d: adjusted without a receipt or points", ev.Seq)
+			}
+			if err := flush(); err != nil {
+				return err
+			}
+			rec := StoredReceipt{ID: ev.ReceiptID, Tenant: ev.Tenant, Receipt: *ev.Receipt, Points: *ev.Points, Breakdown: *ev.Breakdown}
+			if _, err := s.Update(ctx, rec); err != nil && !errors.Is(err, ErrReceiptNotFound) {
+				return err
+			}
+		case eventDeleted:
+			if err := flush(); err != nil {
+				return err
+			}
+			if ev.ExpiredBefore != nil {
+				_, err := s.DeleteExpired(ctx, *ev.ExpiredBefore, ev.ByPurchaseDate)
+				return err
+			}
+			if err := s.Delete(ctx, ev.Tenant, ev.ReceiptID); err != nil && !errors.Is(err, ErrReceiptNotFound) {
+				return err
+			}
+		default:
+			return fmt.Errorf("event %d: unknown type %q", ev.Seq, ev.Type)
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	return events, err
+}
+
+// The event log, when EVENT_LOG is set
+var receiptEvents *eventLog
+
+// eventsHandler handles GET /admin/events
+// Every event of the log after the one numbered after (0 for all of them),
+// as newline-delimited JSON, for consumers replaying the history of every
+// tenant's receipts. The response is streamed, so like an export it gets
+// timeout rather than REQUEST_TIMEOUT and WRITE_TIMEOUT.
+func eventsHandler(timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var after int64
+		if v := r.URL.Query().Get("after"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				p := newProblem(http.StatusBadRequest, codeInvalidParameter, "after must be an event number, 0 or more")
+				p.Field = "after"
+				writeProblem(w, p)
+				return
+			}
+			after = n
+		}
+
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), timeout)
+		defer cancel()
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		err := receiptEvents.read(ctx, after, func(ev ReceiptEvent) error {
+			return enc.Encode(ev)
+		})
+		if err != nil {
+			// The body has begun, so it just ends early.
+			slog.Error("Error reading event log", "after", after, "err", err)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// One receipt in an export: the receipt as submitted, with its ID, points
+// and when it was stored.
+type ExportedReceipt struct {
+	ID string `json:"id"`
+	Receipt
+	Points    int       `json:"points"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// The columns of a CSV export. The receipt columns are those POST
+// /receipts/import reads, so an export can be imported again.
+var exportColumns = []string{"id", "retailer", "purchaseDate", "purchaseTime", "total", "currency", "items", "points", "createdAt"}
+
+// Receipts read from the store at a time while exporting
+const exportPageSize = 500
+
+// exportReceiptsHandler handles GET /receipts/export
+// Every receipt of the tenant is written out as a JSON array, or CSV with
+// format=csv, oldest ID first. from and to limit the purchase dates and
+// retailer the retailer, ignoring case. The response is streamed page by
+// page, so instead of REQUEST_TIMEOUT and WRITE_TIMEOUT an export gets
+// timeout; when the store fails partway through, the body just ends early.
+func exportReceiptsHandler(timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		exportReceipts(w, r, timeout)
+	}
+}
+
+func exportReceipts(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+	q := r.URL.Query()
+	format := q.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		p := newProblem(http.StatusBadRequest, codeInvalidParameter, "format must be json or csv")
+		p.Field = "format"
+		writeProblem(w, p)
+		return
+	}
+	for _, name := range []string{"from", "to"} {
+		if v := q.Get(name); v != "" {
+			if _, err := time.Parse("2006-01-02", v); err != nil {
+				p := newProblem(http.StatusBadRequest, codeInvalidParameter, name+" must be a date such as 2022-01-31")
+				p.Field = name
+				writeProblem(w, p)
+				return
+			}
+		}
+	}
+	from, to, retailer := q.Get("from"), q.Get("to"), q.Get("retailer")
+	match := func(rec StoredReceipt) bool {
+		d := rec.Receipt.PurchaseDate
+		return (from == "" || d >= from) && (to == "" || d <= to) &&
+			(retailer == "" || strings.EqualFold(rec.Receipt.Retailer, retailer))
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), timeout)
+	defer cancel()
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Now().Add(timeout))
+
+	// Read the first page before answering, so a store that is down still
+	// gets a Problem.
+	tenant := tenantFrom(r.Context())
+	recs, err := store.List(ctx, tenant, "", exportPageSize)
+	if err != nil {
+		requestLogger(r).Error("Error listing receipts", "err", err)
+		writeProblem(w, storeFailure(err, "Error listing receipts"))
+		return
+	}
+
+	// write writes a receipt, and flush what is buffered before a page is
+	// flushed to the client.
+	var write func(rec StoredReceipt) error
+	flush := func() {}
+	switch format {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="receipts.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write(exportColumns)
+		write = func(rec StoredReceipt) error {
+			cw.Write([]string{
+				rec.ID, rec.Receipt.Retailer, rec.Receipt.PurchaseDate, rec.Receipt.PurchaseTime, rec.Receipt.Total, receiptCurrency(rec.Receipt),
+				formatCSVItems(rec.Receipt.Items), strconv.Itoa(rec.Points), rec.CreatedAt.UTC().Format(time.RFC3339),
+			})
+			return cw.Error()
+		}
+		flush = cw.Flush
+		defer cw.Flush()
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="receipts.json"`)
+		w.Write([]byte("["))
+		enc := json.NewEncoder(w)
+		first := true
+		write = func(rec StoredReceipt) error {
+			if !first {
+				w.Write([]byte(","))
+			}
+			first = false
+			return enc.Encode(ExportedReceipt{ID: rec.ID, Receipt: rec.Receipt, Points: rec.Points, CreatedAt: rec.CreatedAt})
+		}
+		defer w.Write([]byte("]\n"))
+	}
+
+	exported := 0
+	for {
+		for _, rec := range recs {
+			if !match(rec) {
+				continue
+			}
+			if err := write(rec); err != nil {
+				requestLogger(r).Warn("Error writing export", "exported", exported, "err", err)
+				return
+			}
+			exported++
+		}
+		if len(recs) < exportPageSize {
+			return
+		}
+		flush()
+		rc.Flush()
+		if recs, err = store.List(ctx, tenant, recs[len(recs)-1].ID, exportPageSize); err != nil {
+			requestLogger(r).Error("Error listing receipts, export cut short", "exported", exported, "err", err)
+			return
+		}
+	}
+}
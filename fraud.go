@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Check receipts for signs of fraud as they are stored. A suspicious
+// receipt is still scored and stored; it is flagged for review. Set from
+// FRAUD_CHECKS.
+var fraudChecks bool
+
+// How far, in percent of the larger of the two, a receipt's total may be
+// from the sum of its item prices before it is flagged. Set from
+// FRAUD_TOTAL_TOLERANCE_PERCENT.
+var fraudTotalTolerance = 25
+
+// Receipts a user may submit in an hour before the next is flagged, 0 for
+// no limit. Set from FRAUD_MAX_RECEIPTS_PER_HOUR.
+var fraudMaxReceiptsPerHour = 10
+
+// The checks a receipt can be flagged by
+const (
+	checkTotalMismatch  = "total_mismatch"
+	checkSubmissionRate = "submission_rate"
+	checkFuturePurchase = "future_purchase"
+)
+
+var receiptsFlagged = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "receipts_flagged_total",
+	Help: "Receipts flagged for review, by the check that flagged them.",
+}, []string{"check"})
+
+// One reason a receipt looks suspicious
+type FraudFlag struct {
+	Check  string `json:"check"`
+	Detail string `json:"detail"`
+}
+
+// The flags raised on a receipt, and when. It waits in the review queue
+// until ReviewedAt is set. A receipt that passed the checks has no flags
+// and no FlaggedAt.
+type ReceiptFlags struct {
+	ReceiptID  string      `json:"receiptId"`
+	Tenant     string      `json:"tenant,omitempty"`
+	UserID     string      `json:"userId,omitempty"`
+	Flags      []FraudFlag `json:"flags"`
+	FlaggedAt  *time.Time  `json:"flaggedAt,omitempty"`
+	ReviewedAt *time.Time  `json:"reviewedAt,omitempty"`
+}
+
+// Response for GET /review-queue
+type ReviewQueueResponse struct {
+	Receipts   []ReceiptFlags `json:"receipts"`
+	NextCursor string         `json:"nextCursor,omitempty"`
+}
+
+// flagSuspicious runs the fraud checks on a newly stored receipt and keeps
+// the flags it raises, if any. A failure is logged; the receipt is stored
+// either way.
+func flagSuspicious(ctx context.Context, rec StoredReceipt) {
+	if !fraudChecks {
+		return
+	}
+	flags, err := fraudFlags(ctx, rec, time.Now())
+	if err != nil {
+		slog.Error("Error checking receipt for fraud", "receipt_id", rec.ID, "err", err)
+	}
+	if len(flags) == 0 {
+		return
+	}
+	for _, f := range flags {
+		receiptsFlagged.WithLabelValues(f.Check).Inc()
+	}
+	now := time.Now().UTC()
+	rf := ReceiptFlags{ReceiptID: rec.ID, Tenant: rec.Tenant, UserID: rec.Receipt.UserID, Flags: flags, FlaggedAt: &now}
+	if err := store.SaveFlags(ctx, rf); err != nil {
+		slog.Error("Error saving fraud flags", "receipt_id", rec.ID, "err", err)
+	}
+}
+
+// fraudFlags returns the checks rec fails at now. When a check can't be
+// made, the flags of the others are returned with the error.
+func fraudFlags(ctx context.Context, rec StoredReceipt, now time.Time) ([]FraudFlag, error) {
+	var flags []FraudFlag
+	var checkErr error
+	receipt := rec.Receipt
+
+	decimals := currencyDecimals[receiptCurrency(receipt)]
+	total, err := parseMinorUnits(receipt.Total, decimals)
+	var sum int64
+	for _, item := range receipt.Items {
+		if err != nil {
+			break
+		}
+		var price int64
+		price, err = parseMinorUnits(item.Price, decimals)
+		sum += price
+	}
+	if err != nil {
+		checkErr = fmt.Errorf("%s check: %w", checkTotalMismatch, err)
+	} else {
+		diff := total - sum
+		if diff < 0 {
+			diff = -diff
+		}
+		if diff*100 > int64(fraudTotalTolerance)*max(total, sum) {
+			flags = append(flags, FraudFlag{Check: checkTotalMismatch,
+				Detail: fmt.Sprintf("total %s is more than %d%% from the item prices", receipt.Total, fraudTotalTolerance)})
+		}
+	}
+
+	if purchased, err := time.Parse("2006-01-02 15:04", receipt.PurchaseDate+" "+receipt.PurchaseTime); err == nil {
+		// Without a time zone the purchase time could be anywhere's, up
+		// to 14 hours ahead of UTC.
+		slack := 5 * time.Minute
+		if loc, err := receiptTimezone(ctx, receipt); err == nil && loc == nil {
+			slack += 14 * time.Hour
+		}
+		if purchased.Sub(now) > slack {
+			flags = append(flags, FraudFlag{Check: checkFuturePurchase,
+				Detail: "purchased at " + receipt.PurchaseDate + " " + receipt.PurchaseTime + ", which is in the future"})
+		}
+	}
+
+	if receipt.UserID != "" && fraudMaxReceiptsPerHour > 0 {
+		up, err := store.UserPoints(ctx, rec.Tenant, receipt.UserID, fraudMaxReceiptsPerHour+1)
+		if err != nil {
+			return flags, errors.Join(checkErr, err)
+		}
+		n := 0
+		for _, r := range up.Recent {
+			if now.Sub(r.CreatedAt) < time.Hour {
+				n++
+			}
+		}
+		if n > fraudMaxReceiptsPerHour {
+			flags = append(flags, FraudFlag{Check: checkSubmissionRate,
+				Detail: fmt.Sprintf("more than %d receipts from the user in an hour", fraudMaxReceiptsPerHour)})
+		}
+	}
+	return flags, checkErr
+}
+
+// getFlagsHandler handles GET /receipts/{id}/flags
+// A receipt nothing looked suspicious on has an empty list of flags.
+func getFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	setLogReceiptID(r, id)
+
+	flags, ok := loadFlags(w, r, id)
+	if !ok {
+		return
+	}
+	writeResponse(w, r, flags, nil)
+}
+
+// reviewFlagsHandler handles POST /admin/receipts/{id}/flags/review
+// It takes a flagged receipt of the X-Tenant-ID tenant off the review
+// queue. It is on the admin API so that clients, which can only submit
+// receipts, can't clear the flags on their own. Reviewing it again keeps
+// the time of the first review.
+func reviewFlagsHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	setLogReceiptID(r, id)
+
+	flags, ok := loadFlags(w, r, id)
+	if !ok {
+		return
+	}
+	if len(flags.Flags) == 0 {
+		writeProblem(w, newProblem(http.StatusNotFound, codeNotFound, "Receipt not flagged"))
+		return
+	}
+	if flags.ReviewedAt == nil {
+		now := time.Now().UTC()
+		flags.ReviewedAt = &now
+		if err := store.SaveFlags(r.Context(), flags); err != nil {
+			requestLogger(r).Error("Error saving fraud flags", "receipt_id", id, "err", err)
+			writeProblem(w, storeFailure(err, "Error saving review"))
+			return
+		}
+	}
+	writeResponse(w, r, flags, nil)
+}
+
+// loadFlags returns the flags of the tenant's receipt id. When the receipt
+// doesn't exist or they can't be read it has already answered the request
+// and ok is false.
+func loadFlags(w http.ResponseWriter, r *http.Request, id string) (flags ReceiptFlags, ok bool) {
+	tenant := tenantFrom(r.Context())
+	_, err := store.GetPoints(r.Context(), tenant, id)
+	if err == nil {
+		flags, err = store.GetFlags(r.Context(), tenant, id)
+	}
+	if errors.Is(err, ErrReceiptNotFound) {
+		writeProblem(w, newProblem(http.StatusNotFound, codeNotFound, "Receipt not found"))
+		return ReceiptFlags{}, false
+	}
+	if err != nil {
+		requestLogger(r).Error("Error loading fraud flags", "receipt_id", id, "err", err)
+		writeProblem(w, storeFailure(err, "Error loading flags"))
+		return ReceiptFlags{}, false
+	}
+	if flags.ReceiptID == "" {
+		flags = ReceiptFlags{ReceiptID: id, Tenant: tenant}
+	}
+	if flags.Flags == nil {
+		flags.Flags = []FraudFlag{}
+	}
+	return flags, true
+}
+
+// reviewQueueHandler handles GET /review-queue
+// The tenant's flagged receipts that are yet to be reviewed, by receipt
+// ID, paged like GET /receipts.
+func reviewQueueHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			p := newProblem(http.StatusBadRequest, codeInvalidParameter, "limit must be between 1 and 500")
+			p.Field = "limit"
+			writeProblem(w, p)
+			return
+		}
+		limit = n
+	}
+	after := ""
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			p := newProblem(http.StatusBadRequest, codeInvalidParameter, "Invalid cursor")
+			p.Field = "cursor"
+			writeProblem(w, p)
+			return
+		}
+		after = string(decoded)
+	}
+
+	flagged, err := store.ReviewQueue(r.Context(), tenantFrom(r.Context()), after, limit+1)
+	if err != nil {
+		requestLogger(r).Error("Error listing flagged receipts", "err", err)
+		writeProblem(w, storeFailure(err, "Error listing flagged receipts"))
+		return
+	}
+	resp := ReviewQueueResponse{Receipts: []ReceiptFlags{}}
+	if len(flagged) > limit {
+		flagged = flagged[:limit]
+		resp.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(flagged[limit-1].ReceiptID))
+	}
+	resp.Receipts = append(resp.Receipts, flagged...)
+	writeResponse(w, r, resp, nil)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// receiptService serves the ReceiptService defined in receipts.proto. It
+// scores and stores receipts exactly like the HTTP handlers do.
+type receiptService struct {
+	UnimplementedReceiptServiceServer
+}
+
+// newGRPCServer creates the gRPC server. Calls are authenticated the same
+// way as HTTP requests: with an x-api-key when requireAPIKey is set, with
+// a bearer token in authorization when auth is not nil, and otherwise the
+// tenant comes from x-tenant-id. Each call gets the request deadline.
+func newGRPCServer(requireAPIKey bool, auth *jwtAuth, timeout time.Duration) *grpc.Server {
+	g := grpcAuth{requireAPIKey: requireAPIKey, jwt: auth, timeout: timeout}
+	srv := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(g.unary),
+		grpc.ChainStreamInterceptor(g.stream),
+	)
+	RegisterReceiptServiceServer(srv, receiptService{})
+	return srv
+}
+
+// stopGRPC lets in-flight calls finish, cutting them off when ctx is done.
+func stopGRPC(ctx context.Context, srv *grpc.Server) {
+	done := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		srv.Stop()
+	}
+}
+
+func (receiptService) ProcessReceipt(ctx context.Context, req *ProcessReceiptRequest) (*ProcessReceiptResponse, error) {
+	resp, err := processGRPCReceipt(ctx, req)
+	if p, ok := err.(*Problem); ok {
+		return nil, problemStatus(p)
+	}
+	return resp, err
+}
+
+func (receiptService) ProcessReceipts(stream ReceiptService_ProcessReceiptsServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resp, err := processGRPCReceipt(stream.Context(), req)
+		if p, ok := err.(*Problem); ok && (p.Status == http.StatusBadRequest || p.Status == http.StatusConflict) {
+			resp = &ProcessReceiptResponse{Error: p.Detail, Code: p.Code, Field: p.Field}
+		} else if ok {
+			return problemStatus(p)
+		} else if err != nil {
+			return err
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// processGRPCReceipt scores and stores one receipt. The receipt goes
+// through scorePayload as JSON, so the schema and every validation rule
+// apply just as they do over HTTP. Errors are *Problem.
+func processGRPCReceipt(ctx context.Context, req *ProcessReceiptRequest) (*ProcessReceiptResponse, error) {
+	body, err := json.Marshal(receiptFromProto(req.GetReceipt()))
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, codeInvalidJSON, "Invalid receipt")
+	}
+	receipt, breakdown, err := scorePayload(ctx, body)
+	if err != nil {
+		recordRejected(ctx, body, err.Error())
+		return nil, err
+	}
+
+	rec := StoredReceipt{ID: uuid.New().String(), Tenant: tenantFrom(ctx), Receipt: receipt, Points: breakdown.Total, Breakdown: breakdown, CreatedAt: time.Now().UTC()}
+	if err := saveReceipt(ctx, rec); err != nil {
+		return nil, err
+	}
+	recordProcessed(ctx, rec)
+	return &ProcessReceiptResponse{Id: rec.ID, Points: int64(rec.Points)}, nil
+}
+
+func (receiptService) GetPoints(ctx context.Context, req *GetPointsRequest) (*GetPointsResponse, error) {
+	points, err := store.GetPoints(ctx, tenantFrom(ctx), req.GetId())
+	if errors.Is(err, ErrReceiptNotFound) {
+		return nil, status.Error(codes.NotFound, "Receipt not found")
+	}
+	if err != nil {
+		slog.Error("Error loading receipt", "receipt_id", req.GetId(), "err", err)
+		return nil, problemStatus(storeFailure(err, "Error loading receipt"))
+	}
+	return &GetPointsResponse{Points: int64(points)}, nil
+}
+
+func (receiptService) GetReceipt(ctx context.Context, req *GetReceiptRequest) (*GetReceiptResponse, error) {
+	rec, err := store.Get(ctx, tenantFrom(ctx), req.GetId())
+	if errors.Is(err, ErrReceiptNotFound) {
+		return nil, status.Error(codes.NotFound, "Receipt not found")
+	}
+	if err != nil {
+		slog.Error("Error loading receipt", "receipt_id", req.GetId(), "err", err)
+		return nil, problemStatus(storeFailure(err, "Error loading receipt"))
+	}
+	return &GetReceiptResponse{
+		Id:          rec.ID,
+		Receipt:     receiptToProto(rec.Receipt),
+		Points:      int64(rec.Points),
+		RuleVersion: rec.Breakdown.RuleVersion,
+		CreatedAt:   rec.CreatedAt.Format(time.RFC3339),
+	}, nil
+}
+
+func receiptFromProto(pb *ReceiptBody) Receipt {
+	receipt := Receipt{
+		Retailer:     pb.GetRetailer(),
+		PurchaseDate: pb.GetPurchaseDate(),
+		PurchaseTime: pb.GetPurchaseTime(),
+		Total:        pb.GetTotal(),
+		Items:        []Item{},
+	}
+	for _, item := range pb.GetItems() {
+		receipt.Items = append(receipt.Items, Item{ShortDescription: item.GetShortDescription(), Price: item.GetPrice()})
+	}
+	return receipt
+}
+
+func receiptToProto(receipt Receipt) *ReceiptBody {
+	pb := &ReceiptBody{
+		Retailer:     receipt.Retailer,
+		PurchaseDate: receipt.PurchaseDate,
+		PurchaseTime: receipt.PurchaseTime,
+		Total:        receipt.Total,
+	}
+	for _, item := range receipt.Items {
+		pb.Items = append(pb.Items, &ReceiptItem{ShortDescription: item.ShortDescription, Price: item.Price})
+	}
+	return pb
+}
+
+// problemStatus turns a Problem into the gRPC status closest to its HTTP
+// status.
+func problemStatus(p *Problem) error {
+	code := codes.Internal
+	switch p.Status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.AlreadyExists
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+		if p.Code == codeTimeout {
+			code = codes.DeadlineExceeded
+		}
+	}
+	return status.Error(code, p.Detail)
+}
+
+// grpcAuth authenticates gRPC calls and decides their tenant, as the HTTP
+// middleware does for requests.
+type grpcAuth struct {
+	requireAPIKey bool
+	jwt           *jwtAuth
+	timeout       time.Duration
+}
+
+func (g grpcAuth) unary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, g.timeout)
+	defer cancel()
+	ctx, err := g.authorize(ctx, info.FullMethod)
+	var resp any
+	if err == nil {
+		resp, err = handler(ctx, req)
+	}
+	logGRPCCall(info.FullMethod, start, err)
+	return resp, err
+}
+
+func (g grpcAuth) stream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	ctx, err := g.authorize(ss.Context(), info.FullMethod)
+	if err == nil {
+		err = handler(srv, authorizedStream{ServerStream: ss, ctx: ctx})
+	}
+	logGRPCCall(info.FullMethod, start, err)
+	return err
+}
+
+// authorize checks the caller's credentials and returns ctx carrying the
+// tenant. GetPoints and GetReceipt need the receipts:read scope, anything
+// else receipts:write.
+func (g grpcAuth) authorize(ctx context.Context, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	first := func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	switch {
+	case g.requireAPIKey:
+		key := first("x-api-key")
+		if key == "" {
+			return nil, status.Error(codes.Unauthenticated, "x-api-key metadata is required")
+		}
+		k, err := lookupAPIKey(ctx, key)
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			return nil, status.Error(codes.Unauthenticated, "Invalid API key")
+		}
+		if err != nil {
+			slog.Error("Error checking API key", "err", err)
+			return nil, problemStatus(storeFailure(err, "Error checking API key"))
+		}
+		ctx = context.WithValue(ctx, apiKeyIDKey{}, k.ID)
+		return withTenant(ctx, k.Tenant), nil
+	case g.jwt != nil:
+		raw, ok := strings.CutPrefix(first("authorization"), "Bearer ")
+		if !ok || raw == "" {
+			return nil, status.Error(codes.Unauthenticated, "A bearer token is required")
+		}
+		claims, err := g.jwt.parse(raw)
+		if err != nil {
+			return nil, status.Error(codes.Unauthenticated, "Invalid bearer token")
+		}
+		scope := scopeWrite
+		if method == ReceiptService_GetPoints_FullMethodName || method == ReceiptService_GetReceipt_FullMethodName {
+			scope = scopeRead
+		}
+		if !claims.hasScope(scope) {
+			return nil, status.Error(codes.PermissionDenied, "The token lacks the "+scope+" scope")
+		}
+		ctx = context.WithValue(ctx, tokenSubjectKey{}, claims.Subject)
+		return withTenant(ctx, claims.Tenant), nil
+	}
+
+	tenant := first("x-tenant-id")
+	if tenant != "" && !tenantPattern.MatchString(tenant) {
+		return nil, status.Error(codes.InvalidArgument, "x-tenant-id may only contain letters, digits, '-' and '_'")
+	}
+	return withTenant(ctx, tenant), nil
+}
+
+// authorizedStream hands the stream handler the context authorize built.
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s authorizedStream) Context() context.Context {
+	return s.ctx
+}
+
+// logGRPCCall logs a finished call like logRequests logs HTTP requests.
+func logGRPCCall(method string, start time.Time, err error) {
+	slog.Info("grpc call",
+		"method", method,
+		"code", status.Code(err).String(),
+		"duration_ms", float64(time.Since(start).Microseconds())/1000,
+	)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Pinger is implemented by stores that talk to a server, so readiness can
+// check the connection.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Probes, metric scrapes and the API docs, which are never rate limited and
+// never need an API key
+var probePaths = map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true, "/openapi.json": true, "/docs": true}
+
+// Set once shutdown starts, so load balancers stop sending new requests
+// while the in-flight ones drain.
+var shuttingDown atomic.Bool
+
+// Response for GET /healthz and GET /readyz
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+// healthzHandler handles GET /healthz
+// It only shows the process is up and serving.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HealthResponse{Status: "ok"})
+}
+
+// readyzHandler handles GET /readyz
+// The service is ready when it has warmed up, is not shutting down and the
+// store answers.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !warmedUp.Load() {
+		writeProblem(w, newProblem(http.StatusServiceUnavailable, codeNotReady, "Warming up"))
+		return
+	}
+	if shuttingDown.Load() {
+		writeProblem(w, newProblem(http.StatusServiceUnavailable, codeNotReady, "Shutting down"))
+		return
+	}
+	if p, ok := store.(Pinger); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		if err := p.Ping(ctx); err != nil {
+			requestLogger(r).Warn("Store is not reachable", "err", err)
+			writeProblem(w, newProblem(http.StatusServiceUnavailable, codeNotReady, "Store is not reachable"))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(HealthResponse{Status: "ready"})
+}
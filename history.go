@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// What changed a receipt's points
+const (
+	// The receipt was processed and stored.
+	scoringProcessed = "processed"
+	// POST /admin/recalculate scored it again with the rules loaded now.
+	scoringRecalculated = "recalculated"
+	// It was replaced through PUT /receipts/{id}.
+	scoringAdjusted = "adjusted"
+	// It was deleted through DELETE /receipts/{id}.
+	scoringDeleted = "deleted"
+	// The janitor removed it for being past the retention period.
+	scoringExpired = "expired"
+)
+
+// One change to a receipt's points, kept for audits. PointsBefore is 0 for
+// the event that stored the receipt, and PointsAfter 0 for the one that
+// removed it.
+type ScoringEvent struct {
+	Kind         string    `json:"kind"`
+	At           time.Time `json:"at"`
+	RuleVersion  string    `json:"ruleVersion"`
+	PointsBefore int       `json:"pointsBefore"`
+	PointsAfter  int       `json:"pointsAfter"`
+}
+
+// Response for GET /receipts/{id}/history
+type HistoryResponse struct {
+	ReceiptID string         `json:"receiptId"`
+	Events    []ScoringEvent `json:"events"`
+}
+
+// recordScoring adds an event to the history of a stored receipt, whose
+// points were before until it was stored as rec. A failure is logged; the
+// receipt is stored either way.
+func recordScoring(ctx context.Context, kind string, rec StoredReceipt, before int) {
+	ev := ScoringEvent{
+		Kind:         kind,
+		At:           time.Now().UTC(),
+		RuleVersion:  rec.Breakdown.RuleVersion,
+		PointsBefore: before,
+		PointsAfter:  rec.Points,
+	}
+	if err := store.AppendHistory(ctx, rec.Tenant, rec.ID, ev); err != nil {
+		slog.Error("Error saving scoring history", "receipt_id", rec.ID, "err", err)
+	}
+}
+
+// recordRemoval adds the event of rec being removed, of kind
+// scoringDeleted or scoringExpired, to its history, which outlives it.
+func recordRemoval(ctx context.Context, kind string, rec StoredReceipt) {
+	removed := rec
+	removed.Points = 0
+	recordScoring(ctx, kind, removed, rec.Points)
+}
+
+// getHistoryHandler handles GET /receipts/{id}/history
+// Every scoring event of the receipt, oldest first. The history of a
+// receipt that was deleted or expired is still there.
+func getHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	setLogReceiptID(r, id)
+
+	tenant := tenantFrom(r.Context())
+	events, err := store.History(r.Context(), tenant, id)
+	if err == nil && len(events) == 0 {
+		_, err = store.GetPoints(r.Context(), tenant, id)
+	}
+	if errors.Is(err, ErrReceiptNotFound) {
+		writeProblem(w, newProblem(http.StatusNotFound, codeNotFound, "Receipt not found"))
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Error loading scoring history", "receipt_id", id, "err", err)
+		writeProblem(w, storeFailure(err, "Error loading history"))
+		return
+	}
+	if events == nil {
+		events = []ScoringEvent{}
+	}
+	writeResponse(w, r, HistoryResponse{ReceiptID: id, Events: events}, nil)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// What is published for every receipt consumed from a message queue:
+// the receipt's ID and points, or, when the message isn't a valid receipt,
+// Error, Code, Field and OriginalID as in a Problem.
+type PointsEvent struct {
+	ReceiptID  string `json:"receiptId,omitempty"`
+	Tenant     string `json:"tenant,omitempty"`
+	Points     *int   `json:"points,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Code       string `json:"code,omitempty"`
+	Field      string `json:"field,omitempty"`
+	OriginalID string `json:"originalId,omitempty"`
+}
+
+// scoreAndSave scores a JSON receipt on the scoring workers and stores it
+// as the tenant's receipt id. Errors are *Problem.
+func scoreAndSave(ctx context.Context, id, tenant string, payload []byte) (StoredReceipt, error) {
+	receipt, breakdown, err := scoring.score(ctx, payload)
+	if err != nil {
+		recordRejected(ctx, payload, err.Error())
+		return StoredReceipt{}, err
+	}
+	rec := StoredReceipt{ID: id, Tenant: tenant, Receipt: receipt, Points: breakdown.Total, Breakdown: breakdown, CreatedAt: time.Now().UTC()}
+	if err := saveReceipt(ctx, rec); err != nil {
+		return StoredReceipt{}, err
+	}
+	recordProcessed(ctx, rec)
+	return rec, nil
+}
+
+// ingestMessage scores and stores a receipt consumed from a message queue
+// and returns the event to publish about it. msgKey names the message in
+// its source, such as the topic, partition and offset, so a message that
+// is delivered again gets the receipt of its first delivery instead of a
+// second one. An error means the message could not be handled for now and
+// should be retried.
+func ingestMessage(ctx context.Context, tenant, msgKey string, payload []byte) (PointsEvent, error) {
+	if tenant != "" && !tenantPattern.MatchString(tenant) {
+		return PointsEvent{Error: "tenant may only contain letters, digits, '-' and '_'", Code: codeInvalidParameter, Field: "tenant"}, nil
+	}
+
+	id := uuid.New().String()
+	originalID, err := store.ClaimIdempotencyKey(ctx, scopedKey(keySpaceMessage, tenant, msgKey), id, idempotencyTTL)
+	if err != nil {
+		return PointsEvent{}, err
+	}
+	if originalID != id {
+		points, err := store.GetPoints(ctx, tenant, originalID)
+		if err == nil {
+			return PointsEvent{ReceiptID: originalID, Tenant: tenant, Points: &points}, nil
+		}
+		if !errors.Is(err, ErrReceiptNotFound) {
+			return PointsEvent{}, err
+		}
+		// The first delivery wasn't stored; finish it under the same ID.
+		id = originalID
+	}
+
+	rec, err := scoreAndSave(withTenant(ctx, tenant), id, tenant, payload)
+	if err != nil {
+		p := asProblem(err)
+		if p.Status != http.StatusBadRequest && p.Status != http.StatusConflict {
+			return PointsEvent{}, p
+		}
+		return PointsEvent{Tenant: tenant, Error: p.Detail, Code: p.Code, Field: p.Field, OriginalID: p.OriginalID}, nil
+	}
+	return PointsEvent{ReceiptID: rec.ID, Tenant: tenant, Points: &rec.Points}, nil
+}
+
+// retry calls fn until it succeeds, waiting from one second doubling up to
+// 30 seconds between attempts. It returns false if ctx is done first.
+func retry(ctx context.Context, what string, fn func() error) bool {
+	backoff := time.Second
+	for {
+		err := fn()
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		slog.Warn(what+" failed, retrying", "retry_in", backoff.String(), "err", err)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIngestMessage(t *testing.T) {
+	tests := []struct {
+		name      string
+		clientKey string
+		msgKeys   []string
+		wantSame  bool
+	}{
+		{name: "redelivered message", msgKeys: []string{"kafka:receipts:0:7", "kafka:receipts:0:7"}, wantSame: true},
+		{name: "other offsets", msgKeys: []string{"kafka:receipts:0:7", "kafka:receipts:0:8"}},
+		{name: "Idempotency-Key equal to a message key", clientKey: "kafka:receipts:0:7", msgKeys: []string{"kafka:receipts:0:7"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPI(t)
+			var ids []string
+			if tt.clientKey != "" {
+				req := httptest.NewRequest("POST", "/receipts/process", strings.NewReader(strings.Replace(targetReceipt, "Target", "Walgreens", 1)))
+				req.Header.Set("Idempotency-Key", tt.clientKey)
+				rec := httptest.NewRecorder()
+				api.ServeHTTP(rec, req)
+				var resp ProcessResponse
+				if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, resp.ID)
+			}
+			for _, msgKey := range tt.msgKeys {
+				event, err := ingestMessage(context.Background(), "", msgKey, []byte(targetReceipt))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if event.Points == nil || *event.Points != 28 {
+					t.Fatalf("message %s: event %+v, want 28 points", msgKey, event)
+				}
+				ids = append(ids, event.ReceiptID)
+			}
+			if same := ids[0] == ids[1]; same != tt.wantSame {
+				t.Errorf("receipt IDs %v, want the same %v", ids, tt.wantSame)
+			}
+		})
+	}
+}
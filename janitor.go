@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var receiptsExpired = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "receipts_expired_total",
+	Help: "Receipts deleted by the janitor for being past the retention period.",
+})
+
+// janitor deletes receipts older than the retention period, once at
+// startup and then every interval.
+type janitor struct {
+	retention      time.Duration
+	byPurchaseDate bool
+	interval       time.Duration
+	timeout        time.Duration
+	stopping       chan struct{}
+	done           chan struct{}
+}
+
+// startJanitor starts expiring receipts as cfg says.
+func startJanitor(cfg Config) *janitor {
+	j := &janitor{
+		retention:      cfg.Retention,
+		byPurchaseDate: cfg.RetentionBy == "purchase",
+		interval:       cfg.JanitorInterval,
+		timeout:        5 * time.Minute,
+		stopping:       make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	slog.Info("Expiring old receipts", "retention", j.retention.String(), "by", cfg.RetentionBy, "interval", j.interval.String())
+	go j.run()
+	return j
+}
+
+// stop waits for a sweep in progress to finish, until ctx is done.
+func (j *janitor) stop(ctx context.Context) {
+	close(j.stopping)
+	select {
+	case <-j.done:
+	case <-ctx.Done():
+	}
+}
+
+func (j *janitor) run() {
+	defer close(j.done)
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		j.sweep()
+		select {
+		case <-j.stopping:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// sweep deletes the receipts that are past the retention period now, takes
+// their points off the leaderboard and notes their expiry in their history.
+func (j *janitor) sweep() {
+	ctx, cancel := context.WithTimeout(context.Background(), j.timeout)
+	defer cancel()
+	start := time.Now()
+	expired, err := store.DeleteExpired(ctx, start.Add(-j.retention), j.byPurchaseDate)
+	for _, rec := range expired {
+		addToLeaderboard(ctx, rec, -rec.Points)
+		recordRemoval(ctx, scoringExpired, rec)
+	}
+	n := len(expired)
+	receiptsExpired.Add(float64(n))
+	if err != nil {
+		slog.Error("Error expiring receipts", "expired", n, "err", err)
+		return
+	}
+	level := slog.LevelInfo
+	if n == 0 {
+		level = slog.LevelDebug
+	}
+	slog.Log(ctx, level, "Expired old receipts", "expired", n, "duration_ms", float64(time.Since(start).Microseconds())/1000)
+}
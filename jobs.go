@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Returned by a ReceiptStore when no job has the requested ID.
+var ErrJobNotFound = errors.New("job not found")
+
+// Returned by jobQueue.enqueue when the queue has no room.
+var errQueueFull = errors.New("job queue full")
+
+// The states of a Job, in order. A job ends as succeeded or failed.
+const (
+	jobQueued     = "queued"
+	jobProcessing = "processing"
+	jobSucceeded  = "succeeded"
+	jobFailed     = "failed"
+)
+
+// A receipt submitted asynchronously. ReceiptID is the ID the receipt is
+// stored under once the job succeeds, when Points is set too. A failed
+// job has Error, Code, Field and OriginalID, as in a Problem.
+type Job struct {
+	ID         string    `json:"id"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Status     string    `json:"status"`
+	ReceiptID  string    `json:"receiptId"`
+	Points     *int      `json:"points,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Code       string    `json:"code,omitempty"`
+	Field      string    `json:"field,omitempty"`
+	OriginalID string    `json:"originalId,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// Set when every submission is processed asynchronously.
+var asyncProcessing bool
+
+// Processes queued receipts. Set up in main.
+var jobs *jobQueue
+
+// wantsAsync reports whether a submission is to be queued: always with
+// ASYNC_PROCESSING, and otherwise when the client sent Prefer: respond-async.
+func wantsAsync(r *http.Request) bool {
+	if asyncProcessing {
+		return true
+	}
+	for _, pref := range strings.Split(r.Header.Get("Prefer"), ",") {
+		if strings.EqualFold(strings.TrimSpace(pref), "respond-async") {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueueReceiptHandler is POST /receipts/process when the receipt is to
+// be processed asynchronously. Only the JSON or protobuf syntax is checked
+// up front; the client gets 202 with the job and follows its status on
+// /jobs/{id}.
+func enqueueReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rejectSubmission(w, r, body, unreadableBody(err))
+		return
+	}
+	payload, p := receiptPayload(r, body)
+	if p != nil {
+		rejectSubmission(w, r, body, p)
+		return
+	}
+	if !json.Valid(payload) {
+		rejectSubmission(w, r, payload, newProblem(http.StatusBadRequest, codeInvalidJSON, "Invalid JSON payload"))
+		return
+	}
+
+	receiptID := uuid.New().String()
+	setLogReceiptID(r, receiptID)
+	tenant := tenantFrom(r.Context())
+
+	// As for a synchronous submission, a retry gets the original receipt ID.
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" {
+		key = scopedIdempotencyKey(tenant, key)
+		originalID, err := store.ClaimIdempotencyKey(r.Context(), key, receiptID, idempotencyTTL)
+		if err != nil {
+			requestLogger(r).Error("Error claiming idempotency key", "err", err)
+			writeProblem(w, storeFailure(err, "Error queueing receipt"))
+			return
+		}
+		if originalID != receiptID {
+			setLogReceiptID(r, originalID)
+			writeResponse(w, r, ProcessResponse{ID: originalID}, &ProcessReceiptResponse{Id: originalID})
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	job := Job{ID: uuid.New().String(), Tenant: tenant, Status: jobQueued, ReceiptID: receiptID, CreatedAt: now, UpdatedAt: now}
+	if err := jobs.enqueue(r.Context(), job, payload, key); err != nil {
+		if key != "" {
+			if err := store.ReleaseIdempotencyKey(r.Context(), key); err != nil {
+				requestLogger(r).Error("Error releasing idempotency key", "err", err)
+			}
+		}
+		if errors.Is(err, errQueueFull) {
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, newProblem(http.StatusServiceUnavailable, codeQueueFull, "Too many receipts waiting to be processed"))
+			return
+		}
+		requestLogger(r).Error("Error queueing receipt", "job_id", job.ID, "err", err)
+		writeProblem(w, storeFailure(err, "Error queueing receipt"))
+		return
+	}
+
+	w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/receipts/process")+"/jobs/"+job.ID)
+	w.Header().Set("Preference-Applied", "respond-async")
+	writeResponseStatus(w, r, http.StatusAccepted, job, nil)
+}
+
+// getJobHandler handles GET /jobs/{id}
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	job, err := store.GetJob(r.Context(), tenantFrom(r.Context()), id)
+	if errors.Is(err, ErrJobNotFound) {
+		writeProblem(w, newProblem(http.StatusNotFound, codeNotFound, "Job not found"))
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Error loading job", "job_id", id, "err", err)
+		writeProblem(w, storeFailure(err, "Error loading job"))
+		return
+	}
+	writeResponse(w, r, job, nil)
+}
+
+// A job waiting for a worker, with the submitted receipt and the scoped
+// Idempotency-Key to release if it fails.
+type queuedJob struct {
+	job            Job
+	payload        []byte
+	idempotencyKey string
+}
+
+// jobQueue processes submitted receipts with a few workers. The queue
+// lives in memory: jobs still waiting when the process is killed are
+// never processed and stay queued until they expire.
+type jobQueue struct {
+	queue    chan queuedJob
+	ttl      time.Duration
+	timeout  time.Duration
+	stopping chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newJobQueue starts workers processing queued receipts. Each receipt gets
+// timeout to be processed, and its job is kept for ttl.
+func newJobQueue(workers int, ttl, timeout time.Duration) *jobQueue {
+	q := &jobQueue{
+		queue:    make(chan queuedJob, 1000),
+		ttl:      ttl,
+		timeout:  timeout,
+		stopping: make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// enqueue saves the job and queues the receipt, or returns errQueueFull
+// without waiting for room.
+func (q *jobQueue) enqueue(ctx context.Context, job Job, payload []byte, idempotencyKey string) error {
+	if len(q.queue) == cap(q.queue) {
+		return errQueueFull
+	}
+	if err := store.SaveJob(ctx, job, q.ttl); err != nil {
+		return err
+	}
+	select {
+	case q.queue <- queuedJob{job: job, payload: payload, idempotencyKey: idempotencyKey}:
+		return nil
+	default:
+		job.Status, job.Error, job.Code = jobFailed, "Too many receipts waiting to be processed", codeQueueFull
+		q.save(job)
+		return errQueueFull
+	}
+}
+
+// stop lets the workers finish the jobs already queued, until ctx is done.
+func (q *jobQueue) stop(ctx context.Context) {
+	close(q.stopping)
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (q *jobQueue) work() {
+	defer q.wg.Done()
+	for {
+		select {
+		case qj := <-q.queue:
+			q.process(qj)
+		case <-q.stopping:
+			for {
+				select {
+				case qj := <-q.queue:
+					q.process(qj)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// process scores and stores one queued receipt, recording the outcome on
+// its job.
+func (q *jobQueue) process(qj queuedJob) {
+	job := qj.job
+	ctx, cancel := context.WithTimeout(withTenant(context.Background(), job.Tenant), q.timeout)
+	defer cancel()
+	job.Status = jobProcessing
+	q.save(job)
+
+	rec, err := scoreAndSave(ctx, job.ReceiptID, job.Tenant, qj.payload)
+	if err == nil {
+		job.Status, job.Points = jobSucceeded, &rec.Points
+		q.save(job)
+		return
+	}
+
+	if qj.idempotencyKey != "" {
+		// Let the client submit the receipt again with the same key.
+		if err := store.ReleaseIdempotencyKey(ctx, qj.idempotencyKey); err != nil {
+			slog.Error("Error releasing idempotency key", "job_id", job.ID, "err", err)
+		}
+	}
+	p := asProblem(err)
+	job.Status, job.Error, job.Code, job.Field, job.OriginalID = jobFailed, p.Detail, p.Code, p.Field, p.OriginalID
+	q.save(job)
+}
+
+// save records the job's new state. A job whose state can't be saved is
+// still processed; its status is just out of date.
+func (q *jobQueue) save(job Job) {
+	job.UpdatedAt = time.Now().UTC()
+	ctx, cancel := context.WithTimeout(context.Background(), q.timeout)
+	defer cancel()
+	if err := store.SaveJob(ctx, job, q.ttl); err != nil {
+		slog.Error("Error saving job", "job_id", job.ID, "status", job.Status, "err", err)
+	}
+}
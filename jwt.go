@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/MicahParks/keyfunc/v3"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Scopes a bearer token needs: reading receipts and points, or submitting,
+// changing and deleting receipts.
+const (
+	scopeRead  = "receipts:read"
+	scopeWrite = "receipts:write"
+)
+
+// The scope each API route needs, by method and path template without the
+// /v1 prefix. What a route does decides it, not its method:
+// POST /receipts/points:batchGet only reads. Routes missing here need
+// receipts:write.
+var routeScopes = map[string]string{
+	"POST /receipts/process":              scopeWrite,
+	"POST /receipts/process/batch":        scopeWrite,
+	"POST /receipts/import":               scopeWrite,
+	"POST /receipts/process/stream":       scopeWrite,
+	"POST /receipts/scan":                 scopeWrite,
+	"POST /receipts/points:batchGet":      scopeRead,
+	"GET /receipts/{id}/points":           scopeRead,
+	"GET /receipts/{id}/points/breakdown": scopeRead,
+	"GET /receipts/{id}/history":          scopeRead,
+	"GET /receipts/{id}/flags":            scopeRead,
+	"GET /review-queue":                   scopeRead,
+	"GET /rules/versions":                 scopeRead,
+	"GET /receipts/export":                scopeRead,
+	"GET /receipts":                       scopeRead,
+	"GET /receipts/{id}":                  scopeRead,
+	"PUT /receipts/{id}":                  scopeWrite,
+	"DELETE /receipts/{id}":               scopeWrite,
+	"GET /users/{id}/points":              scopeRead,
+	"GET /stats":                          scopeRead,
+	"GET /leaderboard":                    scopeRead,
+	"POST /users/{id}/redeem":             scopeWrite,
+	"GET /jobs/{id}":                      scopeRead,
+	"GET /rejected":                       scopeRead,
+}
+
+// requiredScope returns the scope a request needs, going by the route it
+// matched. HEAD needs what GET does. A request that matched no route is
+// answered with 404 or 405 anyway, so it only needs receipts:read.
+func requiredScope(r *http.Request) string {
+	template := routeTemplate(r)
+	if template == "" {
+		return scopeRead
+	}
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	if scope, ok := routeScopes[method+" "+strings.TrimPrefix(template, "/v1")]; ok {
+		return scope
+	}
+	return scopeWrite
+}
+
+// The claims read from a bearer token. Identity providers put the granted
+// scopes either in a space-separated "scope" or in a "scp" list. Tenant
+// is the tenant the caller acts for, the default tenant when it is empty.
+type tokenClaims struct {
+	jwt.RegisteredClaims
+	Scope  string   `json:"scope"`
+	Scp    []string `json:"scp"`
+	Tenant string   `json:"tenant"`
+}
+
+// hasScope reports whether the token grants scope.
+func (c *tokenClaims) hasScope(scope string) bool {
+	for _, s := range strings.Fields(c.Scope) {
+		if s == scope {
+			return true
+		}
+	}
+	for _, s := range c.Scp {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtAuth checks bearer tokens signed by a key from the identity provider's
+// JWKS, which is refreshed in the background.
+type jwtAuth struct {
+	keys   keyfunc.Keyfunc
+	parser *jwt.Parser
+}
+
+// newJWTAuth fetches the JWKS at url. Tokens must carry an expiry and,
+// when they are set, match the issuer and audience.
+func newJWTAuth(ctx context.Context, url, issuer, audience string) (*jwtAuth, error) {
+	keys, err := keyfunc.NewDefaultCtx(ctx, []string{url})
+	if err != nil {
+		return nil, err
+	}
+	opts := []jwt.ParserOption{jwt.WithExpirationRequired()}
+	if issuer != "" {
+		opts = append(opts, jwt.WithIssuer(issuer))
+	}
+	if audience != "" {
+		opts = append(opts, jwt.WithAudience(audience))
+	}
+	return &jwtAuth{keys: keys, parser: jwt.NewParser(opts...)}, nil
+}
+
+// parse checks a raw bearer token and returns its claims.
+func (a *jwtAuth) parse(raw string) (*tokenClaims, error) {
+	var claims tokenClaims
+	if _, err := a.parser.ParseWithClaims(raw, &claims, a.keys.Keyfunc); err != nil {
+		return nil, err
+	}
+	if claims.Tenant != "" && !tenantPattern.MatchString(claims.Tenant) {
+		return nil, errors.New("invalid tenant claim")
+	}
+	return &claims, nil
+}
+
+type tokenSubjectKey struct{}
+
+// tokenSubject returns the subject of the bearer token the request was
+// made with, or "" when tokens are not required.
+func tokenSubject(ctx context.Context) string {
+	sub, _ := ctx.Value(tokenSubjectKey{}).(string)
+	return sub
+}
+
+// middleware is router middleware that requires a valid bearer token with
+// the scope of the route, receipts:read or receipts:write (see routeScopes).
+// Probes, metrics and the admin API are left alone.
+func (a *jwtAuth) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probePaths[r.URL.Path] || isAdminRoute(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || raw == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer`)
+			writeProblem(w, newProblem(http.StatusUnauthorized, codeUnauthorized, "A bearer token is required"))
+			return
+		}
+		claims, err := a.parse(raw)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeProblem(w, newProblem(http.StatusUnauthorized, codeUnauthorized, "Invalid bearer token"))
+			return
+		}
+
+		scope := requiredScope(r)
+		if !claims.hasScope(scope) {
+			w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+			writeProblem(w, newProblem(http.StatusForbidden, codeForbidden, "The token lacks the "+scope+" scope"))
+			return
+		}
+		ctx := context.WithValue(r.Context(), tokenSubjectKey{}, claims.Subject)
+		h.ServeHTTP(w, r.WithContext(withTenant(ctx, claims.Tenant)))
+	})
+}
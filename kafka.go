@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaConsumer reads receipts from a Kafka topic, scores and stores them
+// and publishes a PointsEvent for each to another topic. A message is
+// committed once its event is published, so after a crash it is delivered
+// again; ingestMessage makes sure that doesn't store it twice.
+type kafkaConsumer struct {
+	reader  *kafka.Reader
+	writer  *kafka.Writer
+	timeout time.Duration
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// startKafkaConsumer joins the consumer group on the input topic and
+// starts consuming. Each message gets timeout to be processed.
+func startKafkaConsumer(cfg Config, timeout time.Duration) *kafkaConsumer {
+	k := &kafkaConsumer{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers: cfg.KafkaBrokers,
+			GroupID: cfg.KafkaGroupID,
+			Topic:   cfg.KafkaInputTopic,
+		}),
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(cfg.KafkaBrokers...),
+			Topic:        cfg.KafkaOutputTopic,
+			RequiredAcks: kafka.RequireAll,
+		},
+		timeout: timeout,
+		done:    make(chan struct{}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	k.cancel = cancel
+	go k.run(ctx)
+	slog.Info("Consuming receipts from Kafka", "topic", cfg.KafkaInputTopic, "group", cfg.KafkaGroupID, "output_topic", cfg.KafkaOutputTopic)
+	return k
+}
+
+// stop stops consuming and closes the connections. A message being
+// processed is left uncommitted, to be delivered again.
+func (k *kafkaConsumer) stop(ctx context.Context) {
+	k.cancel()
+	select {
+	case <-k.done:
+	case <-ctx.Done():
+	}
+	if err := k.reader.Close(); err != nil {
+		slog.Error("Error closing Kafka reader", "err", err)
+	}
+	if err := k.writer.Close(); err != nil {
+		slog.Error("Error closing Kafka writer", "err", err)
+	}
+}
+
+func (k *kafkaConsumer) run(ctx context.Context) {
+	defer close(k.done)
+	for {
+		var msg kafka.Message
+		if !retry(ctx, "Reading from Kafka", func() (err error) {
+			msg, err = k.reader.FetchMessage(ctx)
+			return err
+		}) {
+			return
+		}
+		if !k.handle(ctx, msg) {
+			return
+		}
+	}
+}
+
+// handle processes one message, publishes its event and commits it,
+// retrying each step until it succeeds. It returns false when ctx is done
+// first.
+func (k *kafkaConsumer) handle(ctx context.Context, msg kafka.Message) bool {
+	var tenant string
+	for _, h := range msg.Headers {
+		if h.Key == "tenant" {
+			tenant = string(h.Value)
+		}
+	}
+	msgKey := fmt.Sprintf("kafka:%s:%d:%d", msg.Topic, msg.Partition, msg.Offset)
+	logger := slog.With("topic", msg.Topic, "partition", msg.Partition, "offset", msg.Offset)
+
+	var event PointsEvent
+	if !retry(ctx, "Processing Kafka message", func() (err error) {
+		mctx, cancel := context.WithTimeout(ctx, k.timeout)
+		defer cancel()
+		event, err = ingestMessage(mctx, tenant, msgKey, msg.Value)
+		return err
+	}) {
+		return false
+	}
+	if event.Error != "" {
+		logger.Info("Rejected receipt from Kafka", "code", event.Code, "err", event.Error)
+	}
+
+	value, err := json.Marshal(event)
+	if err != nil {
+		logger.Error("Error encoding points event", "err", err)
+		return false
+	}
+	key := msg.Key
+	if key == nil {
+		key = []byte(event.ReceiptID)
+	}
+	out := kafka.Message{Key: key, Value: value}
+	if tenant != "" {
+		out.Headers = []kafka.Header{{Key: "tenant", Value: []byte(tenant)}}
+	}
+	return retry(ctx, "Publishing points event to Kafka", func() error {
+		return k.writer.WriteMessages(ctx, out)
+	}) && retry(ctx, "Committing Kafka message", func() error {
+		return k.reader.CommitMessages(ctx, msg)
+	})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A week or month the leaderboard adds up points over. Key names it in
+// the store, such as "week:2026-W42" or "month:2026-10"; Start and End
+// are when it begins and ends in UTC.
+type LeaderboardPeriod struct {
+	Key   string
+	Start time.Time
+	End   time.Time
+}
+
+// The periods the leaderboard keeps totals for
+var leaderboardPeriods = []string{"week", "month"}
+
+// leaderboardPeriodAt returns the week, starting on Monday, or month that
+// t falls in.
+func leaderboardPeriodAt(name string, t time.Time) LeaderboardPeriod {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if name == "month" {
+		start := day.AddDate(0, 0, 1-day.Day())
+		return LeaderboardPeriod{Key: start.Format("month:2006-01"), Start: start, End: start.AddDate(0, 1, 0)}
+	}
+	start := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	year, week := start.ISOWeek()
+	return LeaderboardPeriod{Key: fmt.Sprintf("week:%d-W%02d", year, week), Start: start, End: start.AddDate(0, 0, 7)}
+}
+
+// A user's points in a leaderboard period
+type LeaderboardEntry struct {
+	UserID string `json:"userId"`
+	Points int    `json:"points"`
+}
+
+// Response for GET /leaderboard
+type LeaderboardResponse struct {
+	Period string             `json:"period"`
+	Start  time.Time          `json:"start"`
+	End    time.Time          `json:"end"`
+	Users  []LeaderboardEntry `json:"users"`
+}
+
+// addToLeaderboard adds points, which are negative to take them off, to
+// the totals of rec's user for the week and month rec was stored in. The
+// totals are kept up as receipts are stored, changed and removed, so
+// reading the leaderboard never goes through the receipts. Periods that
+// have already ended are left as they were. A failure is logged; the
+// receipt is stored either way.
+func addToLeaderboard(ctx context.Context, rec StoredReceipt, points int) {
+	if rec.Receipt.UserID == "" || points == 0 {
+		return
+	}
+	now := time.Now()
+	var periods []LeaderboardPeriod
+	for _, name := range leaderboardPeriods {
+		if period := leaderboardPeriodAt(name, rec.CreatedAt); now.Before(period.End) {
+			periods = append(periods, period)
+		}
+	}
+	if len(periods) == 0 {
+		return
+	}
+	if err := store.AddLeaderboardPoints(ctx, rec.Tenant, rec.Receipt.UserID, periods, points); err != nil {
+		slog.Error("Error updating the leaderboard", "receipt_id", rec.ID, "err", err)
+	}
+}
+
+// moveLeaderboardPoints updates the leaderboard for a receipt that was
+// stored as old and now is rec: by the difference in points, or when the
+// user changed, by taking old's points off the old user and giving rec's
+// to the new one.
+func moveLeaderboardPoints(ctx context.Context, old, rec StoredReceipt) {
+	if old.Receipt.UserID == rec.Receipt.UserID {
+		addToLeaderboard(ctx, rec, rec.Points-old.Points)
+		return
+	}
+	addToLeaderboard(ctx, old, -old.Points)
+	addToLeaderboard(ctx, rec, rec.Points)
+}
+
+// leaderboardHandler handles GET /leaderboard
+// The users of the tenant who earned the most points so far this week or,
+// with period=month, this month, most first.
+func leaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("period")
+	if name == "" {
+		name = "week"
+	}
+	if name != "week" && name != "month" {
+		p := newProblem(http.StatusBadRequest, codeInvalidParameter, "period must be week or month")
+		p.Field = "period"
+		writeProblem(w, p)
+		return
+	}
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			p := newProblem(http.StatusBadRequest, codeInvalidParameter, "limit must be between 1 and 100")
+			p.Field = "limit"
+			writeProblem(w, p)
+			return
+		}
+		limit = n
+	}
+
+	period := leaderboardPeriodAt(name, time.Now())
+	entries, err := store.Leaderboard(r.Context(), tenantFrom(r.Context()), period, limit)
+	if err != nil {
+		requestLogger(r).Error("Error getting leaderboard", "err", err)
+		writeProblem(w, storeFailure(err, "Error getting leaderboard"))
+		return
+	}
+	if entries == nil {
+		entries = []LeaderboardEntry{}
+	}
+	writeResponse(w, r, LeaderboardResponse{Period: name, Start: period.Start, End: period.End, Users: entries}, nil)
+}
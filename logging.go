@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// newLogger creates the JSON logger for the level named in the config.
+func newLogger(level string) *slog.Logger {
+	var l slog.Level
+	l.UnmarshalText([]byte(level))
+	return slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: l}))
+}
+
+// fatal logs err and exits. It is only for errors while starting up.
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
+}
+
+// What is known about a request while it is handled. Handlers fill in
+// receiptID so the access log line can name the receipt.
+type requestInfo struct {
+	id        string
+	receiptID string
+}
+
+type requestInfoKey struct{}
+
+// requestLogger returns the default logger with the request's ID attached.
+func requestLogger(r *http.Request) *slog.Logger {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return slog.With("request_id", info.id)
+	}
+	return slog.Default()
+}
+
+// setLogReceiptID records which receipt a request was about.
+func setLogReceiptID(r *http.Request, id string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.receiptID = id
+	}
+}
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// logRequests gives every request an ID, taken from the X-Request-ID header
+// when the client sent one, returns it in the same header and logs a line
+// for the request once it has been answered.
+func logRequests(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		info := &requestInfo{id: r.Header.Get("X-Request-ID")}
+		if info.id == "" {
+			info.id = uuid.New().String()
+		}
+		w.Header().Set("X-Request-ID", info.id)
+
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sr, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+
+		attrs := []any{
+			"request_id", info.id,
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", sr.status,
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if info.receiptID != "" {
+			attrs = append(attrs, "receipt_id", info.receiptID)
+		}
+		slog.Info("request", attrs...)
+	})
+}
@@ -1,34 +1,52 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
-	"math"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
-	"regexp"
+	"os"
+	"os/signal"
+	"slices"
 	"strconv"
-	"strings"
-	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
-	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
 )
 
 // The receipt payload structure
 type Receipt struct {
-	Retailer     string  `json:"retailer"`
-	PurchaseDate string  `json:"purchaseDate"`
-	PurchaseTime string  `json:"purchaseTime"`
-	Total        string  `json:"total"`
-	Items        []Item  `json:"items"`
+	Retailer     string `json:"retailer" xml:"retailer"`
+	PurchaseDate string `json:"purchaseDate" xml:"purchaseDate"`
+	PurchaseTime string `json:"purchaseTime" xml:"purchaseTime"`
+	Total        string `json:"total" xml:"total"`
+	Items        []Item `json:"items" xml:"items>item"`
+	// ISO 4217 code of the currency the amounts are in, USD when empty.
+	Currency string `json:"currency,omitempty" xml:"currency,omitempty"`
+	// IANA time zone of the purchase, such as America/Chicago. When set,
+	// purchaseDate and purchaseTime are in UTC.
+	Timezone string `json:"timezone,omitempty" xml:"timezone,omitempty"`
+	// The loyalty member the points go to, if any.
+	UserID string `json:"userId,omitempty" xml:"userId,omitempty"`
 }
 
 // A single item in the receipt
 type Item struct {
-	ShortDescription string `json:"shortDescription"`
-	Price            string `json:"price"`
+	ShortDescription string `json:"shortDescription" xml:"shortDescription"`
+	Price            string `json:"price" xml:"price"`
 }
 
 // Response for POST /receipts/process
@@ -36,141 +54,1020 @@ type ProcessResponse struct {
 	ID string `json:"id"`
 }
 
+// Response for POST /receipts/process/batch
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+	Summary *BatchSummary `json:"summary,omitempty"`
+}
+
+// The outcome for one receipt in a batch: its new ID, or why it was rejected.
+// Code, Field and OriginalID are the same as in a Problem.
+type BatchResult struct {
+	ID         string `json:"id,omitempty"`
+	Error      string `json:"error,omitempty"`
+	Code       string `json:"code,omitempty"`
+	Field      string `json:"field,omitempty"`
+	OriginalID string `json:"originalId,omitempty"`
+	points     int    // awarded to the stored receipt, for the summary
+}
+
+// Totals over the results of a batch or import, sent with summary=true so
+// clients needn't go through every result: how many receipts were stored
+// and rejected, the points the stored ones got, and the distinct codes
+// the rejected ones got, sorted.
+type BatchSummary struct {
+	Succeeded   int      `json:"succeeded"`
+	Failed      int      `json:"failed"`
+	TotalPoints int      `json:"totalPoints"`
+	ErrorCodes  []string `json:"errorCodes"`
+}
+
+// summarizeBatch adds up results, when the request asked for a summary
+// with summary=true, or returns nil.
+func summarizeBatch(r *http.Request, results []BatchResult) *BatchSummary {
+	if r.URL.Query().Get("summary") != "true" {
+		return nil
+	}
+	s := &BatchSummary{ErrorCodes: []string{}}
+	for _, res := range results {
+		if res.ID == "" {
+			s.Failed++
+			if !slices.Contains(s.ErrorCodes, res.Code) {
+				s.ErrorCodes = append(s.ErrorCodes, res.Code)
+			}
+			continue
+		}
+		s.Succeeded++
+		s.TotalPoints += res.points
+	}
+	slices.Sort(s.ErrorCodes)
+	return s
+}
+
 // Response for GET /receipts/{id}/points
 type PointsResponse struct {
 	Points int `json:"points"`
 }
 
-// The storage for the points in memory
-var (
-	receiptStore = make(map[string]int)
-	storeMutex   = sync.RWMutex{}
-)
+// Response for GET /rules/versions
+type RuleVersionsResponse struct {
+	Versions []*RuleSet `json:"versions"`
+}
+
+// Response for GET /receipts
+type ListReceiptsResponse struct {
+	Receipts   []ReceiptSummary `json:"receipts"`
+	NextCursor string           `json:"nextCursor,omitempty"`
+}
+
+// One receipt in a ListReceiptsResponse
+type ReceiptSummary struct {
+	ID           string `json:"id"`
+	Retailer     string `json:"retailer"`
+	PurchaseDate string `json:"purchaseDate"`
+	Points       int    `json:"points"`
+}
+
+// Where processed receipts are kept, chosen by STORAGE_BACKEND
+var store ReceiptStore
+
+// When an item is priced above the receipt total the receipt is rejected if
+// this is set, otherwise a warning is logged and the receipt is still scored.
+// Set from ITEM_PRICE_EXCEEDS_TOTAL_IS_ERROR.
+var itemPriceExceedsTotalIsError bool
+
+// How long an Idempotency-Key keeps returning the same receipt ID, set
+// from IDEMPOTENCY_TTL.
+var idempotencyTTL = 24 * time.Hour
+
+// Most receipts accepted by one call to the batch endpoint, set from
+// MAX_BATCH_SIZE.
+var maxBatchSize = 5000
+
+// Most items accepted on one receipt, set from MAX_ITEMS.
+var maxItems = 1000
+
+// Reject payloads that repeat a top-level key, such as two "total" fields.
+// Set from REJECT_DUPLICATE_KEYS.
+var rejectDuplicateKeys bool
 
 func main() {
-	// Using Gorilla Mux for URL routing.
-	r := mux.NewRouter()
-	r.HandleFunc("/receipts/process", processReceiptHandler).Methods("POST")
-	r.HandleFunc("/receipts/{id}/points", getPointsHandler).Methods("GET")
-	port := "8080"
-	log.Printf("Listening on port %s...", port)
-	log.Fatal(http.ListenAndServe(":"+port, r))
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fatal("Invalid configuration", err)
+	}
+	slog.SetDefault(newLogger(cfg.LogLevel))
+	for _, name := range cfg.DeprecatedRuleEnv {
+		slog.Warn("Deprecated rule variable, use RULE_"+name+" instead", "name", name)
+	}
+	ruleVersions, err = loadRules(cfg.RulesFile, cfg.RuleOverrides)
+	if err != nil {
+		fatal("Error loading rules", err)
+	}
+	shutdownTracing, err := setupTracing(cfg)
+	if err != nil {
+		fatal("Error setting up tracing", err)
+	}
+	store, err = newReceiptStore(cfg)
+	if err != nil {
+		fatal("Error opening store", err)
+	}
+	if cfg.EventLog != "" {
+		receiptEvents, err = openEventLog(cfg.EventLog)
+		if err != nil {
+			fatal("Error opening event log", err)
+		}
+		if cfg.RebuildFromEventLog {
+			start := time.Now()
+			n, err := rebuildFromEventLog(context.Background(), receiptEvents, store)
+			if err != nil {
+				fatal("Error rebuilding store from event log", err)
+			}
+			slog.Info("Rebuilt store from event log", "events", n, "duration", time.Since(start))
+		}
+		store = eventLogStore{ReceiptStore: store, log: receiptEvents}
+	}
+	if cfg.OTLPTracesEndpoint != "" {
+		store = tracedStore{inner: store}
+	}
+	maxItems = cfg.MaxItems
+	maxBatchSize, maxPointsBatchSize = cfg.MaxBatchSize, cfg.MaxPointsBatchSize
+	idempotencyTTL = cfg.IdempotencyTTL
+	itemPriceExceedsTotalIsError = cfg.ItemPriceExceedsTotalIsError
+	rejectDuplicateKeys = cfg.RejectDuplicateKeys
+	tenantPerAPIKey = cfg.TenantPerAPIKey
+	storeRejected, rejectedRetention = cfg.StoreRejected, cfg.RejectedRetention
+	pointsCacheMaxAge = cfg.PointsCacheMaxAge
+	fraudChecks, fraudTotalTolerance, fraudMaxReceiptsPerHour = cfg.FraudChecks, cfg.FraudTotalTolerancePercent, cfg.FraudMaxReceiptsPerHour
+	rejectedMaxEntries, rejectedMaxPayloadBytes = cfg.RejectedMaxEntries, cfg.RejectedMaxPayloadBytes
+	maxStreamLineBytes = int(cfg.MaxBodyBytes)
+	defaultTimezone, tenantTimezones = cfg.DefaultTimezone, cfg.TenantTimezones
+	webhooks = newWebhookDispatcher(4, cfg.WebhookMaxAttempts, cfg.WebhookBatchSize, cfg.WebhookBatchInterval)
+	if cfg.NATSURL != "" {
+		natsEvents, err = newNATSPublisher(cfg)
+		if err != nil {
+			fatal("Error connecting to NATS", err)
+		}
+	}
+	asyncProcessing = cfg.AsyncProcessing
+	rejectDuplicateReceipts, duplicateWindow = cfg.RejectDuplicateReceipts, cfg.DuplicateWindow
+	scoring = newScoringPool(cfg.ScoringWorkers)
+	jobs = newJobQueue(cfg.AsyncWorkers, cfg.JobTTL, cfg.Timeouts.Process)
+	ocr, err = newOCRProvider(cfg)
+	if err != nil {
+		fatal("Error setting up OCR", err)
+	}
+	if cfg.SchemaFile != "" {
+		if err := loadReceiptSchema(cfg.SchemaFile); err != nil {
+			fatal("Error loading schema", err)
+		}
+	}
+
+	// The API lives under /v1, and the original unversioned paths are kept
+	// as aliases for existing clients.
+	r, err := newRouter(cfg.Router)
+	if err != nil {
+		fatal("Error creating router", err)
+	}
+	var auth *jwtAuth
+	if cfg.JWKSURL != "" {
+		auth, err = newJWTAuth(context.Background(), cfg.JWKSURL, cfg.JWTIssuer, cfg.JWTAudience)
+		if err != nil {
+			fatal("Error loading JWKS", err)
+		}
+	}
+	useMiddleware(r, cfg, auth)
+	registerRoutes(r, "/v1", cfg.Timeouts)
+	registerRoutes(r, "", cfg.Timeouts)
+	r.Handle("GET", "/metrics", promhttp.Handler())
+	r.HandleFunc("GET", "/healthz", healthzHandler)
+	r.HandleFunc("GET", "/readyz", readyzHandler)
+	if cfg.AdminToken != "" {
+		registerAdminRoutes(r, cfg.AdminToken, cfg.Timeouts)
+	}
+	openAPI, err := buildOpenAPI(r, cfg.RequireAPIKey, auth != nil)
+	if err != nil {
+		fatal("Error building OpenAPI document", err)
+	}
+	r.HandleFunc("GET", "/openapi.json", openAPIHandler(openAPI))
+	r.HandleFunc("GET", "/docs", docsHandler)
+	var handler http.Handler = limitBody(r, cfg.MaxBodyBytes)
+	// Decompress before limiting, so the limit applies to what the
+	// handlers actually read.
+	handler = compression{respond: cfg.Compression, algorithms: cfg.CompressionAlgorithms}.middleware(handler)
+	if len(cfg.CORSAllowedOrigins) > 0 {
+		handler = newCORSPolicy(cfg.CORSAllowedOrigins, cfg.CORSAllowedMethods, cfg.CORSAllowedHeaders).middleware(handler)
+	}
+	handler = otelhttp.NewHandler(logRequests(handler), "receipts")
+
+	srv := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	serve := setupTLS(srv, cfg)
+
+	if err := configureHTTP2(srv, cfg); err != nil {
+		fatal("Error configuring HTTP/2", err)
+	}
+
+	// Serve until SIGINT or SIGTERM, then stop taking new connections and
+	// give in-flight requests up to SHUTDOWN_TIMEOUT to finish.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		slog.Info("Listening", "port", cfg.Port)
+		if err := serve(); err != http.ErrServerClosed {
+			fatal("Server stopped", err)
+		}
+	}()
+	// /readyz answers 503 until this is done.
+	warmup(context.Background(), cfg.WarmupReceipts)
+	var admin *http.Server
+	if cfg.AdminAddr != "" {
+		admin = newAdminServer(cfg.AdminAddr, cfg.ReadHeaderTimeout)
+		startAdminServer(admin)
+	}
+	var grpcSrv *grpc.Server
+	if cfg.GRPCPort != "" {
+		lis, err := net.Listen("tcp", ":"+cfg.GRPCPort)
+		if err != nil {
+			fatal("Error listening for gRPC", err)
+		}
+		grpcSrv = newGRPCServer(cfg.RequireAPIKey, auth, cfg.RequestTimeout)
+		go func() {
+			slog.Info("Listening for gRPC", "port", cfg.GRPCPort)
+			if err := grpcSrv.Serve(lis); err != nil {
+				fatal("gRPC server stopped", err)
+			}
+		}()
+	}
+	var consumer *kafkaConsumer
+	if len(cfg.KafkaBrokers) > 0 {
+		consumer = startKafkaConsumer(cfg, cfg.Timeouts.Process)
+	}
+	var jan *janitor
+	if cfg.Retention > 0 {
+		jan = startJanitor(cfg)
+	}
+	var sqsPoller *sqsWorker
+	if cfg.SQSQueueURL != "" {
+		sqsPoller, err = startSQSWorker(cfg, cfg.Timeouts.Process)
+		if err != nil {
+			fatal("Error setting up SQS", err)
+		}
+	}
+	sig := <-stop
+	slog.Info("Shutting down", "signal", sig.String())
+	shuttingDown.Store(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("Error draining connections", "err", err)
+	}
+	if grpcSrv != nil {
+		stopGRPC(ctx, grpcSrv)
+	}
+	if consumer != nil {
+		consumer.stop(ctx)
+	}
+	if sqsPoller != nil {
+		sqsPoller.stop(ctx)
+	}
+	jobs.stop(ctx)
+	if jan != nil {
+		jan.stop(ctx)
+	}
+	webhooks.stop(ctx)
+	if natsEvents != nil {
+		natsEvents.close(ctx)
+	}
+	if admin != nil {
+		admin.Close()
+	}
+	if err := store.Close(); err != nil {
+		slog.Error("Error closing store", "err", err)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Error flushing traces", "err", err)
+	}
+	slog.Info("Shut down")
 }
 
-// processReceiptHandler handles POST /receipts/process
-func processReceiptHandler(w http.ResponseWriter, r *http.Request) {
-	var receipt Receipt
+// useMiddleware adds what every route runs before its handler to r. auth,
+// when not nil, requires bearer tokens.
+func useMiddleware(r *router, cfg Config, auth *jwtAuth) {
+	r.Use(instrumentRoutes)
+	r.Use(withDeadline(cfg.RequestTimeout))
+	if cfg.RateLimit > 0 {
+		// Limit by address ahead of authentication, so guessing API keys
+		// or tokens, and the lookups each guess costs, are limited too.
+		r.Use(newRateLimiter(cfg.RateLimit, cfg.RateBurst, cfg.TrustProxy, false).middleware)
+	}
+	if cfg.RequireAPIKey {
+		r.Use(requireAPIKey)
+		pointsCachePublic = false
+	}
+	if auth != nil {
+		r.Use(auth.middleware)
+		pointsCachePublic = false
+	}
+	r.Use(resolveTenant)
+	if cfg.RateLimit > 0 && (cfg.RequireAPIKey || auth != nil) {
+		// And by API key or token once the client is known, however many
+		// addresses it uses.
+		r.Use(newRateLimiter(cfg.RateLimit, cfg.RateBurst, cfg.TrustProxy, true).middleware)
+	}
+}
 
-	// Decoding JSON into the struct we made
-	if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil {
-		http.Error(w, "Invalid JSON payload", http.StatusBadRequest)
-		return
+// configureHTTP2 applies the HTTP/2 settings to srv, used for TLS
+// connections and for h2c when enabled.
+func configureHTTP2(srv *http.Server, cfg Config) error {
+	h2s := &http2.Server{
+		MaxConcurrentStreams:         uint32(cfg.H2MaxConcurrentStreams),
+		MaxReadFrameSize:             uint32(cfg.H2MaxReadFrameSize),
+		MaxUploadBufferPerConnection: int32(cfg.H2MaxUploadBuffer),
+		IdleTimeout:                  srv.IdleTimeout,
+	}
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		return err
 	}
+	if cfg.EnableH2C {
+		// Accept HTTP/2 over plaintext connections.
+		srv.Handler = h2c.NewHandler(srv.Handler, h2s)
+	}
+	return nil
+}
 
-	// Calculating points based on rules
-	points, err := calculatePoints(receipt)
+// registerRoutes adds the API's endpoints to r, under prefix, each with
+// the deadline of its group in timeouts.
+func registerRoutes(r *router, prefix string, timeouts RouteTimeouts) {
+	r.Handle("POST", prefix+"/receipts/process", withTimeout(processReceiptHandler, timeouts.Process))
+	r.Handle("POST", prefix+"/receipts/process/batch", withTimeout(processBatchHandler, timeouts.Batch))
+	r.Handle("POST", prefix+"/receipts/import", withTimeout(importReceiptsHandler, timeouts.Batch))
+	r.HandleFunc("POST", prefix+"/receipts/process/stream", processStreamHandler(timeouts.Stream))
+	if ocr != nil {
+		r.Handle("POST", prefix+"/receipts/scan", withTimeout(scanReceiptHandler, timeouts.Scan))
+	}
+	r.Handle("POST", prefix+"/receipts/points:batchGet", withTimeout(batchGetPointsHandler, timeouts.Points))
+	r.Handle("GET", prefix+"/receipts/{id}/points", withTimeout(getPointsHandler, timeouts.Points))
+	r.Handle("GET", prefix+"/receipts/{id}/points/breakdown", withTimeout(getBreakdownHandler, timeouts.Points))
+	r.Handle("GET", prefix+"/receipts/{id}/history", withTimeout(getHistoryHandler, timeouts.Receipt))
+	r.Handle("GET", prefix+"/receipts/{id}/flags", withTimeout(getFlagsHandler, timeouts.Receipt))
+	r.Handle("GET", prefix+"/review-queue", withTimeout(reviewQueueHandler, timeouts.List))
+	r.HandleFunc("GET", prefix+"/rules/versions", getRuleVersionsHandler)
+	r.HandleFunc("GET", prefix+"/receipts/export", exportReceiptsHandler(timeouts.Export))
+	r.Handle("GET", prefix+"/receipts", withTimeout(listReceiptsHandler, timeouts.List))
+	r.Handle("GET", prefix+"/receipts/{id}", withTimeout(getReceiptHandler, timeouts.Receipt))
+	r.Handle("PUT", prefix+"/receipts/{id}", withTimeout(updateReceiptHandler, timeouts.Process))
+	r.Handle("DELETE", prefix+"/receipts/{id}", withTimeout(deleteReceiptHandler, timeouts.Receipt))
+	r.Handle("GET", prefix+"/users/{id}/points", withTimeout(getUserPointsHandler, timeouts.Points))
+	r.Handle("GET", prefix+"/stats", withTimeout(statsHandler, timeouts.Stats))
+	r.Handle("GET", prefix+"/leaderboard", withTimeout(leaderboardHandler, timeouts.Points))
+	r.Handle("POST", prefix+"/users/{id}/redeem", withTimeout(redeemHandler, timeouts.Process))
+	r.Handle("GET", prefix+"/jobs/{id}", withTimeout(getJobHandler, timeouts.Points))
+	if storeRejected {
+		r.HandleFunc("GET", prefix+"/rejected", getRejectedHandler)
+	}
+}
+
+// envString reads a string from the environment, falling back to def when unset.
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envInt reads an integer from the environment, falling back to def.
+func envInt(key string, def int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envFloat reads a number from the environment, falling back to def.
+func envFloat(key string, def float64) float64 {
+	v, err := strconv.ParseFloat(os.Getenv(key), 64)
+	if err != nil {
+		return def
+	}
+	return v
+}
+
+// envDuration reads a duration such as "90s" from the environment, falling back to def.
+func envDuration(key string, def time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Error calculating points: %v", err), http.StatusBadRequest)
+		return def
+	}
+	return v
+}
+
+// limitBody stops reading request bodies after n bytes, so the handlers see
+// a read error instead of buffering an oversized payload. Streams limit
+// their lines instead.
+func limitBody(h http.Handler, n int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !streamedBody(r) {
+			r.Body = http.MaxBytesReader(w, r.Body, n)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withDeadline gives every request's context a deadline d away, so store
+// calls made on its behalf, including the API key lookup, give up instead
+// of piling up behind a slow backend.
+func withDeadline(d time.Duration) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// withTimeout limits how long a single route may run. When the limit is hit
+// the client gets a 503 with a timeout Problem.
+func withTimeout(h http.HandlerFunc, d time.Duration) http.Handler {
+	th := http.TimeoutHandler(h, d, `{"title":"Service Unavailable","status":503,"code":"timeout","detail":"Request timed out"}`)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		th.ServeHTTP(&timeoutProblemWriter{ResponseWriter: w}, r)
+	})
+}
+
+// timeoutProblemWriter gives the Problem http.TimeoutHandler writes on a
+// timeout its Content-Type. The handler's own responses have their headers
+// copied over before their status is written, so they keep theirs, and a
+// 204 gets none.
+type timeoutProblemWriter struct {
+	http.ResponseWriter
+}
+
+func (tw *timeoutProblemWriter) WriteHeader(status int) {
+	if status == http.StatusServiceUnavailable && tw.Header().Get("Content-Type") == "" {
+		tw.Header().Set("Content-Type", "application/problem+json")
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
+func (tw *timeoutProblemWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
+
+// processReceiptHandler handles POST /receipts/process
+func processReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	if wantsAsync(r) {
+		enqueueReceiptHandler(w, r)
+		return
+	}
+	receipt, breakdown, ok := scoreSubmission(w, r)
+	if !ok {
 		return
 	}
 
 	// Generate unique ID for the receipt.
 	id := uuid.New().String()
+	setLogReceiptID(r, id)
+	tenant := tenantFrom(r.Context())
 
-	// Store the calculated points in the in-memory map.
-	storeMutex.Lock()
-	receiptStore[id] = points
-	storeMutex.Unlock()
+	// A retried request with the same Idempotency-Key gets the original ID
+	// back instead of creating a second receipt.
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" {
+		key = scopedIdempotencyKey(tenant, key)
+		originalID, err := store.ClaimIdempotencyKey(r.Context(), key, id, idempotencyTTL)
+		if err != nil {
+			requestLogger(r).Error("Error claiming idempotency key", "err", err)
+			writeProblem(w, storeFailure(err, "Error saving receipt"))
+			return
+		}
+		if originalID != id {
+			setLogReceiptID(r, originalID)
+			resp := ProcessResponse{ID: originalID}
+			writeResponse(w, r, resp, &ProcessReceiptResponse{Id: originalID})
+			return
+		}
+	}
+
+	// Store the receipt along with its points.
+	rec := StoredReceipt{ID: id, Tenant: tenant, Receipt: receipt, Points: breakdown.Total, Breakdown: breakdown, CreatedAt: time.Now().UTC()}
+	if err := saveReceipt(r.Context(), rec); err != nil {
+		if key != "" {
+			// Let the client's retry try again rather than get an ID that was never saved.
+			if err := store.ReleaseIdempotencyKey(r.Context(), key); err != nil {
+				requestLogger(r).Error("Error releasing idempotency key", "err", err)
+			}
+		}
+		writeProblem(w, asProblem(err))
+		return
+	}
+
+	recordProcessed(r.Context(), rec)
 
 	// Return the receipt ID.
 	resp := ProcessResponse{ID: id}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	writeResponse(w, r, resp, &ProcessReceiptResponse{Id: id, Points: int64(rec.Points)})
 }
 
-// getPointsHandler handles GET /receipts/{id}/points
-func getPointsHandler(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
+// processBatchHandler handles POST /receipts/process/batch
+// Each receipt in the array is scored on its own; one bad receipt does not
+// stop the others from being stored.
+func processBatchHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeProblem(w, unreadableBody(err))
+		return
+	}
+	body, p := requestJSON(r, body)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+	var payloads []json.RawMessage
+	if err := json.Unmarshal(body, &payloads); err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, codeInvalidJSON, "Invalid JSON payload: expected an array of receipts"))
+		return
+	}
+	if len(payloads) > maxBatchSize {
+		writeProblem(w, newProblem(http.StatusBadRequest, codeBatchTooLarge, fmt.Sprintf("Batch too large: at most %d receipts", maxBatchSize)))
+		return
+	}
+
+	results, p := processPayloads(r, payloads)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+
+	resp := BatchResponse{Results: results, Summary: summarizeBatch(r, results)}
+	writeResponse(w, r, resp, nil)
+}
+
+// processPayloads scores each JSON receipt on its own, on the scoring
+// workers, and stores the ones that pass in one go. The results line up with payloads. A Problem means
+// nothing was stored.
+func processPayloads(r *http.Request, payloads []json.RawMessage) ([]BatchResult, *Problem) {
+	tenant := tenantFrom(r.Context())
+	results := make([]BatchResult, len(payloads))
+	recs := make([]StoredReceipt, 0, len(payloads))
+	// The fingerprints claimed for recs, to release if they aren't stored.
+	keys := make([]string, 0, len(payloads))
+	now := time.Now().UTC()
+	scored := scoring.scoreAll(r.Context(), payloads)
+	// Store nothing once the client is gone or the deadline has passed.
+	if r.Context().Err() != nil {
+		return nil, newProblem(http.StatusServiceUnavailable, codeTimeout, "Request timed out")
+	}
+	for i, res := range scored {
+		if res.err != nil {
+			recordRejected(r.Context(), payloads[i], res.err.Error())
+			p := asProblem(res.err)
+			results[i] = BatchResult{Error: p.Detail, Code: p.Code, Field: p.Field}
+			continue
+		}
+		rec := StoredReceipt{ID: uuid.New().String(), Tenant: tenant, Receipt: res.receipt, Points: res.breakdown.Total, Breakdown: res.breakdown, CreatedAt: now}
+		key, err := claimFingerprint(r.Context(), rec)
+		if err != nil {
+			p := asProblem(err)
+			if p.Status != http.StatusConflict {
+				releaseFingerprints(r.Context(), keys...)
+				return nil, p
+			}
+			results[i] = BatchResult{Error: p.Detail, Code: p.Code, OriginalID: p.OriginalID}
+			continue
+		}
+		recs = append(recs, rec)
+		keys = append(keys, key)
+		results[i].ID, results[i].points = rec.ID, rec.Points
+	}
+
+	if err := saveBatch(r.Context(), store, recs); err != nil {
+		requestLogger(r).Error("Error saving batch", "receipts", len(recs), "err", err)
+		releaseFingerprints(r.Context(), keys...)
+		return nil, storeFailure(err, "Error saving receipts")
+	}
+	for _, rec := range recs {
+		recordProcessed(r.Context(), rec)
+	}
+	return results, nil
+}
+
+// recordProcessed counts a newly stored receipt in the metrics and the
+// leaderboard and tells the webhooks and NATS about it.
+func recordProcessed(ctx context.Context, rec StoredReceipt) {
+	pointsAwarded.Observe(float64(rec.Points))
+	addToLeaderboard(ctx, rec, rec.Points)
+	recordScoring(ctx, scoringProcessed, rec, 0)
+	flagSuspicious(ctx, rec)
+	webhooks.receiptProcessed(ctx, rec)
+	if natsEvents != nil {
+		natsEvents.receiptProcessed(rec)
+	}
+}
+
+// saveBatch stores receipts in one go when the store supports it.
+func saveBatch(ctx context.Context, s ReceiptStore, recs []StoredReceipt) error {
+	if bs, ok := s.(BatchSaver); ok {
+		return bs.SaveBatch(ctx, recs)
+	}
+	for _, rec := range recs {
+		if err := s.Save(ctx, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	storeMutex.RLock()
-	points, exists := receiptStore[id]
-	storeMutex.RUnlock()
+// updateReceiptHandler handles PUT /receipts/{id}
+func updateReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	setLogReceiptID(r, id)
 
-	if !exists {
-		http.Error(w, "Receipt not found", http.StatusNotFound)
+	receipt, breakdown, ok := scoreSubmission(w, r)
+	if !ok {
 		return
 	}
 
-	resp := PointsResponse{Points: points}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(resp)
+	// Replace the receipt and its points in one step, keeping its ID. The
+	// leaderboard and history move by the difference from the receipt the
+	// store actually replaced.
+	rec := StoredReceipt{ID: id, Tenant: tenantFrom(r.Context()), Receipt: receipt, Points: breakdown.Total, Breakdown: breakdown}
+	old, err := store.Update(r.Context(), rec)
+	if errors.Is(err, ErrReceiptNotFound) {
+		writeProblem(w, newProblem(http.StatusNotFound, codeNotFound, "Receipt not found"))
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Error updating receipt", "receipt_id", id, "err", err)
+		writeProblem(w, storeFailure(err, "Error updating receipt"))
+		return
+	}
+	rec.CreatedAt = old.CreatedAt
+	moveLeaderboardPoints(r.Context(), old, rec)
+	recordScoring(r.Context(), scoringAdjusted, rec, old.Points)
+
+	resp := PointsResponse{Points: breakdown.Total}
+	writeResponse(w, r, resp, &GetPointsResponse{Points: int64(breakdown.Total)})
+}
+
+// scoreSubmission reads a receipt from the request body, validates it and
+// calculates its points. When it fails it has already answered the request
+// and ok is false.
+func scoreSubmission(w http.ResponseWriter, r *http.Request) (receipt Receipt, breakdown PointsBreakdown, ok bool) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rejectSubmission(w, r, body, unreadableBody(err))
+		return
+	}
+	payload, p := receiptPayload(r, body)
+	if p != nil {
+		rejectSubmission(w, r, body, p)
+		return
+	}
+	receipt, breakdown, err = scorePayload(r.Context(), payload)
+	if err != nil {
+		rejectSubmission(w, r, payload, asProblem(err))
+		return
+	}
+	return receipt, breakdown, true
 }
 
-// calculatePoints applies the business rules to calculate points for a receipt.
-func calculatePoints(receipt Receipt) (int, error) {
-	totalPoints := 0
+// scorePayload validates a single JSON receipt and calculates its points.
+// Errors are always a *Problem worded for the client.
+func scorePayload(ctx context.Context, body []byte) (Receipt, PointsBreakdown, error) {
+	var receipt Receipt
 
-	// One point for every alphanumeric character in the retailer name.
-	re := regexp.MustCompile(`[A-Za-z0-9]`)
-	alphaNumChars := re.FindAllString(receipt.Retailer, -1)
-	totalPoints += len(alphaNumChars)
+	// encoding/json keeps the last of two identical keys, so check for them first
+	if rejectDuplicateKeys {
+		if err := checkDuplicateKeys(body); err != nil {
+			return Receipt{}, PointsBreakdown{}, newProblem(http.StatusBadRequest, codeInvalidJSON, "Invalid JSON payload: "+err.Error())
+		}
+	}
 
-	// Parse the string into a float.
-	totalFloat, err := strconv.ParseFloat(receipt.Total, 64)
+	// Checking the payload against the user supplied schema, if any
+	if receiptSchema != nil {
+		if err := validateAgainstSchema(body); err != nil {
+			return Receipt{}, PointsBreakdown{}, invalidReceipt(err)
+		}
+	}
+
+	// Decoding JSON into the struct we made
+	if err := json.Unmarshal(body, &receipt); err != nil {
+		return Receipt{}, PointsBreakdown{}, newProblem(http.StatusBadRequest, codeInvalidJSON, "Invalid JSON payload")
+	}
+	if len(receipt.Items) > maxItems {
+		return Receipt{}, PointsBreakdown{}, invalidReceipt(&FieldError{"items", fmt.Sprintf("may not have more than %d entries", maxItems)})
+	}
+
+	// Checking the fields against the API schema, unless a custom schema
+	// has replaced it
+	if receiptSchema == nil {
+		if err := validateReceipt(receipt); err != nil {
+			return Receipt{}, PointsBreakdown{}, invalidReceipt(err)
+		}
+	}
+
+	// Checking that no single item costs more than the whole receipt
+	if err := checkItemPrices(receipt); err != nil {
+		return Receipt{}, PointsBreakdown{}, invalidReceipt(err)
+	}
+	if receipt.UserID != "" && !userIDPattern.MatchString(receipt.UserID) {
+		return Receipt{}, PointsBreakdown{}, invalidReceipt(&FieldError{"userId", "may only contain letters, digits, '.', '@', '-' and '_', up to 128 of them"})
+	}
+
+	// Calculating points based on rules
+	breakdown, err := calculatePoints(ctx, receipt)
+	if ctx.Err() != nil {
+		return Receipt{}, PointsBreakdown{}, newProblem(http.StatusServiceUnavailable, codeTimeout, "Request timed out")
+	}
 	if err != nil {
-		return 0, fmt.Errorf("invalid total")
+		return Receipt{}, PointsBreakdown{}, newProblem(http.StatusBadRequest, codeScoringFailed, "Error calculating points: "+err.Error())
 	}
+	return receipt, breakdown, nil
+}
+
+// getPointsHandler handles GET /receipts/{id}/points
+func getPointsHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	setLogReceiptID(r, id)
 
-	// 50 points if the total is a round dollar amount with no cents.
-	if math.Mod(totalFloat, 1.0) == 0 {
-		totalPoints += 50
+	points, err := store.GetPoints(r.Context(), tenantFrom(r.Context()), id)
+	if errors.Is(err, ErrReceiptNotFound) {
+		writeProblem(w, newProblem(http.StatusNotFound, codeNotFound, "Receipt not found"))
+		return
 	}
+	if err != nil {
+		requestLogger(r).Error("Error loading receipt", "receipt_id", id, "err", err)
+		writeProblem(w, storeFailure(err, "Error loading receipt"))
+		return
+	}
+
+	writeCacheable(w, r, PointsResponse{Points: points}, &GetPointsResponse{Points: int64(points)})
+}
+
+// getBreakdownHandler handles GET /receipts/{id}/points/breakdown
+func getBreakdownHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	setLogReceiptID(r, id)
 
-	// 25 points if the total is a multiple of 0.25.
-	if math.Mod(totalFloat, 0.25) == 0 {
-		totalPoints += 25
+	rec, err := store.Get(r.Context(), tenantFrom(r.Context()), id)
+	if errors.Is(err, ErrReceiptNotFound) {
+		writeProblem(w, newProblem(http.StatusNotFound, codeNotFound, "Receipt not found"))
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Error loading receipt", "receipt_id", id, "err", err)
+		writeProblem(w, storeFailure(err, "Error loading receipt"))
+		return
 	}
 
-	// 5 points for every two items on the receipt.
-	totalPoints += (len(receipt.Items) / 2) * 5
+	breakdown := rec.Breakdown
+	if r.URL.Query().Get("explain") == "true" {
+		breakdown = explainBreakdown(r, rec)
+	}
+	writeCacheable(w, r, breakdown, nil)
+}
 
-	// if item trimmed length of the short description is a multiple of 3 add the multiply of price by 0.2 and round up to the nearest integer
-	for _, item := range receipt.Items {
-		desc := strings.TrimSpace(item.ShortDescription)
-		if len(desc)%3 == 0 {
-			priceFloat, err := strconv.ParseFloat(item.Price, 64)
-			if err != nil {
-				return 0, fmt.Errorf("invalid item price")
-			}
-			// Calculate points: price * 0.2 then round up.
-			itemPoints := int(math.Ceil(priceFloat * 0.2))
-			totalPoints += itemPoints
+// explainBreakdown returns the stored breakdown of rec with hints, from
+// scoring it again, on the rules that gave it no points. A receipt that
+// can't be scored now, such as one stored before the full receipt was
+// kept, gets no hints.
+func explainBreakdown(r *http.Request, rec StoredReceipt) PointsBreakdown {
+	breakdown := rec.Breakdown
+	explained, err := explainPoints(r.Context(), rec.Receipt)
+	if err != nil {
+		requestLogger(r).Warn("Error explaining points", "receipt_id", rec.ID, "err", err)
+		return breakdown
+	}
+	hints := make(map[string]string)
+	for _, rp := range explained.Rules {
+		hints[rp.Rule] = rp.Hint
+	}
+	breakdown.Rules = slices.Clone(breakdown.Rules)
+	for i, rp := range breakdown.Rules {
+		if rp.Points == 0 {
+			breakdown.Rules[i].Hint = hints[rp.Rule]
 		}
 	}
+	return breakdown
+}
 
-	// 6 points if the day in the purchase date is odd.
-	// Expecting date in YYYY-MM-DD format.
-	date, err := time.Parse("2006-01-02", receipt.PurchaseDate)
+// getRuleVersionsHandler handles GET /rules/versions
+// Each receipt's breakdown names the version that scored it.
+func getRuleVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	resp := RuleVersionsResponse{Versions: ruleVersions}
+	writeResponse(w, r, resp, nil)
+}
+
+// getReceiptHandler handles GET /receipts/{id}
+func getReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	setLogReceiptID(r, id)
+
+	rec, err := store.Get(r.Context(), tenantFrom(r.Context()), id)
+	if errors.Is(err, ErrReceiptNotFound) {
+		writeProblem(w, newProblem(http.StatusNotFound, codeNotFound, "Receipt not found"))
+		return
+	}
 	if err != nil {
-		return 0, fmt.Errorf("invalid purchaseDate")
+		requestLogger(r).Error("Error loading receipt", "receipt_id", id, "err", err)
+		writeProblem(w, storeFailure(err, "Error loading receipt"))
+		return
+	}
+
+	writeResponse(w, r, rec, &GetReceiptResponse{
+		Id:          rec.ID,
+		Receipt:     receiptToProto(rec.Receipt),
+		Points:      int64(rec.Points),
+		RuleVersion: rec.Breakdown.RuleVersion,
+		CreatedAt:   rec.CreatedAt.Format(time.RFC3339),
+	})
+}
+
+// deleteReceiptHandler handles DELETE /receipts/{id}
+func deleteReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	setLogReceiptID(r, id)
+
+	rec, err := store.Get(r.Context(), tenantFrom(r.Context()), id)
+	if err == nil {
+		err = store.Delete(r.Context(), rec.Tenant, id)
+	}
+	if errors.Is(err, ErrReceiptNotFound) {
+		writeProblem(w, newProblem(http.StatusNotFound, codeNotFound, "Receipt not found"))
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Error deleting receipt", "receipt_id", id, "err", err)
+		writeProblem(w, storeFailure(err, "Error deleting receipt"))
+		return
+	}
+	addToLeaderboard(r.Context(), rec, -rec.Points)
+	recordRemoval(r.Context(), scoringDeleted, rec)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listReceiptsHandler handles GET /receipts?limit=50&cursor=...
+// The cursor is the nextCursor from the previous page. retailer, from, to,
+// minPoints and maxPoints narrow down the receipts listed; the next page
+// must be asked for with the same ones.
+func listReceiptsHandler(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 500 {
+			p := newProblem(http.StatusBadRequest, codeInvalidParameter, "limit must be between 1 and 500")
+			p.Field = "limit"
+			writeProblem(w, p)
+			return
+		}
+		limit = n
 	}
-	if date.Day()%2 == 1 {
-		totalPoints += 6
+
+	after := ""
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(v)
+		if err != nil {
+			p := newProblem(http.StatusBadRequest, codeInvalidParameter, "Invalid cursor")
+			p.Field = "cursor"
+			writeProblem(w, p)
+			return
+		}
+		after = string(decoded)
 	}
 
-	// 10 points if the time of purchase is after 2:00pm and before 4:00pm.
-	// Expecting time in HH:MM (24-hour) format.
-	purchaseTime, err := time.Parse("15:04", receipt.PurchaseTime)
+	filter, ok := receiptFilter(w, r)
+	if !ok {
+		return
+	}
+
+	// Ask for one extra receipt to find out whether there is another page.
+	recs, err := store.Search(r.Context(), tenantFrom(r.Context()), filter, after, limit+1)
 	if err != nil {
-		return 0, fmt.Errorf("invalid purchaseTime")
+		requestLogger(r).Error("Error listing receipts", "err", err)
+		writeProblem(w, storeFailure(err, "Error listing receipts"))
+		return
 	}
-	// Create fixed times for 14:00 and 16:00.
-	afterTwo, _ := time.Parse("15:04", "14:00")
-	beforeFour, _ := time.Parse("15:04", "16:00")
-	if purchaseTime.After(afterTwo) && purchaseTime.Before(beforeFour) {
-		totalPoints += 10
+
+	resp := ListReceiptsResponse{Receipts: []ReceiptSummary{}}
+	if len(recs) > limit {
+		recs = recs[:limit]
+		resp.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(recs[limit-1].ID))
+	}
+	for _, rec := range recs {
+		resp.Receipts = append(resp.Receipts, ReceiptSummary{
+			ID:           rec.ID,
+			Retailer:     rec.Receipt.Retailer,
+			PurchaseDate: rec.Receipt.PurchaseDate,
+			Points:       rec.Points,
+		})
 	}
 
-	return totalPoints, nil
+	writeResponse(w, r, resp, nil)
+}
+
+// receiptFilter reads the search parameters of GET /receipts. When one is
+// malformed it has already answered the request and ok is false.
+func receiptFilter(w http.ResponseWriter, r *http.Request) (f ReceiptFilter, ok bool) {
+	q := r.URL.Query()
+	f.Retailer = q.Get("retailer")
+	if utf8.RuneCountInString(f.Retailer) > 100 {
+		p := newProblem(http.StatusBadRequest, codeInvalidParameter, "retailer may not be longer than 100 characters")
+		p.Field = "retailer"
+		writeProblem(w, p)
+		return f, false
+	}
+	for _, d := range []struct {
+		name string
+		v    *string
+	}{{"from", &f.PurchasedFrom}, {"to", &f.PurchasedTo}} {
+		*d.v = q.Get(d.name)
+		if *d.v == "" {
+			continue
+		}
+		if _, err := time.Parse("2006-01-02", *d.v); err != nil {
+			p := newProblem(http.StatusBadRequest, codeInvalidParameter, d.name+" must be a date such as 2022-01-31")
+			p.Field = d.name
+			writeProblem(w, p)
+			return f, false
+		}
+	}
+	for _, b := range []struct {
+		name string
+		v    **int
+	}{{"minPoints", &f.MinPoints}, {"maxPoints", &f.MaxPoints}} {
+		v := q.Get(b.name)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			p := newProblem(http.StatusBadRequest, codeInvalidParameter, b.name+" must be a whole number of points, 0 or more")
+			p.Field = b.name
+			writeProblem(w, p)
+			return f, false
+		}
+		*b.v = &n
+	}
+	return f, true
+}
+
+// checkDuplicateKeys returns an error if a top-level key of the JSON object
+// appears more than once. Malformed JSON is left for the decoder to report.
+func checkDuplicateKeys(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil
+	}
+	seen := make(map[string]bool)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		key, _ := tok.(string)
+		if seen[key] {
+			return fmt.Errorf("duplicate key %q", key)
+		}
+		seen[key] = true
+
+		// Skip over the value, whatever its type.
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// checkItemPrices compares every item price against the receipt total.
+// Prices that cannot be parsed are left for calculatePoints to report.
+func checkItemPrices(receipt Receipt) error {
+	decimals := currencyDecimals[receiptCurrency(receipt)]
+	total, err := parseMinorUnits(receipt.Total, decimals)
+	if err != nil {
+		return nil
+	}
+	for i, item := range receipt.Items {
+		price, err := parseMinorUnits(item.Price, decimals)
+		if err != nil || price <= total {
+			continue
+		}
+		if itemPriceExceedsTotalIsError {
+			return &FieldError{fmt.Sprintf("items[%d].price", i), "exceeds total"}
+		}
+		slog.Warn("Item price exceeds total", "item", i, "price", item.Price, "total", receipt.Total)
+	}
+	return nil
 }
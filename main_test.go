@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// The example receipt from the README, worth 28 points
+const targetReceipt = `{
+  "retailer": "Target",
+  "purchaseDate": "2022-01-01",
+  "purchaseTime": "13:01",
+  "items": [
+    {"shortDescription": "Mountain Dew 12PK", "price": "6.49"},
+    {"shortDescription": "Emils Cheese Pizza", "price": "12.25"},
+    {"shortDescription": "Knorr Creamy Chicken", "price": "1.26"},
+    {"shortDescription": "Doritos Nacho Cheese", "price": "3.35"},
+    {"shortDescription": "   Klarbrunn 12-PK 12 FL OZ  ", "price": "12.00"}
+  ],
+  "total": "35.35"
+}`
+
+// newTestAPI returns the API's routes backed by an empty memory store,
+// which replaces the package's store until the test ends.
+func newTestAPI(t *testing.T) http.Handler {
+	t.Helper()
+	prevStore, prevWebhooks := store, webhooks
+	store, webhooks = newMemoryStore(0), newWebhookDispatcher(1, 1, 1, time.Second)
+	if scoring == nil {
+		// The pool's workers have no way to stop, so one is shared.
+		scoring = newScoringPool(2)
+	}
+	t.Cleanup(func() {
+		webhooks.stop(context.Background())
+		store, webhooks = prevStore, prevWebhooks
+	})
+	r, err := newRouter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Use(resolveTenant)
+	registerRoutes(r, "", defaultRouteTimeouts)
+	return r
+}
+
+func TestWithTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		handler     http.HandlerFunc
+		wantStatus  int
+		contentType string
+	}{
+		{
+			name:       "no content",
+			handler:    func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) },
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name: "json",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"points":28}`))
+			},
+			wantStatus:  http.StatusOK,
+			contentType: "application/json",
+		},
+		{
+			name: "handler's own 503",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				writeProblem(w, newProblem(http.StatusServiceUnavailable, codeNotReady, "Not ready"))
+			},
+			wantStatus:  http.StatusServiceUnavailable,
+			contentType: "application/problem+json",
+		},
+		{
+			name: "timeout",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				<-r.Context().Done()
+			},
+			wantStatus:  http.StatusServiceUnavailable,
+			contentType: "application/problem+json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			withTimeout(tt.handler, 50*time.Millisecond).ServeHTTP(rec, httptest.NewRequest("GET", "/receipts/1", nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Type"); got != tt.contentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.contentType)
+			}
+		})
+	}
+}
+
+func TestCheckItemPrices(t *testing.T) {
+	tests := []struct {
+		name      string
+		isError   bool
+		receipt   Receipt
+		wantField string // of the error, none when empty
+	}{
+		{
+			name:    "prices within total",
+			isError: true,
+			receipt: Receipt{Total: "10.00", Items: []Item{{Price: "6.00"}, {Price: "4.00"}}},
+		},
+		{
+			name:    "price equal to total",
+			isError: true,
+			receipt: Receipt{Total: "10.00", Items: []Item{{Price: "10.00"}}},
+		},
+		{
+			name:    "price over total warns",
+			receipt: Receipt{Total: "10.00", Items: []Item{{Price: "10.01"}}},
+		},
+		{
+			name:      "price over total rejected",
+			isError:   true,
+			receipt:   Receipt{Total: "10.00", Items: []Item{{Price: "10.01"}}},
+			wantField: "items[0].price",
+		},
+		{
+			name:      "later item over total",
+			isError:   true,
+			receipt:   Receipt{Total: "10.00", Items: []Item{{Price: "1.00"}, {Price: "2.00"}, {Price: "12.00"}}},
+			wantField: "items[2].price",
+		},
+		{
+			name:      "amounts in a currency without decimals",
+			isError:   true,
+			receipt:   Receipt{Currency: "JPY", Total: "1000", Items: []Item{{Price: "1200"}}},
+			wantField: "items[0].price",
+		},
+		{
+			name:    "unparsable price left for scoring",
+			isError: true,
+			receipt: Receipt{Total: "10.00", Items: []Item{{Price: "abc"}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(v bool) { itemPriceExceedsTotalIsError = v }(itemPriceExceedsTotalIsError)
+			itemPriceExceedsTotalIsError = tt.isError
+			err := checkItemPrices(tt.receipt)
+			if tt.wantField == "" {
+				if err != nil {
+					t.Errorf("checkItemPrices = %v, want no error", err)
+				}
+				return
+			}
+			var fe *FieldError
+			if !errors.As(err, &fe) || fe.Field != tt.wantField {
+				t.Fatalf("checkItemPrices = %v, want a FieldError for %s", err, tt.wantField)
+			}
+			if p := invalidReceipt(err); p.Status != http.StatusBadRequest || p.Code != codeInvalidReceipt || p.Field != tt.wantField {
+				t.Errorf("problem = %d %s %s, want 400 %s %s", p.Status, p.Code, p.Field, codeInvalidReceipt, tt.wantField)
+			}
+		})
+	}
+}
+
+func TestItemPriceExceedsTotalRejected(t *testing.T) {
+	defer func(v bool) { itemPriceExceedsTotalIsError = v }(itemPriceExceedsTotalIsError)
+	itemPriceExceedsTotalIsError = true
+	api := newTestAPI(t)
+
+	payload := strings.Replace(targetReceipt, `"total": "35.35"`, `"total": "12.00"`, 1)
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest("POST", "/receipts/process", strings.NewReader(payload)))
+	var p Problem
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusBadRequest || p.Code != codeInvalidReceipt || p.Field != "items[1].price" {
+		t.Errorf("status %d, problem %+v, want 400 %s for items[1].price", rec.Code, p, codeInvalidReceipt)
+	}
+}
+
+func TestHTTP2Cleartext(t *testing.T) {
+	tests := []struct {
+		name      string
+		enableH2C bool
+		wantProto int
+	}{
+		{name: "h2c enabled", enableH2C: true, wantProto: 2},
+		{name: "h2c disabled", wantProto: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewUnstartedServer(newTestAPI(t))
+			cfg := Config{EnableH2C: tt.enableH2C, H2MaxConcurrentStreams: 250, H2MaxReadFrameSize: 1 << 20, H2MaxUploadBuffer: 1 << 20}
+			if err := configureHTTP2(srv.Config, cfg); err != nil {
+				t.Fatal(err)
+			}
+			srv.Start()
+			defer srv.Close()
+
+			// Speak HTTP/2 from the first byte, as an h2c client with prior
+			// knowledge does, falling back to HTTP/1.1 when h2c is off.
+			var client *http.Client
+			if tt.enableH2C {
+				client = &http.Client{Transport: &http2.Transport{
+					AllowHTTP: true,
+					DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+						return (&net.Dialer{}).DialContext(ctx, network, addr)
+					},
+				}}
+			} else {
+				client = srv.Client()
+			}
+
+			resp, err := client.Post(srv.URL+"/receipts/process", "application/json", strings.NewReader(targetReceipt))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var processed ProcessResponse
+			err = json.NewDecoder(resp.Body).Decode(&processed)
+			resp.Body.Close()
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("process: status %d, err %v", resp.StatusCode, err)
+			}
+			if resp.ProtoMajor != tt.wantProto {
+				t.Errorf("process: HTTP/%d, want HTTP/%d", resp.ProtoMajor, tt.wantProto)
+			}
+
+			resp, err = client.Get(srv.URL + "/receipts/" + processed.ID + "/points")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var points PointsResponse
+			err = json.NewDecoder(resp.Body).Decode(&points)
+			resp.Body.Close()
+			if err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("points: status %d, err %v", resp.StatusCode, err)
+			}
+			if resp.ProtoMajor != tt.wantProto {
+				t.Errorf("points: HTTP/%d, want HTTP/%d", resp.ProtoMajor, tt.wantProto)
+			}
+			if points.Points != 28 {
+				t.Errorf("points = %d, want 28", points.Points)
+			}
+		})
+	}
+}
+
+func TestCheckDuplicateKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		wantErr bool
+	}{
+		{name: "unique keys", payload: `{"retailer":"M","total":"1.00"}`},
+		{name: "duplicate total", payload: `{"total":"1.00","retailer":"M","total":"9.00"}`, wantErr: true},
+		{name: "repeated key in a nested object", payload: `{"items":[{"price":"1.00"},{"price":"2.00"}]}`},
+		{name: "duplicate key in an item", payload: `{"items":[{"price":"1.00","price":"2.00"}]}`},
+		{name: "not an object", payload: `[1,2]`},
+		{name: "malformed", payload: `{"total":`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkDuplicateKeys([]byte(tt.payload)); (err != nil) != tt.wantErr {
+				t.Errorf("checkDuplicateKeys = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRejectDuplicateKeys(t *testing.T) {
+	payload := strings.Replace(targetReceipt, `"total": "35.35"`, `"total": "35.35", "total": "100.00"`, 1)
+	tests := []struct {
+		name       string
+		reject     bool
+		wantStatus int
+	}{
+		{name: "enabled", reject: true, wantStatus: http.StatusBadRequest},
+		{name: "disabled", reject: false, wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPI(t)
+			defer func(v bool) { rejectDuplicateKeys = v }(rejectDuplicateKeys)
+			rejectDuplicateKeys = tt.reject
+
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, httptest.NewRequest("POST", "/receipts/process", strings.NewReader(payload)))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
+
+func BenchmarkProcessReceipt(b *testing.B) {
+	prevStore, prevWebhooks := store, webhooks
+	store, webhooks = newMemoryStore(0), newWebhookDispatcher(1, 1, 1, time.Second)
+	defer func() {
+		webhooks.stop(context.Background())
+		store, webhooks = prevStore, prevWebhooks
+	}()
+	body := []byte(targetReceipt)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rec := httptest.NewRecorder()
+		processReceiptHandler(rec, httptest.NewRequest("POST", "/receipts/process", bytes.NewReader(body)))
+		if rec.Code != http.StatusOK {
+			b.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+	}
+}
+
+// slowReadStore takes a while to read a receipt, so whatever else happens
+// to it in the meantime shows.
+type slowReadStore struct{ ReceiptStore }
+
+func (s slowReadStore) Get(ctx context.Context, tenant, id string) (StoredReceipt, error) {
+	rec, err := s.ReceiptStore.Get(ctx, tenant, id)
+	time.Sleep(time.Millisecond)
+	return rec, err
+}
+
+func TestUpdateReceiptConcurrently(t *testing.T) {
+	api := newTestAPI(t)
+	store = slowReadStore{store}
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+	alices := strings.Replace(targetReceipt, `"total"`, `"userId": "alice", "total"`, 1)
+	bobs := strings.Replace(strings.Replace(targetReceipt, "Target", "Walgreens", 1), `"total"`, `"userId": "bob", "total"`, 1)
+
+	rec := do("POST", "/receipts/process", alices)
+	var resp ProcessResponse
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil {
+		t.Fatalf("process: status %d: %s", rec.Code, rec.Body)
+	}
+	// Move the receipt back and forth between the users at the same time.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		payload := alices
+		if i%2 == 0 {
+			payload = bobs
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rec := do("PUT", "/receipts/"+resp.ID, payload); rec.Code != http.StatusOK {
+				t.Errorf("update: status %d: %s", rec.Code, rec.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	var points PointsResponse
+	if rec := do("GET", "/receipts/"+resp.ID+"/points", ""); json.Unmarshal(rec.Body.Bytes(), &points) != nil {
+		t.Fatalf("points: status %d: %s", rec.Code, rec.Body)
+	}
+	var board LeaderboardResponse
+	if rec := do("GET", "/leaderboard", ""); json.Unmarshal(rec.Body.Bytes(), &board) != nil {
+		t.Fatalf("leaderboard: status %d: %s", rec.Code, rec.Body)
+	}
+	var total int
+	for _, u := range board.Users {
+		total += u.Points
+	}
+	if total != points.Points {
+		t.Errorf("leaderboard %+v adds up to %d points, want the receipt's %d", board.Users, total, points.Points)
+	}
+}
+
+func TestBatchSummary(t *testing.T) {
+	api := newTestAPI(t)
+	walgreens := strings.Replace(targetReceipt, "Target", "Walgreens", 1)
+	batch := "[" + targetReceipt + "," + walgreens + `, {"retailer": ""}, {"total": "x"}]`
+	tests := []struct {
+		query string
+		want  *BatchSummary
+	}{
+		{query: ""},
+		{query: "?summary=true", want: &BatchSummary{Succeeded: 2, Failed: 2, TotalPoints: 28 + 31, ErrorCodes: []string{"invalid_receipt"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, httptest.NewRequest("POST", "/receipts/process/batch"+tt.query, strings.NewReader(batch)))
+			var resp BatchResponse
+			if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			if tt.want == nil {
+				if resp.Summary != nil {
+					t.Errorf("summary %+v, want none", resp.Summary)
+				}
+				return
+			}
+			if resp.Summary == nil {
+				t.Fatal("no summary")
+			}
+			got := *resp.Summary
+			if got.Succeeded != tt.want.Succeeded || got.Failed != tt.want.Failed || got.TotalPoints != tt.want.TotalPoints || !slices.Equal(got.ErrorCodes, tt.want.ErrorCodes) {
+				t.Errorf("summary %+v, want %+v", got, *tt.want)
+			}
+		})
+	}
+}
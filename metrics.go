@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Upper bounds of the buckets receipts are sorted into by points, in
+// receipts_points_awarded and GET /stats
+var pointsBuckets = []float64{0, 10, 25, 50, 75, 100, 150, 200, 300, 500}
+
+// Metrics served on /metrics for Prometheus to scrape
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipts_http_requests_total",
+		Help: "HTTP requests answered, by method, route and status code.",
+	}, []string{"method", "route", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "receipts_http_request_duration_seconds",
+		Help:    "Time taken to answer HTTP requests, by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+	httpInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "receipts_http_requests_in_flight",
+		Help: "HTTP requests currently being handled.",
+	})
+	pointsAwarded = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "receipts_points_awarded",
+		Help:    "Points awarded to each newly processed receipt.",
+		Buckets: pointsBuckets,
+	})
+
+	// Counted on every scrape, which for the redis backend means a SCAN of
+	// all receipt keys.
+	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "receipts_stored",
+		Help: "Receipts currently in the store.",
+	}, func() float64 {
+		n, err := store.Count(context.Background())
+		if err != nil {
+			slog.Error("Error counting receipts", "err", err)
+			return math.NaN()
+		}
+		return float64(n)
+	})
+)
+
+// instrumentRoutes is router middleware that records the request metrics.
+// Requests are labelled with the route's path template, such as
+// /receipts/{id}/points, so every receipt ID doesn't get its own series.
+func instrumentRoutes(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeTemplate(r)
+		if route == "" {
+			route = "unknown"
+		}
+
+		// Name the request's span after the route too.
+		trace.SpanFromContext(r.Context()).SetName(r.Method + " " + route)
+
+		httpInFlight.Inc()
+		defer httpInFlight.Dec()
+		start := time.Now()
+		sr := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sr, r)
+
+		httpRequests.WithLabelValues(r.Method, route, strconv.Itoa(sr.status)).Inc()
+		httpDuration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// Publishes receipt.processed events to NATS JetStream when NATS_URL is
+// set. Set up in main.
+var natsEvents *natsPublisher
+
+// natsPublisher publishes an event for every stored receipt without
+// holding up the request: publishes are acknowledged in the background,
+// and failures are logged rather than retried. Each event's ID is sent as
+// Nats-Msg-Id, so JetStream drops duplicates.
+type natsPublisher struct {
+	conn    *nats.Conn
+	js      jetstream.JetStream
+	subject string
+}
+
+// newNATSPublisher connects to the NATS server at cfg.NATSURL. When
+// cfg.NATSStream is set, a stream by that name capturing the subject is
+// created if it doesn't exist; otherwise one must already capture it.
+func newNATSPublisher(cfg Config) (*natsPublisher, error) {
+	opts := []nats.Option{
+		nats.Name("receipt-processor"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				slog.Warn("Disconnected from NATS", "err", err)
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			slog.Info("Reconnected to NATS", "url", nc.ConnectedUrl())
+		}),
+	}
+	if cfg.NATSCredsFile != "" {
+		opts = append(opts, nats.UserCredentials(cfg.NATSCredsFile))
+	}
+	if cfg.NATSToken != "" {
+		opts = append(opts, nats.Token(cfg.NATSToken))
+	}
+	nc, err := nats.Connect(cfg.NATSURL, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("nats: %w", err)
+	}
+	js, err := jetstream.New(nc,
+		jetstream.WithPublishAsyncMaxPending(1000),
+		jetstream.WithPublishAsyncErrHandler(func(_ jetstream.JetStream, msg *nats.Msg, err error) {
+			slog.Error("Error publishing event to NATS", "subject", msg.Subject, "event_id", msg.Header.Get(jetstream.MsgIDHeader), "err", err)
+		}),
+	)
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("nats: %w", err)
+	}
+	if cfg.NATSStream != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := js.CreateStream(ctx, jetstream.StreamConfig{Name: cfg.NATSStream, Subjects: []string{cfg.NATSSubject}}); err != nil && !errors.Is(err, jetstream.ErrStreamNameAlreadyInUse) {
+			nc.Close()
+			return nil, fmt.Errorf("nats: creating stream %s: %w", cfg.NATSStream, err)
+		}
+	}
+	return &natsPublisher{conn: nc, js: js, subject: cfg.NATSSubject}, nil
+}
+
+// receiptProcessed publishes a receipt.processed event about rec.
+func (p *natsPublisher) receiptProcessed(rec StoredReceipt) {
+	event := receiptProcessedEvent(rec)
+	data, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding NATS event", "err", err)
+		return
+	}
+	msg := nats.NewMsg(p.subject)
+	msg.Data = data
+	msg.Header.Set(jetstream.MsgIDHeader, event.ID)
+	if _, err := p.js.PublishMsgAsync(msg); err != nil {
+		slog.Error("Error publishing event to NATS", "subject", p.subject, "event_id", event.ID, "err", err)
+	}
+}
+
+// close waits until ctx is done for outstanding publishes to be
+// acknowledged, then drains the connection.
+func (p *natsPublisher) close(ctx context.Context) {
+	select {
+	case <-p.js.PublishAsyncComplete():
+	case <-ctx.Done():
+		slog.Warn("Closing NATS with events unacknowledged", "pending", p.js.PublishAsyncPending())
+	}
+	if err := p.conn.Drain(); err != nil {
+		slog.Error("Error draining NATS connection", "err", err)
+	}
+}
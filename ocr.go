@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OCRProvider reads the text of a photographed receipt. Implementations
+// return the text line by line, top to bottom, as printed.
+type OCRProvider interface {
+	ReadText(ctx context.Context, image []byte) (string, error)
+}
+
+// The OCR provider behind POST /receipts/scan, chosen by OCR_PROVIDER.
+// The endpoint is off while it is nil.
+var ocr OCRProvider
+
+// newOCRProvider returns the provider named by cfg, or nil when scanning
+// is off. Its calls are bounded and retried as cfg says.
+func newOCRProvider(cfg Config) (OCRProvider, error) {
+	var provider OCRProvider
+	switch cfg.OCRProvider {
+	case "":
+		return nil, nil
+	case "tesseract":
+		provider = tesseractOCR{path: cfg.TesseractPath}
+	default:
+		return nil, fmt.Errorf("unknown OCR provider %q", cfg.OCRProvider)
+	}
+	return retryingOCR{provider: provider, timeout: cfg.OCRTimeout, maxAttempts: cfg.OCRMaxAttempts, backoff: cfg.OCRRetryBackoff}, nil
+}
+
+// retryingOCR gives each call to provider timeout, and tries a call that
+// fails or times out again, up to maxAttempts times in all, waiting
+// backoff before the first retry and twice as long before each next one.
+type retryingOCR struct {
+	provider    OCRProvider
+	timeout     time.Duration
+	maxAttempts int
+	backoff     time.Duration
+}
+
+func (o retryingOCR) ReadText(ctx context.Context, image []byte) (string, error) {
+	backoff := o.backoff
+	for attempt := 1; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, o.timeout)
+		text, err := o.provider.ReadText(callCtx, image)
+		if err == nil && callCtx.Err() != nil {
+			err = callCtx.Err()
+		}
+		cancel()
+		if err == nil {
+			return text, nil
+		}
+		if attempt >= o.maxAttempts || ctx.Err() != nil {
+			return "", fmt.Errorf("after %d attempts: %w", attempt, err)
+		}
+		slog.Warn("Reading receipt image failed, retrying", "attempt", attempt, "retry_in", backoff.String(), "err", err)
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("after %d attempts: %w", attempt, err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// tesseractOCR runs the tesseract command line tool.
+type tesseractOCR struct {
+	path string
+}
+
+func (t tesseractOCR) ReadText(ctx context.Context, image []byte) (string, error) {
+	cmd := exec.CommandContext(ctx, t.path, "stdin", "stdout")
+	cmd.Stdin = bytes.NewReader(image)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("tesseract: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// Response for POST /receipts/scan
+// Receipt is what could be read from the image. When it is a valid receipt
+// Points and Breakdown are what it would be awarded; otherwise Error, Code
+// and Field say what to correct, as in a Problem. Nothing is stored: the
+// client submits the confirmed receipt to /receipts/process.
+type ScanResponse struct {
+	Receipt   Receipt          `json:"receipt"`
+	Points    *int             `json:"points,omitempty"`
+	Breakdown *PointsBreakdown `json:"breakdown,omitempty"`
+	Error     string           `json:"error,omitempty"`
+	Code      string           `json:"code,omitempty"`
+	Field     string           `json:"field,omitempty"`
+}
+
+// scanReceiptHandler handles POST /receipts/scan
+func scanReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	image, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeProblem(w, unreadableBody(err))
+		return
+	}
+	if mt := http.DetectContentType(image); mt != "image/jpeg" && mt != "image/png" {
+		writeProblem(w, newProblem(http.StatusUnsupportedMediaType, codeUnsupportedImage, "Send a JPEG or PNG image"))
+		return
+	}
+
+	text, err := ocr.ReadText(r.Context(), image)
+	if err != nil {
+		requestLogger(r).Error("Error reading receipt image", "err", err)
+		if r.Context().Err() != nil {
+			writeProblem(w, newProblem(http.StatusServiceUnavailable, codeTimeout, "Request timed out"))
+			return
+		}
+		writeProblem(w, newProblem(http.StatusBadGateway, codeOCRFailed, "The OCR provider failed or timed out reading the receipt image; try again later"))
+		return
+	}
+
+	resp := ScanResponse{Receipt: receiptFromText(text)}
+	payload, _ := json.Marshal(resp.Receipt)
+	_, breakdown, err := scorePayload(r.Context(), payload)
+	if err != nil {
+		p := asProblem(err)
+		if p.Status != http.StatusBadRequest {
+			writeProblem(w, p)
+			return
+		}
+		resp.Error, resp.Code, resp.Field = p.Detail, p.Code, p.Field
+	} else {
+		resp.Points = &breakdown.Total
+		resp.Breakdown = &breakdown
+	}
+
+	writeResponse(w, r, resp, nil)
+}
+
+// Patterns for picking receipt fields out of OCR text.
+var (
+	scanDatePattern  = regexp.MustCompile(`\b(\d{4})-(\d{2})-(\d{2})\b|\b(\d{1,2})/(\d{1,2})/(\d{2}|\d{4})\b`)
+	scanTimePattern  = regexp.MustCompile(`(?i)\b(\d{1,2}):(\d{2})(?::\d{2})?\s*(AM|PM)?\b`)
+	scanTotalPattern = regexp.MustCompile(`(?i)^\s*(?:total|amount due|balance due)\b.*?\$?(\d+\.\d{2})\s*$`)
+	scanItemPattern  = regexp.MustCompile(`^\s*(.*?[A-Za-z].*?)\s+\$?(\d+\.\d{2})\s*[A-Z]?\s*$`)
+	// Lines with an amount that are not items.
+	scanSkipPattern = regexp.MustCompile(`(?i)\b(sub\s*total|total|tax|change|cash|credit|debit|visa|mastercard|amex|balance|tender|savings|discount)\b`)
+	// Characters the retailer and description patterns don't allow.
+	scanStripPattern = regexp.MustCompile(`[^\w\s\-&]+`)
+)
+
+// receiptFromText maps the text of a receipt onto its fields: the first
+// line is taken as the retailer, the first date and time found as the
+// purchase date and time, the TOTAL line as the total, and every other
+// line ending in an amount as an item. Fields that can't be found are left
+// empty for the client to fill in.
+func receiptFromText(text string) Receipt {
+	receipt := Receipt{Items: []Item{}}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if receipt.Retailer == "" {
+			receipt.Retailer = strings.Join(strings.Fields(scanStripPattern.ReplaceAllString(line, " ")), " ")
+			continue
+		}
+		if receipt.PurchaseDate == "" {
+			receipt.PurchaseDate = scanDate(line)
+		}
+		if receipt.PurchaseTime == "" {
+			receipt.PurchaseTime = scanTime(line)
+		}
+		if m := scanTotalPattern.FindStringSubmatch(line); m != nil {
+			if receipt.Total == "" {
+				receipt.Total = m[1]
+			}
+			continue
+		}
+		if scanSkipPattern.MatchString(line) {
+			continue
+		}
+		if m := scanItemPattern.FindStringSubmatch(line); m != nil {
+			desc := strings.Join(strings.Fields(scanStripPattern.ReplaceAllString(m[1], " ")), " ")
+			if desc != "" {
+				receipt.Items = append(receipt.Items, Item{ShortDescription: desc, Price: m[2]})
+			}
+		}
+	}
+	return receipt
+}
+
+// scanDate returns the first date on line as YYYY-MM-DD, reading slashed
+// dates as MM/DD/YY or MM/DD/YYYY, or "" when there is none.
+func scanDate(line string) string {
+	m := scanDatePattern.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+	var s string
+	if m[1] != "" {
+		s = m[1] + "-" + m[2] + "-" + m[3]
+	} else {
+		year, _ := strconv.Atoi(m[6])
+		if year < 100 {
+			year += 2000
+		}
+		month, _ := strconv.Atoi(m[4])
+		day, _ := strconv.Atoi(m[5])
+		s = fmt.Sprintf("%04d-%02d-%02d", year, month, day)
+	}
+	if _, err := time.Parse("2006-01-02", s); err != nil {
+		return ""
+	}
+	return s
+}
+
+// scanTime returns the first time of day on line as 24-hour HH:MM, or ""
+// when there is none.
+func scanTime(line string) string {
+	m := scanTimePattern.FindStringSubmatch(line)
+	if m == nil {
+		return ""
+	}
+	hour, _ := strconv.Atoi(m[1])
+	switch strings.ToUpper(m[3]) {
+	case "PM":
+		if hour < 12 {
+			hour += 12
+		}
+	case "AM":
+		if hour == 12 {
+			hour = 0
+		}
+	}
+	s := fmt.Sprintf("%02d:%s", hour, m[2])
+	if _, err := time.Parse("15:04", s); err != nil {
+		return ""
+	}
+	return s
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hangingOCR hangs on its first hangs calls, until their context is done,
+// and then reads text.
+type hangingOCR struct {
+	hangs int
+	calls int
+}
+
+func (o *hangingOCR) ReadText(ctx context.Context, image []byte) (string, error) {
+	o.calls++
+	if o.calls <= o.hangs {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
+	return "TARGET\n", nil
+}
+
+func TestRetryingOCR(t *testing.T) {
+	tests := []struct {
+		name      string
+		hangs     int
+		wantErr   bool
+		wantCalls int
+	}{
+		{name: "answers at once", hangs: 0, wantCalls: 1},
+		{name: "times out and then answers", hangs: 1, wantCalls: 2},
+		{name: "times out every time", hangs: 3, wantErr: true, wantCalls: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &hangingOCR{hangs: tt.hangs}
+			o := retryingOCR{provider: provider, timeout: 10 * time.Millisecond, maxAttempts: 3, backoff: time.Millisecond}
+			text, err := o.ReadText(context.Background(), nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && text != "TARGET\n" {
+				t.Errorf("text = %q", text)
+			}
+			if provider.calls != tt.wantCalls {
+				t.Errorf("provider called %d times, want %d", provider.calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestScanProviderTimesOut(t *testing.T) {
+	defer func(o OCRProvider) { ocr = o }(ocr)
+	ocr = retryingOCR{provider: &hangingOCR{hangs: 2}, timeout: 10 * time.Millisecond, maxAttempts: 2, backoff: time.Millisecond}
+	api := newTestAPI(t)
+
+	png := "\x89PNG\r\n\x1a\n" + strings.Repeat("\x00", 16)
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest("POST", "/receipts/scan", strings.NewReader(png)))
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), codeOCRFailed) {
+		t.Errorf("status %d: %s, want 502 with code %s", rec.Code, rec.Body, codeOCRFailed)
+	}
+}
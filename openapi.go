@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What the OpenAPI document says about one operation. Request and Response
+// are zero values of the types the handler decodes and encodes; their
+// schemas are generated from the Go types, so they can't drift apart.
+type apiOperation struct {
+	Summary string
+	Query   []apiParam
+	Request any
+	// Media type of the request body, application/json when empty.
+	RequestType string
+	Response    any
+	// Media type of the response body, application/json when empty.
+	ResponseType string
+	// Status of a successful response, 200 when zero.
+	Status int
+	// Statuses of the Problems the operation may answer with.
+	Problems []int
+}
+
+// A query parameter of an operation
+type apiParam struct {
+	Name        string
+	Description string
+	Type        string
+}
+
+// The summary parameter of the batch and import operations
+var summaryParam = apiParam{Name: "summary", Description: "true to add a summary of the results: how many succeeded and failed, the points awarded and the error codes.", Type: "boolean"}
+
+// The operations behind each route, keyed by method and the route's path
+// template without the /v1 prefix. Routes that aren't listed still appear
+// in the document, with only their method and path.
+var apiOperations = map[string]apiOperation{
+	"POST /receipts/process": {
+		Summary:  "Score and store a receipt. Send an Idempotency-Key header to make retries safe, and Prefer: respond-async to have it queued and get 202 with a Job instead.",
+		Request:  Receipt{},
+		Response: ProcessResponse{},
+		Problems: []int{http.StatusBadRequest, http.StatusConflict, http.StatusRequestEntityTooLarge},
+	},
+	"POST /receipts/process/batch": {
+		Summary:  "Score and store many receipts. Each one succeeds or fails on its own.",
+		Query:    []apiParam{summaryParam},
+		Request:  []Receipt{},
+		Response: BatchResponse{},
+		Problems: []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge},
+	},
+	"POST /receipts/process/stream": {
+		Summary:      "Score and store receipts sent as newline-delimited JSON, one per line, answering with a result line for each as it is processed. Each line succeeds or fails on its own.",
+		Request:      Receipt{},
+		RequestType:  "application/x-ndjson",
+		Response:     StreamResult{},
+		ResponseType: "application/x-ndjson",
+	},
+	"POST /receipts/import": {
+		Summary:     "Score and store the receipts in a CSV, one per row. Each row succeeds or fails on its own.",
+		Query:       []apiParam{summaryParam},
+		Request:     "",
+		RequestType: "text/csv",
+		Response:    ImportResponse{},
+		Problems:    []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge},
+	},
+	"POST /receipts/scan": {
+		Summary:     "Read a receipt from a JPEG or PNG photo and score it without storing it, so the user can confirm it.",
+		Request:     "",
+		RequestType: "image/*",
+		Response:    ScanResponse{},
+		Problems:    []int{http.StatusRequestEntityTooLarge, http.StatusUnsupportedMediaType, http.StatusBadGateway},
+	},
+	"GET /receipts/{id}/points": {
+		Summary:  "Get the points a receipt was awarded. The answer carries an ETag; send it back in If-None-Match to get 304 while the points are unchanged.",
+		Response: PointsResponse{},
+		Problems: []int{http.StatusNotFound},
+	},
+	"POST /receipts/points:batchGet": {
+		Summary:  "Get the points of up to MAX_POINTS_BATCH_SIZE receipts at once. Each ID gets a result, in the order asked for, with its points or the code not_found.",
+		Request:  BatchPointsRequest{},
+		Response: BatchPointsResponse{},
+		Problems: []int{http.StatusBadRequest},
+	},
+	"GET /receipts/{id}/points/breakdown": {
+		Summary:  "Get the points a receipt was awarded, split up by rule, with an ETag like GET /receipts/{id}/points.",
+		Query:    []apiParam{{Name: "explain", Description: "true to add a hint to each rule that gave no points saying how close the receipt came, such as a purchase time just before the afternoon window.", Type: "boolean"}},
+		Response: PointsBreakdown{},
+		Problems: []int{http.StatusNotFound},
+	},
+	"GET /receipts/{id}/history": {
+		Summary:  "Get every change to a receipt's points, oldest first: when it was processed, recalculated, replaced, deleted or expired, with the rule version and the points before and after. It outlives the receipt.",
+		Response: HistoryResponse{},
+		Problems: []int{http.StatusNotFound},
+	},
+	"GET /receipts/{id}/flags": {
+		Summary:  "Get the fraud checks a receipt failed when it was stored, and whether it was reviewed. A receipt that passed them has no flags.",
+		Response: ReceiptFlags{},
+		Problems: []int{http.StatusNotFound},
+	},
+	"GET /review-queue": {
+		Summary: "List the flagged receipts not yet reviewed, by receipt ID.",
+		Query: []apiParam{
+			{Name: "limit", Description: "Receipts per page, 1 to 500 (default 50).", Type: "integer"},
+			{Name: "cursor", Description: "The nextCursor of the previous page.", Type: "string"},
+		},
+		Response: ReviewQueueResponse{},
+		Problems: []int{http.StatusBadRequest},
+	},
+	"GET /jobs/{id}": {
+		Summary:  "Get the status of an asynchronously submitted receipt and, once it is done, its points or error.",
+		Response: Job{},
+		Problems: []int{http.StatusNotFound},
+	},
+	"GET /users/{id}/points": {
+		Summary: "Get a user's points balance, the points of their receipts less what they redeemed, with their most recent receipts and redemptions.",
+		Query: []apiParam{
+			{Name: "limit", Description: "Recent receipts and redemptions to include, 0 to 100 (default 10).", Type: "integer"},
+		},
+		Response: UserPointsResponse{},
+		Problems: []int{http.StatusBadRequest},
+	},
+	"POST /users/{id}/redeem": {
+		Summary:  "Take points off a user's balance and record it in their ledger. An Idempotency-Key header is required; a retry with the same key gets the first redemption back. Answers 409 when the balance is too low.",
+		Request:  RedeemRequest{},
+		Response: RedeemResponse{},
+		Status:   http.StatusCreated,
+		Problems: []int{http.StatusBadRequest, http.StatusConflict},
+	},
+	"GET /stats": {
+		Summary: "Count the receipts stored on each day of a date range, and the points they got in total, on average and by bucket, overall, per day and per retailer.",
+		Query: []apiParam{
+			{Name: "from", Description: "First day, such as 2022-01-01 (default 29 days before to).", Type: "string"},
+			{Name: "to", Description: "Last day, such as 2022-01-31 (default today, UTC).", Type: "string"},
+		},
+		Response: StatsResponse{},
+		Problems: []int{http.StatusBadRequest},
+	},
+	"GET /leaderboard": {
+		Summary: "List the users who earned the most points so far this week (from Monday, UTC) or month.",
+		Query: []apiParam{
+			{Name: "period", Description: "week (default) or month.", Type: "string"},
+			{Name: "limit", Description: "Users to list, 1 to 100 (default 10).", Type: "integer"},
+		},
+		Response: LeaderboardResponse{},
+		Problems: []int{http.StatusBadRequest},
+	},
+	"GET /rules/versions": {
+		Summary:  "List the versions of the scoring rules and when each applies.",
+		Response: RuleVersionsResponse{},
+	},
+	"GET /receipts": {
+		Summary: "List stored receipts, oldest first, optionally only those matching a search.",
+		Query: []apiParam{
+			{Name: "limit", Description: "Receipts per page, 1 to 500 (default 50).", Type: "integer"},
+			{Name: "cursor", Description: "The nextCursor of the previous page.", Type: "string"},
+			{Name: "retailer", Description: "Only receipts whose retailer contains this, ignoring case.", Type: "string"},
+			{Name: "from", Description: "Earliest purchase date to include, such as 2022-01-01.", Type: "string"},
+			{Name: "to", Description: "Latest purchase date to include, such as 2022-12-31.", Type: "string"},
+			{Name: "minPoints", Description: "Only receipts worth at least this many points.", Type: "integer"},
+			{Name: "maxPoints", Description: "Only receipts worth at most this many points.", Type: "integer"},
+		},
+		Response: ListReceiptsResponse{},
+		Problems: []int{http.StatusBadRequest},
+	},
+	"GET /receipts/export": {
+		Summary: "Download every stored receipt with its points, as a JSON array or, with format=csv, as a CSV in the columns POST /receipts/import reads plus id, points and createdAt.",
+		Query: []apiParam{
+			{Name: "format", Description: "json (default) or csv.", Type: "string"},
+			{Name: "from", Description: "Earliest purchase date to include, such as 2022-01-01.", Type: "string"},
+			{Name: "to", Description: "Latest purchase date to include, such as 2022-12-31.", Type: "string"},
+			{Name: "retailer", Description: "Only receipts from this retailer, ignoring case.", Type: "string"},
+		},
+		Response: []ExportedReceipt{},
+		Problems: []int{http.StatusBadRequest},
+	},
+	"GET /receipts/{id}": {
+		Summary:  "Get a stored receipt with its points.",
+		Response: StoredReceipt{},
+		Problems: []int{http.StatusNotFound},
+	},
+	"PUT /receipts/{id}": {
+		Summary:  "Replace a receipt and score it again.",
+		Request:  Receipt{},
+		Response: PointsResponse{},
+		Problems: []int{http.StatusBadRequest, http.StatusNotFound, http.StatusRequestEntityTooLarge},
+	},
+	"DELETE /receipts/{id}": {
+		Summary:  "Delete a receipt.",
+		Status:   http.StatusNoContent,
+		Problems: []int{http.StatusNotFound},
+	},
+	"GET /rejected": {
+		Summary: "List the tenant's recently rejected submissions.",
+		Query: []apiParam{
+			{Name: "offset", Description: "Submissions to skip.", Type: "integer"},
+			{Name: "limit", Description: "Submissions per page, 1 to 500 (default 50).", Type: "integer"},
+		},
+		Response: RejectedResponse{},
+	},
+}
+
+// Patterns the built-in validation applies to receipt fields, added to the
+// generated schemas.
+var schemaPatterns = map[string]*regexp.Regexp{
+	"Receipt.retailer":      retailerPattern,
+	"Receipt.total":         anyAmountPattern,
+	"Receipt.currency":      currencyPattern,
+	"Receipt.timezone":      timezonePattern,
+	"Receipt.userId":        userIDPattern,
+	"Item.shortDescription": descriptionPattern,
+	"Item.price":            anyAmountPattern,
+}
+
+// Matches the variables of a route's path template, such as {id}.
+var pathParamPattern = regexp.MustCompile(`\{(\w+)\}`)
+
+// buildOpenAPI describes every /v1 route registered on r as an OpenAPI 3
+// document. The security schemes in use are listed so clients know which
+// credentials to send.
+func buildOpenAPI(r *router, requireAPIKey, bearer bool) ([]byte, error) {
+	schemas := map[string]any{}
+	schemaFor(reflect.TypeOf(Problem{}), schemas)
+	paths := map[string]map[string]any{}
+
+	for _, route := range r.Routes() {
+		tmpl := route.Template
+		if !strings.HasPrefix(tmpl, "/v1/") {
+			continue
+		}
+		op := apiOperations[route.Method+" "+strings.TrimPrefix(tmpl, "/v1")]
+		if paths[tmpl] == nil {
+			paths[tmpl] = map[string]any{}
+		}
+		paths[tmpl][strings.ToLower(route.Method)] = describeOperation(tmpl, op, schemas)
+	}
+
+	securitySchemes := map[string]any{}
+	var security []map[string][]string
+	if requireAPIKey {
+		securitySchemes["apiKey"] = map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"}
+		security = append(security, map[string][]string{"apiKey": {}})
+	}
+	if bearer {
+		securitySchemes["bearer"] = map[string]any{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"}
+		security = append(security, map[string][]string{"bearer": {}})
+	}
+	doc := map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "Receipt Processor",
+			"version":     "1",
+			"description": "Scores receipts for points. The paths are also served without the /v1 prefix.",
+		},
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas, "securitySchemes": securitySchemes},
+	}
+	if len(security) > 0 {
+		doc["security"] = security
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// describeOperation builds the OpenAPI operation object for op on the
+// route with path template tmpl.
+func describeOperation(tmpl string, op apiOperation, schemas map[string]any) map[string]any {
+	var params []map[string]any
+	for _, m := range pathParamPattern.FindAllStringSubmatch(tmpl, -1) {
+		params = append(params, map[string]any{"name": m[1], "in": "path", "required": true, "schema": map[string]any{"type": "string"}})
+	}
+	for _, q := range op.Query {
+		params = append(params, map[string]any{"name": q.Name, "in": "query", "description": q.Description, "schema": map[string]any{"type": q.Type}})
+	}
+	params = append(params, map[string]any{"name": "X-Tenant-ID", "in": "header", "description": "Tenant to act for, when no API key or token decides it.", "schema": map[string]any{"type": "string"}})
+
+	status := op.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	ok := map[string]any{"description": http.StatusText(status)}
+	if op.Response != nil {
+		mediaType := op.ResponseType
+		if mediaType == "" {
+			mediaType = "application/json"
+		}
+		ok["content"] = map[string]any{mediaType: map[string]any{"schema": schemaFor(reflect.TypeOf(op.Response), schemas)}}
+	}
+	responses := map[string]any{strconv.Itoa(status): ok}
+	for _, s := range op.Problems {
+		responses[strconv.Itoa(s)] = map[string]any{
+			"description": http.StatusText(s),
+			"content":     map[string]any{"application/problem+json": map[string]any{"schema": map[string]any{"$ref": "#/components/schemas/Problem"}}},
+		}
+	}
+
+	o := map[string]any{"responses": responses}
+	if op.Summary != "" {
+		o["summary"] = op.Summary
+	}
+	if len(params) > 0 {
+		o["parameters"] = params
+	}
+	if op.Request != nil {
+		mediaType := op.RequestType
+		if mediaType == "" {
+			mediaType = "application/json"
+		}
+		o["requestBody"] = map[string]any{
+			"required": true,
+			"content":  map[string]any{mediaType: map[string]any{"schema": schemaFor(reflect.TypeOf(op.Request), schemas)}},
+		}
+	}
+	return o
+}
+
+// schemaFor returns the JSON schema of t. Named structs are added to
+// schemas once and referred to with $ref.
+func schemaFor(t reflect.Type, schemas map[string]any) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem(), schemas)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": schemaFor(t.Elem(), schemas)}
+	case reflect.Struct:
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, done := schemas[t.Name()]; done {
+			return ref
+		}
+		// Claim the name first, so recursive types end.
+		schemas[t.Name()] = nil
+		props := map[string]any{}
+		var required []string
+		// Fields of embedded structs are listed after the embedded field
+		// itself, which encoding/json leaves out like this.
+		for _, f := range reflect.VisibleFields(t) {
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if !f.IsExported() || name == "-" || (f.Anonymous && name == "") {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			prop := schemaFor(f.Type, schemas)
+			if re := schemaPatterns[t.Name()+"."+name]; re != nil {
+				prop["pattern"] = re.String()
+			}
+			props[name] = prop
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+		s := map[string]any{"type": "object", "properties": props}
+		if len(required) > 0 {
+			s["required"] = required
+		}
+		schemas[t.Name()] = s
+		return ref
+	}
+	return map[string]any{}
+}
+
+// openAPIHandler serves the document built at startup.
+func openAPIHandler(doc []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(doc)
+	}
+}
+
+// The Swagger UI page. Its scripts come from a CDN, so /docs needs the
+// browser to have internet access; /openapi.json does not.
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Receipt Processor API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5.17.14/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5.17.14/swagger-ui-bundle.js" crossorigin></script>
+  <script>
+    window.ui = SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});
+  </script>
+</body>
+</html>
+`
+
+// docsHandler handles GET /docs
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Layouts of a receipt's purchase date and time
+const (
+	dateLayout  = "2006-01-02"
+	clockLayout = "15:04"
+)
+
+// How many points one rule gave a receipt. Rules that score items one by
+// one, such as itemDescription, also say in Items how many items earned
+// the points. Hint says how close a receipt the rule gave no points came,
+// only in breakdowns asked for with explain=true.
+type RulePoints struct {
+	Rule   string `json:"rule"`
+	Points int    `json:"points"`
+	Items  *int   `json:"items,omitempty"`
+	Hint   string `json:"hint,omitempty"`
+}
+
+// The points for a receipt split up by rule. RawTotal is the sum of the rules
+// and Total is what the receipt was awarded after final rounding.
+// RuleVersion names the rule set version that did the scoring.
+// ExchangeRate is what one unit of the receipt's currency was counted as
+// in USD, left out for USD receipts, and Timezone the zone the purchase
+// time was scored in, left out when it was scored as written.
+type PointsBreakdown struct {
+	RuleVersion  string       `json:"ruleVersion"`
+	ExchangeRate float64      `json:"exchangeRate,omitempty"`
+	Timezone     string       `json:"timezone,omitempty"`
+	Rules        []RulePoints `json:"rules"`
+	RawTotal     int          `json:"rawTotal"`
+	Total        int          `json:"total"`
+}
+
+// add records the points a rule contributed.
+func (b *PointsBreakdown) add(rule string, points int) {
+	b.Rules = append(b.Rules, RulePoints{Rule: rule, Points: points})
+	b.RawTotal += points
+}
+
+// Rule is a single scoring rule. Apply is only given receipts that passed
+// checkScorable, so it can rely on the total, prices, date and time parsing.
+type Rule interface {
+	Name() string
+	Apply(Receipt) int
+}
+
+// An itemRule is a Rule that scores items one by one. ApplyItems returns
+// the points, as Apply does, and how many items earned them.
+type itemRule interface {
+	Rule
+	ApplyItems(Receipt) (points, items int)
+}
+
+// A hintRule is a Rule that can say how close a receipt it gave no points
+// came to earning them. Hint returns "" when the receipt wasn't close.
+type hintRule interface {
+	Rule
+	Hint(Receipt) string
+}
+
+// A ruleFactory builds a Rule from the rule set, or returns nil when the
+// rule set turns the rule off.
+type ruleFactory func(rs *RuleSet) Rule
+
+// Rules added from other files with registerRule, applied after the
+// built-in rules.
+var customRules []ruleFactory
+
+// registerRule adds a custom rule to every rule set. Call it from an init
+// function in the file that defines the rule.
+func registerRule(f ruleFactory) {
+	customRules = append(customRules, f)
+}
+
+// buildChain creates the rules of a rule set in the order they are applied.
+func (rs *RuleSet) buildChain() []Rule {
+	var chain []Rule
+	for _, factory := range append(builtinRules[:len(builtinRules):len(builtinRules)], customRules...) {
+		if rule := factory(rs); rule != nil {
+			chain = append(chain, rule)
+		}
+	}
+	return chain
+}
+
+// calculatePoints applies the business rules to calculate points for a receipt.
+// Every rule in the chain appears in the breakdown, even when it gives no
+// points, so it is clear which rules the receipt missed.
+func calculatePoints(ctx context.Context, receipt Receipt) (PointsBreakdown, error) {
+	return scorePoints(ctx, receipt, false)
+}
+
+// explainPoints is calculatePoints with a hint for every rule that gave no
+// points to a receipt that came close, for customer support.
+func explainPoints(ctx context.Context, receipt Receipt) (PointsBreakdown, error) {
+	return scorePoints(ctx, receipt, true)
+}
+
+// scorePoints is calculatePoints, adding hints when explain is set.
+func scorePoints(ctx context.Context, receipt Receipt, explain bool) (PointsBreakdown, error) {
+	_, span := tracer.Start(ctx, "calculatePoints")
+	defer span.End()
+
+	if err := checkScorable(receipt); err != nil {
+		return PointsBreakdown{}, err
+	}
+
+	// Score the purchase at its local date and time, with the rules that
+	// applied on that day.
+	loc, err := receiptTimezone(ctx, receipt)
+	if err != nil {
+		return PointsBreakdown{}, err
+	}
+	local := inTimezone(receipt, loc)
+	purchaseDate, _ := time.Parse(dateLayout, local.PurchaseDate)
+	rs, err := rulesFor(purchaseDate)
+	if err != nil {
+		return PointsBreakdown{}, err
+	}
+	scored, rate, err := rs.inBaseCurrency(local)
+	if err != nil {
+		return PointsBreakdown{}, err
+	}
+	b := PointsBreakdown{RuleVersion: rs.Version, Rules: make([]RulePoints, 0, len(rs.chain))}
+	if receiptCurrency(receipt) != baseCurrency {
+		b.ExchangeRate = rate
+	}
+	if loc != nil {
+		b.Timezone = loc.String()
+	}
+	for _, rule := range rs.chain {
+		if err := ctx.Err(); err != nil {
+			return PointsBreakdown{}, err
+		}
+		if ir, ok := rule.(itemRule); ok {
+			points, items := ir.ApplyItems(scored)
+			b.add(rule.Name(), points)
+			b.Rules[len(b.Rules)-1].Items = &items
+		} else {
+			b.add(rule.Name(), rule.Apply(scored))
+		}
+		if hr, ok := rule.(hintRule); ok && explain && b.Rules[len(b.Rules)-1].Points == 0 {
+			b.Rules[len(b.Rules)-1].Hint = hr.Hint(scored)
+		}
+	}
+	b.Total = rs.roundFinalPoints(b.RawTotal)
+	if span.IsRecording() {
+		span.SetAttributes(attribute.String("rules.version", rs.Version), attribute.Int("points", b.Total))
+	}
+	return b, nil
+}
+
+// checkScorable makes sure the fields the rules read can be parsed.
+// Amounts must be whole numbers of the currency's minor unit, such as
+// cents.
+func checkScorable(receipt Receipt) error {
+	decimals := currencyDecimals[receiptCurrency(receipt)]
+	if _, err := parseMinorUnits(receipt.Total, decimals); err != nil {
+		return fmt.Errorf("invalid total")
+	}
+	for _, item := range receipt.Items {
+		if _, err := parseMinorUnits(item.Price, decimals); err != nil {
+			return fmt.Errorf("invalid item price")
+		}
+	}
+	// Expecting date in YYYY-MM-DD format.
+	if _, err := time.Parse(dateLayout, receipt.PurchaseDate); err != nil {
+		return fmt.Errorf("invalid purchaseDate")
+	}
+	// Expecting time in HH:MM (24-hour) format.
+	if _, err := time.Parse(clockLayout, receipt.PurchaseTime); err != nil {
+		return fmt.Errorf("invalid purchaseTime")
+	}
+	return nil
+}
+
+// purchaseDay returns the day of the month of a purchase date that parses
+// with dateLayout, such as 20 for 2022-03-20. The rules call it for every
+// receipt, so it reads the last two digits rather than parsing the date
+// again.
+func purchaseDay(date string) int {
+	if len(date) < 2 {
+		return 0
+	}
+	return atoiDigits(date[len(date)-2:])
+}
+
+// purchaseClock returns the hour and minute of a purchase time that parses
+// with clockLayout, such as 14 and 33 for 14:33.
+func purchaseClock(clock string) (hour, minute int) {
+	h, m, _ := strings.Cut(clock, ":")
+	return atoiDigits(h), atoiDigits(m)
+}
+
+// atoiDigits returns the value of a string of ASCII digits.
+func atoiDigits(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		n = n*10 + int(s[i]-'0')
+	}
+	return n
+}
+
+// roundFinalPoints rounds a points total to the configured multiple, so 28
+// becomes 30 when rounding to the nearest 5 or 10.
+func (rs *RuleSet) roundFinalPoints(points int) int {
+	m := rs.RoundFinalPointsTo
+	if m <= 1 {
+		return points
+	}
+	down := points - points%m
+	switch rs.RoundFinalPointsMode {
+	case "down":
+		return down
+	case "up":
+		if down == points {
+			return points
+		}
+		return down + m
+	default:
+		// Halfway values round up.
+		if points-down >= (m+1)/2 {
+			return down + m
+		}
+		return down
+	}
+}
+
+// countSamePriceRuns counts the runs of two or more back-to-back items with
+// the same price, so prices [2.00, 2.00, 3.00, 3.00, 3.00] make two runs.
+func countSamePriceRuns(items []Item) (int, error) {
+	runs := 0
+	runLength := 0
+	var prevCents int64
+	for i, item := range items {
+		cents, err := parseCents(item.Price)
+		if err != nil {
+			return 0, fmt.Errorf("invalid item price")
+		}
+		if i > 0 && cents == prevCents {
+			runLength++
+			// Count the run once, as soon as it reaches two items.
+			if runLength == 2 {
+				runs++
+			}
+		} else {
+			runLength = 1
+		}
+		prevCents = cents
+	}
+	return runs, nil
+}
+
+// parseCents parses a dollar amount such as "35.35" into integer cents.
+func parseCents(amount string) (int64, error) {
+	return parseMinorUnits(amount, 2)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withRules makes rs, once compiled, the only rule set version until the
+// test ends.
+func withRules(t *testing.T, rs *RuleSet) {
+	t.Helper()
+	if err := rs.compile(); err != nil {
+		t.Fatal(err)
+	}
+	prev := ruleVersions
+	ruleVersions = []*RuleSet{rs}
+	t.Cleanup(func() { ruleVersions = prev })
+}
+
+// rulePoints returns the points one rule gave in a breakdown, and whether
+// the rule was applied at all.
+func rulePoints(b PointsBreakdown, rule string) (int, bool) {
+	for _, r := range b.Rules {
+		if r.Rule == rule {
+			return r.Points, true
+		}
+	}
+	return 0, false
+}
+
+func TestPurchaseHourPoints(t *testing.T) {
+	tests := []struct {
+		name       string
+		hourPoints map[int]int
+		time       string
+		want       int
+		wantRule   bool
+	}{
+		{name: "09:30", hourPoints: map[int]int{9: 2, 17: 5}, time: "09:30", want: 2, wantRule: true},
+		{name: "17:45", hourPoints: map[int]int{9: 2, 17: 5}, time: "17:45", want: 5, wantRule: true},
+		{name: "hour not in the table", hourPoints: map[int]int{9: 2, 17: 5}, time: "10:00", want: 0, wantRule: true},
+		{name: "end of the hour", hourPoints: map[int]int{9: 2, 17: 5}, time: "09:59", want: 2, wantRule: true},
+		{name: "empty table", hourPoints: map[int]int{}, time: "09:30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := defaultRules()
+			rs.HourPoints = tt.hourPoints
+			withRules(t, rs)
+
+			receipt := Receipt{Retailer: "M", PurchaseDate: "2022-01-02", PurchaseTime: tt.time, Total: "1.01"}
+			b, err := calculatePoints(context.Background(), receipt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, applied := rulePoints(b, "purchaseHour")
+			if applied != tt.wantRule || got != tt.want {
+				t.Errorf("purchaseHour = %d (applied %v), want %d (applied %v)", got, applied, tt.want, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestMinItemPriceForDescriptionPoints(t *testing.T) {
+	// Both descriptions are 6 characters long, a multiple of 3.
+	items := []Item{{ShortDescription: "Cheese", Price: "4.99"}, {ShortDescription: "Crisps", Price: "5.00"}}
+	tests := []struct {
+		name     string
+		minPrice float64
+		want     int
+	}{
+		{name: "no minimum", minPrice: 0, want: 2},
+		{name: "cheaper item skipped", minPrice: 5, want: 1},
+		{name: "both below", minPrice: 5.01, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := defaultRules()
+			rs.MinItemPriceForDescriptionPoints = tt.minPrice
+			withRules(t, rs)
+
+			receipt := Receipt{Retailer: "M", PurchaseDate: "2022-01-02", PurchaseTime: "10:00", Total: "9.99", Items: items}
+			b, err := calculatePoints(context.Background(), receipt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := rulePoints(b, "itemDescription"); got != tt.want {
+				t.Errorf("itemDescription = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDescriptionItemsCount(t *testing.T) {
+	withRules(t, defaultRules())
+	// Three of the descriptions have a length that is a multiple of 3.
+	items := []Item{
+		{ShortDescription: "Cheese", Price: "4.99"},
+		{ShortDescription: "Milk", Price: "2.00"},
+		{ShortDescription: "  Jam  ", Price: "3.00"},
+		{ShortDescription: "Emils Cheese Pizza", Price: "12.25"},
+		{ShortDescription: "Eggs", Price: "5.00"},
+	}
+	receipt := Receipt{Retailer: "M", PurchaseDate: "2022-01-02", PurchaseTime: "10:00", Total: "27.24", Items: items}
+	b, err := calculatePoints(context.Background(), receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range b.Rules {
+		if r.Rule != "itemDescription" {
+			if r.Items != nil {
+				t.Errorf("%s has items %d, want none", r.Rule, *r.Items)
+			}
+			continue
+		}
+		// 0.998, 0.6 and 2.45 round up to 1, 1 and 3.
+		if r.Items == nil || *r.Items != 3 || r.Points != 5 {
+			t.Errorf("itemDescription = %+v, want 5 points from 3 items", r)
+		}
+	}
+}
+
+func TestSamePriceRunPoints(t *testing.T) {
+	tests := []struct {
+		name     string
+		points   int
+		prices   []string
+		want     int
+		wantRule bool
+	}{
+		{name: "two runs", points: 4, prices: []string{"2.00", "2.00", "3.00", "3.00", "3.00"}, want: 8, wantRule: true},
+		{name: "runs apart", points: 4, prices: []string{"2.00", "2.00", "3.00", "2.00", "2.00"}, want: 8, wantRule: true},
+		{name: "same price not back to back", points: 4, prices: []string{"2.00", "3.00", "2.00"}, want: 0, wantRule: true},
+		{name: "one run of two", points: 4, prices: []string{"1.50", "1.50"}, want: 4, wantRule: true},
+		{name: "single item", points: 4, prices: []string{"2.00"}, want: 0, wantRule: true},
+		{name: "rule off", points: 0, prices: []string{"2.00", "2.00"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := defaultRules()
+			rs.SamePriceRunPoints = tt.points
+			withRules(t, rs)
+
+			receipt := Receipt{Retailer: "M", PurchaseDate: "2022-01-02", PurchaseTime: "10:00", Total: "20.00"}
+			for _, price := range tt.prices {
+				receipt.Items = append(receipt.Items, Item{ShortDescription: "Item", Price: price})
+			}
+			b, err := calculatePoints(context.Background(), receipt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, applied := rulePoints(b, "samePriceRuns")
+			if applied != tt.wantRule || got != tt.want {
+				t.Errorf("samePriceRuns = %d (applied %v), want %d (applied %v)", got, applied, tt.want, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestRoundFinalPoints(t *testing.T) {
+	tests := []struct {
+		name   string
+		to     int
+		mode   string
+		points int
+		want   int
+	}{
+		{name: "28 to nearest 5", to: 5, mode: "nearest", points: 28, want: 30},
+		{name: "28 to nearest 10", to: 10, mode: "nearest", points: 28, want: 30},
+		{name: "halfway rounds up", to: 10, mode: "nearest", points: 25, want: 30},
+		{name: "below halfway", to: 10, mode: "nearest", points: 24, want: 20},
+		{name: "up", to: 10, mode: "up", points: 21, want: 30},
+		{name: "up on a multiple", to: 10, mode: "up", points: 20, want: 20},
+		{name: "down", to: 10, mode: "down", points: 29, want: 20},
+		{name: "no rounding", to: 1, mode: "nearest", points: 28, want: 28},
+		{name: "zero", to: 5, mode: "up", points: 0, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := defaultRules()
+			rs.RoundFinalPointsTo, rs.RoundFinalPointsMode = tt.to, tt.mode
+			if got := rs.roundFinalPoints(tt.points); got != tt.want {
+				t.Errorf("roundFinalPoints(%d) = %d, want %d", tt.points, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRoundFinalPointsBreakdown(t *testing.T) {
+	rs := defaultRules()
+	rs.RoundFinalPointsTo = 5
+	withRules(t, rs)
+
+	var receipt Receipt
+	if err := json.Unmarshal([]byte(targetReceipt), &receipt); err != nil {
+		t.Fatal(err)
+	}
+	b, err := calculatePoints(context.Background(), receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.RawTotal != 28 || b.Total != 30 {
+		t.Errorf("rawTotal %d and total %d, want 28 and 30", b.RawTotal, b.Total)
+	}
+}
+
+func TestDescriptionPatternPoints(t *testing.T) {
+	items := []Item{
+		{ShortDescription: "Organic Bananas", Price: "1.00"},
+		{ShortDescription: "  organic milk ", Price: "1.00"},
+		{ShortDescription: "Bread", Price: "1.00"},
+		{ShortDescription: "Non-organic Eggs", Price: "1.00"},
+	}
+	tests := []struct {
+		name     string
+		patterns []PatternPoints
+		want     int
+		wantRule bool
+	}{
+		{name: "some items match", patterns: []PatternPoints{{Pattern: "(?i)^organic", Points: 3}}, want: 6, wantRule: true},
+		{name: "case sensitive", patterns: []PatternPoints{{Pattern: "^Organic", Points: 3}}, want: 3, wantRule: true},
+		{name: "every pattern counts", patterns: []PatternPoints{{Pattern: "(?i)organic", Points: 1}, {Pattern: "Eggs$", Points: 10}}, want: 13, wantRule: true},
+		{name: "no match", patterns: []PatternPoints{{Pattern: "^Cheese", Points: 3}}, want: 0, wantRule: true},
+		{name: "no patterns"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := defaultRules()
+			rs.DescriptionPatterns = tt.patterns
+			withRules(t, rs)
+
+			receipt := Receipt{Retailer: "M", PurchaseDate: "2022-01-02", PurchaseTime: "10:00", Total: "4.00", Items: items}
+			b, err := calculatePoints(context.Background(), receipt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, applied := rulePoints(b, "descriptionPattern")
+			if applied != tt.wantRule || got != tt.want {
+				t.Errorf("descriptionPattern = %d (applied %v), want %d (applied %v)", got, applied, tt.want, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestDescriptionPatternRejectedAtLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+	}{
+		{name: "invalid", pattern: "(organic"},
+		{name: "empty", pattern: ""},
+		{name: "too long", pattern: strings.Repeat("a", maxDescriptionPatternLength+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := defaultRules()
+			rs.DescriptionPatterns = []PatternPoints{{Pattern: tt.pattern, Points: 3}}
+			if err := rs.compile(); err == nil {
+				t.Errorf("compile accepted pattern %q", tt.pattern)
+			}
+		})
+	}
+}
+
+func TestParseCents(t *testing.T) {
+	tests := []struct {
+		amount  string
+		want    int64
+		wantErr bool
+	}{
+		{amount: "35.35", want: 3535},
+		{amount: "35.10", want: 3510},
+		{amount: "0.00", want: 0},
+		{amount: "0.01", want: 1},
+		{amount: "1.5", want: 150},
+		{amount: "12", want: 1200},
+		{amount: "10995116277.75", want: 1099511627775},
+		{amount: "10995116277.76", wantErr: true},
+		{amount: "1.234", wantErr: true},
+		{amount: "1.", wantErr: true},
+		{amount: ".50", wantErr: true},
+		{amount: "-1.00", wantErr: true},
+		{amount: "1e2", wantErr: true},
+		{amount: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.amount, func(t *testing.T) {
+			got, err := parseCents(tt.amount)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("parseCents(%q) = %d, %v, want %d, error %v", tt.amount, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTotalRulesEdgeTotals(t *testing.T) {
+	withRules(t, defaultRules())
+	tests := []struct {
+		total           string
+		roundDollar     int
+		quarterMultiple int
+	}{
+		// Not exactly representable as a float64, but exact in cents.
+		{total: "35.10"},
+		{total: "0.25", quarterMultiple: 25},
+		{total: "0.00", roundDollar: 50, quarterMultiple: 25},
+		{total: "100.00", roundDollar: 50, quarterMultiple: 25},
+		{total: "9.75", quarterMultiple: 25},
+		{total: "9.99"},
+		{total: "0.01"},
+		{total: "10995116277.75", quarterMultiple: 25},
+	}
+	for _, tt := range tests {
+		t.Run(tt.total, func(t *testing.T) {
+			receipt := Receipt{Retailer: "M", PurchaseDate: "2022-01-02", PurchaseTime: "10:00", Total: tt.total}
+			b, err := calculatePoints(context.Background(), receipt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, _ := rulePoints(b, "roundDollar"); got != tt.roundDollar {
+				t.Errorf("roundDollar = %d, want %d", got, tt.roundDollar)
+			}
+			if got, _ := rulePoints(b, "quarterMultiple"); got != tt.quarterMultiple {
+				t.Errorf("quarterMultiple = %d, want %d", got, tt.quarterMultiple)
+			}
+		})
+	}
+}
+
+func BenchmarkCalculatePoints(b *testing.B) {
+	var receipt Receipt
+	if err := json.Unmarshal([]byte(targetReceipt), &receipt); err != nil {
+		b.Fatal(err)
+	}
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := calculatePoints(ctx, receipt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkValidateReceipt(b *testing.B) {
+	var receipt Receipt
+	if err := json.Unmarshal([]byte(targetReceipt), &receipt); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := validateReceipt(receipt); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestExplainBreakdown(t *testing.T) {
+	api := newTestAPI(t)
+	tests := []struct {
+		name      string
+		time      string
+		query     string
+		wantHints map[string]string
+	}{
+		{name: "without explain", time: "13:55"},
+		{
+			name:  "just before the afternoon",
+			time:  "13:55",
+			query: "?explain=true",
+			wantHints: map[string]string{
+				"roundDollar":     "total 35.35 missed a round dollar amount by 0.65",
+				"quarterMultiple": "total 35.35 missed a multiple of 0.25 by 0.15",
+				"afternoon":       "purchase at 13:55 was 5 minutes before the afternoon window, which starts after 14:00",
+			},
+		},
+		{
+			name:  "far from the afternoon",
+			time:  "09:00",
+			query: "?explain=true",
+			wantHints: map[string]string{
+				"roundDollar":     "total 35.35 missed a round dollar amount by 0.65",
+				"quarterMultiple": "total 35.35 missed a multiple of 0.25 by 0.15",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := strings.Replace(targetReceipt, "13:01", tt.time, 1)
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, httptest.NewRequest("POST", "/receipts/process", strings.NewReader(payload)))
+			var processed ProcessResponse
+			if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &processed) != nil {
+				t.Fatalf("process: status %d: %s", rec.Code, rec.Body)
+			}
+
+			rec = httptest.NewRecorder()
+			api.ServeHTTP(rec, httptest.NewRequest("GET", "/receipts/"+processed.ID+"/points/breakdown"+tt.query, nil))
+			var b PointsBreakdown
+			if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &b) != nil {
+				t.Fatalf("breakdown: status %d: %s", rec.Code, rec.Body)
+			}
+			for _, r := range b.Rules {
+				if r.Hint != tt.wantHints[r.Rule] {
+					t.Errorf("%s hint %q, want %q", r.Rule, r.Hint, tt.wantHints[r.Rule])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// Codes clients can switch on, sent in the code member of a Problem
+const (
+	codeInvalidJSON         = "invalid_json"
+	codeInvalidCSV          = "invalid_csv"
+	codeInvalidProtobuf     = "invalid_protobuf"
+	codeInvalidMsgpack      = "invalid_msgpack"
+	codeInvalidXML          = "invalid_xml"
+	codeInvalidReceipt      = "invalid_receipt"
+	codeScoringFailed       = "scoring_failed"
+	codeBatchTooLarge       = "batch_too_large"
+	codePayloadTooLarge     = "payload_too_large"
+	codeInvalidParameter    = "invalid_parameter"
+	codeNotFound            = "not_found"
+	codeTimeout             = "timeout"
+	codeNotReady            = "not_ready"
+	codeRateLimited         = "rate_limited"
+	codeQueueFull           = "queue_full"
+	codeInsufficientPoints  = "insufficient_points"
+	codeConflict            = "conflict"
+	codeDuplicateReceipt    = "duplicate_receipt"
+	codeUnauthorized        = "unauthorized"
+	codeForbidden           = "forbidden"
+	codeUnsupportedEncoding = "unsupported_encoding"
+	codeUnsupportedImage    = "unsupported_image"
+	codeOCRFailed           = "ocr_failed"
+	codeInternal            = "internal_error"
+)
+
+// An RFC 7807 problem details body. Title is always the HTTP status text, as
+// for the default "about:blank" type; Code tells the problems apart and Field
+// names the offending field, when there is one. OriginalID is the receipt
+// a duplicate_receipt repeats.
+type Problem struct {
+	Title      string `json:"title"`
+	Status     int    `json:"status"`
+	Code       string `json:"code"`
+	Detail     string `json:"detail"`
+	Field      string `json:"field,omitempty"`
+	OriginalID string `json:"originalId,omitempty"`
+}
+
+func (p *Problem) Error() string {
+	return p.Detail
+}
+
+// newProblem creates a Problem with the title filled in from the status.
+func newProblem(status int, code, detail string) *Problem {
+	return &Problem{Title: http.StatusText(status), Status: status, Code: code, Detail: detail}
+}
+
+// invalidReceipt turns a validation error into a 400 Problem, picking up the
+// field from a *FieldError.
+func invalidReceipt(err error) *Problem {
+	p := newProblem(http.StatusBadRequest, codeInvalidReceipt, "Invalid receipt: "+err.Error())
+	var fe *FieldError
+	if errors.As(err, &fe) {
+		p.Field = fe.Field
+	}
+	return p
+}
+
+// unreadableBody turns an error reading a request body into a Problem: a
+// 413 when the body went over the size limit, otherwise a 400.
+func unreadableBody(err error) *Problem {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		return newProblem(http.StatusRequestEntityTooLarge, codePayloadTooLarge, fmt.Sprintf("Payload too large: at most %d bytes", mbe.Limit))
+	}
+	return newProblem(http.StatusBadRequest, codeInvalidJSON, "Invalid JSON payload")
+}
+
+// storeFailure turns an error from the store into a Problem: a 503 when
+// the request ran out of time waiting on it, otherwise a 500 with detail.
+func storeFailure(err error, detail string) *Problem {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return newProblem(http.StatusServiceUnavailable, codeTimeout, "Request timed out")
+	}
+	return newProblem(http.StatusInternalServerError, codeInternal, detail)
+}
+
+// asProblem returns the *Problem in err's chain. Errors the handlers pass
+// on are all meant to be one, so anything else is logged and answered
+// with a 500 rather than a panic.
+func asProblem(err error) *Problem {
+	var p *Problem
+	if errors.As(err, &p) {
+		return p
+	}
+	slog.Error("Error that is not a Problem", "err", err)
+	return newProblem(http.StatusInternalServerError, codeInternal, "Internal server error")
+}
+
+// writeProblem sends p as application/problem+json.
+func writeProblem(w http.ResponseWriter, p *Problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestAsProblem(t *testing.T) {
+	conflict := newProblem(http.StatusConflict, codeDuplicateReceipt, "Duplicate receipt")
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "problem", err: conflict, wantStatus: http.StatusConflict, wantCode: codeDuplicateReceipt},
+		{name: "wrapped problem", err: fmt.Errorf("saving: %w", conflict), wantStatus: http.StatusConflict, wantCode: codeDuplicateReceipt},
+		{name: "other error", err: errors.New("boom"), wantStatus: http.StatusInternalServerError, wantCode: codeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := asProblem(tt.err)
+			if p.Status != tt.wantStatus || p.Code != tt.wantCode {
+				t.Errorf("asProblem = %d %s, want %d %s", p.Status, p.Code, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
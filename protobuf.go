@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Media type of request and response bodies encoded as the messages in
+// receipts.proto
+const protobufType = "application/x-protobuf"
+
+// Marshals responses the same way every time, so their ETags are stable.
+var protobufMarshal = proto.MarshalOptions{Deterministic: true}
+
+// sentProtobuf reports whether the request body is protobuf, going by its
+// Content-Type.
+func sentProtobuf(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == protobufType
+}
+
+// protobufReceipt turns a ReceiptBody into a JSON receipt the way the gRPC
+// service does it, so the schema and every validation rule apply to it as
+// well.
+func protobufReceipt(body []byte) ([]byte, *Problem) {
+	var pb ReceiptBody
+	if err := proto.Unmarshal(body, &pb); err != nil {
+		return nil, newProblem(http.StatusBadRequest, codeInvalidProtobuf, "Invalid protobuf payload: expected a ReceiptBody")
+	}
+	payload, err := json.Marshal(receiptFromProto(&pb))
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, codeInvalidProtobuf, "Invalid protobuf payload")
+	}
+	return payload, nil
+}
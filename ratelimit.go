@@ -0,0 +1,139 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimiter gives every client its own token bucket.
+type rateLimiter struct {
+	limit        rate.Limit
+	burst        int
+	trustProxy   bool
+	byCredential bool
+
+	mu        sync.Mutex
+	clients   map[string]*clientLimiter
+	lastPrune time.Time
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// newRateLimiter allows each client perSecond requests a second on average,
+// and up to burst at once. Clients are told apart by address, or with
+// byCredential by the API key or token subject the request was
+// authenticated with, so it must run after authentication. With
+// trustProxy the client address is taken from the entry the load balancer
+// adds to X-Forwarded-For, for when the service sits behind one.
+func newRateLimiter(perSecond float64, burst int, trustProxy, byCredential bool) *rateLimiter {
+	return &rateLimiter{
+		limit:        rate.Limit(perSecond),
+		burst:        burst,
+		trustProxy:   trustProxy,
+		byCredential: byCredential,
+		clients:      make(map[string]*clientLimiter),
+		lastPrune:    time.Now(),
+	}
+}
+
+// clientKey names the bucket a request is charged to: its API key or token
+// subject when limiting by credential and there is one, otherwise its
+// address.
+func (rl *rateLimiter) clientKey(r *http.Request) string {
+	if rl.byCredential {
+		if id := apiKeyID(r.Context()); id != "" {
+			return "key:" + id
+		}
+		if sub := tokenSubject(r.Context()); sub != "" {
+			return "sub:" + sub
+		}
+	}
+	if rl.trustProxy {
+		if ip := forwardedFor(r); ip != "" {
+			return "ip:" + ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// forwardedFor returns the client address the proxy in front of the
+// service added to X-Forwarded-For: the last entry, since the ones before
+// it are whatever the client sent. It is "" when there is no valid one.
+func forwardedFor(r *http.Request) string {
+	values := r.Header.Values("X-Forwarded-For")
+	if len(values) == 0 {
+		return ""
+	}
+	fwd := values[len(values)-1]
+	if i := strings.LastIndexByte(fwd, ','); i >= 0 {
+		fwd = fwd[i+1:]
+	}
+	ip := net.ParseIP(strings.TrimSpace(fwd))
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// reserve takes a token from the client's bucket and returns how long the
+// client must wait before the request would be allowed, zero if it is
+// allowed now.
+func (rl *rateLimiter) reserve(key string) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := time.Now()
+
+	// Forget clients that have been quiet long enough to have a full bucket.
+	if now.Sub(rl.lastPrune) > time.Minute {
+		for k, c := range rl.clients {
+			if now.Sub(c.lastSeen) > 10*time.Minute {
+				delete(rl.clients, k)
+			}
+		}
+		rl.lastPrune = now
+	}
+
+	c, ok := rl.clients[key]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[key] = c
+	}
+	c.lastSeen = now
+	res := c.limiter.ReserveN(now, 1)
+	delay := res.DelayFrom(now)
+	if delay > 0 {
+		// Don't charge the client for a request that is turned away.
+		res.CancelAt(now)
+	}
+	return delay
+}
+
+// middleware answers 429 with Retry-After once a client runs out of tokens.
+func (rl *rateLimiter) middleware(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probePaths[r.URL.Path] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if delay := rl.reserve(rl.clientKey(r)); delay > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeProblem(w, newProblem(http.StatusTooManyRequests, codeRateLimited, "Too many requests"))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitBeforeAuth(t *testing.T) {
+	tests := []struct {
+		name          string
+		requireAPIKey bool
+		apiKey        string
+		wantStatus    []int
+	}{
+		{
+			name:       "no authentication",
+			wantStatus: []int{http.StatusNotFound, http.StatusNotFound, http.StatusTooManyRequests},
+		},
+		{
+			name:          "missing API key",
+			requireAPIKey: true,
+			wantStatus:    []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests},
+		},
+		{
+			name:          "guessed API key",
+			requireAPIKey: true,
+			apiKey:        "guess",
+			wantStatus:    []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestAPI(t)
+			defer func(public bool) { pointsCachePublic = public }(pointsCachePublic)
+			r, err := newRouter("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := Config{RequestTimeout: time.Second, RateLimit: 0.001, RateBurst: 2, RequireAPIKey: tt.requireAPIKey}
+			useMiddleware(r, cfg, nil)
+			registerRoutes(r, "", defaultRouteTimeouts)
+
+			for i, want := range tt.wantStatus {
+				req := httptest.NewRequest("GET", "/receipts/missing/points", nil)
+				if tt.apiKey != "" {
+					req.Header.Set("X-API-Key", tt.apiKey)
+				}
+				rec := httptest.NewRecorder()
+				r.ServeHTTP(rec, req)
+				if rec.Code != want {
+					t.Errorf("request %d: status %d, want %d", i, rec.Code, want)
+				}
+			}
+
+			// Another address has its own bucket.
+			req := httptest.NewRequest("GET", "/receipts/missing/points", nil)
+			req.RemoteAddr = "192.0.2.2:1234"
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+			if rec.Code == http.StatusTooManyRequests {
+				t.Error("another address was limited too")
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+// Response for POST /admin/recalculate. Checked receipts were scored
+// again; Changed of them now have different points. Skipped receipts
+// couldn't be scored, usually because they were stored before the full
+// receipt was kept.
+type RecalculateResponse struct {
+	Checked int `json:"checked"`
+	Changed int `json:"changed"`
+	Skipped int `json:"skipped"`
+}
+
+// Receipts read from the store at a time while recalculating
+const recalculatePageSize = 500
+
+// recalculateHandler handles POST /admin/recalculate
+// Every stored receipt of every tenant is scored again with the rules
+// loaded now and updated when its points or breakdown differ, so a change
+// to the rules file can be applied to what is already stored. It may take
+// a while, so it gets timeout instead of REQUEST_TIMEOUT.
+func recalculateHandler(timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), timeout)
+		defer cancel()
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+
+		resp, err := recalculateAll(ctx)
+		requestLogger(r).Info("Recalculated points", "checked", resp.Checked, "changed", resp.Changed, "skipped", resp.Skipped)
+		if err != nil {
+			requestLogger(r).Error("Error recalculating points", "err", err)
+			writeProblem(w, storeFailure(err, "Error recalculating points; the receipts checked so far were updated"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// recalculateAll scores every stored receipt again. When it fails partway
+// through, the counts say how far it got.
+func recalculateAll(ctx context.Context) (RecalculateResponse, error) {
+	var resp RecalculateResponse
+	tenants, err := store.Tenants(ctx)
+	if err != nil {
+		return resp, err
+	}
+	for _, tenant := range tenants {
+		// The tenant's time zone applies to its receipts.
+		ctx := withTenant(ctx, tenant)
+		for after := ""; ; {
+			recs, err := store.List(ctx, tenant, after, recalculatePageSize)
+			if err != nil {
+				return resp, err
+			}
+			for _, rec := range recs {
+				breakdown, err := calculatePoints(ctx, rec.Receipt)
+				if ctx.Err() != nil {
+					return resp, ctx.Err()
+				}
+				if err != nil {
+					resp.Skipped++
+					continue
+				}
+				resp.Checked++
+				if reflect.DeepEqual(breakdown, rec.Breakdown) {
+					continue
+				}
+				rec.Points, rec.Breakdown = breakdown.Total, breakdown
+				old, err := store.Update(ctx, rec)
+				if errors.Is(err, ErrReceiptNotFound) {
+					// Deleted since it was listed.
+					continue
+				}
+				if err != nil {
+					return resp, err
+				}
+				rec.CreatedAt = old.CreatedAt
+				moveLeaderboardPoints(ctx, old, rec)
+				recordScoring(ctx, scoringRecalculated, rec, old.Points)
+				if rec.Points != old.Points {
+					resp.Changed++
+				}
+			}
+			if len(recs) < recalculatePageSize {
+				break
+			}
+			after = recs[len(recs)-1].ID
+		}
+	}
+	return resp, nil
+}
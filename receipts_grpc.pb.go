@@ -0,0 +1,272 @@
+// gRPC interface to the receipt processor. It shares validation, scoring
+// and storage with the HTTP API. Regenerate receipts.pb.go and
+// receipts_grpc.pb.go after changing this file:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//	    --go-grpc_out=. --go-grpc_opt=paths=source_relative receipts.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.25.3
+// source: receipts.proto
+
+package main
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ReceiptService_ProcessReceipt_FullMethodName  = "/receipts.v1.ReceiptService/ProcessReceipt"
+	ReceiptService_ProcessReceipts_FullMethodName = "/receipts.v1.ReceiptService/ProcessReceipts"
+	ReceiptService_GetPoints_FullMethodName       = "/receipts.v1.ReceiptService/GetPoints"
+	ReceiptService_GetReceipt_FullMethodName      = "/receipts.v1.ReceiptService/GetReceipt"
+)
+
+// ReceiptServiceClient is the client API for ReceiptService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ReceiptServiceClient interface {
+	// Scores and stores one receipt.
+	ProcessReceipt(ctx context.Context, in *ProcessReceiptRequest, opts ...grpc.CallOption) (*ProcessReceiptResponse, error)
+	// Scores and stores receipts as they arrive, answering each in order.
+	// A receipt that fails validation gets an error in its response and
+	// does not end the stream.
+	ProcessReceipts(ctx context.Context, opts ...grpc.CallOption) (ReceiptService_ProcessReceiptsClient, error)
+	// Returns the points a stored receipt was awarded.
+	GetPoints(ctx context.Context, in *GetPointsRequest, opts ...grpc.CallOption) (*GetPointsResponse, error)
+	// Returns a stored receipt.
+	GetReceipt(ctx context.Context, in *GetReceiptRequest, opts ...grpc.CallOption) (*GetReceiptResponse, error)
+}
+
+type receiptServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewReceiptServiceClient(cc grpc.ClientConnInterface) ReceiptServiceClient {
+	return &receiptServiceClient{cc}
+}
+
+func (c *receiptServiceClient) ProcessReceipt(ctx context.Context, in *ProcessReceiptRequest, opts ...grpc.CallOption) (*ProcessReceiptResponse, error) {
+	out := new(ProcessReceiptResponse)
+	err := c.cc.Invoke(ctx, ReceiptService_ProcessReceipt_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *receiptServiceClient) ProcessReceipts(ctx context.Context, opts ...grpc.CallOption) (ReceiptService_ProcessReceiptsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ReceiptService_ServiceDesc.Streams[0], ReceiptService_ProcessReceipts_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &receiptServiceProcessReceiptsClient{stream}
+	return x, nil
+}
+
+type ReceiptService_ProcessReceiptsClient interface {
+	Send(*ProcessReceiptRequest) error
+	Recv() (*ProcessReceiptResponse, error)
+	grpc.ClientStream
+}
+
+type receiptServiceProcessReceiptsClient struct {
+	grpc.ClientStream
+}
+
+func (x *receiptServiceProcessReceiptsClient) Send(m *ProcessReceiptRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *receiptServiceProcessReceiptsClient) Recv() (*ProcessReceiptResponse, error) {
+	m := new(ProcessReceiptResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *receiptServiceClient) GetPoints(ctx context.Context, in *GetPointsRequest, opts ...grpc.CallOption) (*GetPointsResponse, error) {
+	out := new(GetPointsResponse)
+	err := c.cc.Invoke(ctx, ReceiptService_GetPoints_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *receiptServiceClient) GetReceipt(ctx context.Context, in *GetReceiptRequest, opts ...grpc.CallOption) (*GetReceiptResponse, error) {
+	out := new(GetReceiptResponse)
+	err := c.cc.Invoke(ctx, ReceiptService_GetReceipt_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ReceiptServiceServer is the server API for ReceiptService service.
+// All implementations must embed UnimplementedReceiptServiceServer
+// for forward compatibility
+type ReceiptServiceServer interface {
+	// Scores and stores one receipt.
+	ProcessReceipt(context.Context, *ProcessReceiptRequest) (*ProcessReceiptResponse, error)
+	// Scores and stores receipts as they arrive, answering each in order.
+	// A receipt that fails validation gets an error in its response and
+	// does not end the stream.
+	ProcessReceipts(ReceiptService_ProcessReceiptsServer) error
+	// Returns the points a stored receipt was awarded.
+	GetPoints(context.Context, *GetPointsRequest) (*GetPointsResponse, error)
+	// Returns a stored receipt.
+	GetReceipt(context.Context, *GetReceiptRequest) (*GetReceiptResponse, error)
+	mustEmbedUnimplementedReceiptServiceServer()
+}
+
+// UnimplementedReceiptServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedReceiptServiceServer struct {
+}
+
+func (UnimplementedReceiptServiceServer) ProcessReceipt(context.Context, *ProcessReceiptRequest) (*ProcessReceiptResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ProcessReceipt not implemented")
+}
+func (UnimplementedReceiptServiceServer) ProcessReceipts(ReceiptService_ProcessReceiptsServer) error {
+	return status.Errorf(codes.Unimplemented, "method ProcessReceipts not implemented")
+}
+func (UnimplementedReceiptServiceServer) GetPoints(context.Context, *GetPointsRequest) (*GetPointsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPoints not implemented")
+}
+func (UnimplementedReceiptServiceServer) GetReceipt(context.Context, *GetReceiptRequest) (*GetReceiptResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetReceipt not implemented")
+}
+func (UnimplementedReceiptServiceServer) mustEmbedUnimplementedReceiptServiceServer() {}
+
+// UnsafeReceiptServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ReceiptServiceServer will
+// result in compilation errors.
+type UnsafeReceiptServiceServer interface {
+	mustEmbedUnimplementedReceiptServiceServer()
+}
+
+func RegisterReceiptServiceServer(s grpc.ServiceRegistrar, srv ReceiptServiceServer) {
+	s.RegisterService(&ReceiptService_ServiceDesc, srv)
+}
+
+func _ReceiptService_ProcessReceipt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ProcessReceiptRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiptServiceServer).ProcessReceipt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ReceiptService_ProcessReceipt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiptServiceServer).ProcessReceipt(ctx, req.(*ProcessReceiptRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ReceiptService_ProcessReceipts_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ReceiptServiceServer).ProcessReceipts(&receiptServiceProcessReceiptsServer{stream})
+}
+
+type ReceiptService_ProcessReceiptsServer interface {
+	Send(*ProcessReceiptResponse) error
+	Recv() (*ProcessReceiptRequest, error)
+	grpc.ServerStream
+}
+
+type receiptServiceProcessReceiptsServer struct {
+	grpc.ServerStream
+}
+
+func (x *receiptServiceProcessReceiptsServer) Send(m *ProcessReceiptResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *receiptServiceProcessReceiptsServer) Recv() (*ProcessReceiptRequest, error) {
+	m := new(ProcessReceiptRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _ReceiptService_GetPoints_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetPointsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiptServiceServer).GetPoints(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ReceiptService_GetPoints_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiptServiceServer).GetPoints(ctx, req.(*GetPointsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ReceiptService_GetReceipt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetReceiptRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ReceiptServiceServer).GetReceipt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ReceiptService_GetReceipt_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ReceiptServiceServer).GetReceipt(ctx, req.(*GetReceiptRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ReceiptService_ServiceDesc is the grpc.ServiceDesc for ReceiptService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ReceiptService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "receipts.v1.ReceiptService",
+	HandlerType: (*ReceiptServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ProcessReceipt",
+			Handler:    _ReceiptService_ProcessReceipt_Handler,
+		},
+		{
+			MethodName: "GetPoints",
+			Handler:    _ReceiptService_GetPoints_Handler,
+		},
+		{
+			MethodName: "GetReceipt",
+			Handler:    _ReceiptService_GetReceipt_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ProcessReceipts",
+			Handler:       _ReceiptService_ProcessReceipts_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "receipts.proto",
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// Returned by a ReceiptStore when a redemption would take more points
+// than the user has.
+var ErrInsufficientPoints = errors.New("insufficient points")
+
+// Returned by a ReceiptStore when no redemption has the requested ID.
+var ErrRedemptionNotFound = errors.New("redemption not found")
+
+// An entry in a user's redemption ledger: points taken off their balance.
+type Redemption struct {
+	ID          string    `json:"id"`
+	Tenant      string    `json:"tenant,omitempty"`
+	UserID      string    `json:"userId"`
+	Points      int       `json:"points"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// Request body for POST /users/{id}/redeem
+type RedeemRequest struct {
+	Points      int    `json:"points"`
+	Description string `json:"description,omitempty"`
+}
+
+// Response for POST /users/{id}/redeem
+type RedeemResponse struct {
+	Redemption Redemption `json:"redemption"`
+	// The user's balance after the redemption
+	Balance int `json:"balance"`
+}
+
+// redeemHandler handles POST /users/{id}/redeem
+// The points are taken off the user's balance, and recorded in their
+// ledger, in one step that fails with 409 when the balance is too low. An
+// Idempotency-Key is required: a retry with the same key gets the first
+// redemption back instead of redeeming twice.
+func redeemHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := pathUserID(w, r)
+	if !ok {
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeProblem(w, unreadableBody(err))
+		return
+	}
+	body, p := requestJSON(r, body)
+	if p != nil {
+		writeProblem(w, p)
+		return
+	}
+	var req RedeemRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeProblem(w, newProblem(http.StatusBadRequest, codeInvalidJSON, "Invalid JSON payload"))
+		return
+	}
+	if req.Points < 1 {
+		p := newProblem(http.StatusBadRequest, codeInvalidParameter, "points must be a positive whole number")
+		p.Field = "points"
+		writeProblem(w, p)
+		return
+	}
+	if utf8.RuneCountInString(req.Description) > 200 {
+		p := newProblem(http.StatusBadRequest, codeInvalidParameter, "description may not be longer than 200 characters")
+		p.Field = "description"
+		writeProblem(w, p)
+		return
+	}
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		p := newProblem(http.StatusBadRequest, codeInvalidParameter, "An Idempotency-Key header is required")
+		p.Field = "Idempotency-Key"
+		writeProblem(w, p)
+		return
+	}
+
+	tenant := tenantFrom(r.Context())
+	red := Redemption{ID: uuid.New().String(), Tenant: tenant, UserID: userID, Points: req.Points, Description: req.Description, CreatedAt: time.Now().UTC()}
+	key = scopedKey(keySpaceRedemption, tenant, strconv.Itoa(len(userID))+":"+userID+":"+key)
+	originalID, err := store.ClaimIdempotencyKey(r.Context(), key, red.ID, idempotencyTTL)
+	if err != nil {
+		requestLogger(r).Error("Error claiming idempotency key", "err", err)
+		writeProblem(w, storeFailure(err, "Error redeeming points"))
+		return
+	}
+	if originalID != red.ID {
+		replayRedemption(w, r, tenant, originalID)
+		return
+	}
+
+	balance, err := store.Redeem(r.Context(), red)
+	if err != nil {
+		// Let a retry with the same key try again.
+		if err := store.ReleaseIdempotencyKey(r.Context(), key); err != nil {
+			requestLogger(r).Error("Error releasing idempotency key", "err", err)
+		}
+		if errors.Is(err, ErrInsufficientPoints) {
+			p := newProblem(http.StatusConflict, codeInsufficientPoints, "Not enough points to redeem")
+			p.Field = "points"
+			writeProblem(w, p)
+			return
+		}
+		requestLogger(r).Error("Error redeeming points", "user_id", userID, "err", err)
+		writeProblem(w, storeFailure(err, "Error redeeming points"))
+		return
+	}
+
+	writeResponseStatus(w, r, http.StatusCreated, RedeemResponse{Redemption: red, Balance: balance}, nil)
+}
+
+// replayRedemption answers a retried redemption with the one made first
+// and the user's balance now.
+func replayRedemption(w http.ResponseWriter, r *http.Request, tenant, id string) {
+	red, err := store.GetRedemption(r.Context(), tenant, id)
+	if errors.Is(err, ErrRedemptionNotFound) {
+		writeProblem(w, newProblem(http.StatusConflict, codeConflict, "A redemption with this Idempotency-Key is still in progress"))
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Error getting redemption", "redemption_id", id, "err", err)
+		writeProblem(w, storeFailure(err, "Error redeeming points"))
+		return
+	}
+	up, err := store.UserPoints(r.Context(), tenant, red.UserID, 0)
+	if err != nil {
+		requestLogger(r).Error("Error adding up user points", "user_id", red.UserID, "err", err)
+		writeProblem(w, storeFailure(err, "Error redeeming points"))
+		return
+	}
+	writeResponseStatus(w, r, http.StatusCreated, RedeemResponse{Redemption: red, Balance: up.balance()}, nil)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedeemIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name       string
+		clientKey  string
+		redeemKeys []string
+		wantStatus []int
+	}{
+		{name: "retried redemption", redeemKeys: []string{"k1", "k1"}, wantStatus: []int{http.StatusCreated, http.StatusCreated}},
+		{name: "second redemption overdraws", redeemKeys: []string{"k1", "k2"}, wantStatus: []int{http.StatusCreated, http.StatusConflict}},
+		{name: "receipt key spelling a redemption key", clientKey: "redeem:bob:k1", redeemKeys: []string{"k1"}, wantStatus: []int{http.StatusCreated}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPI(t)
+			post := func(path, key, body string) *httptest.ResponseRecorder {
+				t.Helper()
+				req := httptest.NewRequest("POST", path, strings.NewReader(body))
+				if key != "" {
+					req.Header.Set("Idempotency-Key", key)
+				}
+				rec := httptest.NewRecorder()
+				api.ServeHTTP(rec, req)
+				return rec
+			}
+
+			// Bob earns 28 points.
+			bobs := strings.Replace(targetReceipt, `"total"`, `"userId": "bob", "total"`, 1)
+			if rec := post("/receipts/process", tt.clientKey, bobs); rec.Code != http.StatusOK {
+				t.Fatalf("process: status %d: %s", rec.Code, rec.Body)
+			}
+			for i, key := range tt.redeemKeys {
+				rec := post("/users/bob/redeem", key, `{"points": 20}`)
+				if rec.Code != tt.wantStatus[i] {
+					t.Errorf("redemption %d: status %d, want %d: %s", i, rec.Code, tt.wantStatus[i], rec.Body)
+				}
+			}
+		})
+	}
+}
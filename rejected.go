@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A submission that failed validation, kept to help debug client integrations
+type RejectedSubmission struct {
+	Tenant     string    `json:"-"`
+	ReceivedAt time.Time `json:"receivedAt"`
+	Error      string    `json:"error"`
+	Payload    string    `json:"payload"`
+	// Set when Payload was cut to REJECTED_MAX_PAYLOAD_BYTES
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Response for GET /rejected
+type RejectedResponse struct {
+	Total    int                  `json:"total"`
+	Rejected []RejectedSubmission `json:"rejected"`
+}
+
+// Rejected submissions are only kept when storeRejected is set, and are
+// dropped once they are older than rejectedRetention. At most
+// rejectedMaxEntries are kept, the oldest going first, and only the first
+// rejectedMaxPayloadBytes of each payload, so invalid bodies can't fill
+// the memory. Set from the Config fields of the same names.
+var (
+	storeRejected           bool
+	rejectedRetention       = 24 * time.Hour
+	rejectedMaxEntries      = 1000
+	rejectedMaxPayloadBytes = 4096
+)
+
+// The storage for rejected submissions in memory, oldest first
+var (
+	rejectedStore []RejectedSubmission
+	rejectedMutex = sync.Mutex{}
+)
+
+// rejectSubmission answers with the problem and records the payload when enabled.
+func rejectSubmission(w http.ResponseWriter, r *http.Request, payload []byte, p *Problem) {
+	recordRejected(r.Context(), payload, p.Detail)
+	writeProblem(w, p)
+}
+
+// recordRejected keeps a rejected payload and the reason under the tenant
+// of ctx, when enabled.
+func recordRejected(ctx context.Context, payload []byte, msg string) {
+	if !storeRejected {
+		return
+	}
+	sub := RejectedSubmission{Tenant: tenantFrom(ctx), ReceivedAt: time.Now(), Error: msg}
+	if len(payload) > rejectedMaxPayloadBytes {
+		payload, sub.Truncated = payload[:rejectedMaxPayloadBytes], true
+	}
+	sub.Payload = string(payload)
+	rejectedMutex.Lock()
+	pruneRejected(sub.ReceivedAt)
+	rejectedStore = append(rejectedStore, sub)
+	if len(rejectedStore) > rejectedMaxEntries {
+		rejectedStore = rejectedStore[len(rejectedStore)-rejectedMaxEntries:]
+	}
+	rejectedMutex.Unlock()
+}
+
+// pruneRejected drops submissions older than the retention period.
+// The caller must hold rejectedMutex.
+func pruneRejected(now time.Time) {
+	cutoff := now.Add(-rejectedRetention)
+	i := 0
+	for i < len(rejectedStore) && rejectedStore[i].ReceivedAt.Before(cutoff) {
+		i++
+	}
+	rejectedStore = rejectedStore[i:]
+}
+
+// getRejectedHandler handles GET /rejected?offset=0&limit=50
+// Only the tenant's own submissions are listed.
+func getRejectedHandler(w http.ResponseWriter, r *http.Request) {
+	offset, err := strconv.Atoi(r.URL.Query().Get("offset"))
+	if err != nil || offset < 0 {
+		offset = 0
+	}
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = 50
+	}
+
+	tenant := tenantFrom(r.Context())
+	rejectedMutex.Lock()
+	pruneRejected(time.Now())
+	total := 0
+	page := []RejectedSubmission{}
+	for _, sub := range rejectedStore {
+		if sub.Tenant != tenant {
+			continue
+		}
+		if total >= offset && len(page) < limit {
+			page = append(page, sub)
+		}
+		total++
+	}
+	rejectedMutex.Unlock()
+
+	writeResponse(w, r, RejectedResponse{Total: total, Rejected: page}, nil)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRejectedSubmissions(t *testing.T) {
+	tests := []struct {
+		name           string
+		tenant         string
+		payloads       []string
+		maxEntries     int
+		maxPayload     int
+		wantTotal      int
+		wantTruncated  bool
+		wantFirstError string
+	}{
+		{
+			name:           "invalid receipt listed",
+			payloads:       []string{`{"retailer":"M"}`},
+			maxEntries:     10,
+			maxPayload:     4096,
+			wantTotal:      1,
+			wantFirstError: "purchaseDate",
+		},
+		{
+			name:       "valid receipt not listed",
+			payloads:   []string{targetReceipt},
+			maxEntries: 10,
+			maxPayload: 4096,
+		},
+		{
+			name:       "other tenant's rejections not listed",
+			tenant:     "other",
+			payloads:   []string{`{"retailer":"M"}`},
+			maxEntries: 10,
+			maxPayload: 4096,
+		},
+		{
+			name:       "oldest dropped beyond the cap",
+			payloads:   []string{`{"retailer":"A"}`, `{"retailer":"B"}`, `{"retailer":"C"}`},
+			maxEntries: 2,
+			maxPayload: 4096,
+			wantTotal:  2,
+		},
+		{
+			name:          "payload truncated",
+			payloads:      []string{`{"retailer":"` + strings.Repeat("M", 100) + `"}`},
+			maxEntries:    10,
+			maxPayload:    16,
+			wantTotal:     1,
+			wantTruncated: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(enabled bool, entries, payload int) {
+				storeRejected, rejectedMaxEntries, rejectedMaxPayloadBytes = enabled, entries, payload
+				rejectedStore = nil
+			}(storeRejected, rejectedMaxEntries, rejectedMaxPayloadBytes)
+			storeRejected, rejectedMaxEntries, rejectedMaxPayloadBytes = true, tt.maxEntries, tt.maxPayload
+			rejectedStore = nil
+			api := newTestAPI(t)
+
+			for _, payload := range tt.payloads {
+				req := httptest.NewRequest("POST", "/receipts/process", strings.NewReader(payload))
+				if tt.tenant != "" {
+					req.Header.Set("X-Tenant-ID", tt.tenant)
+				}
+				api.ServeHTTP(httptest.NewRecorder(), req)
+			}
+
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, httptest.NewRequest("GET", "/rejected", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			var resp RejectedResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.Total != tt.wantTotal || len(resp.Rejected) != tt.wantTotal {
+				t.Fatalf("total %d with %d listed, want %d", resp.Total, len(resp.Rejected), tt.wantTotal)
+			}
+			if tt.wantTotal == 0 {
+				return
+			}
+			first := resp.Rejected[0]
+			if !strings.Contains(first.Error, tt.wantFirstError) {
+				t.Errorf("error = %q, want it to mention %q", first.Error, tt.wantFirstError)
+			}
+			if first.Truncated != tt.wantTruncated || (tt.wantTruncated && len(first.Payload) != tt.maxPayload) {
+				t.Errorf("truncated %v with %d bytes, want %v", first.Truncated, len(first.Payload), tt.wantTruncated)
+			}
+			if tt.maxEntries < len(tt.payloads) && !strings.Contains(first.Payload, `"B"`) {
+				t.Errorf("oldest kept is %s, want the second submission", first.Payload)
+			}
+		})
+	}
+}
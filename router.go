@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// routeMux is the routing library underneath a router. It sends requests
+// for a method and path template, such as /receipts/{id}, to h along with
+// the values of the template's variables by name, and answers requests
+// that match no route with 404, or 405 when only the method is wrong.
+type routeMux interface {
+	http.Handler
+	handle(method, template string, h func(w http.ResponseWriter, r *http.Request, params map[string]string))
+}
+
+// The routing libraries built in, by the name ROUTER selects them with.
+// gorilla/mux is left out of builds with the stdmux tag, and the standard
+// library's ServeMux needs Go 1.22.
+var routeMuxes = map[string]func() routeMux{}
+
+// defaultRouteMux names the routing library used when ROUTER is empty:
+// gorilla when it is built in, otherwise stdmux.
+func defaultRouteMux() string {
+	if routeMuxes["gorilla"] != nil {
+		return "gorilla"
+	}
+	return "stdmux"
+}
+
+// builtinRouteMuxes lists the names of the routing libraries built in.
+func builtinRouteMuxes() string {
+	var names []string
+	for name := range routeMuxes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// A registered route: its method and path template
+type route struct {
+	Method   string
+	Template string
+}
+
+// router dispatches requests to the API's handlers on top of one of the
+// routeMuxes, so the handlers don't depend on a routing library. Like
+// gorilla/mux, it runs middleware only for requests that match a route,
+// after the route is known.
+type router struct {
+	mux         routeMux
+	middlewares []func(http.Handler) http.Handler
+	routes      []route
+}
+
+// The route a request matched and its path variables, kept in the request
+// context
+type routeMatch struct {
+	template string
+	params   map[string]string
+}
+
+type routeMatchKey struct{}
+
+// newRouter returns an empty router on the routing library with the given
+// name, or the default one when it is empty.
+func newRouter(name string) (*router, error) {
+	if name == "" {
+		name = defaultRouteMux()
+	}
+	newMux := routeMuxes[name]
+	if newMux == nil {
+		return nil, fmt.Errorf("router %q is not built in; built in: %s", name, builtinRouteMuxes())
+	}
+	return &router{mux: newMux()}, nil
+}
+
+// Use adds middleware run, in the order added, for every request that
+// matches a route, whether the route was added before or after.
+func (rt *router) Use(mw ...func(http.Handler) http.Handler) {
+	rt.middlewares = append(rt.middlewares, mw...)
+}
+
+// Handle sends requests with method for the path template to h. A template
+// variable such as {id} matches one path segment; its value is read with
+// pathParam.
+func (rt *router) Handle(method, template string, h http.Handler) {
+	rt.routes = append(rt.routes, route{Method: method, Template: template})
+	rt.mux.handle(method, template, func(w http.ResponseWriter, r *http.Request, params map[string]string) {
+		r = r.WithContext(context.WithValue(r.Context(), routeMatchKey{}, routeMatch{template: template, params: params}))
+		next := h
+		for i := len(rt.middlewares) - 1; i >= 0; i-- {
+			next = rt.middlewares[i](next)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleFunc is Handle for a handler function.
+func (rt *router) HandleFunc(method, template string, h http.HandlerFunc) {
+	rt.Handle(method, template, h)
+}
+
+// Routes returns every route in the order they were added.
+func (rt *router) Routes() []route {
+	return rt.routes
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.mux.ServeHTTP(w, r)
+}
+
+// pathParam returns the value of a variable in the path template of the
+// route the request matched, such as the receipt ID of /receipts/{id}.
+func pathParam(r *http.Request, name string) string {
+	m, _ := r.Context().Value(routeMatchKey{}).(routeMatch)
+	return m.params[name]
+}
+
+// routeTemplate returns the path template of the route the request
+// matched, or "" before it is matched.
+func routeTemplate(r *http.Request) string {
+	m, _ := r.Context().Value(routeMatchKey{}).(routeMatch)
+	return m.template
+}
@@ -0,0 +1,25 @@
+//go:build !stdmux
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// gorillaMux routes with gorilla/mux. Builds with the stdmux tag leave it,
+// and the dependency, out.
+type gorillaMux struct {
+	*mux.Router
+}
+
+func init() {
+	routeMuxes["gorilla"] = func() routeMux { return gorillaMux{mux.NewRouter()} }
+}
+
+func (m gorillaMux) handle(method, template string, h func(w http.ResponseWriter, r *http.Request, params map[string]string)) {
+	m.HandleFunc(template, func(w http.ResponseWriter, r *http.Request) {
+		h(w, r, mux.Vars(r))
+	}).Methods(method)
+}
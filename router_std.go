@@ -0,0 +1,34 @@
+//go:build go1.22
+
+// The module's go version predates the method and wildcard patterns
+// stdMux relies on, so turn them on.
+//go:debug httpmuxgo121=0
+
+package main
+
+import "net/http"
+
+// stdMux routes with the standard library's ServeMux, which matches
+// methods and {name} wildcards since Go 1.22. Unlike gorilla/mux, a GET
+// route also answers HEAD.
+type stdMux struct {
+	*http.ServeMux
+}
+
+func init() {
+	routeMuxes["stdmux"] = func() routeMux { return stdMux{http.NewServeMux()} }
+}
+
+func (m stdMux) handle(method, template string, h func(w http.ResponseWriter, r *http.Request, params map[string]string)) {
+	var names []string
+	for _, match := range pathParamPattern.FindAllStringSubmatch(template, -1) {
+		names = append(names, match[1])
+	}
+	m.HandleFunc(method+" "+template, func(w http.ResponseWriter, r *http.Request) {
+		params := make(map[string]string, len(names))
+		for _, name := range names {
+			params[name] = r.PathValue(name)
+		}
+		h(w, r, params)
+	})
+}
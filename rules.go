@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"sigs.k8s.io/yaml"
+)
+
+// RuleSet holds every value the scoring rules can be tuned with. It starts
+// from the built-in defaults, is overlaid by RULES_FILE (JSON or YAML) and
+// then by Config.RuleOverrides, so RULE_* env vars > file > defaults.
+type RuleSet struct {
+	// Name of this version of the rules, recorded with every receipt it scores.
+	Version string `json:"version"`
+	// The rule set scores receipts purchased from EffectiveFrom up to but not
+	// including EffectiveTo, both YYYY-MM-DD. Either may be left empty for
+	// an open-ended range.
+	EffectiveFrom string `json:"effectiveFrom,omitempty"`
+	EffectiveTo   string `json:"effectiveTo,omitempty"`
+
+	// Points per alphanumeric character in the retailer name. With
+	// RetailerCharMode "ascii" only A-Z, a-z and 0-9 count; with "unicode"
+	// every letter and digit does.
+	RetailerCharPoints int    `json:"retailerCharPoints"`
+	RetailerCharMode   string `json:"retailerCharMode"`
+	// Points when the total is a round dollar amount.
+	RoundDollarPoints int `json:"roundDollarPoints"`
+	// Points when the total is a multiple of 0.25.
+	QuarterMultiplePoints int `json:"quarterMultiplePoints"`
+	// Points for every two items on the receipt.
+	ItemPairPoints int `json:"itemPairPoints"`
+
+	// An item whose trimmed description length is a multiple of
+	// DescriptionLengthMultiple earns its price times
+	// DescriptionPriceMultiplier, rounded up, unless it costs less than
+	// MinItemPriceForDescriptionPoints.
+	DescriptionLengthMultiple        int     `json:"descriptionLengthMultiple"`
+	DescriptionPriceMultiplier       float64 `json:"descriptionPriceMultiplier"`
+	MinItemPriceForDescriptionPoints float64 `json:"minItemPriceForDescriptionPoints"`
+
+	// Points for items whose description matches a regular expression.
+	DescriptionPatterns []PatternPoints `json:"descriptionPatterns"`
+	// Points for every run of two or more consecutive items with the same
+	// price. Zero turns the rule off.
+	SamePriceRunPoints int `json:"samePriceRunPoints"`
+
+	// Points when the day of the purchase date is odd.
+	OddDayPoints int `json:"oddDayPoints"`
+	// Points when the purchase time falls strictly inside AfternoonWindow.
+	AfternoonPoints int        `json:"afternoonPoints"`
+	AfternoonWindow TimeWindow `json:"afternoonWindow"`
+	// Extra points keyed by the hour of purchase (0-23).
+	HourPoints map[int]int `json:"hourPoints"`
+
+	// The final total is rounded to a multiple of RoundFinalPointsTo using
+	// RoundFinalPointsMode, which is "nearest", "up" or "down".
+	RoundFinalPointsTo   int    `json:"roundFinalPointsTo"`
+	RoundFinalPointsMode string `json:"roundFinalPointsMode"`
+
+	// What one unit of each currency is worth in USD, such as
+	// {"EUR": 1.08}. Receipts in other currencies are converted at this
+	// rate before scoring; those in a currency without a rate aren't
+	// scored.
+	CurrencyRates map[string]float64 `json:"currencyRates"`
+
+	// Filled in by compile. The description rule's multiplier is kept in
+	// millionths and its minimum price in cents, so scoring needs no
+	// floating point.
+	effectiveFrom           time.Time
+	effectiveTo             time.Time
+	patterns                []*regexp.Regexp
+	afternoonStart          time.Time
+	afternoonEnd            time.Time
+	descriptionMultiplier   int64
+	minDescriptionItemPrice int64
+	chain                   []Rule
+}
+
+// A points bonus for items whose description matches Pattern
+type PatternPoints struct {
+	Pattern string `json:"pattern"`
+	Points  int    `json:"points"`
+}
+
+// A time of day range such as {"start": "14:00", "end": "16:00"}
+type TimeWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// Longest description pattern accepted, to keep matching cheap.
+const maxDescriptionPatternLength = 256
+
+// The range of currencyRates, wide enough for any currency in
+// currencyDecimals while keeping converted amounts far from overflowing.
+const (
+	minCurrencyRate = 0.000001
+	maxCurrencyRate = 1_000_000
+)
+
+// descriptionPriceMultiplier is kept to six decimal places.
+const multiplierScale = 1_000_000
+
+// The rule set versions calculatePoints chooses from, ordered by
+// EffectiveFrom. main replaces them with the configured ones.
+var ruleVersions = []*RuleSet{defaultRules()}
+
+// defaultRules returns the standard receipt scoring rules.
+func defaultRules() *RuleSet {
+	rs := &RuleSet{
+		Version:                    "default",
+		RetailerCharPoints:         1,
+		RetailerCharMode:           "ascii",
+		RoundDollarPoints:          50,
+		QuarterMultiplePoints:      25,
+		ItemPairPoints:             5,
+		DescriptionLengthMultiple:  3,
+		DescriptionPriceMultiplier: 0.2,
+		OddDayPoints:               6,
+		AfternoonPoints:            10,
+		AfternoonWindow:            TimeWindow{Start: "14:00", End: "16:00"},
+		HourPoints:                 map[int]int{},
+		RoundFinalPointsTo:         1,
+		RoundFinalPointsMode:       "nearest",
+		CurrencyRates:              map[string]float64{},
+	}
+	if err := rs.compile(); err != nil {
+		panic(err)
+	}
+	return rs
+}
+
+// loadRules builds the rule set versions from the defaults, the rules file
+// at path (skipped when empty) and the overrides, by rule name. The file
+// holds either a single rule set or {"versions": [...]}, where each version
+// is a rule set with its own effective dates. Versions may not overlap.
+// Exchange rates change over time, so a CURRENCY_RATES override only
+// replaces those of the version in force today; older versions keep the
+// rates they scored with.
+func loadRules(path string, overrides map[string]string) ([]*RuleSet, error) {
+	var overlays []json.RawMessage
+	if path != "" {
+		var err error
+		if overlays, err = readRulesFile(path); err != nil {
+			return nil, err
+		}
+	} else {
+		overlays = []json.RawMessage{nil}
+	}
+
+	rates, overrideRates := overrides["CURRENCY_RATES"]
+	if overrideRates {
+		rest := make(map[string]string, len(overrides))
+		for name, v := range overrides {
+			if name != "CURRENCY_RATES" {
+				rest[name] = v
+			}
+		}
+		overrides = rest
+	}
+
+	var versions []*RuleSet
+	for i, overlay := range overlays {
+		rs := defaultRules()
+		if overlay != nil {
+			dec := json.NewDecoder(bytes.NewReader(overlay))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(rs); err != nil {
+				return nil, fmt.Errorf("parsing rules file %s: version %d: %w", path, i, err)
+			}
+		}
+		if err := rs.applyOverrides(overrides); err != nil {
+			return nil, err
+		}
+		if err := rs.compile(); err != nil {
+			return nil, fmt.Errorf("rules version %q: %w", rs.Version, err)
+		}
+		versions = append(versions, rs)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].effectiveFrom.Before(versions[j].effectiveFrom)
+	})
+	for i := 1; i < len(versions); i++ {
+		prev, next := versions[i-1], versions[i]
+		if prev.effectiveTo.IsZero() || prev.effectiveTo.After(next.effectiveFrom) {
+			return nil, fmt.Errorf("rules versions %q and %q overlap", prev.Version, next.Version)
+		}
+	}
+
+	if overrideRates {
+		current := ruleVersionAt(versions, time.Now())
+		if current == nil {
+			return nil, fmt.Errorf("no rules version in force today to apply CURRENCY_RATES to")
+		}
+		if err := current.applyOverrides(map[string]string{"CURRENCY_RATES": rates}); err != nil {
+			return nil, err
+		}
+		if err := current.compile(); err != nil {
+			return nil, fmt.Errorf("rules version %q: %w", current.Version, err)
+		}
+	}
+	return versions, nil
+}
+
+// readRulesFile returns the JSON for each rule set version in a JSON or
+// YAML rules file.
+func readRulesFile(path string) ([]json.RawMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading rules file: %w", err)
+	}
+	if ext := filepath.Ext(path); ext == ".yaml" || ext == ".yml" {
+		if data, err = yaml.YAMLToJSON(data); err != nil {
+			return nil, fmt.Errorf("parsing rules file %s: %w", path, err)
+		}
+	}
+
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(data, &top); err != nil {
+		return nil, fmt.Errorf("parsing rules file %s: %w", path, err)
+	}
+	raw, versioned := top["versions"]
+	if !versioned {
+		return []json.RawMessage{data}, nil
+	}
+	if len(top) > 1 {
+		return nil, fmt.Errorf("parsing rules file %s: only \"versions\" is allowed beside a list of versions", path)
+	}
+	var versions []json.RawMessage
+	if err := json.Unmarshal(raw, &versions); err != nil {
+		return nil, fmt.Errorf("parsing rules file %s: %w", path, err)
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("parsing rules file %s: no versions", path)
+	}
+	return versions, nil
+}
+
+// rulesFor returns the rule set version in force on a purchase date.
+func rulesFor(purchaseDate time.Time) (*RuleSet, error) {
+	if rs := ruleVersionAt(ruleVersions, purchaseDate); rs != nil {
+		return rs, nil
+	}
+	return nil, fmt.Errorf("no rules in force on %s", purchaseDate.Format("2006-01-02"))
+}
+
+// ruleVersionAt returns the version in force at t, or nil if there is none.
+func ruleVersionAt(versions []*RuleSet, t time.Time) *RuleSet {
+	for _, rs := range versions {
+		if t.Before(rs.effectiveFrom) {
+			continue
+		}
+		if !rs.effectiveTo.IsZero() && !t.Before(rs.effectiveTo) {
+			continue
+		}
+		return rs
+	}
+	return nil
+}
+
+// The rule values that can be set without a rules file, by name. Each is
+// read from RULE_<name> or given as -rule <name>=value.
+var ruleOverrideNames = []string{
+	"RETAILER_CHAR_POINTS",
+	"RETAILER_CHAR_MODE",
+	"ROUND_DOLLAR_POINTS",
+	"QUARTER_MULTIPLE_POINTS",
+	"ITEM_PAIR_POINTS",
+	"DESCRIPTION_PRICE_MULTIPLIER",
+	"MIN_ITEM_PRICE_FOR_DESCRIPTION_POINTS",
+	"DESCRIPTION_PATTERN_POINTS",
+	"SAME_PRICE_RUN_POINTS",
+	"ODD_DAY_POINTS",
+	"AFTERNOON_POINTS",
+	"HOUR_POINTS",
+	"ROUND_FINAL_POINTS_TO",
+	"ROUND_FINAL_POINTS_MODE",
+	"CURRENCY_RATES",
+}
+
+// Rule values that were first read from an environment variable without
+// the RULE_ prefix. The old names still work when the RULE_ one isn't set.
+var deprecatedRuleEnv = []string{
+	"SAME_PRICE_RUN_POINTS",
+	"ROUND_FINAL_POINTS_TO",
+	"ROUND_FINAL_POINTS_MODE",
+	"MIN_ITEM_PRICE_FOR_DESCRIPTION_POINTS",
+	"HOUR_POINTS",
+	"CURRENCY_RATES",
+	"DESCRIPTION_PATTERN_POINTS",
+}
+
+// ruleOverridesFromEnv returns the rule values set in the environment by
+// name, and the deprecated variables they were read from.
+func ruleOverridesFromEnv() (overrides map[string]string, deprecated []string) {
+	overrides = map[string]string{}
+	for _, name := range ruleOverrideNames {
+		if v := os.Getenv("RULE_" + name); v != "" {
+			overrides[name] = v
+		}
+	}
+	for _, name := range deprecatedRuleEnv {
+		if v := os.Getenv(name); v != "" {
+			deprecated = append(deprecated, name)
+			if _, ok := overrides[name]; !ok {
+				overrides[name] = v
+			}
+		}
+	}
+	return overrides, deprecated
+}
+
+// applyOverrides overlays rule values by name, as ruleOverridesFromEnv
+// returns them.
+func (rs *RuleSet) applyOverrides(overrides map[string]string) error {
+	ints := map[string]*int{
+		"RETAILER_CHAR_POINTS":    &rs.RetailerCharPoints,
+		"ROUND_DOLLAR_POINTS":     &rs.RoundDollarPoints,
+		"QUARTER_MULTIPLE_POINTS": &rs.QuarterMultiplePoints,
+		"ITEM_PAIR_POINTS":        &rs.ItemPairPoints,
+		"ODD_DAY_POINTS":          &rs.OddDayPoints,
+		"AFTERNOON_POINTS":        &rs.AfternoonPoints,
+		"SAME_PRICE_RUN_POINTS":   &rs.SamePriceRunPoints,
+		"ROUND_FINAL_POINTS_TO":   &rs.RoundFinalPointsTo,
+	}
+	floats := map[string]*float64{
+		"DESCRIPTION_PRICE_MULTIPLIER":          &rs.DescriptionPriceMultiplier,
+		"MIN_ITEM_PRICE_FOR_DESCRIPTION_POINTS": &rs.MinItemPriceForDescriptionPoints,
+	}
+	strs := map[string]*string{
+		"RETAILER_CHAR_MODE":      &rs.RetailerCharMode,
+		"ROUND_FINAL_POINTS_MODE": &rs.RoundFinalPointsMode,
+	}
+
+	for name, v := range overrides {
+		switch {
+		case ints[name] != nil:
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("invalid rule %s %q", name, v)
+			}
+			*ints[name] = n
+		case floats[name] != nil:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return fmt.Errorf("invalid rule %s %q", name, v)
+			}
+			*floats[name] = f
+		case strs[name] != nil:
+			*strs[name] = v
+
+		// HOUR_POINTS looks like "9:2,17:5", meaning 2 points for a purchase
+		// made between 09:00 and 09:59 and 5 points between 17:00 and 17:59.
+		case name == "HOUR_POINTS":
+			hourPoints := map[int]int{}
+			for _, entry := range strings.Split(v, ",") {
+				hourStr, pointsStr, ok := strings.Cut(strings.TrimSpace(entry), ":")
+				hour, hourErr := strconv.Atoi(hourStr)
+				points, pointsErr := strconv.Atoi(pointsStr)
+				if !ok || hourErr != nil || pointsErr != nil {
+					return fmt.Errorf("invalid rule HOUR_POINTS entry %q", entry)
+				}
+				hourPoints[hour] = points
+			}
+			rs.HourPoints = hourPoints
+
+		// CURRENCY_RATES looks like "EUR:1.08,GBP:1.27", replacing the rates
+		// from the rules file.
+		case name == "CURRENCY_RATES":
+			rates := map[string]float64{}
+			for _, entry := range strings.Split(v, ",") {
+				currency, rateStr, ok := strings.Cut(strings.TrimSpace(entry), ":")
+				rate, err := strconv.ParseFloat(rateStr, 64)
+				if !ok || err != nil {
+					return fmt.Errorf("invalid rule CURRENCY_RATES entry %q", entry)
+				}
+				rates[currency] = rate
+			}
+			rs.CurrencyRates = rates
+
+		// DESCRIPTION_PATTERN_POINTS looks like [{"pattern":"(?i)^organic","points":3}]
+		case name == "DESCRIPTION_PATTERN_POINTS":
+			var patterns []PatternPoints
+			if err := json.Unmarshal([]byte(v), &patterns); err != nil {
+				return fmt.Errorf("invalid rule DESCRIPTION_PATTERN_POINTS: %v", err)
+			}
+			rs.DescriptionPatterns = patterns
+
+		default:
+			return fmt.Errorf("unknown rule %s", name)
+		}
+	}
+	return nil
+}
+
+// compile checks the rule set and prepares its patterns and time window.
+func (rs *RuleSet) compile() error {
+	if rs.DescriptionLengthMultiple < 1 {
+		return fmt.Errorf("invalid descriptionLengthMultiple %d: must be at least 1", rs.DescriptionLengthMultiple)
+	}
+	if !(rs.DescriptionPriceMultiplier >= 0 && rs.DescriptionPriceMultiplier <= 1000) {
+		return fmt.Errorf("invalid descriptionPriceMultiplier %v: must be 0 to 1000", rs.DescriptionPriceMultiplier)
+	}
+	if !(rs.MinItemPriceForDescriptionPoints >= 0 && rs.MinItemPriceForDescriptionPoints <= 1e9) {
+		return fmt.Errorf("invalid minItemPriceForDescriptionPoints %v: must be 0 to 1000000000", rs.MinItemPriceForDescriptionPoints)
+	}
+	rs.descriptionMultiplier = int64(math.Round(rs.DescriptionPriceMultiplier * multiplierScale))
+	rs.minDescriptionItemPrice = int64(math.Round(rs.MinItemPriceForDescriptionPoints * 100))
+	if rs.RoundFinalPointsTo < 1 {
+		return fmt.Errorf("invalid roundFinalPointsTo %d: must be at least 1", rs.RoundFinalPointsTo)
+	}
+	switch rs.RoundFinalPointsMode {
+	case "nearest", "up", "down":
+	default:
+		return fmt.Errorf("invalid roundFinalPointsMode %q: must be nearest, up or down", rs.RoundFinalPointsMode)
+	}
+	if rs.RetailerCharMode != "ascii" && rs.RetailerCharMode != "unicode" {
+		return fmt.Errorf("invalid retailerCharMode %q: must be ascii or unicode", rs.RetailerCharMode)
+	}
+	for hour := range rs.HourPoints {
+		if hour < 0 || hour > 23 {
+			return fmt.Errorf("invalid hourPoints hour %d: must be 0 to 23", hour)
+		}
+	}
+	for currency, rate := range rs.CurrencyRates {
+		if _, ok := currencyDecimals[currency]; !ok || currency == baseCurrency {
+			return fmt.Errorf("invalid currencyRates currency %q: must be a supported currency other than %s", currency, baseCurrency)
+		}
+		if !(rate >= minCurrencyRate && rate <= maxCurrencyRate) {
+			return fmt.Errorf("invalid currencyRates rate %v for %s: must be %v to %v", rate, currency, minCurrencyRate, maxCurrencyRate)
+		}
+	}
+
+	var err error
+	if rs.Version == "" {
+		return fmt.Errorf("version is required")
+	}
+	if rs.EffectiveFrom != "" {
+		if rs.effectiveFrom, err = time.Parse(dateLayout, rs.EffectiveFrom); err != nil {
+			return fmt.Errorf("invalid effectiveFrom %q", rs.EffectiveFrom)
+		}
+	}
+	if rs.EffectiveTo != "" {
+		if rs.effectiveTo, err = time.Parse(dateLayout, rs.EffectiveTo); err != nil {
+			return fmt.Errorf("invalid effectiveTo %q", rs.EffectiveTo)
+		}
+		if !rs.effectiveTo.After(rs.effectiveFrom) {
+			return fmt.Errorf("effectiveTo %s must be after effectiveFrom", rs.EffectiveTo)
+		}
+	}
+	if rs.afternoonStart, err = time.Parse(clockLayout, rs.AfternoonWindow.Start); err != nil {
+		return fmt.Errorf("invalid afternoonWindow start %q", rs.AfternoonWindow.Start)
+	}
+	if rs.afternoonEnd, err = time.Parse(clockLayout, rs.AfternoonWindow.End); err != nil {
+		return fmt.Errorf("invalid afternoonWindow end %q", rs.AfternoonWindow.End)
+	}
+
+	rs.patterns = nil
+	for _, p := range rs.DescriptionPatterns {
+		if p.Pattern == "" || len(p.Pattern) > maxDescriptionPatternLength {
+			return fmt.Errorf("invalid description pattern %q: must be 1 to %d characters", p.Pattern, maxDescriptionPatternLength)
+		}
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return fmt.Errorf("invalid description pattern %q: %v", p.Pattern, err)
+		}
+		rs.patterns = append(rs.patterns, re)
+	}
+
+	rs.chain = rs.buildChain()
+	return nil
+}
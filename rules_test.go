@@ -0,0 +1,147 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRuleOverridesFromEnv(t *testing.T) {
+	tests := []struct {
+		name           string
+		env            map[string]string
+		wantOverrides  map[string]string
+		wantDeprecated []string
+	}{
+		{
+			name:          "none",
+			wantOverrides: map[string]string{},
+		},
+		{
+			name:          "prefixed",
+			env:           map[string]string{"RULE_ROUND_DOLLAR_POINTS": "40", "RULE_HOUR_POINTS": "9:2"},
+			wantOverrides: map[string]string{"ROUND_DOLLAR_POINTS": "40", "HOUR_POINTS": "9:2"},
+		},
+		{
+			name:           "deprecated name",
+			env:            map[string]string{"SAME_PRICE_RUN_POINTS": "3"},
+			wantOverrides:  map[string]string{"SAME_PRICE_RUN_POINTS": "3"},
+			wantDeprecated: []string{"SAME_PRICE_RUN_POINTS"},
+		},
+		{
+			name:           "prefixed name wins",
+			env:            map[string]string{"RULE_ROUND_FINAL_POINTS_TO": "5", "ROUND_FINAL_POINTS_TO": "10"},
+			wantOverrides:  map[string]string{"ROUND_FINAL_POINTS_TO": "5"},
+			wantDeprecated: []string{"ROUND_FINAL_POINTS_TO"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range ruleOverrideNames {
+				t.Setenv("RULE_"+name, "")
+			}
+			for _, name := range deprecatedRuleEnv {
+				t.Setenv(name, "")
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			overrides, deprecated := ruleOverridesFromEnv()
+			if !reflect.DeepEqual(overrides, tt.wantOverrides) {
+				t.Errorf("overrides = %v, want %v", overrides, tt.wantOverrides)
+			}
+			if !reflect.DeepEqual(deprecated, tt.wantDeprecated) {
+				t.Errorf("deprecated = %v, want %v", deprecated, tt.wantDeprecated)
+			}
+		})
+	}
+}
+
+func TestLoadRulesOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	if err := os.WriteFile(path, []byte("version: v1\nroundDollarPoints: 30\nitemPairPoints: 7\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		overrides map[string]string
+		check     func(rs *RuleSet) bool
+		wantErr   bool
+	}{
+		{
+			name:  "defaults",
+			check: func(rs *RuleSet) bool { return rs.RoundDollarPoints == 50 && rs.ItemPairPoints == 5 },
+		},
+		{
+			name:  "file over defaults",
+			path:  path,
+			check: func(rs *RuleSet) bool { return rs.RoundDollarPoints == 30 && rs.ItemPairPoints == 7 },
+		},
+		{
+			name:      "override over file",
+			path:      path,
+			overrides: map[string]string{"ROUND_DOLLAR_POINTS": "40"},
+			check:     func(rs *RuleSet) bool { return rs.RoundDollarPoints == 40 && rs.ItemPairPoints == 7 },
+		},
+		{
+			name:      "float",
+			overrides: map[string]string{"MIN_ITEM_PRICE_FOR_DESCRIPTION_POINTS": "2.50"},
+			check:     func(rs *RuleSet) bool { return rs.minDescriptionItemPrice == 250 },
+		},
+		{
+			name:      "mode",
+			overrides: map[string]string{"ROUND_FINAL_POINTS_MODE": "up", "ROUND_FINAL_POINTS_TO": "5"},
+			check:     func(rs *RuleSet) bool { return rs.RoundFinalPointsMode == "up" && rs.RoundFinalPointsTo == 5 },
+		},
+		{
+			name:      "hour points",
+			overrides: map[string]string{"HOUR_POINTS": "9:2, 17:5"},
+			check:     func(rs *RuleSet) bool { return reflect.DeepEqual(rs.HourPoints, map[int]int{9: 2, 17: 5}) },
+		},
+		{
+			name:      "description patterns",
+			overrides: map[string]string{"DESCRIPTION_PATTERN_POINTS": `[{"pattern":"(?i)^organic","points":3}]`},
+			check:     func(rs *RuleSet) bool { return len(rs.patterns) == 1 },
+		},
+		{
+			name:      "not a number",
+			overrides: map[string]string{"ITEM_PAIR_POINTS": "five"},
+			wantErr:   true,
+		},
+		{
+			name:      "unknown rule",
+			overrides: map[string]string{"ROUND_DOLLAR_POINT": "40"},
+			wantErr:   true,
+		},
+		{
+			name:      "bad hour entry",
+			overrides: map[string]string{"HOUR_POINTS": "9=2"},
+			wantErr:   true,
+		},
+		{
+			name:      "fails compile",
+			overrides: map[string]string{"ROUND_FINAL_POINTS_TO": "0"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			versions, err := loadRules(tt.path, tt.overrides)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("loadRules succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadRules: %v", err)
+			}
+			if len(versions) != 1 || !tt.check(versions[0]) {
+				t.Errorf("unexpected rules %+v", versions[0])
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// The JSON Schema receipts are checked against when SCHEMA_FILE is set.
+// Left nil, receipts are only checked by the built-in rules.
+var receiptSchema *jsonschema.Schema
+
+// loadReceiptSchema compiles the JSON Schema (draft 2020-12) at path.
+func loadReceiptSchema(path string) error {
+	c := jsonschema.NewCompiler()
+	c.Draft = jsonschema.Draft2020
+	schema, err := c.Compile(path)
+	if err != nil {
+		return fmt.Errorf("loading schema %s: %w", path, err)
+	}
+	receiptSchema = schema
+	return nil
+}
+
+// validateAgainstSchema checks the raw payload against receiptSchema and
+// lists every violation with the location of the offending value.
+func validateAgainstSchema(payload []byte) error {
+	// The validator wants numbers decoded as json.Number.
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	err := receiptSchema.Validate(doc)
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+
+	var violations []string
+	for _, e := range ve.BasicOutput().Errors {
+		// The top-level entries only say that a subschema failed.
+		if e.Error == "" || strings.HasPrefix(e.Error, "doesn't validate with") {
+			continue
+		}
+		location := e.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		violations = append(violations, location+": "+e.Error)
+	}
+	if len(violations) == 0 {
+		return err
+	}
+	return errors.New(strings.Join(violations, "; "))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A schema that only accepts receipts naming the store they came from
+const storeIDSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "type": "object",
+  "required": ["retailer", "storeId"],
+  "properties": {
+    "storeId": {"type": "string", "pattern": "^[0-9]+$"}
+  }
+}`
+
+func TestReceiptSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "receipt.schema.json")
+	if err := os.WriteFile(path, []byte(storeIDSchema), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { receiptSchema = nil }()
+	if err := loadReceiptSchema(path); err != nil {
+		t.Fatal(err)
+	}
+
+	withStoreID := func(storeID string) string {
+		return strings.Replace(targetReceipt, `"retailer": "Target",`, `"retailer": "Target", "storeId": `+storeID+`,`, 1)
+	}
+	tests := []struct {
+		name       string
+		payload    string
+		wantStatus int
+		wantDetail string
+	}{
+		{name: "has the extra field", payload: withStoreID(`"1234"`), wantStatus: http.StatusOK},
+		{name: "missing the extra field", payload: targetReceipt, wantStatus: http.StatusBadRequest, wantDetail: "storeId"},
+		{name: "extra field of the wrong type", payload: withStoreID(`1234`), wantStatus: http.StatusBadRequest, wantDetail: "/storeId"},
+		{name: "extra field not matching", payload: withStoreID(`"A1"`), wantStatus: http.StatusBadRequest, wantDetail: "/storeId"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			api := newTestAPI(t)
+			rec := httptest.NewRecorder()
+			api.ServeHTTP(rec, httptest.NewRequest("POST", "/receipts/process", strings.NewReader(tt.payload)))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantDetail) {
+				t.Errorf("body %s does not mention %q", rec.Body, tt.wantDetail)
+			}
+		})
+	}
+}
+
+func TestLoadReceiptSchemaInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bad.schema.json")
+	if err := os.WriteFile(path, []byte(`{"type": 5}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { receiptSchema = nil }()
+	if err := loadReceiptSchema(path); err == nil {
+		t.Error("loadReceiptSchema succeeded, want an error")
+	}
+}
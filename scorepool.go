@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Scores receipts for batches, imports and queued jobs. Set up in main.
+var scoring *scoringPool
+
+var (
+	scoringWorkers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "receipts_scoring_workers",
+		Help: "Workers scoring receipts for batches and queued jobs.",
+	})
+	scoringWaiting = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "receipts_scoring_waiting",
+		Help: "Receipts waiting for a scoring worker.",
+	})
+	receiptsScored = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipts_scored_total",
+		Help: "Receipts scored by the scoring workers, by worker.",
+	}, []string{"worker"})
+	scoringBusy = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "receipts_scoring_busy_seconds_total",
+		Help: "Time spent scoring receipts, by worker.",
+	}, []string{"worker"})
+)
+
+// The outcome of scoring one payload, as scorePayload returns it
+type scoreResult struct {
+	receipt   Receipt
+	breakdown PointsBreakdown
+	err       error
+}
+
+// A payload waiting for a worker, and where its result goes
+type scoreTask struct {
+	ctx     context.Context
+	payload []byte
+	result  *scoreResult
+	done    *sync.WaitGroup
+}
+
+// scoringPool scores receipts on a fixed number of workers, so a batch of
+// thousands is scored in parallel without starting a goroutine for each
+// receipt, and batches arriving together share the workers rather than
+// each taking more. The workers run for the life of the process.
+type scoringPool struct {
+	tasks chan scoreTask
+}
+
+// newScoringPool starts workers scoring receipts.
+func newScoringPool(workers int) *scoringPool {
+	p := &scoringPool{tasks: make(chan scoreTask)}
+	for i := 0; i < workers; i++ {
+		go p.work(strconv.Itoa(i))
+	}
+	scoringWorkers.Set(float64(workers))
+	return p
+}
+
+// scoreAll scores each payload with scorePayload on the pool's workers and
+// returns the results in the same order. Payloads still waiting for a
+// worker once ctx is done fail with a timeout.
+func (p *scoringPool) scoreAll(ctx context.Context, payloads []json.RawMessage) []scoreResult {
+	results := make([]scoreResult, len(payloads))
+	var done sync.WaitGroup
+	scoringWaiting.Add(float64(len(payloads)))
+	for i, payload := range payloads {
+		done.Add(1)
+		select {
+		case p.tasks <- scoreTask{ctx: ctx, payload: payload, result: &results[i], done: &done}:
+		case <-ctx.Done():
+			results[i].err = newProblem(http.StatusServiceUnavailable, codeTimeout, "Request timed out")
+			done.Done()
+		}
+		scoringWaiting.Dec()
+	}
+	done.Wait()
+	return results
+}
+
+// score scores one payload on the pool's workers.
+func (p *scoringPool) score(ctx context.Context, payload []byte) (Receipt, PointsBreakdown, error) {
+	res := p.scoreAll(ctx, []json.RawMessage{payload})[0]
+	return res.receipt, res.breakdown, res.err
+}
+
+func (p *scoringPool) work(worker string) {
+	scored := receiptsScored.WithLabelValues(worker)
+	busy := scoringBusy.WithLabelValues(worker)
+	for t := range p.tasks {
+		start := time.Now()
+		t.result.receipt, t.result.breakdown, t.result.err = scorePayload(t.ctx, t.payload)
+		busy.Add(time.Since(start).Seconds())
+		scored.Inc()
+		t.done.Done()
+	}
+}
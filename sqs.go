@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+)
+
+// sqsWorker polls an SQS queue for receipts and scores and stores them.
+// A message is deleted once it is handled. One that isn't a valid receipt
+// is moved to the dead-letter queue, if there is one, with the reason in
+// its attributes. One that fails for another reason, such as the store
+// being down, is left for SQS to deliver again after its visibility
+// timeout; ingestMessage makes sure that doesn't store it twice.
+type sqsWorker struct {
+	client   *sqs.Client
+	queueURL string
+	dlqURL   string
+	timeout  time.Duration
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// startSQSWorker starts cfg.SQSWorkers pollers on cfg.SQSQueueURL. AWS
+// credentials and region come from the usual AWS environment variables,
+// shared config files or instance role. Each message gets timeout to be
+// processed.
+func startSQSWorker(cfg Config, timeout time.Duration) (*sqsWorker, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("sqs: %w", err)
+	}
+
+	w := &sqsWorker{
+		client:   sqs.NewFromConfig(awsCfg),
+		queueURL: cfg.SQSQueueURL,
+		dlqURL:   cfg.SQSDeadLetterQueueURL,
+		timeout:  timeout,
+	}
+	ctx, w.cancel = context.WithCancel(context.Background())
+	for i := 0; i < cfg.SQSWorkers; i++ {
+		w.wg.Add(1)
+		go w.poll(ctx)
+	}
+	slog.Info("Polling SQS for receipts", "queue", cfg.SQSQueueURL, "workers", cfg.SQSWorkers)
+	return w, nil
+}
+
+// stop stops polling and waits, until ctx is done, for the messages being
+// handled.
+func (w *sqsWorker) stop(ctx context.Context) {
+	w.cancel()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (w *sqsWorker) poll(ctx context.Context) {
+	defer w.wg.Done()
+	for {
+		var out *sqs.ReceiveMessageOutput
+		if !retry(ctx, "Receiving from SQS", func() (err error) {
+			out, err = w.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+				QueueUrl:              aws.String(w.queueURL),
+				MaxNumberOfMessages:   10,
+				WaitTimeSeconds:       20,
+				MessageAttributeNames: []string{"tenant"},
+			})
+			return err
+		}) {
+			return
+		}
+		for _, msg := range out.Messages {
+			// Finish the batch even when stopping; what isn't deleted
+			// would only be delivered again.
+			w.handle(context.WithoutCancel(ctx), msg)
+		}
+	}
+}
+
+// handle processes one message and deletes it, unless it should be
+// delivered again.
+func (w *sqsWorker) handle(ctx context.Context, msg types.Message) {
+	var tenant string
+	if attr, ok := msg.MessageAttributes["tenant"]; ok {
+		tenant = aws.ToString(attr.StringValue)
+	}
+	messageID := aws.ToString(msg.MessageId)
+	logger := slog.With("queue", w.queueURL, "message_id", messageID)
+
+	mctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+	event, err := ingestMessage(mctx, tenant, "sqs:"+messageID, []byte(aws.ToString(msg.Body)))
+	if err != nil {
+		logger.Warn("Error processing SQS message, leaving it to be delivered again", "err", err)
+		return
+	}
+	if event.Error != "" {
+		logger.Info("Rejected receipt from SQS", "code", event.Code, "err", event.Error)
+		if w.dlqURL != "" && !w.deadLetter(mctx, msg, event) {
+			return
+		}
+	}
+	if _, err := w.client.DeleteMessage(mctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(w.queueURL),
+		ReceiptHandle: msg.ReceiptHandle,
+	}); err != nil {
+		logger.Error("Error deleting SQS message", "err", err)
+	}
+}
+
+// deadLetter copies a rejected message to the dead-letter queue with the
+// error, code and field of its event as attributes. It reports whether
+// the copy was sent, so the original may be deleted.
+func (w *sqsWorker) deadLetter(ctx context.Context, msg types.Message, event PointsEvent) bool {
+	attrs := map[string]types.MessageAttributeValue{}
+	for name, value := range map[string]string{
+		"tenant":    event.Tenant,
+		"error":     event.Error,
+		"code":      event.Code,
+		"field":     event.Field,
+		"messageId": aws.ToString(msg.MessageId),
+	} {
+		if value != "" {
+			attrs[name] = types.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(value)}
+		}
+	}
+	if _, err := w.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:          aws.String(w.dlqURL),
+		MessageBody:       msg.Body,
+		MessageAttributes: attrs,
+	}); err != nil {
+		slog.Error("Error sending SQS message to the dead-letter queue", "message_id", aws.ToString(msg.MessageId), "err", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Response for GET /stats. Receipts are counted by the day, in UTC, they
+// were stored on.
+type StatsResponse struct {
+	From      string       `json:"from"`
+	To        string       `json:"to"`
+	Total     StatsGroup   `json:"total"`
+	Days      []StatsGroup `json:"days"`
+	Retailers []StatsGroup `json:"retailers"`
+}
+
+// Figures for a set of receipts: all of them, those of one day or those
+// of one retailer.
+type StatsGroup struct {
+	Day           string        `json:"day,omitempty"`
+	Retailer      string        `json:"retailer,omitempty"`
+	Receipts      int           `json:"receipts"`
+	Points        int           `json:"points"`
+	AveragePoints float64       `json:"averagePoints"`
+	Buckets       []StatsBucket `json:"buckets"`
+}
+
+// How many receipts got at most UpTo points and more than the bucket
+// before; the last bucket has no UpTo and holds the rest.
+type StatsBucket struct {
+	UpTo     *int `json:"upTo,omitempty"`
+	Receipts int  `json:"receipts"`
+}
+
+// Receipts read from the store at a time while adding up statistics
+const statsPageSize = 500
+
+// Longest date range GET /stats covers
+const maxStatsDays = 366
+
+// newStatsGroup returns an empty group with a bucket for each of
+// pointsBuckets and one for the rest.
+func newStatsGroup() *StatsGroup {
+	g := &StatsGroup{Buckets: make([]StatsBucket, len(pointsBuckets)+1)}
+	for i, bound := range pointsBuckets {
+		upTo := int(bound)
+		g.Buckets[i].UpTo = &upTo
+	}
+	return g
+}
+
+// add counts a receipt in the group.
+func (g *StatsGroup) add(points int) {
+	g.Receipts++
+	g.Points += points
+	g.AveragePoints = float64(g.Points) / float64(g.Receipts)
+	i := sort.SearchFloat64s(pointsBuckets, float64(points))
+	g.Buckets[i].Receipts++
+}
+
+// statsHandler handles GET /stats
+// It goes through every receipt of the tenant, so it gets slower as the
+// store grows. from and to (YYYY-MM-DD) pick the days, the last 30 up to
+// today by default.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	to, ok := statsDate(w, r, "to", today)
+	if !ok {
+		return
+	}
+	from, ok := statsDate(w, r, "from", to.AddDate(0, 0, -29))
+	if !ok {
+		return
+	}
+	if from.After(to) || to.Sub(from) >= maxStatsDays*24*time.Hour {
+		p := newProblem(http.StatusBadRequest, codeInvalidParameter, "from must be on or before to, and at most 366 days before it")
+		p.Field = "from"
+		writeProblem(w, p)
+		return
+	}
+	end := to.AddDate(0, 0, 1)
+
+	total := newStatsGroup()
+	days := make(map[string]*StatsGroup)
+	retailers := make(map[string]*StatsGroup)
+	tenant := tenantFrom(r.Context())
+	for after := ""; ; {
+		recs, err := store.List(r.Context(), tenant, after, statsPageSize)
+		if err != nil {
+			requestLogger(r).Error("Error listing receipts", "err", err)
+			writeProblem(w, storeFailure(err, "Error adding up statistics"))
+			return
+		}
+		for _, rec := range recs {
+			if rec.CreatedAt.Before(from) || !rec.CreatedAt.Before(end) {
+				continue
+			}
+			total.add(rec.Points)
+			day := rec.CreatedAt.UTC().Format("2006-01-02")
+			if days[day] == nil {
+				days[day] = newStatsGroup()
+				days[day].Day = day
+			}
+			days[day].add(rec.Points)
+			retailer := rec.Receipt.Retailer
+			if retailers[retailer] == nil {
+				retailers[retailer] = newStatsGroup()
+				retailers[retailer].Retailer = retailer
+			}
+			retailers[retailer].add(rec.Points)
+		}
+		if len(recs) < statsPageSize {
+			break
+		}
+		after = recs[len(recs)-1].ID
+	}
+
+	resp := StatsResponse{From: from.Format("2006-01-02"), To: to.Format("2006-01-02"), Total: *total, Days: []StatsGroup{}, Retailers: []StatsGroup{}}
+	for _, g := range days {
+		resp.Days = append(resp.Days, *g)
+	}
+	sort.Slice(resp.Days, func(i, j int) bool { return resp.Days[i].Day < resp.Days[j].Day })
+	for _, g := range retailers {
+		resp.Retailers = append(resp.Retailers, *g)
+	}
+	// Busiest retailers first
+	sort.Slice(resp.Retailers, func(i, j int) bool {
+		a, b := resp.Retailers[i], resp.Retailers[j]
+		if a.Receipts != b.Receipts {
+			return a.Receipts > b.Receipts
+		}
+		return a.Retailer < b.Retailer
+	})
+
+	writeResponse(w, r, resp, nil)
+}
+
+// statsDate reads a date query parameter, returning def when it is
+// missing. When it is malformed it has already answered the request and ok
+// is false.
+func statsDate(w http.ResponseWriter, r *http.Request, name string, def time.Time) (t time.Time, ok bool) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return def, true
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err != nil {
+		p := newProblem(http.StatusBadRequest, codeInvalidParameter, name+" must be a date such as 2022-01-31")
+		p.Field = name
+		writeProblem(w, p)
+		return time.Time{}, false
+	}
+	return t, true
+}
@@ -0,0 +1,738 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Returned by a ReceiptStore when no receipt has the requested ID.
+var ErrReceiptNotFound = errors.New("receipt not found")
+
+// A processed receipt as kept in the store. Receipts belong to a tenant,
+// which is "" when the service isn't shared.
+type StoredReceipt struct {
+	ID        string          `json:"id"`
+	Tenant    string          `json:"tenant,omitempty"`
+	Receipt   Receipt         `json:"receipt"`
+	Points    int             `json:"points"`
+	Breakdown PointsBreakdown `json:"breakdown"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// expired reports whether a receipt is past a retention period ending at
+// cutoff: when it was stored before cutoff or, with byPurchaseDate, when
+// it was purchased on an earlier day. Receipts without a purchase date
+// fall back to when they were stored.
+func (rec StoredReceipt) expired(cutoff time.Time, byPurchaseDate bool) bool {
+	if byPurchaseDate && rec.Receipt.PurchaseDate != "" {
+		return rec.Receipt.PurchaseDate < cutoff.UTC().Format("2006-01-02")
+	}
+	return rec.CreatedAt.Before(cutoff)
+}
+
+// Narrows down the receipts a search returns. Empty fields match every
+// receipt.
+type ReceiptFilter struct {
+	// Part of the retailer's name, matched ignoring case
+	Retailer string
+	// First and last purchase dates, as YYYY-MM-DD
+	PurchasedFrom, PurchasedTo string
+	MinPoints, MaxPoints       *int
+}
+
+// matches reports whether a receipt passes the filter.
+func (f ReceiptFilter) matches(rec StoredReceipt) bool {
+	return (f.Retailer == "" || strings.Contains(strings.ToLower(rec.Receipt.Retailer), strings.ToLower(f.Retailer))) &&
+		(f.PurchasedFrom == "" || rec.Receipt.PurchaseDate >= f.PurchasedFrom) &&
+		(f.PurchasedTo == "" || rec.Receipt.PurchaseDate <= f.PurchasedTo) &&
+		(f.MinPoints == nil || rec.Points >= *f.MinPoints) &&
+		(f.MaxPoints == nil || rec.Points <= *f.MaxPoints)
+}
+
+// ReceiptStore is where processed receipts and their points are kept.
+// Lookups are scoped to a tenant: a receipt of another tenant is reported
+// as ErrReceiptNotFound, exactly like a receipt that doesn't exist.
+type ReceiptStore interface {
+	// Save stores a receipt under its ID and tenant, replacing any earlier
+	// one, and adds its points to its user's earned points. Points earned
+	// by a receipt it replaces stay earned; Update changes a stored receipt.
+	Save(ctx context.Context, rec StoredReceipt) error
+	// Update replaces the receipt and points of an existing receipt of
+	// rec.Tenant, keeping its CreatedAt, and returns the receipt it
+	// replaced, or returns ErrReceiptNotFound. Reading the old receipt and
+	// writing the new one is one step, so callers adjusting anything by the
+	// difference see what was actually replaced. The user's earned points
+	// change by the difference, or when the user changed, the old user loses
+	// the old points and the new one gains the new.
+	Update(ctx context.Context, rec StoredReceipt) (StoredReceipt, error)
+	// Get returns the tenant's receipt with the given ID, or ErrReceiptNotFound.
+	Get(ctx context.Context, tenant, id string) (StoredReceipt, error)
+	// GetPoints returns the points for a tenant's receipt, or ErrReceiptNotFound.
+	GetPoints(ctx context.Context, tenant, id string) (int, error)
+	// Delete removes a tenant's receipt, or returns ErrReceiptNotFound.
+	Delete(ctx context.Context, tenant, id string) error
+	// List returns up to limit of the tenant's receipts ordered by ID,
+	// starting after the ID given (or from the beginning when it is empty).
+	List(ctx context.Context, tenant, after string, limit int) ([]StoredReceipt, error)
+	// Search is List limited to the receipts that match f.
+	Search(ctx context.Context, tenant string, f ReceiptFilter, after string, limit int) ([]StoredReceipt, error)
+	// Count returns how many receipts are stored, across all tenants.
+	Count(ctx context.Context) (int, error)
+	// Tenants returns every tenant with a receipt stored, sorted.
+	Tenants(ctx context.Context) ([]string, error)
+	// UserPoints returns the points the tenant's user with the given
+	// Receipt.UserID earned and redeemed, how many of their receipts are
+	// stored, and the recent most recent receipts and redemptions. A user
+	// without receipts has a zero balance, not an error.
+	UserPoints(ctx context.Context, tenant, userID string, recent int) (UserPoints, error)
+	// Redeem records a redemption and returns the user's balance after it,
+	// or returns ErrInsufficientPoints when the balance is less than its
+	// points. Checking and recording happen as one step, so concurrent
+	// redemptions can't overdraw the balance.
+	Redeem(ctx context.Context, red Redemption) (int, error)
+	// GetRedemption returns the tenant's redemption with the given ID, or
+	// ErrRedemptionNotFound.
+	GetRedemption(ctx context.Context, tenant, id string) (Redemption, error)
+	// AddLeaderboardPoints adds points, which may be negative, to the user's
+	// total in each period. A user whose total comes down to zero or less
+	// is taken off the period's leaderboard.
+	AddLeaderboardPoints(ctx context.Context, tenant, userID string, periods []LeaderboardPeriod, points int) error
+	// Leaderboard returns up to limit of the tenant's users with the highest
+	// totals in the period, highest first. Totals of periods that have
+	// ended may be dropped.
+	Leaderboard(ctx context.Context, tenant string, period LeaderboardPeriod, limit int) ([]LeaderboardEntry, error)
+	// DeleteExpired removes the receipts of every tenant that expired at
+	// cutoff (see StoredReceipt.expired) and returns them. On an error the
+	// receipts removed until then are returned with it.
+	DeleteExpired(ctx context.Context, cutoff time.Time, byPurchaseDate bool) ([]StoredReceipt, error)
+
+	// ClaimIdempotencyKey links an Idempotency-Key to a receipt ID for ttl
+	// and returns that ID. If the key is already linked the earlier ID is
+	// returned instead and nothing changes.
+	ClaimIdempotencyKey(ctx context.Context, key, id string, ttl time.Duration) (string, error)
+	// ReleaseIdempotencyKey removes the link for a key, if there is one.
+	ReleaseIdempotencyKey(ctx context.Context, key string) error
+
+	// CreateAPIKey stores a new API key.
+	CreateAPIKey(ctx context.Context, key APIKey) error
+	// GetAPIKeyByHash returns the key with the given hash, revoked or not,
+	// or ErrAPIKeyNotFound.
+	GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error)
+	// ListAPIKeys returns every key, oldest first.
+	ListAPIKeys(ctx context.Context) ([]APIKey, error)
+	// RevokeAPIKey marks a key as revoked at the time given, or returns
+	// ErrAPIKeyNotFound.
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) error
+
+	// CreateWebhook stores a new webhook, secret included.
+	CreateWebhook(ctx context.Context, hook Webhook) error
+	// ListWebhooks returns every webhook, oldest first.
+	ListWebhooks(ctx context.Context) ([]Webhook, error)
+	// DeleteWebhook removes a webhook, or returns ErrWebhookNotFound.
+	DeleteWebhook(ctx context.Context, id string) error
+
+	// SaveJob stores a job, replacing any earlier state of it, and keeps
+	// it for ttl.
+	SaveJob(ctx context.Context, job Job, ttl time.Duration) error
+	// GetJob returns the tenant's job with the given ID, or ErrJobNotFound.
+	GetJob(ctx context.Context, tenant, id string) (Job, error)
+
+	// SaveFlags stores the fraud flags of a receipt, replacing any earlier
+	// ones. They are removed along with the receipt.
+	SaveFlags(ctx context.Context, flags ReceiptFlags) error
+	// GetFlags returns the flags of the tenant's receipt, or a zero
+	// ReceiptFlags when it has none.
+	GetFlags(ctx context.Context, tenant, id string) (ReceiptFlags, error)
+	// ReviewQueue returns up to limit of the tenant's flags not yet
+	// reviewed, in order of receipt ID, starting after the ID given.
+	ReviewQueue(ctx context.Context, tenant, after string, limit int) ([]ReceiptFlags, error)
+
+	// AppendHistory adds an event to the scoring history of the tenant's
+	// receipt. The history is kept for audits when the receipt is deleted
+	// or expires; only the memory backend drops it, when it evicts the
+	// receipt.
+	AppendHistory(ctx context.Context, tenant, id string, ev ScoringEvent) error
+	// History returns the scoring events of the tenant's receipt, oldest
+	// first.
+	History(ctx context.Context, tenant, id string) ([]ScoringEvent, error)
+
+	// Close flushes anything not yet written and releases the store's
+	// connections. The store must not be used afterwards.
+	Close() error
+}
+
+// BatchSaver is implemented by stores that can save many receipts at once
+// more cheaply than one at a time.
+type BatchSaver interface {
+	SaveBatch(ctx context.Context, recs []StoredReceipt) error
+}
+
+// newReceiptStore creates the store named by cfg.StorageBackend.
+func newReceiptStore(cfg Config) (ReceiptStore, error) {
+	switch cfg.StorageBackend {
+	case "", "memory":
+		return newMemoryStore(cfg.MemoryMaxReceipts), nil
+	case "postgres":
+		return newPostgresStore(cfg.PostgresDSN)
+	case "sqlite":
+		return newSQLiteStore(cfg.SQLitePath)
+	case "redis":
+		return newRedisStore(cfg.RedisURL, cfg.RedisTTL)
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.StorageBackend)
+	}
+}
+
+// Receipts the memory store dropped to stay within MEMORY_MAX_RECEIPTS
+var receiptsEvicted = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "receipts_evicted_total",
+	Help: "Receipts evicted from the memory store to make room for new ones.",
+})
+
+// memoryStore keeps receipts in a map, so they are lost on restart. When
+// maxReceipts is set, saving a receipt beyond it evicts the one least
+// recently saved or read.
+type memoryStore struct {
+	mu       sync.RWMutex
+	receipts map[string]StoredReceipt
+	ids      map[string][]string // by tenant, sorted, for paging through List
+
+	maxReceipts int
+	lru         *list.List                // receipt IDs, most recently used first
+	lruElems    map[string]*list.Element  // by receipt ID
+	redemptions []Redemption              // oldest first
+	flags       map[string]ReceiptFlags   // by receipt ID
+	history     map[string][]ScoringEvent // by tenant and receipt ID
+	earned      map[string]int            // by tenant and user ID
+
+	keysMu      sync.Mutex
+	keys        map[string]idempotencyEntry
+	keysPruneAt int // size of keys at which expired ones are next dropped
+
+	apiKeysMu sync.Mutex
+	apiKeys   map[string]APIKey // by hash
+
+	webhooksMu sync.Mutex
+	webhooks   map[string]Webhook // by ID
+
+	jobsMu sync.Mutex
+	jobs   map[string]jobEntry // by ID
+
+	leaderboardMu sync.Mutex
+	leaderboard   map[string]*leaderboardTotals // by tenant and period key
+}
+
+// The users' totals in one leaderboard period, dropped once it ends
+type leaderboardTotals struct {
+	end    time.Time
+	points map[string]int // by user ID
+}
+
+// A job and when it expires
+type jobEntry struct {
+	job     Job
+	expires time.Time
+}
+
+// The receipt ID an Idempotency-Key is linked to, and until when
+type idempotencyEntry struct {
+	id      string
+	expires time.Time
+}
+
+// newMemoryStore returns an empty store holding up to maxReceipts
+// receipts, or any number when it is 0.
+func newMemoryStore(maxReceipts int) *memoryStore {
+	s := &memoryStore{
+		receipts: make(map[string]StoredReceipt),
+		ids:      make(map[string][]string),
+		flags:    make(map[string]ReceiptFlags),
+		history:  make(map[string][]ScoringEvent),
+		earned:   make(map[string]int),
+		keys:     make(map[string]idempotencyEntry),
+		apiKeys:  make(map[string]APIKey),
+		webhooks: make(map[string]Webhook),
+		jobs:     make(map[string]jobEntry),
+
+		leaderboard: make(map[string]*leaderboardTotals),
+	}
+	if maxReceipts > 0 {
+		s.maxReceipts = maxReceipts
+		s.lru = list.New()
+		s.lruElems = make(map[string]*list.Element)
+	}
+	return s
+}
+
+func (s *memoryStore) Save(ctx context.Context, rec StoredReceipt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, exists := s.receipts[rec.ID]; exists {
+		s.removeID(old.Tenant, old.ID)
+	}
+	ids := s.ids[rec.Tenant]
+	i := sort.SearchStrings(ids, rec.ID)
+	ids = append(ids, "")
+	copy(ids[i+1:], ids[i:])
+	ids[i] = rec.ID
+	s.ids[rec.Tenant] = ids
+	s.receipts[rec.ID] = rec
+	s.earn(rec.Tenant, rec.Receipt.UserID, rec.Points)
+	s.touch(rec.ID)
+	for s.lru != nil && len(s.receipts) > s.maxReceipts {
+		oldest := s.receipts[s.lru.Back().Value.(string)]
+		s.remove(oldest.ID)
+		// Unlike a deleted or expired receipt's, an evicted receipt's
+		// history goes too, or it would outgrow maxReceipts.
+		delete(s.history, oldest.Tenant+"\x00"+oldest.ID)
+		receiptsEvicted.Inc()
+	}
+	return nil
+}
+
+// touch marks a receipt as the most recently used. The caller must hold
+// mu for writing.
+func (s *memoryStore) touch(id string) {
+	if s.lru == nil {
+		return
+	}
+	if e, exists := s.lruElems[id]; exists {
+		s.lru.MoveToFront(e)
+		return
+	}
+	s.lruElems[id] = s.lru.PushFront(id)
+}
+
+// remove deletes a receipt. The caller must hold mu for writing.
+func (s *memoryStore) remove(id string) {
+	rec, exists := s.receipts[id]
+	if !exists {
+		return
+	}
+	delete(s.receipts, id)
+	delete(s.flags, id)
+	s.removeID(rec.Tenant, id)
+	if s.lru != nil {
+		s.lru.Remove(s.lruElems[id])
+		delete(s.lruElems, id)
+	}
+}
+
+// removeID takes an ID out of its tenant's sorted list. The caller must
+// hold mu.
+func (s *memoryStore) removeID(tenant, id string) {
+	ids := s.ids[tenant]
+	i := sort.SearchStrings(ids, id)
+	if i < len(ids) && ids[i] == id {
+		s.ids[tenant] = append(ids[:i], ids[i+1:]...)
+	}
+}
+
+func (s *memoryStore) Update(ctx context.Context, rec StoredReceipt) (StoredReceipt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, exists := s.receipts[rec.ID]
+	if !exists || old.Tenant != rec.Tenant {
+		return StoredReceipt{}, ErrReceiptNotFound
+	}
+	rec.CreatedAt = old.CreatedAt
+	s.receipts[rec.ID] = rec
+	s.earn(old.Tenant, old.Receipt.UserID, -old.Points)
+	s.earn(rec.Tenant, rec.Receipt.UserID, rec.Points)
+	s.touch(rec.ID)
+	return old, nil
+}
+
+// earn adds points to what a user earned. The caller must hold mu for
+// writing.
+func (s *memoryStore) earn(tenant, userID string, points int) {
+	if userID != "" {
+		s.earned[tenant+"\x00"+userID] += points
+	}
+}
+
+func (s *memoryStore) Get(ctx context.Context, tenant, id string) (StoredReceipt, error) {
+	// Reads reorder the LRU list, so a bounded store needs the write lock.
+	if s.lru != nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+	} else {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+	}
+	rec, exists := s.receipts[id]
+	if !exists || rec.Tenant != tenant {
+		return StoredReceipt{}, ErrReceiptNotFound
+	}
+	s.touch(id)
+	return rec, nil
+}
+
+func (s *memoryStore) GetPoints(ctx context.Context, tenant, id string) (int, error) {
+	rec, err := s.Get(ctx, tenant, id)
+	return rec.Points, err
+}
+
+func (s *memoryStore) Delete(ctx context.Context, tenant, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, exists := s.receipts[id]; !exists || rec.Tenant != tenant {
+		return ErrReceiptNotFound
+	}
+	s.remove(id)
+	return nil
+}
+
+func (s *memoryStore) List(ctx context.Context, tenant, after string, limit int) ([]StoredReceipt, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := s.ids[tenant]
+	start := 0
+	if after != "" {
+		start = sort.Search(len(ids), func(i int) bool { return ids[i] > after })
+	}
+	end := start + limit
+	if end > len(ids) {
+		end = len(ids)
+	}
+	recs := make([]StoredReceipt, 0, end-start)
+	for _, id := range ids[start:end] {
+		recs = append(recs, s.receipts[id])
+	}
+	return recs, nil
+}
+
+func (s *memoryStore) Search(ctx context.Context, tenant string, f ReceiptFilter, after string, limit int) ([]StoredReceipt, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := s.ids[tenant]
+	start := sort.Search(len(ids), func(i int) bool { return ids[i] > after })
+	var recs []StoredReceipt
+	for _, id := range ids[start:] {
+		if len(recs) == limit {
+			break
+		}
+		if rec := s.receipts[id]; f.matches(rec) {
+			recs = append(recs, rec)
+		}
+	}
+	return recs, nil
+}
+
+func (s *memoryStore) Count(ctx context.Context) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.receipts), nil
+}
+
+func (s *memoryStore) Tenants(ctx context.Context) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var tenants []string
+	for tenant, ids := range s.ids {
+		if len(ids) > 0 {
+			tenants = append(tenants, tenant)
+		}
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
+
+// UserPoints goes through every receipt of the tenant to find the user's.
+func (s *memoryStore) UserPoints(ctx context.Context, tenant, userID string, recent int) (UserPoints, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	up := s.userPoints(tenant, userID)
+	up.keepRecent(recent)
+	return up, nil
+}
+
+// userPoints adds up a user's points. The caller must hold mu.
+func (s *memoryStore) userPoints(tenant, userID string) UserPoints {
+	up := UserPoints{Earned: s.earned[tenant+"\x00"+userID]}
+	for _, id := range s.ids[tenant] {
+		if rec := s.receipts[id]; rec.Receipt.UserID == userID {
+			up.add(rec)
+		}
+	}
+	for _, red := range s.redemptions {
+		if red.Tenant == tenant && red.UserID == userID {
+			up.addRedemption(red)
+		}
+	}
+	return up
+}
+
+func (s *memoryStore) Redeem(ctx context.Context, red Redemption) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	balance := s.userPoints(red.Tenant, red.UserID).balance()
+	if balance < red.Points {
+		return 0, ErrInsufficientPoints
+	}
+	s.redemptions = append(s.redemptions, red)
+	return balance - red.Points, nil
+}
+
+func (s *memoryStore) GetRedemption(ctx context.Context, tenant, id string) (Redemption, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, red := range s.redemptions {
+		if red.ID == id && red.Tenant == tenant {
+			return red, nil
+		}
+	}
+	return Redemption{}, ErrRedemptionNotFound
+}
+
+func (s *memoryStore) AddLeaderboardPoints(ctx context.Context, tenant, userID string, periods []LeaderboardPeriod, points int) error {
+	s.leaderboardMu.Lock()
+	defer s.leaderboardMu.Unlock()
+	now := time.Now()
+	for key, totals := range s.leaderboard {
+		if !now.Before(totals.end) {
+			delete(s.leaderboard, key)
+		}
+	}
+	for _, period := range periods {
+		key := tenant + "\x00" + period.Key
+		totals := s.leaderboard[key]
+		if totals == nil {
+			totals = &leaderboardTotals{end: period.End, points: make(map[string]int)}
+			s.leaderboard[key] = totals
+		}
+		totals.points[userID] += points
+		if totals.points[userID] <= 0 {
+			delete(totals.points, userID)
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Leaderboard(ctx context.Context, tenant string, period LeaderboardPeriod, limit int) ([]LeaderboardEntry, error) {
+	s.leaderboardMu.Lock()
+	defer s.leaderboardMu.Unlock()
+	totals := s.leaderboard[tenant+"\x00"+period.Key]
+	if totals == nil {
+		return nil, nil
+	}
+	entries := make([]LeaderboardEntry, 0, len(totals.points))
+	for userID, points := range totals.points {
+		entries = append(entries, LeaderboardEntry{UserID: userID, Points: points})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Points != entries[j].Points {
+			return entries[i].Points > entries[j].Points
+		}
+		return entries[i].UserID < entries[j].UserID
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries, nil
+}
+
+func (s *memoryStore) DeleteExpired(ctx context.Context, cutoff time.Time, byPurchaseDate bool) ([]StoredReceipt, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired []StoredReceipt
+	for id, rec := range s.receipts {
+		if rec.expired(cutoff, byPurchaseDate) {
+			s.remove(id)
+			expired = append(expired, rec)
+		}
+	}
+	return expired, nil
+}
+
+func (s *memoryStore) ClaimIdempotencyKey(ctx context.Context, key, id string, ttl time.Duration) (string, error) {
+	s.keysMu.Lock()
+	defer s.keysMu.Unlock()
+	now := time.Now()
+	if entry, exists := s.keys[key]; exists && now.Before(entry.expires) {
+		return entry.id, nil
+	}
+
+	// Drop expired keys whenever the map has doubled since they last were,
+	// so it doesn't grow forever and going through it costs little for each
+	// key added. Receipt fingerprints are kept for a long time, so the map
+	// can be large.
+	if len(s.keys) >= s.keysPruneAt {
+		for k, entry := range s.keys {
+			if !now.Before(entry.expires) {
+				delete(s.keys, k)
+			}
+		}
+		s.keysPruneAt = max(2*len(s.keys), 1000)
+	}
+	s.keys[key] = idempotencyEntry{id: id, expires: now.Add(ttl)}
+	return id, nil
+}
+
+func (s *memoryStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	s.keysMu.Lock()
+	delete(s.keys, key)
+	s.keysMu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) CreateAPIKey(ctx context.Context, key APIKey) error {
+	s.apiKeysMu.Lock()
+	s.apiKeys[key.Hash] = key
+	s.apiKeysMu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	s.apiKeysMu.Lock()
+	defer s.apiKeysMu.Unlock()
+	key, exists := s.apiKeys[hash]
+	if !exists {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	return key, nil
+}
+
+func (s *memoryStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	s.apiKeysMu.Lock()
+	keys := make([]APIKey, 0, len(s.apiKeys))
+	for _, key := range s.apiKeys {
+		keys = append(keys, key)
+	}
+	s.apiKeysMu.Unlock()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *memoryStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	s.apiKeysMu.Lock()
+	defer s.apiKeysMu.Unlock()
+	for hash, key := range s.apiKeys {
+		if key.ID == id {
+			key.RevokedAt = &at
+			s.apiKeys[hash] = key
+			return nil
+		}
+	}
+	return ErrAPIKeyNotFound
+}
+
+func (s *memoryStore) CreateWebhook(ctx context.Context, hook Webhook) error {
+	s.webhooksMu.Lock()
+	s.webhooks[hook.ID] = hook
+	s.webhooksMu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	s.webhooksMu.Lock()
+	hooks := make([]Webhook, 0, len(s.webhooks))
+	for _, hook := range s.webhooks {
+		hooks = append(hooks, hook)
+	}
+	s.webhooksMu.Unlock()
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+	return hooks, nil
+}
+
+func (s *memoryStore) DeleteWebhook(ctx context.Context, id string) error {
+	s.webhooksMu.Lock()
+	defer s.webhooksMu.Unlock()
+	if _, exists := s.webhooks[id]; !exists {
+		return ErrWebhookNotFound
+	}
+	delete(s.webhooks, id)
+	return nil
+}
+
+func (s *memoryStore) SaveJob(ctx context.Context, job Job, ttl time.Duration) error {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	now := time.Now()
+	// Drop expired jobs now and then so the map doesn't grow forever.
+	if len(s.jobs)%1000 == 0 {
+		for id, entry := range s.jobs {
+			if !now.Before(entry.expires) {
+				delete(s.jobs, id)
+			}
+		}
+	}
+	s.jobs[job.ID] = jobEntry{job: job, expires: now.Add(ttl)}
+	return nil
+}
+
+func (s *memoryStore) GetJob(ctx context.Context, tenant, id string) (Job, error) {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	entry, exists := s.jobs[id]
+	if !exists || entry.job.Tenant != tenant || !time.Now().Before(entry.expires) {
+		return Job{}, ErrJobNotFound
+	}
+	return entry.job, nil
+}
+
+// SaveFlags drops the flags of a receipt removed in the meantime, since
+// nothing would remove them later.
+func (s *memoryStore) SaveFlags(ctx context.Context, flags ReceiptFlags) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rec, exists := s.receipts[flags.ReceiptID]; exists && rec.Tenant == flags.Tenant {
+		s.flags[flags.ReceiptID] = flags
+	}
+	return nil
+}
+
+func (s *memoryStore) GetFlags(ctx context.Context, tenant, id string) (ReceiptFlags, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	flags, exists := s.flags[id]
+	if !exists || flags.Tenant != tenant {
+		return ReceiptFlags{}, nil
+	}
+	return flags, nil
+}
+
+// ReviewQueue goes through the tenant's receipt IDs after the one given,
+// so it gets slower as the store grows.
+func (s *memoryStore) ReviewQueue(ctx context.Context, tenant, after string, limit int) ([]ReceiptFlags, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := s.ids[tenant]
+	var queue []ReceiptFlags
+	for i := sort.SearchStrings(ids, after); i < len(ids) && len(queue) < limit; i++ {
+		flags, exists := s.flags[ids[i]]
+		if exists && ids[i] != after && flags.ReviewedAt == nil {
+			queue = append(queue, flags)
+		}
+	}
+	return queue, nil
+}
+
+// AppendHistory appends whether or not the receipt is still stored, since
+// the history outlives its receipt; only evicting the receipt drops it.
+func (s *memoryStore) AppendHistory(ctx context.Context, tenant, id string, ev ScoringEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := tenant + "\x00" + id
+	s.history[key] = append(s.history[key], ev)
+	return nil
+}
+
+func (s *memoryStore) History(ctx context.Context, tenant, id string) ([]ScoringEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]ScoringEvent(nil), s.history[tenant+"\x00"+id]...), nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
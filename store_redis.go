@@ -0,0 +1,908 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Prefix of the Redis keys that hold receipts as JSON.
+const redisReceiptPrefix = "receipt:"
+
+// redisReceiptKey returns the key of a tenant's receipt: receipt:{id} for
+// the default tenant and receipt:{tenant}:{id} for the others. Tenant
+// names never contain a colon, so the two can't be confused.
+func redisReceiptKey(tenant, id string) string {
+	if tenant == "" {
+		return redisReceiptPrefix + id
+	}
+	return redisReceiptPrefix + tenant + ":" + id
+}
+
+// Prefix of the Redis keys that link an Idempotency-Key to a receipt ID.
+const redisIdempotencyPrefix = "idempotency:"
+
+// Prefix of the Redis keys that hold API keys as JSON, by hash, and of the
+// keys that map an API key's ID to its hash.
+const (
+	redisAPIKeyPrefix   = "apikey:"
+	redisAPIKeyIDPrefix = "apikeyid:"
+)
+
+// Prefix of the Redis keys that hold webhooks as JSON, by ID.
+const redisWebhookPrefix = "webhook:"
+
+// Prefix of the Redis sets that hold the IDs of a user's receipts. They are
+// keyed like receipts, by tenant and user ID, and only ever grow: IDs of
+// receipts that expired, were deleted or moved to another user are skipped
+// and removed when read.
+const redisUserPrefix = "user:"
+
+// Prefixes of the Redis keys for redemptions: each as JSON by tenant and
+// ID, the list of a user's redemptions as JSON, newest first, and the
+// total a user redeemed. The last two are keyed by tenant and user ID.
+const (
+	redisRedemptionPrefix     = "redemption:"
+	redisUserRedemptionPrefix = "redemptions:"
+	redisRedeemedPrefix       = "redeemed:"
+)
+
+// Prefix of the Redis keys that hold the points a user earned, keyed by
+// tenant and user ID. They never expire, unlike receipts with REDIS_TTL.
+const redisEarnedPrefix = "earned:"
+
+// Key set once the earned points have been filled in from the receipts
+// stored before they were kept.
+const redisEarnedBackfilledKey = "earned-backfilled"
+
+// Prefix of the Redis sorted sets that hold the users' totals in a
+// leaderboard period, keyed by tenant and period. Each expires an hour
+// after its period ends.
+const redisLeaderboardPrefix = "leaderboard:"
+
+// Prefix of the Redis keys that hold jobs as JSON. They are keyed like
+// receipts, by tenant and ID.
+const redisJobPrefix = "job:"
+
+// Prefix of the Redis keys that hold a receipt's fraud flags as JSON, keyed
+// like receipts, and of the sorted set of each tenant's receipt IDs with
+// flags not yet reviewed, such as reviewqueue:acme. Every member has the
+// same score, so the set is in order of ID.
+const (
+	redisFlagsPrefix       = "flags:"
+	redisReviewQueuePrefix = "reviewqueue:"
+)
+
+// Prefix of the Redis lists that hold a receipt's scoring events as JSON,
+// oldest first, keyed like receipts. They are kept when the receipt is
+// deleted or expires, REDIS_TTL or not.
+const redisHistoryPrefix = "history:"
+
+// How a webhook is kept in Redis. Webhook leaves its secret out of JSON,
+// so it is added back here.
+type redisWebhook struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+// redisStore keeps receipts in Redis so several instances can share them.
+// Each receipt expires after ttl, or never when ttl is zero.
+type redisStore struct {
+	client *redis.Client
+	ttl    time.Duration
+}
+
+// newRedisStore connects to the Redis server at url, such as
+// "redis://localhost:6379/0".
+func newRedisStore(url string, ttl time.Duration) (*redisStore, error) {
+	if url == "" {
+		return nil, errors.New("REDIS_URL is required for the redis storage backend")
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("redis store: %w", err)
+	}
+	client := redis.NewClient(opts)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("redis store: %w", err)
+	}
+	s := &redisStore{client: client, ttl: ttl}
+	if err := s.backfillEarned(context.Background()); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("redis store: filling in earned points: %w", err)
+	}
+	return s, nil
+}
+
+// backfillEarned adds the points of the receipts stored before earned
+// points were kept to their users, the first time any instance starts.
+// The totals are added up first and written in one transaction, so a
+// failure leaves nothing half done for the next start to add again.
+func (s *redisStore) backfillEarned(ctx context.Context) error {
+	first, err := s.client.SetNX(ctx, redisEarnedBackfilledKey, time.Now().UTC().Format(time.RFC3339), 0).Result()
+	if err != nil || !first {
+		return err
+	}
+	earned, err := s.earnedFromReceipts(ctx)
+	if err == nil {
+		_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for key, points := range earned {
+				pipe.IncrBy(ctx, key, int64(points))
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		s.client.Del(ctx, redisEarnedBackfilledKey)
+	}
+	return err
+}
+
+// earnedFromReceipts adds up the points of every stored receipt with a
+// user, by the user's earned key. It reads every receipt.
+func (s *redisStore) earnedFromReceipts(ctx context.Context) (map[string]int, error) {
+	earned := make(map[string]int)
+	iter := s.client.Scan(ctx, 0, redisReceiptPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		data, err := s.client.Get(ctx, iter.Val()).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var rec StoredReceipt
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return nil, fmt.Errorf("decoding receipt %s: %w", iter.Val(), err)
+		}
+		if rec.Receipt.UserID != "" {
+			earned[redisTenantKey(redisEarnedPrefix, rec.Tenant, rec.Receipt.UserID)] += rec.Points
+		}
+	}
+	return earned, iter.Err()
+}
+
+func (s *redisStore) Save(ctx context.Context, rec StoredReceipt) error {
+	return s.SaveBatch(ctx, []StoredReceipt{rec})
+}
+
+// SaveBatch writes many receipts in a single round trip.
+func (s *redisStore) SaveBatch(ctx context.Context, recs []StoredReceipt) error {
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, rec := range recs {
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			pipe.Set(ctx, redisReceiptKey(rec.Tenant, rec.ID), data, s.ttl)
+			if rec.Receipt.UserID != "" {
+				pipe.SAdd(ctx, redisUserKey(rec.Tenant, rec.Receipt.UserID), rec.ID)
+				pipe.IncrBy(ctx, redisTenantKey(redisEarnedPrefix, rec.Tenant, rec.Receipt.UserID), int64(rec.Points))
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// Update watches the receipt's key, so an update or delete made between
+// reading the old receipt and writing the new one makes it start over,
+// and a receipt deleted or expired in the meantime is not brought back.
+func (s *redisStore) Update(ctx context.Context, rec StoredReceipt) (StoredReceipt, error) {
+	key := redisReceiptKey(rec.Tenant, rec.ID)
+	var old StoredReceipt
+	for {
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			data, err := tx.Get(ctx, key).Bytes()
+			if errors.Is(err, redis.Nil) {
+				return ErrReceiptNotFound
+			}
+			if err != nil {
+				return err
+			}
+			old = StoredReceipt{}
+			if err := json.Unmarshal(data, &old); err != nil {
+				return fmt.Errorf("decoding receipt %s: %w", rec.ID, err)
+			}
+			rec.CreatedAt = old.CreatedAt
+			data, err = json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.SetXX(ctx, key, data, s.ttl)
+				if old.Receipt.UserID != "" {
+					pipe.DecrBy(ctx, redisTenantKey(redisEarnedPrefix, rec.Tenant, old.Receipt.UserID), int64(old.Points))
+				}
+				if rec.Receipt.UserID != "" {
+					pipe.SAdd(ctx, redisUserKey(rec.Tenant, rec.Receipt.UserID), rec.ID)
+					pipe.IncrBy(ctx, redisTenantKey(redisEarnedPrefix, rec.Tenant, rec.Receipt.UserID), int64(rec.Points))
+				}
+				return nil
+			})
+			return err
+		}, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return StoredReceipt{}, err
+		}
+		return old, nil
+	}
+}
+
+func (s *redisStore) Get(ctx context.Context, tenant, id string) (StoredReceipt, error) {
+	data, err := s.client.Get(ctx, redisReceiptKey(tenant, id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return StoredReceipt{}, ErrReceiptNotFound
+	}
+	if err != nil {
+		return StoredReceipt{}, err
+	}
+	var rec StoredReceipt
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return StoredReceipt{}, fmt.Errorf("decoding receipt %s: %w", id, err)
+	}
+	return rec, nil
+}
+
+func (s *redisStore) GetPoints(ctx context.Context, tenant, id string) (int, error) {
+	rec, err := s.Get(ctx, tenant, id)
+	return rec.Points, err
+}
+
+// GetPointsBatch reads all the receipts in a single round trip.
+func (s *redisStore) GetPointsBatch(ctx context.Context, tenant string, ids []string) (map[string]int, error) {
+	recs, err := s.getMany(ctx, tenant, ids)
+	if err != nil {
+		return nil, err
+	}
+	points := make(map[string]int, len(recs))
+	for _, rec := range recs {
+		points[rec.ID] = rec.Points
+	}
+	return points, nil
+}
+
+func (s *redisStore) Delete(ctx context.Context, tenant, id string) error {
+	n, err := s.client.Del(ctx, redisReceiptKey(tenant, id)).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrReceiptNotFound
+	}
+	_, err = s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, redisTenantKey(redisFlagsPrefix, tenant, id))
+		pipe.ZRem(ctx, redisReviewQueuePrefix+tenant, id)
+		return nil
+	})
+	return err
+}
+
+// scanIDs returns the sorted IDs of the tenant's receipts that come after
+// the ID given. It scans every receipt key of the tenant, so it gets slower
+// as the store grows.
+func (s *redisStore) scanIDs(ctx context.Context, tenant, after string) ([]string, error) {
+	prefix := redisReceiptKey(tenant, "")
+	var ids []string
+	iter := s.client.Scan(ctx, 0, prefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		id := strings.TrimPrefix(iter.Val(), prefix)
+		// The default tenant's pattern also matches the other tenants' keys.
+		if id > after && !strings.Contains(id, ":") {
+			ids = append(ids, id)
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	// SCAN can return a key more than once.
+	sort.Strings(ids)
+	unique := ids[:0]
+	for i, id := range ids {
+		if i == 0 || id != ids[i-1] {
+			unique = append(unique, id)
+		}
+	}
+	return unique, nil
+}
+
+func (s *redisStore) List(ctx context.Context, tenant, after string, limit int) ([]StoredReceipt, error) {
+	unique, err := s.scanIDs(ctx, tenant, after)
+	if err != nil {
+		return nil, err
+	}
+	if len(unique) > limit {
+		unique = unique[:limit]
+	}
+	return s.getMany(ctx, tenant, unique)
+}
+
+// getMany returns the tenant's receipts with the IDs given, leaving out
+// those that no longer exist.
+func (s *redisStore) getMany(ctx context.Context, tenant string, ids []string) ([]StoredReceipt, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = redisReceiptKey(tenant, id)
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	recs := make([]StoredReceipt, 0, len(values))
+	for i, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			// Expired or deleted since the scan.
+			continue
+		}
+		var rec StoredReceipt
+		if err := json.Unmarshal([]byte(data), &rec); err != nil {
+			return nil, fmt.Errorf("decoding receipt %s: %w", ids[i], err)
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// Search reads the tenant's receipts in batches until it has found limit
+// that match, so a filter few receipts match reads most of them.
+func (s *redisStore) Search(ctx context.Context, tenant string, f ReceiptFilter, after string, limit int) ([]StoredReceipt, error) {
+	ids, err := s.scanIDs(ctx, tenant, after)
+	if err != nil {
+		return nil, err
+	}
+	var recs []StoredReceipt
+	for len(ids) > 0 && len(recs) < limit {
+		batch := ids[:min(len(ids), 500)]
+		ids = ids[len(batch):]
+		found, err := s.getMany(ctx, tenant, batch)
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range found {
+			if len(recs) < limit && f.matches(rec) {
+				recs = append(recs, rec)
+			}
+		}
+	}
+	return recs, nil
+}
+
+func (s *redisStore) Count(ctx context.Context) (int, error) {
+	seen := make(map[string]bool)
+	iter := s.client.Scan(ctx, 0, redisReceiptPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		seen[iter.Val()] = true
+	}
+	return len(seen), iter.Err()
+}
+
+// Tenants scans every receipt key, so it gets slower as the store grows.
+func (s *redisStore) Tenants(ctx context.Context) ([]string, error) {
+	seen := make(map[string]bool)
+	iter := s.client.Scan(ctx, 0, redisReceiptPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		// See redisReceiptKey: only other tenants' IDs follow a colon.
+		tenant, _, found := strings.Cut(strings.TrimPrefix(iter.Val(), redisReceiptPrefix), ":")
+		if !found {
+			tenant = ""
+		}
+		seen[tenant] = true
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	tenants := make([]string, 0, len(seen))
+	for tenant := range seen {
+		tenants = append(tenants, tenant)
+	}
+	sort.Strings(tenants)
+	return tenants, nil
+}
+
+func (s *redisStore) UserPoints(ctx context.Context, tenant, userID string, recent int) (UserPoints, error) {
+	up, err := s.userReceipts(ctx, tenant, userID)
+	if err != nil {
+		return UserPoints{}, err
+	}
+	up.Earned, up.Redeemed, err = redisUserTotals(ctx, s.client, tenant, userID)
+	if err != nil {
+		return UserPoints{}, err
+	}
+	if recent > 0 {
+		values, err := s.client.LRange(ctx, redisTenantKey(redisUserRedemptionPrefix, tenant, userID), 0, int64(recent-1)).Result()
+		if err != nil {
+			return UserPoints{}, err
+		}
+		for _, data := range values {
+			var red Redemption
+			if err := json.Unmarshal([]byte(data), &red); err != nil {
+				return UserPoints{}, fmt.Errorf("decoding redemption: %w", err)
+			}
+			up.Redemptions = append(up.Redemptions, red)
+		}
+	}
+	up.keepRecent(recent)
+	return up, nil
+}
+
+// userReceipts counts a user's stored receipts in a UserPoints.
+func (s *redisStore) userReceipts(ctx context.Context, tenant, userID string) (UserPoints, error) {
+	key := redisUserKey(tenant, userID)
+	ids, err := s.client.SMembers(ctx, key).Result()
+	if err != nil || len(ids) == 0 {
+		return UserPoints{}, err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = redisReceiptKey(tenant, id)
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return UserPoints{}, err
+	}
+	var up UserPoints
+	var stale []any
+	for i, v := range values {
+		var rec StoredReceipt
+		if data, ok := v.(string); ok {
+			if err := json.Unmarshal([]byte(data), &rec); err != nil {
+				return UserPoints{}, fmt.Errorf("decoding receipt %s: %w", ids[i], err)
+			}
+		}
+		if rec.Receipt.UserID != userID {
+			stale = append(stale, ids[i])
+			continue
+		}
+		up.add(rec)
+	}
+	if len(stale) > 0 {
+		s.client.SRem(ctx, key, stale...)
+	}
+	return up, nil
+}
+
+// redisUserTotals reads the points a user earned and redeemed through c,
+// which is the connection of the transaction in Redeem.
+func redisUserTotals(ctx context.Context, c redis.Cmdable, tenant, userID string) (earned, redeemed int, err error) {
+	earned, err = c.Get(ctx, redisTenantKey(redisEarnedPrefix, tenant, userID)).Int()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, 0, err
+	}
+	redeemed, err = c.Get(ctx, redisTenantKey(redisRedeemedPrefix, tenant, userID)).Int()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return 0, 0, err
+	}
+	return earned, redeemed, nil
+}
+
+// Redeem watches the user's earned and redeemed totals, so a redemption
+// or an update made between reading the balance and recording this one
+// makes it start over.
+func (s *redisStore) Redeem(ctx context.Context, red Redemption) (int, error) {
+	data, err := json.Marshal(red)
+	if err != nil {
+		return 0, err
+	}
+	redeemedKey := redisTenantKey(redisRedeemedPrefix, red.Tenant, red.UserID)
+	var balance int
+	for {
+		err := s.client.Watch(ctx, func(tx *redis.Tx) error {
+			var up UserPoints
+			var err error
+			up.Earned, up.Redeemed, err = redisUserTotals(ctx, tx, red.Tenant, red.UserID)
+			if err != nil {
+				return err
+			}
+			if up.balance() < red.Points {
+				return ErrInsufficientPoints
+			}
+			balance = up.balance() - red.Points
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.IncrBy(ctx, redeemedKey, int64(red.Points))
+				pipe.Set(ctx, redisTenantKey(redisRedemptionPrefix, red.Tenant, red.ID), data, 0)
+				pipe.LPush(ctx, redisTenantKey(redisUserRedemptionPrefix, red.Tenant, red.UserID), data)
+				return nil
+			})
+			return err
+		}, redeemedKey, redisTenantKey(redisEarnedPrefix, red.Tenant, red.UserID))
+		if !errors.Is(err, redis.TxFailedErr) {
+			return balance, err
+		}
+	}
+}
+
+func (s *redisStore) GetRedemption(ctx context.Context, tenant, id string) (Redemption, error) {
+	data, err := s.client.Get(ctx, redisTenantKey(redisRedemptionPrefix, tenant, id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Redemption{}, ErrRedemptionNotFound
+	}
+	if err != nil {
+		return Redemption{}, err
+	}
+	var red Redemption
+	if err := json.Unmarshal(data, &red); err != nil {
+		return Redemption{}, fmt.Errorf("decoding redemption %s: %w", id, err)
+	}
+	return red, nil
+}
+
+// redisUserKey returns the key of the set of a tenant's user's receipt
+// IDs, laid out like redisReceiptKey.
+func redisUserKey(tenant, userID string) string {
+	return redisTenantKey(redisUserPrefix, tenant, userID)
+}
+
+// redisTenantKey returns prefix and the tenant's name, laid out like
+// redisReceiptKey.
+func redisTenantKey(prefix, tenant, name string) string {
+	if tenant == "" {
+		return prefix + name
+	}
+	return prefix + tenant + ":" + name
+}
+
+func (s *redisStore) AddLeaderboardPoints(ctx context.Context, tenant, userID string, periods []LeaderboardPeriod, points int) error {
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, period := range periods {
+			key := redisTenantKey(redisLeaderboardPrefix, tenant, period.Key)
+			pipe.ZIncrBy(ctx, key, float64(points), userID)
+			if points < 0 {
+				pipe.ZRemRangeByScore(ctx, key, "-inf", "0")
+			}
+			pipe.ExpireAt(ctx, key, period.End.Add(time.Hour))
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) Leaderboard(ctx context.Context, tenant string, period LeaderboardPeriod, limit int) ([]LeaderboardEntry, error) {
+	members, err := s.client.ZRevRangeWithScores(ctx, redisTenantKey(redisLeaderboardPrefix, tenant, period.Key), 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]LeaderboardEntry, len(members))
+	for i, m := range members {
+		entries[i] = LeaderboardEntry{UserID: m.Member.(string), Points: int(m.Score)}
+	}
+	return entries, nil
+}
+
+// DeleteExpired reads every receipt to decide whether it expired, so it
+// gets slower as the store grows. REDIS_TTL is cheaper when expiring by
+// when receipts were stored is enough.
+func (s *redisStore) DeleteExpired(ctx context.Context, cutoff time.Time, byPurchaseDate bool) ([]StoredReceipt, error) {
+	var expired []StoredReceipt
+	iter := s.client.Scan(ctx, 0, redisReceiptPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		data, err := s.client.Get(ctx, iter.Val()).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return expired, err
+		}
+		var rec StoredReceipt
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return expired, fmt.Errorf("decoding receipt %s: %w", iter.Val(), err)
+		}
+		if !rec.expired(cutoff, byPurchaseDate) {
+			continue
+		}
+		deleted, err := s.client.Del(ctx, iter.Val()).Result()
+		if err != nil {
+			return expired, err
+		}
+		if deleted > 0 {
+			expired = append(expired, rec)
+		}
+	}
+	return expired, iter.Err()
+}
+
+func (s *redisStore) ClaimIdempotencyKey(ctx context.Context, key, id string, ttl time.Duration) (string, error) {
+	claimed, err := s.client.SetNX(ctx, redisIdempotencyPrefix+key, id, ttl).Result()
+	if err != nil {
+		return "", err
+	}
+	if claimed {
+		return id, nil
+	}
+	linkedID, err := s.client.Get(ctx, redisIdempotencyPrefix+key).Result()
+	if errors.Is(err, redis.Nil) {
+		// Expired between the two calls; try again.
+		return s.ClaimIdempotencyKey(ctx, key, id, ttl)
+	}
+	return linkedID, err
+}
+
+func (s *redisStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	return s.client.Del(ctx, redisIdempotencyPrefix+key).Err()
+}
+
+func (s *redisStore) SaveJob(ctx context.Context, job Job, ttl time.Duration) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, redisJobKey(job.Tenant, job.ID), data, ttl).Err()
+}
+
+func (s *redisStore) GetJob(ctx context.Context, tenant, id string) (Job, error) {
+	data, err := s.client.Get(ctx, redisJobKey(tenant, id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return Job{}, ErrJobNotFound
+	}
+	if err != nil {
+		return Job{}, err
+	}
+	var job Job
+	if err := json.Unmarshal(data, &job); err != nil {
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// SaveFlags keeps the flags as long as receipts are kept. A receipt that
+// expires leaves its ID in the review queue until ReviewQueue finds the
+// flags gone.
+func (s *redisStore) SaveFlags(ctx context.Context, flags ReceiptFlags) error {
+	data, err := json.Marshal(flags)
+	if err != nil {
+		return err
+	}
+	queue := redisReviewQueuePrefix + flags.Tenant
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisTenantKey(redisFlagsPrefix, flags.Tenant, flags.ReceiptID), data, s.ttl)
+		if flags.ReviewedAt == nil {
+			pipe.ZAdd(ctx, queue, redis.Z{Member: flags.ReceiptID})
+		} else {
+			pipe.ZRem(ctx, queue, flags.ReceiptID)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) GetFlags(ctx context.Context, tenant, id string) (ReceiptFlags, error) {
+	data, err := s.client.Get(ctx, redisTenantKey(redisFlagsPrefix, tenant, id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return ReceiptFlags{}, nil
+	}
+	if err != nil {
+		return ReceiptFlags{}, err
+	}
+	var flags ReceiptFlags
+	if err := json.Unmarshal(data, &flags); err != nil {
+		return ReceiptFlags{}, fmt.Errorf("decoding flags of receipt %s: %w", id, err)
+	}
+	return flags, nil
+}
+
+func (s *redisStore) ReviewQueue(ctx context.Context, tenant, after string, limit int) ([]ReceiptFlags, error) {
+	queue := redisReviewQueuePrefix + tenant
+	from := "-"
+	if after != "" {
+		from = "(" + after
+	}
+	ids, err := s.client.ZRangeByLex(ctx, queue, &redis.ZRangeBy{Min: from, Max: "+", Count: int64(limit)}).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = redisTenantKey(redisFlagsPrefix, tenant, id)
+	}
+	values, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	var list []ReceiptFlags
+	var gone []any
+	for i, v := range values {
+		data, ok := v.(string)
+		if !ok {
+			gone = append(gone, ids[i])
+			continue
+		}
+		var flags ReceiptFlags
+		if err := json.Unmarshal([]byte(data), &flags); err != nil {
+			return nil, fmt.Errorf("decoding flags of receipt %s: %w", ids[i], err)
+		}
+		list = append(list, flags)
+	}
+	if len(gone) > 0 {
+		if err := s.client.ZRem(ctx, queue, gone...).Err(); err != nil {
+			return nil, err
+		}
+		if len(ids) == limit {
+			// Fill the page up with the IDs after the ones removed.
+			more, err := s.ReviewQueue(ctx, tenant, ids[len(ids)-1], len(gone))
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, more...)
+		}
+	}
+	return list, nil
+}
+
+// redisJobKey returns the key of a tenant's job, laid out like
+// redisReceiptKey.
+func redisJobKey(tenant, id string) string {
+	if tenant == "" {
+		return redisJobPrefix + id
+	}
+	return redisJobPrefix + tenant + ":" + id
+}
+
+// AppendHistory keeps the events as long as receipts are kept, counting
+// from the latest.
+func (s *redisStore) AppendHistory(ctx context.Context, tenant, id string, ev ScoringEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return s.client.RPush(ctx, redisTenantKey(redisHistoryPrefix, tenant, id), data).Err()
+}
+
+func (s *redisStore) History(ctx context.Context, tenant, id string) ([]ScoringEvent, error) {
+	list, err := s.client.LRange(ctx, redisTenantKey(redisHistoryPrefix, tenant, id), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	events := make([]ScoringEvent, len(list))
+	for i, data := range list {
+		if err := json.Unmarshal([]byte(data), &events[i]); err != nil {
+			return nil, fmt.Errorf("decoding history of receipt %s: %w", id, err)
+		}
+	}
+	return events, nil
+}
+
+func (s *redisStore) Close() error {
+	return s.client.Close()
+}
+
+func (s *redisStore) CreateAPIKey(ctx context.Context, key APIKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisAPIKeyPrefix+key.Hash, data, 0)
+		pipe.Set(ctx, redisAPIKeyIDPrefix+key.ID, key.Hash, 0)
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	data, err := s.client.Get(ctx, redisAPIKeyPrefix+hash).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	var key APIKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return APIKey{}, fmt.Errorf("decoding api key: %w", err)
+	}
+	key.Hash = hash
+	return key, nil
+}
+
+func (s *redisStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	var keys []APIKey
+	seen := make(map[string]bool)
+	iter := s.client.Scan(ctx, 0, redisAPIKeyPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		hash := strings.TrimPrefix(iter.Val(), redisAPIKeyPrefix)
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		key, err := s.GetAPIKeyByHash(ctx, hash)
+		if errors.Is(err, ErrAPIKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+	return keys, nil
+}
+
+func (s *redisStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	hash, err := s.client.Get(ctx, redisAPIKeyIDPrefix+id).Result()
+	if errors.Is(err, redis.Nil) {
+		return ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+	key, err := s.GetAPIKeyByHash(ctx, hash)
+	if err != nil {
+		return err
+	}
+	key.RevokedAt = &at
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, redisAPIKeyPrefix+hash, data, 0).Err()
+}
+
+func (s *redisStore) CreateWebhook(ctx context.Context, hook Webhook) error {
+	data, err := json.Marshal(redisWebhook{Webhook: hook, Secret: hook.Secret})
+	if err != nil {
+		return err
+	}
+	return s.client.Set(ctx, redisWebhookPrefix+hook.ID, data, 0).Err()
+}
+
+func (s *redisStore) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	var hooks []Webhook
+	seen := make(map[string]bool)
+	iter := s.client.Scan(ctx, 0, redisWebhookPrefix+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		if seen[iter.Val()] {
+			continue
+		}
+		seen[iter.Val()] = true
+		data, err := s.client.Get(ctx, iter.Val()).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var rh redisWebhook
+		if err := json.Unmarshal(data, &rh); err != nil {
+			return nil, fmt.Errorf("decoding webhook: %w", err)
+		}
+		rh.Webhook.Secret = rh.Secret
+		hooks = append(hooks, rh.Webhook)
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+	return hooks, nil
+}
+
+func (s *redisStore) DeleteWebhook(ctx context.Context, id string) error {
+	n, err := s.client.Del(ctx, redisWebhookPrefix+id).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (s *redisStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx).Err()
+}
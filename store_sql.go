@@ -0,0 +1,983 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// Schema changes for the SQL stores, applied in order on startup. Append new
+// steps to the end; never edit one that has shipped.
+var sqlMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS receipts (
+		id     TEXT PRIMARY KEY,
+		points INTEGER NOT NULL
+	)`,
+	`ALTER TABLE receipts ADD COLUMN receipt TEXT NOT NULL DEFAULT '{}'`,
+	`ALTER TABLE receipts ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00'`,
+	`ALTER TABLE receipts ADD COLUMN breakdown TEXT NOT NULL DEFAULT '{}'`,
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		key        TEXT PRIMARY KEY,
+		receipt_id TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS api_keys (
+		id         TEXT PRIMARY KEY,
+		name       TEXT NOT NULL,
+		hash       TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP
+	)`,
+	`ALTER TABLE receipts ADD COLUMN tenant TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS receipts_tenant_id ON receipts (tenant, id)`,
+	`ALTER TABLE api_keys ADD COLUMN tenant TEXT NOT NULL DEFAULT ''`,
+	`CREATE TABLE IF NOT EXISTS webhooks (
+		id         TEXT PRIMARY KEY,
+		url        TEXT NOT NULL,
+		tenant     TEXT NOT NULL DEFAULT '',
+		secret     TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS jobs (
+		id         TEXT PRIMARY KEY,
+		tenant     TEXT NOT NULL DEFAULT '',
+		job        TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	)`,
+	`ALTER TABLE receipts ADD COLUMN purchase_date TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS receipts_created_at ON receipts (created_at)`,
+	`ALTER TABLE receipts ADD COLUMN user_id TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS receipts_tenant_user ON receipts (tenant, user_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS redemptions (
+		id          TEXT PRIMARY KEY,
+		tenant      TEXT NOT NULL DEFAULT '',
+		user_id     TEXT NOT NULL,
+		points      INTEGER NOT NULL,
+		description TEXT NOT NULL DEFAULT '',
+		created_at  TIMESTAMP NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS redemptions_tenant_user ON redemptions (tenant, user_id, created_at)`,
+	`CREATE TABLE IF NOT EXISTS redemption_locks (
+		tenant  TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		PRIMARY KEY (tenant, user_id)
+	)`,
+	`CREATE TABLE IF NOT EXISTS leaderboard (
+		tenant  TEXT NOT NULL,
+		period  TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		points  INTEGER NOT NULL,
+		PRIMARY KEY (tenant, period, user_id)
+	)`,
+	`CREATE INDEX IF NOT EXISTS leaderboard_points ON leaderboard (tenant, period, points)`,
+	`ALTER TABLE receipts ADD COLUMN retailer TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS receipts_tenant_purchase_date ON receipts (tenant, purchase_date)`,
+	`CREATE INDEX IF NOT EXISTS receipts_tenant_points ON receipts (tenant, points)`,
+	`CREATE TABLE IF NOT EXISTS receipt_flags (
+		receipt_id  TEXT PRIMARY KEY,
+		tenant      TEXT NOT NULL,
+		flags       TEXT NOT NULL,
+		reviewed_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS receipt_flags_tenant ON receipt_flags (tenant, receipt_id)`,
+	`CREATE TABLE IF NOT EXISTS receipt_history (
+		receipt_id    TEXT NOT NULL,
+		tenant        TEXT NOT NULL,
+		kind          TEXT NOT NULL,
+		at            TIMESTAMP NOT NULL,
+		rule_version  TEXT NOT NULL,
+		points_before INTEGER NOT NULL,
+		points_after  INTEGER NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS receipt_history_receipt ON receipt_history (tenant, receipt_id, at)`,
+	`CREATE TABLE IF NOT EXISTS user_points (
+		tenant  TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		earned  INTEGER NOT NULL,
+		PRIMARY KEY (tenant, user_id)
+	)`,
+	`INSERT INTO user_points (tenant, user_id, earned)
+		SELECT tenant, user_id, SUM(points) FROM receipts WHERE user_id <> '' GROUP BY tenant, user_id`,
+}
+
+// sqlStore keeps receipts in a SQL database through database/sql.
+type sqlStore struct {
+	db *sql.DB
+
+	saveStmt      *sql.Stmt
+	updateStmt    *sql.Stmt
+	getStmt       *sql.Stmt
+	getPointsStmt *sql.Stmt
+	deleteStmt    *sql.Stmt
+	listStmt      *sql.Stmt
+}
+
+// newPostgresStore connects to the PostgreSQL database at dsn, brings its
+// schema up to date and prepares the queries.
+func newPostgresStore(dsn string) (*sqlStore, error) {
+	if dsn == "" {
+		return nil, errors.New("POSTGRES_DSN (-postgres-dsn) is required for the postgres storage backend")
+	}
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(envInt("DB_MAX_OPEN_CONNS", 10))
+	db.SetMaxIdleConns(envInt("DB_MAX_IDLE_CONNS", 5))
+	db.SetConnMaxLifetime(envDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute))
+
+	s, err := openSQLStore(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("postgres store: %w", err)
+	}
+	return s, nil
+}
+
+// newSQLiteStore opens (creating if needed) the SQLite database file at
+// path, brings its schema up to date and prepares the queries.
+func newSQLiteStore(path string) (*sqlStore, error) {
+	// WAL lets readers carry on while a write is in progress, and the busy
+	// timeout makes writers wait for the lock instead of failing.
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, so one connection avoids lock errors.
+	db.SetMaxOpenConns(1)
+
+	s, err := openSQLStore(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("sqlite store: %w", err)
+	}
+	return s, nil
+}
+
+// openSQLStore migrates the database and prepares the store's statements.
+func openSQLStore(db *sql.DB) (*sqlStore, error) {
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+	if err := migrateSQL(db); err != nil {
+		return nil, err
+	}
+	if err := backfillSQLColumns(db); err != nil {
+		return nil, err
+	}
+
+	s := &sqlStore{db: db}
+	stmts := []struct {
+		dst   **sql.Stmt
+		query string
+	}{
+		{&s.saveStmt, `INSERT INTO receipts (id, points, receipt, breakdown, created_at, tenant, purchase_date, user_id, retailer) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (id) DO UPDATE SET points = excluded.points, receipt = excluded.receipt,
+				breakdown = excluded.breakdown, created_at = excluded.created_at, tenant = excluded.tenant,
+				purchase_date = excluded.purchase_date, user_id = excluded.user_id, retailer = excluded.retailer`},
+		{&s.updateStmt, `UPDATE receipts SET points = $2, receipt = $3, breakdown = $4, purchase_date = $6, user_id = $7, retailer = $8 WHERE id = $1 AND tenant = $5`},
+		{&s.getStmt, `SELECT points, receipt, breakdown, created_at FROM receipts WHERE id = $1 AND tenant = $2`},
+		{&s.getPointsStmt, `SELECT points FROM receipts WHERE id = $1 AND tenant = $2`},
+		{&s.deleteStmt, `DELETE FROM receipts WHERE id = $1 AND tenant = $2`},
+		{&s.listStmt, `SELECT id, points, receipt, breakdown, created_at FROM receipts WHERE tenant = $1 AND id > $2 ORDER BY id LIMIT $3`},
+	}
+	for _, st := range stmts {
+		stmt, err := db.Prepare(st.query)
+		if err != nil {
+			return nil, err
+		}
+		*st.dst = stmt
+	}
+	return s, nil
+}
+
+// migrateSQL applies the entries of sqlMigrations the database hasn't seen.
+func migrateSQL(db *sql.DB) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY)`); err != nil {
+		return err
+	}
+	var applied int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil {
+		return err
+	}
+	for version := applied; version < len(sqlMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqlMigrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES ($1)`, version); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", version, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// backfillSQLColumns fills in the retailer and purchase_date columns of
+// receipts stored before they were added, from the receipt's JSON, so
+// searches find them. Receipts stored since have them already, so after
+// the first run this only looks at the few without a retailer.
+func backfillSQLColumns(db *sql.DB) error {
+	for after := ""; ; {
+		rows, err := db.Query(`SELECT id, receipt FROM receipts WHERE retailer = '' AND receipt <> '{}' AND id > $1 ORDER BY id LIMIT 500`, after)
+		if err != nil {
+			return err
+		}
+		var ids []string
+		var receipts []Receipt
+		for rows.Next() {
+			var id, data string
+			if err := rows.Scan(&id, &data); err != nil {
+				rows.Close()
+				return err
+			}
+			var receipt Receipt
+			if err := json.Unmarshal([]byte(data), &receipt); err != nil {
+				rows.Close()
+				return fmt.Errorf("decoding receipt %s: %w", id, err)
+			}
+			ids = append(ids, id)
+			receipts = append(receipts, receipt)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for i, id := range ids {
+			if receipts[i].Retailer == "" {
+				continue
+			}
+			if _, err := db.Exec(`UPDATE receipts SET retailer = $2, purchase_date = $3 WHERE id = $1`,
+				id, receipts[i].Retailer, receipts[i].PurchaseDate); err != nil {
+				return err
+			}
+		}
+		if len(ids) < 500 {
+			return nil
+		}
+		after = ids[len(ids)-1]
+	}
+}
+
+func (s *sqlStore) Save(ctx context.Context, rec StoredReceipt) error {
+	return s.SaveBatch(ctx, []StoredReceipt{rec})
+}
+
+// SaveBatch saves many receipts, and credits their users, in a single
+// transaction.
+func (s *sqlStore) SaveBatch(ctx context.Context, recs []StoredReceipt) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := tx.Stmt(s.saveStmt)
+	for _, rec := range recs {
+		receipt, breakdown, err := encodeSQLColumns(rec)
+		if err != nil {
+			return err
+		}
+		if _, err := stmt.ExecContext(ctx, rec.ID, rec.Points, receipt, breakdown, rec.CreatedAt.UTC(), rec.Tenant, rec.Receipt.PurchaseDate, rec.Receipt.UserID, rec.Receipt.Retailer); err != nil {
+			return err
+		}
+		if err := earnSQL(ctx, tx, rec.Tenant, rec.Receipt.UserID, rec.Points); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// encodeSQLColumns turns the structured parts of a receipt into the JSON
+// text kept in the receipt and breakdown columns.
+func encodeSQLColumns(rec StoredReceipt) (receipt, breakdown string, err error) {
+	r, err := json.Marshal(rec.Receipt)
+	if err != nil {
+		return "", "", err
+	}
+	b, err := json.Marshal(rec.Breakdown)
+	if err != nil {
+		return "", "", err
+	}
+	return string(r), string(b), nil
+}
+
+// decodeSQLColumns is the reverse of encodeSQLColumns.
+func decodeSQLColumns(rec *StoredReceipt, receipt, breakdown string) error {
+	if err := json.Unmarshal([]byte(receipt), &rec.Receipt); err != nil {
+		return fmt.Errorf("decoding receipt %s: %w", rec.ID, err)
+	}
+	if err := json.Unmarshal([]byte(breakdown), &rec.Breakdown); err != nil {
+		return fmt.Errorf("decoding breakdown of receipt %s: %w", rec.ID, err)
+	}
+	return nil
+}
+
+// Update takes the receipt's row for the transaction before reading it, so
+// concurrent updates of one receipt are made one at a time and each moves
+// the earned points from what the last one left.
+func (s *sqlStore) Update(ctx context.Context, rec StoredReceipt) (StoredReceipt, error) {
+	receipt, breakdown, err := encodeSQLColumns(rec)
+	if err != nil {
+		return StoredReceipt{}, err
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return StoredReceipt{}, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `UPDATE receipts SET points = points WHERE id = $1 AND tenant = $2`, rec.ID, rec.Tenant)
+	if err != nil {
+		return StoredReceipt{}, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return StoredReceipt{}, err
+	}
+	if n == 0 {
+		return StoredReceipt{}, ErrReceiptNotFound
+	}
+	old := StoredReceipt{ID: rec.ID, Tenant: rec.Tenant}
+	var oldReceipt, oldBreakdown string
+	if err := tx.Stmt(s.getStmt).QueryRowContext(ctx, rec.ID, rec.Tenant).Scan(&old.Points, &oldReceipt, &oldBreakdown, &old.CreatedAt); err != nil {
+		return StoredReceipt{}, err
+	}
+	if err := decodeSQLColumns(&old, oldReceipt, oldBreakdown); err != nil {
+		return StoredReceipt{}, err
+	}
+	if _, err := tx.Stmt(s.updateStmt).ExecContext(ctx, rec.ID, rec.Points, receipt, breakdown, rec.Tenant, rec.Receipt.PurchaseDate, rec.Receipt.UserID, rec.Receipt.Retailer); err != nil {
+		return StoredReceipt{}, err
+	}
+	if err := earnSQL(ctx, tx, rec.Tenant, old.Receipt.UserID, -old.Points); err != nil {
+		return StoredReceipt{}, err
+	}
+	if err := earnSQL(ctx, tx, rec.Tenant, rec.Receipt.UserID, rec.Points); err != nil {
+		return StoredReceipt{}, err
+	}
+	return old, tx.Commit()
+}
+
+// earnSQL adds points to what a user earned, as part of tx.
+func earnSQL(ctx context.Context, tx *sql.Tx, tenant, userID string, points int) error {
+	if userID == "" || points == 0 {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx, `INSERT INTO user_points (tenant, user_id, earned) VALUES ($1, $2, $3)
+		ON CONFLICT (tenant, user_id) DO UPDATE SET earned = user_points.earned + excluded.earned`, tenant, userID, points)
+	return err
+}
+
+func (s *sqlStore) Get(ctx context.Context, tenant, id string) (StoredReceipt, error) {
+	rec := StoredReceipt{ID: id, Tenant: tenant}
+	var receipt, breakdown string
+	err := s.getStmt.QueryRowContext(ctx, id, tenant).Scan(&rec.Points, &receipt, &breakdown, &rec.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return StoredReceipt{}, ErrReceiptNotFound
+	}
+	if err != nil {
+		return StoredReceipt{}, err
+	}
+	if err := decodeSQLColumns(&rec, receipt, breakdown); err != nil {
+		return StoredReceipt{}, err
+	}
+	return rec, nil
+}
+
+func (s *sqlStore) GetPoints(ctx context.Context, tenant, id string) (int, error) {
+	var points int
+	err := s.getPointsStmt.QueryRowContext(ctx, id, tenant).Scan(&points)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrReceiptNotFound
+	}
+	return points, err
+}
+
+// GetPointsBatch reads the points of all the receipts in one query.
+func (s *sqlStore) GetPointsBatch(ctx context.Context, tenant string, ids []string) (map[string]int, error) {
+	args := []any{tenant}
+	placeholders := make([]string, len(ids))
+	for i, id := range ids {
+		args = append(args, id)
+		placeholders[i] = fmt.Sprintf("$%d", i+2)
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT id, points FROM receipts WHERE tenant = $1 AND id IN (`+strings.Join(placeholders, ", ")+`)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	points := make(map[string]int, len(ids))
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		points[id] = n
+	}
+	return points, rows.Err()
+}
+
+func (s *sqlStore) Delete(ctx context.Context, tenant, id string) error {
+	res, err := s.deleteStmt.ExecContext(ctx, id, tenant)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrReceiptNotFound
+	}
+	_, err = s.db.ExecContext(ctx, `DELETE FROM receipt_flags WHERE receipt_id = $1 AND tenant = $2`, id, tenant)
+	return err
+}
+
+func (s *sqlStore) List(ctx context.Context, tenant, after string, limit int) ([]StoredReceipt, error) {
+	rows, err := s.listStmt.QueryContext(ctx, tenant, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recs []StoredReceipt
+	for rows.Next() {
+		rec := StoredReceipt{Tenant: tenant}
+		var receipt, breakdown string
+		if err := rows.Scan(&rec.ID, &rec.Points, &receipt, &breakdown, &rec.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := decodeSQLColumns(&rec, receipt, breakdown); err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
+
+// Search adds the filter's conditions to the list query. The retailer is
+// matched with LIKE, which no index helps with; purchase dates and points
+// have indexes.
+func (s *sqlStore) Search(ctx context.Context, tenant string, f ReceiptFilter, after string, limit int) ([]StoredReceipt, error) {
+	query := `SELECT id, points, receipt, breakdown, created_at FROM receipts WHERE tenant = $1 AND id > $2`
+	args := []any{tenant, after}
+	where := func(cond string, arg any) {
+		args = append(args, arg)
+		query += fmt.Sprintf(" AND "+cond, len(args))
+	}
+	if f.Retailer != "" {
+		where(`LOWER(retailer) LIKE $%d ESCAPE '\'`, "%"+likeEscaper.Replace(strings.ToLower(f.Retailer))+"%")
+	}
+	if f.PurchasedFrom != "" {
+		where(`purchase_date >= $%d`, f.PurchasedFrom)
+	}
+	if f.PurchasedTo != "" {
+		where(`purchase_date <= $%d`, f.PurchasedTo)
+	}
+	if f.MinPoints != nil {
+		where(`points >= $%d`, *f.MinPoints)
+	}
+	if f.MaxPoints != nil {
+		where(`points <= $%d`, *f.MaxPoints)
+	}
+	args = append(args, limit)
+	query += fmt.Sprintf(` ORDER BY id LIMIT $%d`, len(args))
+
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recs []StoredReceipt
+	for rows.Next() {
+		rec := StoredReceipt{Tenant: tenant}
+		var receipt, breakdown string
+		if err := rows.Scan(&rec.ID, &rec.Points, &receipt, &breakdown, &rec.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := decodeSQLColumns(&rec, receipt, breakdown); err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
+	}
+	return recs, rows.Err()
+}
+
+// Escapes the characters LIKE treats specially, for ESCAPE '\'.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func (s *sqlStore) Count(ctx context.Context) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM receipts`).Scan(&n)
+	return n, err
+}
+
+func (s *sqlStore) Tenants(ctx context.Context) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT DISTINCT tenant FROM receipts ORDER BY tenant`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tenants []string
+	for rows.Next() {
+		var tenant string
+		if err := rows.Scan(&tenant); err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, rows.Err()
+}
+
+// Reads a user's totals: $1 is the tenant and $2 the user ID.
+const sqlUserTotalsQuery = `SELECT
+	(SELECT COALESCE(SUM(earned), 0) FROM user_points WHERE tenant = $1 AND user_id = $2),
+	(SELECT COUNT(*) FROM receipts WHERE tenant = $1 AND user_id = $2),
+	(SELECT COALESCE(SUM(points), 0) FROM redemptions WHERE tenant = $1 AND user_id = $2)`
+
+func (s *sqlStore) UserPoints(ctx context.Context, tenant, userID string, recent int) (UserPoints, error) {
+	var up UserPoints
+	err := s.db.QueryRowContext(ctx, sqlUserTotalsQuery, tenant, userID).Scan(&up.Earned, &up.Receipts, &up.Redeemed)
+	if err != nil {
+		return UserPoints{}, err
+	}
+	rows, err := s.db.QueryContext(ctx, `SELECT id, points, receipt, breakdown, created_at FROM receipts
+		WHERE tenant = $1 AND user_id = $2 ORDER BY created_at DESC, id DESC LIMIT $3`, tenant, userID, recent)
+	if err != nil {
+		return UserPoints{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		rec := StoredReceipt{Tenant: tenant}
+		var receipt, breakdown string
+		if err := rows.Scan(&rec.ID, &rec.Points, &receipt, &breakdown, &rec.CreatedAt); err != nil {
+			return UserPoints{}, err
+		}
+		if err := decodeSQLColumns(&rec, receipt, breakdown); err != nil {
+			return UserPoints{}, err
+		}
+		up.Recent = append(up.Recent, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return UserPoints{}, err
+	}
+
+	rows, err = s.db.QueryContext(ctx, `SELECT id, points, description, created_at FROM redemptions
+		WHERE tenant = $1 AND user_id = $2 ORDER BY created_at DESC, id DESC LIMIT $3`, tenant, userID, recent)
+	if err != nil {
+		return UserPoints{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		red := Redemption{Tenant: tenant, UserID: userID}
+		if err := rows.Scan(&red.ID, &red.Points, &red.Description, &red.CreatedAt); err != nil {
+			return UserPoints{}, err
+		}
+		up.Redemptions = append(up.Redemptions, red)
+	}
+	return up, rows.Err()
+}
+
+// Redeem takes the user's row in redemption_locks for the transaction, so
+// redemptions for one user are made one at a time even across instances.
+func (s *sqlStore) Redeem(ctx context.Context, red Redemption) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO redemption_locks (tenant, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, red.Tenant, red.UserID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, `UPDATE redemption_locks SET tenant = tenant WHERE tenant = $1 AND user_id = $2`, red.Tenant, red.UserID); err != nil {
+		return 0, err
+	}
+	var up UserPoints
+	if err := tx.QueryRowContext(ctx, sqlUserTotalsQuery, red.Tenant, red.UserID).Scan(&up.Earned, &up.Receipts, &up.Redeemed); err != nil {
+		return 0, err
+	}
+	if up.balance() < red.Points {
+		return 0, ErrInsufficientPoints
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO redemptions (id, tenant, user_id, points, description, created_at) VALUES ($1, $2, $3, $4, $5, $6)`,
+		red.ID, red.Tenant, red.UserID, red.Points, red.Description, red.CreatedAt.UTC()); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return up.balance() - red.Points, nil
+}
+
+func (s *sqlStore) GetRedemption(ctx context.Context, tenant, id string) (Redemption, error) {
+	red := Redemption{ID: id, Tenant: tenant}
+	err := s.db.QueryRowContext(ctx, `SELECT user_id, points, description, created_at FROM redemptions WHERE id = $1 AND tenant = $2`,
+		id, tenant).Scan(&red.UserID, &red.Points, &red.Description, &red.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Redemption{}, ErrRedemptionNotFound
+	}
+	if err != nil {
+		return Redemption{}, err
+	}
+	return red, nil
+}
+
+// AddLeaderboardPoints keeps the totals of past periods; they are small
+// and never read.
+func (s *sqlStore) AddLeaderboardPoints(ctx context.Context, tenant, userID string, periods []LeaderboardPeriod, points int) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, period := range periods {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO leaderboard (tenant, period, user_id, points) VALUES ($1, $2, $3, $4)
+			ON CONFLICT (tenant, period, user_id) DO UPDATE SET points = leaderboard.points + excluded.points`,
+			tenant, period.Key, userID, points); err != nil {
+			return err
+		}
+		if points < 0 {
+			if _, err := tx.ExecContext(ctx, `DELETE FROM leaderboard WHERE tenant = $1 AND period = $2 AND user_id = $3 AND points <= 0`,
+				tenant, period.Key, userID); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) Leaderboard(ctx context.Context, tenant string, period LeaderboardPeriod, limit int) ([]LeaderboardEntry, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT user_id, points FROM leaderboard
+		WHERE tenant = $1 AND period = $2 ORDER BY points DESC, user_id LIMIT $3`, tenant, period.Key, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []LeaderboardEntry
+	for rows.Next() {
+		var e LeaderboardEntry
+		if err := rows.Scan(&e.UserID, &e.Points); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// DeleteExpired matches StoredReceipt.expired. Receipts stored before the
+// purchase_date column was added have it empty, so they go by created_at.
+func (s *sqlStore) DeleteExpired(ctx context.Context, cutoff time.Time, byPurchaseDate bool) ([]StoredReceipt, error) {
+	const returning = ` RETURNING id, tenant, points, receipt, breakdown, created_at`
+	var rows *sql.Rows
+	var err error
+	if byPurchaseDate {
+		rows, err = s.db.QueryContext(ctx, `DELETE FROM receipts
+			WHERE (purchase_date <> '' AND purchase_date < $1) OR (purchase_date = '' AND created_at < $2)`+returning,
+			cutoff.UTC().Format("2006-01-02"), cutoff.UTC())
+	} else {
+		rows, err = s.db.QueryContext(ctx, `DELETE FROM receipts WHERE created_at < $1`+returning, cutoff.UTC())
+	}
+	if err != nil {
+		return nil, err
+	}
+	expired, err := scanExpired(rows)
+	if err != nil || len(expired) == 0 {
+		return expired, err
+	}
+	_, err = s.db.ExecContext(ctx, `DELETE FROM receipt_flags WHERE receipt_id NOT IN (SELECT id FROM receipts)`)
+	return expired, err
+}
+
+// scanExpired reads the receipts DeleteExpired removed and closes rows.
+// The rows are gone whatever happens, so a receipt that can't be decoded
+// is still returned, with the error, without its Receipt and Breakdown.
+func scanExpired(rows *sql.Rows) ([]StoredReceipt, error) {
+	defer rows.Close()
+	var expired []StoredReceipt
+	var decodeErr error
+	for rows.Next() {
+		var rec StoredReceipt
+		var receipt, breakdown string
+		if err := rows.Scan(&rec.ID, &rec.Tenant, &rec.Points, &receipt, &breakdown, &rec.CreatedAt); err != nil {
+			return expired, err
+		}
+		if err := decodeSQLColumns(&rec, receipt, breakdown); err != nil && decodeErr == nil {
+			decodeErr = err
+		}
+		expired = append(expired, rec)
+	}
+	if err := rows.Err(); err != nil {
+		return expired, err
+	}
+	return expired, decodeErr
+}
+
+func (s *sqlStore) ClaimIdempotencyKey(ctx context.Context, key, id string, ttl time.Duration) (string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UTC()
+	if _, err := tx.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE key = $1 AND expires_at <= $2`, key, now); err != nil {
+		return "", err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO idempotency_keys (key, receipt_id, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (key) DO NOTHING`, key, id, now.Add(ttl)); err != nil {
+		return "", err
+	}
+	var linkedID string
+	if err := tx.QueryRowContext(ctx, `SELECT receipt_id FROM idempotency_keys WHERE key = $1`, key).Scan(&linkedID); err != nil {
+		return "", err
+	}
+	return linkedID, tx.Commit()
+}
+
+func (s *sqlStore) ReleaseIdempotencyKey(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE key = $1`, key)
+	return err
+}
+
+func (s *sqlStore) CreateAPIKey(ctx context.Context, key APIKey) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO api_keys (id, name, hash, created_at, tenant) VALUES ($1, $2, $3, $4, $5)`,
+		key.ID, key.Name, key.Hash, key.CreatedAt.UTC(), key.Tenant)
+	return err
+}
+
+func (s *sqlStore) GetAPIKeyByHash(ctx context.Context, hash string) (APIKey, error) {
+	key := APIKey{Hash: hash}
+	var revokedAt sql.NullTime
+	err := s.db.QueryRowContext(ctx, `SELECT id, name, tenant, created_at, revoked_at FROM api_keys WHERE hash = $1`, hash).
+		Scan(&key.ID, &key.Name, &key.Tenant, &key.CreatedAt, &revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+	if revokedAt.Valid {
+		key.RevokedAt = &revokedAt.Time
+	}
+	return key, nil
+}
+
+func (s *sqlStore) ListAPIKeys(ctx context.Context) ([]APIKey, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, name, tenant, hash, created_at, revoked_at FROM api_keys ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		var key APIKey
+		var revokedAt sql.NullTime
+		if err := rows.Scan(&key.ID, &key.Name, &key.Tenant, &key.Hash, &key.CreatedAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		if revokedAt.Valid {
+			key.RevokedAt = &revokedAt.Time
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqlStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	res, err := s.db.ExecContext(ctx, `UPDATE api_keys SET revoked_at = $2 WHERE id = $1`, id, at.UTC())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) CreateWebhook(ctx context.Context, hook Webhook) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO webhooks (id, url, tenant, secret, created_at) VALUES ($1, $2, $3, $4, $5)`,
+		hook.ID, hook.URL, hook.Tenant, hook.Secret, hook.CreatedAt.UTC())
+	return err
+}
+
+func (s *sqlStore) ListWebhooks(ctx context.Context) ([]Webhook, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id, url, tenant, secret, created_at FROM webhooks ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hooks []Webhook
+	for rows.Next() {
+		var hook Webhook
+		if err := rows.Scan(&hook.ID, &hook.URL, &hook.Tenant, &hook.Secret, &hook.CreatedAt); err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, rows.Err()
+}
+
+func (s *sqlStore) DeleteWebhook(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) SaveJob(ctx context.Context, job Job, ttl time.Duration) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if job.Status == jobQueued {
+		// Clear out expired jobs as new ones arrive.
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM jobs WHERE expires_at <= $1`, now); err != nil {
+			return err
+		}
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO jobs (id, tenant, job, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET tenant = excluded.tenant, job = excluded.job, expires_at = excluded.expires_at`,
+		job.ID, job.Tenant, string(data), now.Add(ttl))
+	return err
+}
+
+func (s *sqlStore) GetJob(ctx context.Context, tenant, id string) (Job, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, `SELECT job FROM jobs WHERE id = $1 AND tenant = $2 AND expires_at > $3`, id, tenant, time.Now().UTC()).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, ErrJobNotFound
+	}
+	if err != nil {
+		return Job{}, err
+	}
+	var job Job
+	if err := json.Unmarshal([]byte(data), &job); err != nil {
+		return Job{}, err
+	}
+	return job, nil
+}
+
+func (s *sqlStore) SaveFlags(ctx context.Context, flags ReceiptFlags) error {
+	data, err := json.Marshal(flags)
+	if err != nil {
+		return err
+	}
+	var reviewedAt any
+	if flags.ReviewedAt != nil {
+		reviewedAt = flags.ReviewedAt.UTC()
+	}
+	_, err = s.db.ExecContext(ctx, `INSERT INTO receipt_flags (receipt_id, tenant, flags, reviewed_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (receipt_id) DO UPDATE SET tenant = excluded.tenant, flags = excluded.flags, reviewed_at = excluded.reviewed_at`,
+		flags.ReceiptID, flags.Tenant, string(data), reviewedAt)
+	return err
+}
+
+func (s *sqlStore) GetFlags(ctx context.Context, tenant, id string) (ReceiptFlags, error) {
+	var data string
+	err := s.db.QueryRowContext(ctx, `SELECT flags FROM receipt_flags WHERE receipt_id = $1 AND tenant = $2`, id, tenant).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ReceiptFlags{}, nil
+	}
+	if err != nil {
+		return ReceiptFlags{}, err
+	}
+	var flags ReceiptFlags
+	if err := json.Unmarshal([]byte(data), &flags); err != nil {
+		return ReceiptFlags{}, fmt.Errorf("decoding flags of receipt %s: %w", id, err)
+	}
+	return flags, nil
+}
+
+func (s *sqlStore) ReviewQueue(ctx context.Context, tenant, after string, limit int) ([]ReceiptFlags, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT receipt_id, flags FROM receipt_flags
+		WHERE tenant = $1 AND receipt_id > $2 AND reviewed_at IS NULL ORDER BY receipt_id LIMIT $3`, tenant, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var queue []ReceiptFlags
+	for rows.Next() {
+		var id, data string
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+		var flags ReceiptFlags
+		if err := json.Unmarshal([]byte(data), &flags); err != nil {
+			return nil, fmt.Errorf("decoding flags of receipt %s: %w", id, err)
+		}
+		queue = append(queue, flags)
+	}
+	return queue, rows.Err()
+}
+
+func (s *sqlStore) AppendHistory(ctx context.Context, tenant, id string, ev ScoringEvent) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO receipt_history (receipt_id, tenant, kind, at, rule_version, points_before, points_after)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		id, tenant, ev.Kind, ev.At.UTC(), ev.RuleVersion, ev.PointsBefore, ev.PointsAfter)
+	return err
+}
+
+func (s *sqlStore) History(ctx context.Context, tenant, id string) ([]ScoringEvent, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT kind, at, rule_version, points_before, points_after FROM receipt_history
+		WHERE tenant = $1 AND receipt_id = $2 ORDER BY at`, tenant, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var events []ScoringEvent
+	for rows.Next() {
+		var ev ScoringEvent
+		if err := rows.Scan(&ev.Kind, &ev.At, &ev.RuleVersion, &ev.PointsBefore, &ev.PointsAfter); err != nil {
+			return nil, err
+		}
+		events = append(events, ev)
+	}
+	return events, rows.Err()
+}
+
+// Close finalizes the prepared statements and closes the database, which
+// for SQLite also checkpoints the write-ahead log into the main file.
+func (s *sqlStore) Close() error {
+	for _, stmt := range []*sql.Stmt{s.saveStmt, s.updateStmt, s.getStmt, s.getPointsStmt, s.deleteStmt, s.listStmt} {
+		stmt.Close()
+	}
+	return s.db.Close()
+}
+
+func (s *sqlStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKeyAfterRestart(t *testing.T) {
+	tests := []struct {
+		name     string
+		ttl      time.Duration
+		down     time.Duration
+		wantSame bool
+	}{
+		{name: "within the TTL", ttl: time.Hour, wantSame: true},
+		{name: "past the TTL", ttl: 50 * time.Millisecond, down: 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(ttl time.Duration) { idempotencyTTL = ttl }(idempotencyTTL)
+			idempotencyTTL = tt.ttl
+			api := newTestAPI(t)
+			path := filepath.Join(t.TempDir(), "receipts.db")
+			process := func(payload string) string {
+				t.Helper()
+				// Each submission gets a store of its own, as a restarted
+				// instance would.
+				s, err := newSQLiteStore(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer s.Close()
+				store = s
+				req := httptest.NewRequest("POST", "/receipts/process", strings.NewReader(payload))
+				req.Header.Set("Idempotency-Key", "foo")
+				rec := httptest.NewRecorder()
+				api.ServeHTTP(rec, req)
+				var resp ProcessResponse
+				if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil {
+					t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+				}
+				return resp.ID
+			}
+
+			first := process(targetReceipt)
+			time.Sleep(tt.down)
+			again := process(strings.Replace(targetReceipt, "Target", "Walgreens", 1))
+			if (again == first) != tt.wantSame {
+				t.Errorf("IDs %s and %s after the restart, want the same %v", first, again, tt.wantSame)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Largest line accepted by POST /receipts/process/stream, set from
+// MAX_BODY_BYTES. The body as a whole isn't limited.
+var maxStreamLineBytes = 10 << 20
+
+// Receipts read ahead and scored together while streaming, at most
+const streamChunkSize = 100
+
+// The outcome for one line of a stream. Line is its line number, the first
+// being 1.
+type StreamResult struct {
+	Line int `json:"line"`
+	BatchResult
+}
+
+// processStreamHandler handles POST /receipts/process/stream
+// The body is newline-delimited JSON, one receipt to a line, and each is
+// scored and stored like the receipts of a batch. The response is
+// newline-delimited too, a StreamResult for every line that isn't blank,
+// written as the lines are processed, so an import of any size is handled
+// a little at a time. Like an export it gets timeout rather than
+// REQUEST_TIMEOUT, READ_TIMEOUT and WRITE_TIMEOUT. When the store fails,
+// the lines read so far get its error and the response ends there; lines
+// without a result weren't processed.
+func processStreamHandler(timeout time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		processStream(w, r, timeout)
+	}
+}
+
+func processStream(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), timeout)
+	defer cancel()
+	r = r.WithContext(ctx)
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Now().Add(timeout))
+	rc.SetWriteDeadline(time.Now().Add(timeout))
+	// Answer lines while the client is still sending the rest.
+	rc.EnableFullDuplex()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	br := bufio.NewReader(r.Body)
+	lineNo := 0
+	var results []StreamResult
+	var payloads []json.RawMessage
+	// Where each payload's result is in results.
+	var slots []int
+	for {
+		results, payloads, slots = results[:0], payloads[:0], slots[:0]
+		// Score the lines that have arrived together, up to a chunk, so a
+		// client sending slowly still hears back on each line.
+		var readErr error
+		for len(payloads) < streamChunkSize {
+			line, tooLong, err := readLine(br, maxStreamLineBytes)
+			if err != nil {
+				readErr = err
+				break
+			}
+			lineNo++
+			switch {
+			case tooLong:
+				results = append(results, StreamResult{Line: lineNo, BatchResult: BatchResult{
+					Error: fmt.Sprintf("Line too large: at most %d bytes", maxStreamLineBytes), Code: codePayloadTooLarge}})
+			case len(bytes.TrimSpace(line)) > 0:
+				results = append(results, StreamResult{Line: lineNo})
+				payloads = append(payloads, line)
+				slots = append(slots, len(results)-1)
+			}
+			if br.Buffered() == 0 {
+				break
+			}
+		}
+
+		var failed *Problem
+		if len(payloads) > 0 {
+			var batch []BatchResult
+			batch, failed = processPayloads(r, payloads)
+			for i, slot := range slots {
+				if failed != nil {
+					results[slot].BatchResult = BatchResult{Error: failed.Detail, Code: failed.Code}
+				} else {
+					results[slot].BatchResult = batch[i]
+				}
+			}
+		}
+		for _, res := range results {
+			enc.Encode(res)
+		}
+		rc.Flush()
+
+		if failed != nil {
+			return
+		}
+		if readErr != nil {
+			if !errors.Is(readErr, io.EOF) {
+				requestLogger(r).Warn("Error reading receipt stream", "line", lineNo, "err", readErr)
+			}
+			return
+		}
+	}
+}
+
+// readLine reads the next line from br without its line ending. A line
+// longer than limit is read to its end but not kept, and tooLong is set.
+// The last line needn't end in a newline.
+func readLine(br *bufio.Reader, limit int) (line []byte, tooLong bool, err error) {
+	for {
+		part, err := br.ReadSlice('\n')
+		if tooLong || len(line)+len(bytes.TrimRight(part, "\r\n")) > limit {
+			line, tooLong = nil, true
+		} else {
+			line = append(line, part...)
+		}
+		if errors.Is(err, bufio.ErrBufferFull) {
+			continue
+		}
+		if errors.Is(err, io.EOF) && (len(line) > 0 || tooLong) {
+			err = nil
+		}
+		return bytes.TrimRight(line, "\r\n"), tooLong, err
+	}
+}
+
+// streamedBody reports whether r is a stream for processStream, which
+// limits each line rather than the whole body.
+func streamedBody(r *http.Request) bool {
+	return r.Method == http.MethodPost && (r.URL.Path == "/receipts/process/stream" || r.URL.Path == "/v1/receipts/process/stream")
+}
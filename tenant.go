@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// Tenant names are limited to letters, digits, '-' and '_' so they are
+// safe to use in store keys.
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+type tenantKey struct{}
+
+// withTenant records the tenant a request acts for.
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFrom returns the tenant a request acts for, "" for the default
+// tenant.
+func tenantFrom(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// resolveTenant is router middleware that takes the tenant from the
+// X-Tenant-ID header, unless the API key or bearer token has already
+// decided it. With authentication on, clients can't pick another tenant.
+func resolveTenant(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, decided := r.Context().Value(tenantKey{}).(string); decided {
+			h.ServeHTTP(w, r)
+			return
+		}
+		tenant := r.Header.Get("X-Tenant-ID")
+		if tenant != "" && !tenantPattern.MatchString(tenant) {
+			p := newProblem(http.StatusBadRequest, codeInvalidParameter, "X-Tenant-ID may only contain letters, digits, '-' and '_'")
+			p.Field = "X-Tenant-ID"
+			writeProblem(w, p)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(withTenant(r.Context(), tenant)))
+	})
+}
+
+// The namespaces of the keys claimed with ClaimIdempotencyKey. Each kind
+// of key has its own, so no key a client chooses can reach one of another
+// kind.
+const (
+	// Idempotency-Keys sent by clients
+	keySpaceIdempotency = "idem"
+	// Links from a receipt's fingerprint to the receipt first stored with it
+	keySpaceFingerprint = "fingerprint"
+	// Messages consumed from Kafka or SQS, by their key in the source
+	keySpaceMessage = "msg"
+	// Idempotency-Keys sent with redemptions, by user
+	keySpaceRedemption = "redeem"
+)
+
+// scopedKey returns the store key for key in a namespace and tenant. The
+// tenant is length-prefixed, so neither a tenant nor a key containing ':'
+// can spell another tenant's key.
+func scopedKey(space, tenant, key string) string {
+	return space + ":" + strconv.Itoa(len(tenant)) + ":" + tenant + ":" + key
+}
+
+// scopedIdempotencyKey keeps tenants' Idempotency-Keys apart, so two
+// tenants that happen to send the same key don't share a receipt.
+func scopedIdempotencyKey(tenant, key string) string {
+	return scopedKey(keySpaceIdempotency, tenant, key)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestScopedIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name         string
+		tenantA      string
+		keyA         string
+		tenantB      string
+		keyB         string
+		wantDistinct bool
+	}{
+		{name: "same tenant and key", tenantA: "acme", keyA: "foo", tenantB: "acme", keyB: "foo"},
+		{name: "other tenant", tenantA: "acme", keyA: "foo", tenantB: "globex", keyB: "foo", wantDistinct: true},
+		{name: "default tenant spelling a tenant", tenantA: "", keyA: "acme:foo", tenantB: "acme", keyB: "foo", wantDistinct: true},
+		{name: "tenant with a colon", tenantA: "a:b", keyA: "c", tenantB: "a", keyB: "b:c", wantDistinct: true},
+		{name: "empty key", tenantA: "", keyA: "", tenantB: "", keyB: ":", wantDistinct: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := scopedIdempotencyKey(tt.tenantA, tt.keyA), scopedIdempotencyKey(tt.tenantB, tt.keyB)
+			if (a != b) != tt.wantDistinct {
+				t.Errorf("keys %q and %q, want distinct %v", a, b, tt.wantDistinct)
+			}
+		})
+	}
+}
+
+func TestIdempotencyKeyAcrossTenants(t *testing.T) {
+	api := newTestAPI(t)
+	process := func(tenant, key, payload string) string {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/receipts/process", strings.NewReader(payload))
+		req.Header.Set("Idempotency-Key", key)
+		if tenant != "" {
+			req.Header.Set("X-Tenant-ID", tenant)
+		}
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, req)
+		var resp ProcessResponse
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &resp) != nil {
+			t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+		}
+		return resp.ID
+	}
+
+	acmeID := process("acme", "foo", targetReceipt)
+	defaultID := process("", "acme:foo", strings.Replace(targetReceipt, "Target", "Walgreens", 1))
+	if defaultID == acmeID {
+		t.Fatalf("the default tenant's key acme:foo got acme's receipt %s", acmeID)
+	}
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, httptest.NewRequest("GET", "/receipts/"+defaultID+"/points", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("default tenant's receipt: status %d, want 200", rec.Code)
+	}
+	if again := process("acme", "foo", targetReceipt); again != acmeID {
+		t.Errorf("acme's retry got %s, want %s", again, acmeID)
+	}
+}
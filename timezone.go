@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	// Zones load even where the system has no time zone database.
+	_ "time/tzdata"
+)
+
+// The time zone purchases are scored in when neither the receipt nor
+// tenantTimezones names one, set from DEFAULT_TIMEZONE. When no zone
+// applies the purchase date and time are scored as written.
+var defaultTimezone *time.Location
+
+// Time zones by tenant, set from TENANT_TIMEZONES
+var tenantTimezones map[string]*time.Location
+
+// The form of an IANA time zone name, for the generated schemas
+var timezonePattern = regexp.MustCompile(`^[A-Za-z0-9_+-]+(/[A-Za-z0-9_+-]+)*$`)
+
+// Zones loaded so far, by name. Only valid names are kept, so it can't
+// grow past the size of the time zone database.
+var timezones sync.Map
+
+// loadTimezone loads an IANA time zone such as "America/Chicago". "Local"
+// is refused, since it depends on where the server runs.
+func loadTimezone(name string) (*time.Location, error) {
+	if loc, ok := timezones.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	if name == "" || name == "Local" {
+		return nil, fmt.Errorf("invalid time zone %q", name)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time zone %q", name)
+	}
+	timezones.Store(name, loc)
+	return loc, nil
+}
+
+// parseTenantTimezones parses TENANT_TIMEZONES, which looks like
+// "acme:America/New_York,globex:Europe/Paris".
+func parseTenantTimezones(s string) (map[string]*time.Location, error) {
+	zones := map[string]*time.Location{}
+	for _, entry := range splitList(s) {
+		tenant, name, ok := strings.Cut(entry, ":")
+		if !ok || !tenantPattern.MatchString(tenant) {
+			return nil, fmt.Errorf("invalid tenant-timezones entry %q", entry)
+		}
+		loc, err := loadTimezone(name)
+		if err != nil {
+			return nil, fmt.Errorf("tenant-timezones entry %q: %w", entry, err)
+		}
+		zones[tenant] = loc
+	}
+	return zones, nil
+}
+
+// receiptTimezone returns the zone a receipt's purchase is scored in: its
+// own, its tenant's or the default, or nil for none.
+func receiptTimezone(ctx context.Context, receipt Receipt) (*time.Location, error) {
+	if receipt.Timezone != "" {
+		return loadTimezone(receipt.Timezone)
+	}
+	if loc := tenantTimezones[tenantFrom(ctx)]; loc != nil {
+		return loc, nil
+	}
+	return defaultTimezone, nil
+}
+
+// inTimezone returns the receipt with its purchase date and time, taken as
+// UTC, moved to loc, so 2022-01-01 20:30 becomes 2022-01-01 14:30 in
+// America/Chicago. The receipt is returned as it is when loc is nil.
+func inTimezone(receipt Receipt, loc *time.Location) Receipt {
+	if loc == nil {
+		return receipt
+	}
+	t, err := time.Parse(dateLayout+" "+clockLayout, receipt.PurchaseDate+" "+receipt.PurchaseTime)
+	if err != nil {
+		return receipt
+	}
+	t = t.In(loc)
+	receipt.PurchaseDate = t.Format(dateLayout)
+	receipt.PurchaseTime = t.Format(clockLayout)
+	return receipt
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// setupTLS prepares srv for the TLS settings in cfg and returns the function
+// that starts serving: plain HTTP, TLS with the certificate files given, or
+// TLS with certificates obtained from an ACME CA such as Let's Encrypt.
+// It must run before http2.ConfigureServer so HTTP/2 is offered over TLS.
+func setupTLS(srv *http.Server, cfg Config) func() error {
+	if len(cfg.AutocertDomains) > 0 {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.AutocertDomains...),
+			Cache:      autocert.DirCache(cfg.AutocertCacheDir),
+			Email:      cfg.AutocertEmail,
+		}
+		srv.TLSConfig = m.TLSConfig()
+
+		// The HTTP-01 challenge needs port 80; everything else sent there
+		// is redirected to HTTPS.
+		if cfg.ACMEHTTPAddr != "" {
+			go func() {
+				slog.Info("Answering ACME challenges", "addr", cfg.ACMEHTTPAddr)
+				challenges := &http.Server{
+					Addr:              cfg.ACMEHTTPAddr,
+					Handler:           m.HTTPHandler(nil),
+					ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+					IdleTimeout:       cfg.IdleTimeout,
+				}
+				if err := challenges.ListenAndServe(); err != nil {
+					slog.Error("ACME challenge listener stopped", "err", err)
+				}
+			}()
+		}
+		return func() error { return srv.ListenAndServeTLS("", "") }
+	}
+	if cfg.TLSCertFile != "" {
+		return func() error { return srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile) }
+	}
+	return srv.ListenAndServe
+}
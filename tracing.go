@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// The tracer for the spans this service creates. Until setupTracing
+// installs a provider its spans go nowhere.
+var tracer = otel.Tracer("github.com/EnochQin1/FetchReceiptProcessor")
+
+// setupTracing starts exporting spans over OTLP/HTTP when an endpoint is
+// configured. The function it returns flushes any spans not yet sent.
+// The service name comes from OTEL_SERVICE_NAME.
+func setupTracing(cfg Config) (func(context.Context) error, error) {
+	if cfg.OTLPTracesEndpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.OTLPTracesEndpoint))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(tp)
+	// Continue traces started by our callers.
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// tracedStore wraps a ReceiptStore so every call shows up as a span.
+type tracedStore struct {
+	inner ReceiptStore
+}
+
+// startStoreSpan starts the span for one store call about the receipt id,
+// if there is one.
+func startStoreSpan(ctx context.Context, op, id string) (context.Context, trace.Span) {
+	ctx, span := tracer.Start(ctx, "store."+op, trace.WithSpanKind(trace.SpanKindClient))
+	if id != "" {
+		span.SetAttributes(attribute.String("receipt.id", id))
+	}
+	return ctx, span
+}
+
+// endStoreSpan records err on the span and ends it. A missing receipt or
+// key, or a balance too low to redeem, is an answer rather than a failure,
+// so it is not marked as an error.
+func endStoreSpan(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, ErrReceiptNotFound) && !errors.Is(err, ErrAPIKeyNotFound) && !errors.Is(err, ErrWebhookNotFound) &&
+		!errors.Is(err, ErrJobNotFound) && !errors.Is(err, ErrRedemptionNotFound) && !errors.Is(err, ErrInsufficientPoints) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (s tracedStore) Save(ctx context.Context, rec StoredReceipt) (err error) {
+	ctx, span := startStoreSpan(ctx, "Save", rec.ID)
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.Save(ctx, rec)
+}
+
+func (s tracedStore) SaveBatch(ctx context.Context, recs []StoredReceipt) (err error) {
+	ctx, span := startStoreSpan(ctx, "SaveBatch", "")
+	span.SetAttributes(attribute.Int("receipts", len(recs)))
+	defer func() { endStoreSpan(span, err) }()
+	return saveBatch(ctx, s.inner, recs)
+}
+
+func (s tracedStore) GetPointsBatch(ctx context.Context, tenant string, ids []string) (points map[string]int, err error) {
+	ctx, span := startStoreSpan(ctx, "GetPointsBatch", "")
+	span.SetAttributes(attribute.Int("receipts", len(ids)))
+	defer func() { endStoreSpan(span, err) }()
+	return getPointsBatch(ctx, s.inner, tenant, ids)
+}
+
+func (s tracedStore) Update(ctx context.Context, rec StoredReceipt) (old StoredReceipt, err error) {
+	ctx, span := startStoreSpan(ctx, "Update", rec.ID)
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.Update(ctx, rec)
+}
+
+func (s tracedStore) Get(ctx context.Context, tenant, id string) (rec StoredReceipt, err error) {
+	ctx, span := startStoreSpan(ctx, "Get", id)
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.Get(ctx, tenant, id)
+}
+
+func (s tracedStore) GetPoints(ctx context.Context, tenant, id string) (points int, err error) {
+	ctx, span := startStoreSpan(ctx, "GetPoints", id)
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.GetPoints(ctx, tenant, id)
+}
+
+func (s tracedStore) Delete(ctx context.Context, tenant, id string) (err error) {
+	ctx, span := startStoreSpan(ctx, "Delete", id)
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.Delete(ctx, tenant, id)
+}
+
+func (s tracedStore) List(ctx context.Context, tenant, after string, limit int) (recs []StoredReceipt, err error) {
+	ctx, span := startStoreSpan(ctx, "List", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.List(ctx, tenant, after, limit)
+}
+
+func (s tracedStore) Search(ctx context.Context, tenant string, f ReceiptFilter, after string, limit int) (recs []StoredReceipt, err error) {
+	ctx, span := startStoreSpan(ctx, "Search", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.Search(ctx, tenant, f, after, limit)
+}
+
+func (s tracedStore) Count(ctx context.Context) (n int, err error) {
+	ctx, span := startStoreSpan(ctx, "Count", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.Count(ctx)
+}
+
+func (s tracedStore) Tenants(ctx context.Context) (tenants []string, err error) {
+	ctx, span := startStoreSpan(ctx, "Tenants", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.Tenants(ctx)
+}
+
+func (s tracedStore) UserPoints(ctx context.Context, tenant, userID string, recent int) (up UserPoints, err error) {
+	ctx, span := startStoreSpan(ctx, "UserPoints", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.UserPoints(ctx, tenant, userID, recent)
+}
+
+func (s tracedStore) Redeem(ctx context.Context, red Redemption) (balance int, err error) {
+	ctx, span := startStoreSpan(ctx, "Redeem", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.Redeem(ctx, red)
+}
+
+func (s tracedStore) GetRedemption(ctx context.Context, tenant, id string) (red Redemption, err error) {
+	ctx, span := startStoreSpan(ctx, "GetRedemption", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.GetRedemption(ctx, tenant, id)
+}
+
+func (s tracedStore) AddLeaderboardPoints(ctx context.Context, tenant, userID string, periods []LeaderboardPeriod, points int) (err error) {
+	ctx, span := startStoreSpan(ctx, "AddLeaderboardPoints", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.AddLeaderboardPoints(ctx, tenant, userID, periods, points)
+}
+
+func (s tracedStore) Leaderboard(ctx context.Context, tenant string, period LeaderboardPeriod, limit int) (entries []LeaderboardEntry, err error) {
+	ctx, span := startStoreSpan(ctx, "Leaderboard", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.Leaderboard(ctx, tenant, period, limit)
+}
+
+func (s tracedStore) DeleteExpired(ctx context.Context, cutoff time.Time, byPurchaseDate bool) (expired []StoredReceipt, err error) {
+	ctx, span := startStoreSpan(ctx, "DeleteExpired", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.DeleteExpired(ctx, cutoff, byPurchaseDate)
+}
+
+func (s tracedStore) ClaimIdempotencyKey(ctx context.Context, key, id string, ttl time.Duration) (linkedID string, err error) {
+	ctx, span := startStoreSpan(ctx, "ClaimIdempotencyKey", id)
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.ClaimIdempotencyKey(ctx, key, id, ttl)
+}
+
+func (s tracedStore) ReleaseIdempotencyKey(ctx context.Context, key string) (err error) {
+	ctx, span := startStoreSpan(ctx, "ReleaseIdempotencyKey", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.ReleaseIdempotencyKey(ctx, key)
+}
+
+func (s tracedStore) CreateAPIKey(ctx context.Context, key APIKey) (err error) {
+	ctx, span := startStoreSpan(ctx, "CreateAPIKey", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.CreateAPIKey(ctx, key)
+}
+
+func (s tracedStore) GetAPIKeyByHash(ctx context.Context, hash string) (key APIKey, err error) {
+	ctx, span := startStoreSpan(ctx, "GetAPIKeyByHash", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.GetAPIKeyByHash(ctx, hash)
+}
+
+func (s tracedStore) ListAPIKeys(ctx context.Context) (keys []APIKey, err error) {
+	ctx, span := startStoreSpan(ctx, "ListAPIKeys", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.ListAPIKeys(ctx)
+}
+
+func (s tracedStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) (err error) {
+	ctx, span := startStoreSpan(ctx, "RevokeAPIKey", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.RevokeAPIKey(ctx, id, at)
+}
+
+func (s tracedStore) CreateWebhook(ctx context.Context, hook Webhook) (err error) {
+	ctx, span := startStoreSpan(ctx, "CreateWebhook", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.CreateWebhook(ctx, hook)
+}
+
+func (s tracedStore) ListWebhooks(ctx context.Context) (hooks []Webhook, err error) {
+	ctx, span := startStoreSpan(ctx, "ListWebhooks", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.ListWebhooks(ctx)
+}
+
+func (s tracedStore) DeleteWebhook(ctx context.Context, id string) (err error) {
+	ctx, span := startStoreSpan(ctx, "DeleteWebhook", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.DeleteWebhook(ctx, id)
+}
+
+func (s tracedStore) SaveJob(ctx context.Context, job Job, ttl time.Duration) (err error) {
+	ctx, span := startStoreSpan(ctx, "SaveJob", job.ReceiptID)
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.SaveJob(ctx, job, ttl)
+}
+
+func (s tracedStore) GetJob(ctx context.Context, tenant, id string) (job Job, err error) {
+	ctx, span := startStoreSpan(ctx, "GetJob", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.GetJob(ctx, tenant, id)
+}
+
+func (s tracedStore) SaveFlags(ctx context.Context, flags ReceiptFlags) (err error) {
+	ctx, span := startStoreSpan(ctx, "SaveFlags", flags.ReceiptID)
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.SaveFlags(ctx, flags)
+}
+
+func (s tracedStore) GetFlags(ctx context.Context, tenant, id string) (flags ReceiptFlags, err error) {
+	ctx, span := startStoreSpan(ctx, "GetFlags", id)
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.GetFlags(ctx, tenant, id)
+}
+
+func (s tracedStore) ReviewQueue(ctx context.Context, tenant, after string, limit int) (queue []ReceiptFlags, err error) {
+	ctx, span := startStoreSpan(ctx, "ReviewQueue", "")
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.ReviewQueue(ctx, tenant, after, limit)
+}
+
+func (s tracedStore) AppendHistory(ctx context.Context, tenant, id string, ev ScoringEvent) (err error) {
+	ctx, span := startStoreSpan(ctx, "AppendHistory", id)
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.AppendHistory(ctx, tenant, id, ev)
+}
+
+func (s tracedStore) History(ctx context.Context, tenant, id string) (events []ScoringEvent, err error) {
+	ctx, span := startStoreSpan(ctx, "History", id)
+	defer func() { endStoreSpan(span, err) }()
+	return s.inner.History(ctx, tenant, id)
+}
+
+func (s tracedStore) Ping(ctx context.Context) (err error) {
+	p, ok := s.inner.(Pinger)
+	if !ok {
+		return nil
+	}
+	ctx, span := startStoreSpan(ctx, "Ping", "")
+	defer func() { endStoreSpan(span, err) }()
+	return p.Ping(ctx)
+}
+
+func (s tracedStore) Close() error {
+	return s.inner.Close()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A user's points as a ReceiptStore keeps them: Earned, the points their
+// receipts were credited with as they were stored and changed, Redeemed,
+// the points of all their redemptions, how many receipts are stored, and
+// the most recent receipts and redemptions. Earned doesn't depend on the
+// receipts still being stored, so deleting, expiring or evicting one
+// leaves it as it was.
+type UserPoints struct {
+	Earned      int
+	Redeemed    int
+	Receipts    int
+	Recent      []StoredReceipt
+	Redemptions []Redemption
+}
+
+// balance is what the user has left to redeem.
+func (up UserPoints) balance() int {
+	return up.Earned - up.Redeemed
+}
+
+// add counts a stored receipt in Receipts and Recent.
+func (up *UserPoints) add(rec StoredReceipt) {
+	up.Receipts++
+	up.Recent = append(up.Recent, rec)
+}
+
+// addRedemption takes a redemption off the balance.
+func (up *UserPoints) addRedemption(red Redemption) {
+	up.Redeemed += red.Points
+	up.Redemptions = append(up.Redemptions, red)
+}
+
+// keepRecent keeps the n most recent receipts in Recent and redemptions in
+// Redemptions, newest first.
+func (up *UserPoints) keepRecent(n int) {
+	sort.Slice(up.Recent, func(i, j int) bool {
+		a, b := up.Recent[i], up.Recent[j]
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.After(b.CreatedAt)
+		}
+		return a.ID > b.ID
+	})
+	if len(up.Recent) > n {
+		up.Recent = up.Recent[:n]
+	}
+	sort.Slice(up.Redemptions, func(i, j int) bool {
+		a, b := up.Redemptions[i], up.Redemptions[j]
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.After(b.CreatedAt)
+		}
+		return a.ID > b.ID
+	})
+	if len(up.Redemptions) > n {
+		up.Redemptions = up.Redemptions[:n]
+	}
+}
+
+// Response for GET /users/{id}/points. Points is the balance: the points
+// Earned from receipts less those Redeemed.
+type UserPointsResponse struct {
+	UserID      string               `json:"userId"`
+	Points      int                  `json:"points"`
+	Earned      int                  `json:"earned"`
+	Redeemed    int                  `json:"redeemed"`
+	Receipts    int                  `json:"receipts"`
+	Recent      []UserReceiptSummary `json:"recent"`
+	Redemptions []Redemption         `json:"redemptions"`
+}
+
+// One receipt in a UserPointsResponse
+type UserReceiptSummary struct {
+	ReceiptSummary
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// getUserPointsHandler handles GET /users/{id}/points
+// The balance is the sum of the points of every stored receipt submitted
+// with the user's userId, less what they redeemed, so it follows receipts
+// being updated, deleted or recalculated. A user without receipts has a
+// balance of zero.
+func getUserPointsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := pathUserID(w, r)
+	if !ok {
+		return
+	}
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 100 {
+			p := newProblem(http.StatusBadRequest, codeInvalidParameter, "limit must be between 0 and 100")
+			p.Field = "limit"
+			writeProblem(w, p)
+			return
+		}
+		limit = n
+	}
+
+	up, err := store.UserPoints(r.Context(), tenantFrom(r.Context()), userID, limit)
+	if err != nil {
+		requestLogger(r).Error("Error adding up user points", "user_id", userID, "err", err)
+		writeProblem(w, storeFailure(err, "Error getting user points"))
+		return
+	}
+
+	resp := UserPointsResponse{
+		UserID:      userID,
+		Points:      up.balance(),
+		Earned:      up.Earned,
+		Redeemed:    up.Redeemed,
+		Receipts:    up.Receipts,
+		Recent:      []UserReceiptSummary{},
+		Redemptions: up.Redemptions,
+	}
+	if resp.Redemptions == nil {
+		resp.Redemptions = []Redemption{}
+	}
+	for _, rec := range up.Recent {
+		resp.Recent = append(resp.Recent, UserReceiptSummary{
+			ReceiptSummary: ReceiptSummary{
+				ID:           rec.ID,
+				Retailer:     rec.Receipt.Retailer,
+				PurchaseDate: rec.Receipt.PurchaseDate,
+				Points:       rec.Points,
+			},
+			CreatedAt: rec.CreatedAt,
+		})
+	}
+
+	writeResponse(w, r, resp, nil)
+}
+
+// pathUserID returns the user ID in the request path. When it is malformed
+// it has already answered the request and ok is false.
+func pathUserID(w http.ResponseWriter, r *http.Request) (userID string, ok bool) {
+	userID = pathParam(r, "id")
+	if !userIDPattern.MatchString(userID) {
+		p := newProblem(http.StatusBadRequest, codeInvalidParameter, "userId may only contain letters, digits, '.', '@', '-' and '_', up to 128 of them")
+		p.Field = "id"
+		writeProblem(w, p)
+		return "", false
+	}
+	return userID, true
+}
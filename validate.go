@@ -0,0 +1,137 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"time"
+	"unicode"
+)
+
+// Patterns from the receipt processor API schema, as published in the
+// generated schemas. Retailers may also use letters, digits and accents
+// outside ASCII, such as "Übermarkt". validateReceipt checks them with
+// isRetailer and isDescription, which are cheaper than
+// matching the regular expressions.
+var (
+	retailerPattern    = regexp.MustCompile(`^[\w\p{L}\p{M}\p{N}\s\-&]+$`)
+	descriptionPattern = regexp.MustCompile(`^[\w\s\-]+$`)
+)
+
+// Matches the optional userId of a receipt. It is checked even with a
+// custom SCHEMA_FILE, since it names whose balance the points go to.
+var userIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,128}$`)
+
+// A problem with one field of a submitted receipt, such as
+// Field "items[2].price" and Message "must be an amount like 1.25".
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+func (e *FieldError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+// validateReceipt checks a receipt against the API schema, returning a
+// *FieldError for the first field that is missing or malformed.
+func validateReceipt(receipt Receipt) error {
+	if receipt.Retailer == "" {
+		return &FieldError{"retailer", "is required"}
+	}
+	if !isRetailer(receipt.Retailer) {
+		return &FieldError{"retailer", "may only contain letters, digits, spaces, '-' and '&'"}
+	}
+	if receipt.PurchaseDate == "" {
+		return &FieldError{"purchaseDate", "is required"}
+	}
+	if _, err := time.Parse(dateLayout, receipt.PurchaseDate); err != nil {
+		return &FieldError{"purchaseDate", "must be a date like 2022-01-31"}
+	}
+	if receipt.PurchaseTime == "" {
+		return &FieldError{"purchaseTime", "is required"}
+	}
+	if _, err := time.Parse(clockLayout, receipt.PurchaseTime); err != nil {
+		return &FieldError{"purchaseTime", "must be a 24-hour time like 13:01"}
+	}
+	if receipt.Currency != "" {
+		if _, ok := currencyDecimals[receipt.Currency]; !ok {
+			return &FieldError{"currency", "must be a supported currency code such as EUR"}
+		}
+	}
+	decimals := currencyDecimals[receiptCurrency(receipt)]
+	example := currencyAmountExample(receiptCurrency(receipt))
+	if receipt.Timezone != "" {
+		if _, err := loadTimezone(receipt.Timezone); err != nil {
+			return &FieldError{"timezone", "must be an IANA time zone such as America/Chicago"}
+		}
+	}
+	if receipt.Total == "" {
+		return &FieldError{"total", "is required"}
+	}
+	if !isAmount(receipt.Total, decimals) {
+		return &FieldError{"total", "must be an amount like " + example}
+	}
+	if len(receipt.Items) == 0 {
+		return &FieldError{"items", "must contain at least one item"}
+	}
+	for i, item := range receipt.Items {
+		if item.ShortDescription == "" {
+			return &FieldError{itemField(i, "shortDescription"), "is required"}
+		}
+		if !isDescription(item.ShortDescription) {
+			return &FieldError{itemField(i, "shortDescription"), "may only contain letters, digits, spaces and '-'"}
+		}
+		if item.Price == "" {
+			return &FieldError{itemField(i, "price"), "is required"}
+		}
+		if !isAmount(item.Price, decimals) {
+			return &FieldError{itemField(i, "price"), "must be an amount like " + example}
+		}
+	}
+	return nil
+}
+
+// itemField names a field of the item at index i, such as
+// "items[2].price". It is only built for an error, so valid items cost
+// nothing.
+func itemField(i int, name string) string {
+	return "items[" + strconv.Itoa(i) + "]." + name
+}
+
+// isRetailer reports whether s matches retailerPattern.
+func isRetailer(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !isWordOrSpace(c) && c != '-' && c != '&' && !unicode.In(c, unicode.L, unicode.M, unicode.N) {
+			return false
+		}
+	}
+	return true
+}
+
+// isDescription reports whether s matches descriptionPattern.
+func isDescription(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !isWordOrSpace(c) && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// isWordOrSpace reports whether c is in \w or \s as regexp has them: an
+// ASCII letter, digit or underscore, or ASCII white space.
+func isWordOrSpace(c rune) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '_':
+		return true
+	case c == ' ', c == '\t', c == '\n', c == '\f', c == '\r':
+		return true
+	}
+	return false
+}
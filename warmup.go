@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// The receipt scored during warmup, the example from the README
+var warmupReceipt = []byte(`{
+  "retailer": "Target",
+  "purchaseDate": "2022-01-01",
+  "purchaseTime": "13:01",
+  "items": [
+    {"shortDescription": "Mountain Dew 12PK", "price": "6.49"},
+    {"shortDescription": "Emils Cheese Pizza", "price": "12.25"},
+    {"shortDescription": "Knorr Creamy Chicken", "price": "1.26"},
+    {"shortDescription": "Doritos Nacho Cheese", "price": "3.35"},
+    {"shortDescription": "   Klarbrunn 12-PK 12 FL OZ  ", "price": "12.00"}
+  ],
+  "total": "35.35"
+}`)
+
+// Set once warmup has finished, so /readyz keeps load balancers away from
+// an instance that is still starting.
+var warmedUp atomic.Bool
+
+// warmup gets the instance ready for traffic: it checks the store answers,
+// when it can be asked, and validates and scores warmupReceipt n times, as
+// a submission would be but without storing it, so the first requests
+// don't pay for cold caches. It then marks the instance ready; with n 0
+// it does so at once. Failures are logged, since the instance can serve
+// regardless.
+func warmup(ctx context.Context, n int) {
+	defer warmedUp.Store(true)
+	if n == 0 {
+		return
+	}
+	start := time.Now()
+	if p, ok := store.(Pinger); ok {
+		if err := p.Ping(ctx); err != nil {
+			slog.Warn("Store is not reachable during warmup", "err", err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		if _, _, err := scorePayload(ctx, warmupReceipt); err != nil {
+			slog.Warn("Error scoring the warmup receipt", "err", err)
+			break
+		}
+	}
+	slog.Info("Warmed up", "receipts", n, "duration", time.Since(start))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// gatedPingStore answers pings once open is closed.
+type gatedPingStore struct {
+	ReceiptStore
+	open chan struct{}
+}
+
+func (s gatedPingStore) Ping(ctx context.Context) error {
+	select {
+	case <-s.open:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestReadyAfterWarmup(t *testing.T) {
+	newTestAPI(t)
+	defer func(v bool) { warmedUp.Store(v) }(warmedUp.Load())
+	warmedUp.Store(false)
+	gated := gatedPingStore{ReceiptStore: store, open: make(chan struct{})}
+	store = gated
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		readyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+		return rec.Code
+	}
+
+	done := make(chan struct{})
+	go func() {
+		warmup(context.Background(), 3)
+		close(done)
+	}()
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("during warmup: status %d, want 503", code)
+	}
+	close(gated.open)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("warmup did not finish")
+	}
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("after warmup: status %d, want 200", code)
+	}
+}
+
+func TestNoWarmup(t *testing.T) {
+	newTestAPI(t)
+	defer func(v bool) { warmedUp.Store(v) }(warmedUp.Load())
+	warmedUp.Store(false)
+	warmup(context.Background(), 0)
+	rec := httptest.NewRecorder()
+	readyzHandler(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("status %d, want 200", rec.Code)
+	}
+}
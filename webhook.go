@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Returned by a ReceiptStore when no webhook has the given ID.
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// A URL that is sent an event for every processed receipt. A webhook with
+// a tenant only hears about that tenant's receipts; one without hears
+// about every tenant's. The secret signs the events and is shown once,
+// when the webhook is created.
+type Webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Secret    string    `json:"-"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Request body for POST /admin/webhooks
+type CreateWebhookRequest struct {
+	URL    string `json:"url"`
+	Tenant string `json:"tenant"`
+}
+
+// Response for POST /admin/webhooks
+type CreateWebhookResponse struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+// Response for GET /admin/webhooks
+type ListWebhooksResponse struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// The body POSTed to a webhook, and of the events published to NATS. Type
+// is "receipt.processed"; ID is the same on every retry of the event, so
+// receivers can ignore repeats.
+type WebhookEvent struct {
+	ID        string                `json:"id"`
+	Type      string                `json:"type"`
+	CreatedAt time.Time             `json:"createdAt"`
+	Data      ReceiptProcessedEvent `json:"data"`
+}
+
+// What a receipt.processed event says about the receipt
+type ReceiptProcessedEvent struct {
+	ReceiptID string `json:"receiptId"`
+	Tenant    string `json:"tenant,omitempty"`
+	Retailer  string `json:"retailer"`
+	Points    int    `json:"points"`
+}
+
+// createWebhookHandler handles POST /admin/webhooks
+// The signing secret is only ever returned in this response.
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var req CreateWebhookRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) {
+		writeProblem(w, unreadableBody(err))
+		return
+	}
+	u, uerr := url.Parse(req.URL)
+	if err != nil || uerr != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		p := newProblem(http.StatusBadRequest, codeInvalidParameter, "An http or https url for the webhook is required")
+		p.Field = "url"
+		writeProblem(w, p)
+		return
+	}
+	if req.Tenant != "" && !tenantPattern.MatchString(req.Tenant) {
+		p := newProblem(http.StatusBadRequest, codeInvalidParameter, "tenant may only contain letters, digits, '-' and '_'")
+		p.Field = "tenant"
+		writeProblem(w, p)
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		requestLogger(r).Error("Error generating webhook secret", "err", err)
+		writeProblem(w, newProblem(http.StatusInternalServerError, codeInternal, "Error creating webhook"))
+		return
+	}
+	hook := Webhook{ID: uuid.New().String(), URL: req.URL, Tenant: req.Tenant, Secret: "whsec_" + base64.RawURLEncoding.EncodeToString(secret), CreatedAt: time.Now().UTC()}
+	if err := store.CreateWebhook(r.Context(), hook); err != nil {
+		requestLogger(r).Error("Error saving webhook", "err", err)
+		writeProblem(w, storeFailure(err, "Error creating webhook"))
+		return
+	}
+	webhooks.invalidate()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(CreateWebhookResponse{Webhook: hook, Secret: hook.Secret})
+}
+
+// listWebhooksHandler handles GET /admin/webhooks
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	hooks, err := store.ListWebhooks(r.Context())
+	if err != nil {
+		requestLogger(r).Error("Error listing webhooks", "err", err)
+		writeProblem(w, storeFailure(err, "Error listing webhooks"))
+		return
+	}
+	if hooks == nil {
+		hooks = []Webhook{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ListWebhooksResponse{Webhooks: hooks})
+}
+
+// deleteWebhookHandler handles DELETE /admin/webhooks/{id}
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	err := store.DeleteWebhook(r.Context(), id)
+	if errors.Is(err, ErrWebhookNotFound) {
+		writeProblem(w, newProblem(http.StatusNotFound, codeNotFound, "Webhook not found"))
+		return
+	}
+	if err != nil {
+		requestLogger(r).Error("Error deleting webhook", "webhook_id", id, "err", err)
+		writeProblem(w, storeFailure(err, "Error deleting webhook"))
+		return
+	}
+	webhooks.invalidate()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Delivers events to the registered webhooks. Set up in main.
+var webhooks *webhookDispatcher
+
+// How long the list of webhooks is cached. Changes made through this
+// instance take effect at once; those made through others within this time.
+const webhookCacheTTL = 30 * time.Second
+
+// One event on its way to one webhook
+type webhookDelivery struct {
+	hook Webhook
+	body []byte
+	id   string
+}
+
+// webhookDispatcher sends events from a queue with a few workers. Failed
+// deliveries are retried with exponential backoff, from one second up to
+// a minute, until maxAttempts. With a batchSize above 1 each webhook's
+// events are collected and sent together as a JSON array, once batchSize
+// of them are waiting or batchInterval after the first. Events still
+// waiting or queued when the process stops are lost.
+type webhookDispatcher struct {
+	queue         chan webhookDelivery
+	client        *http.Client
+	maxAttempts   int
+	batchSize     int
+	batchInterval time.Duration
+	stopping      chan struct{}
+	wg            sync.WaitGroup
+
+	mu       sync.Mutex
+	hooks    []Webhook
+	loadedAt time.Time
+
+	batchMu sync.Mutex
+	batches map[string]*webhookBatch // by webhook ID
+}
+
+// Events waiting to be sent to one webhook together
+type webhookBatch struct {
+	hook   Webhook
+	events []json.RawMessage
+	timer  *time.Timer
+}
+
+// newWebhookDispatcher starts workers delivering events, one at a time
+// when batchSize is 1.
+func newWebhookDispatcher(workers, maxAttempts, batchSize int, batchInterval time.Duration) *webhookDispatcher {
+	d := &webhookDispatcher{
+		queue:         make(chan webhookDelivery, 1000),
+		client:        &http.Client{Timeout: 10 * time.Second},
+		maxAttempts:   maxAttempts,
+		batchSize:     batchSize,
+		batchInterval: batchInterval,
+		stopping:      make(chan struct{}),
+		batches:       make(map[string]*webhookBatch),
+	}
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.work()
+	}
+	return d
+}
+
+// stop ends delivery, letting attempts in flight finish until ctx is done.
+func (d *webhookDispatcher) stop(ctx context.Context) {
+	d.batchMu.Lock()
+	for id, b := range d.batches {
+		b.timer.Stop()
+		delete(d.batches, id)
+	}
+	d.batchMu.Unlock()
+	close(d.stopping)
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// invalidate makes the next event reload the webhooks from the store.
+func (d *webhookDispatcher) invalidate() {
+	d.mu.Lock()
+	d.loadedAt = time.Time{}
+	d.mu.Unlock()
+}
+
+// subscribers returns the webhooks that hear about tenant's receipts.
+func (d *webhookDispatcher) subscribers(ctx context.Context, tenant string) ([]Webhook, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if time.Since(d.loadedAt) > webhookCacheTTL {
+		hooks, err := store.ListWebhooks(ctx)
+		if err != nil {
+			return nil, err
+		}
+		d.hooks, d.loadedAt = hooks, time.Now()
+	}
+	var subs []Webhook
+	for _, hook := range d.hooks {
+		if hook.Tenant == "" || hook.Tenant == tenant {
+			subs = append(subs, hook)
+		}
+	}
+	return subs, nil
+}
+
+// receiptProcessed queues a receipt.processed event for every subscribed
+// webhook, or adds it to the webhook's batch. It never blocks: when the
+// queue is full the event, or the batch, is dropped and logged.
+func (d *webhookDispatcher) receiptProcessed(ctx context.Context, rec StoredReceipt) {
+	hooks, err := d.subscribers(ctx, rec.Tenant)
+	if err != nil {
+		slog.Error("Error loading webhooks", "err", err)
+		return
+	}
+	if len(hooks) == 0 {
+		return
+	}
+	event := receiptProcessedEvent(rec)
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Error encoding webhook event", "err", err)
+		return
+	}
+	for _, hook := range hooks {
+		if d.batchSize > 1 {
+			d.addToBatch(hook, body)
+			continue
+		}
+		d.enqueue(webhookDelivery{hook: hook, body: body, id: event.ID})
+	}
+}
+
+// addToBatch adds an encoded event to the webhook's batch, sending the
+// batch when it is full. The first event of a batch starts the timer that
+// sends it when it isn't.
+func (d *webhookDispatcher) addToBatch(hook Webhook, event []byte) {
+	d.batchMu.Lock()
+	defer d.batchMu.Unlock()
+	b := d.batches[hook.ID]
+	if b == nil {
+		b = &webhookBatch{hook: hook}
+		b.timer = time.AfterFunc(d.batchInterval, func() {
+			d.batchMu.Lock()
+			defer d.batchMu.Unlock()
+			if d.batches[hook.ID] == b {
+				d.sendBatch(b)
+			}
+		})
+		d.batches[hook.ID] = b
+	}
+	b.events = append(b.events, event)
+	if len(b.events) >= d.batchSize {
+		b.timer.Stop()
+		d.sendBatch(b)
+	}
+}
+
+// sendBatch queues the batch's events as one JSON array under a new ID;
+// each event keeps its own ID. The caller must hold batchMu.
+func (d *webhookDispatcher) sendBatch(b *webhookBatch) {
+	delete(d.batches, b.hook.ID)
+	body, err := json.Marshal(b.events)
+	if err != nil {
+		slog.Error("Error encoding webhook batch", "err", err)
+		return
+	}
+	d.enqueue(webhookDelivery{hook: b.hook, body: body, id: uuid.New().String()})
+}
+
+// enqueue hands a delivery to the workers, dropping it when the queue is
+// full.
+func (d *webhookDispatcher) enqueue(del webhookDelivery) {
+	select {
+	case d.queue <- del:
+	default:
+		slog.Warn("Webhook queue full, dropping event", "webhook_id", del.hook.ID, "event_id", del.id)
+	}
+}
+
+// receiptProcessedEvent returns a new event about the stored receipt rec.
+func receiptProcessedEvent(rec StoredReceipt) WebhookEvent {
+	return WebhookEvent{
+		ID:        uuid.New().String(),
+		Type:      "receipt.processed",
+		CreatedAt: time.Now().UTC(),
+		Data:      ReceiptProcessedEvent{ReceiptID: rec.ID, Tenant: rec.Tenant, Retailer: rec.Receipt.Retailer, Points: rec.Points},
+	}
+}
+
+func (d *webhookDispatcher) work() {
+	defer d.wg.Done()
+	for {
+		select {
+		case <-d.stopping:
+			return
+		case del := <-d.queue:
+			d.deliver(del)
+		}
+	}
+}
+
+// deliver sends one event, retrying until it is accepted with a 2xx, the
+// attempts run out or the dispatcher stops.
+func (d *webhookDispatcher) deliver(del webhookDelivery) {
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		err := d.send(del)
+		if err == nil {
+			return
+		}
+		if attempt >= d.maxAttempts {
+			slog.Error("Giving up on webhook delivery", "webhook_id", del.hook.ID, "event_id", del.id, "attempts", attempt, "err", err)
+			return
+		}
+		slog.Warn("Webhook delivery failed, retrying", "webhook_id", del.hook.ID, "event_id", del.id, "attempt", attempt, "retry_in", backoff.String(), "err", err)
+		select {
+		case <-d.stopping:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// send POSTs the event once. The X-Webhook-Signature header is
+// "sha256=" and the hex HMAC-SHA256, keyed with the webhook's secret, of
+// the X-Webhook-Timestamp value, a '.', and the body.
+func (d *webhookDispatcher) send(del webhookDelivery) error {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(del.hook.Secret))
+	mac.Write([]byte(ts + "."))
+	mac.Write(del.body)
+
+	req, err := http.NewRequest(http.MethodPost, del.hook.URL, bytes.NewReader(del.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-ID", del.id)
+	req.Header.Set("X-Webhook-Timestamp", ts)
+	req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
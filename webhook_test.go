@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookBatching(t *testing.T) {
+	tests := []struct {
+		name         string
+		batchSize    int
+		events       int
+		wantRequests []int // events in each request, in the order sent
+	}{
+		{name: "one at a time", batchSize: 1, events: 3, wantRequests: []int{1, 1, 1}},
+		{name: "batch sent after the interval", batchSize: 10, events: 3, wantRequests: []int{3}},
+		{name: "full batches sent at once", batchSize: 2, events: 5, wantRequests: []int{2, 2, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var requests []int
+			received := make(chan struct{}, 10)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				n := 1
+				if tt.batchSize > 1 {
+					var events []WebhookEvent
+					if err := json.Unmarshal(body, &events); err != nil {
+						t.Errorf("batch %s: %v", body, err)
+					}
+					n = len(events)
+				}
+				mu.Lock()
+				requests = append(requests, n)
+				mu.Unlock()
+				received <- struct{}{}
+			}))
+			defer srv.Close()
+
+			prevStore := store
+			store = newMemoryStore(0)
+			defer func() { store = prevStore }()
+			if err := store.CreateWebhook(context.Background(), Webhook{ID: "hook", URL: srv.URL}); err != nil {
+				t.Fatal(err)
+			}
+			// One worker, so requests arrive in the order they were queued.
+			d := newWebhookDispatcher(1, 1, tt.batchSize, 50*time.Millisecond)
+			defer d.stop(context.Background())
+
+			for i := 0; i < tt.events; i++ {
+				d.receiptProcessed(context.Background(), StoredReceipt{ID: "r", Receipt: Receipt{Retailer: "Target"}, Points: 28})
+			}
+			for range tt.wantRequests {
+				select {
+				case <-received:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("got requests %v, want %v", requests, tt.wantRequests)
+				}
+			}
+			// Give a request too many the time to show up.
+			time.Sleep(100 * time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			if len(requests) != len(tt.wantRequests) {
+				t.Fatalf("got requests %v, want %v", requests, tt.wantRequests)
+			}
+			for i := range requests {
+				if requests[i] != tt.wantRequests[i] {
+					t.Errorf("got requests %v, want %v", requests, tt.wantRequests)
+					break
+				}
+			}
+		})
+	}
+}
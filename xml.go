@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/http"
+)
+
+// sentXML reports whether the request body is XML, going by its
+// Content-Type.
+func sentXML(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/xml" || mediaType == "text/xml"
+}
+
+// xmlReceipt turns a receipt sent as XML, for point of sale systems that
+// can't send JSON, into a JSON receipt, so it is validated and scored just
+// the same. The elements are named like the JSON fields:
+//
+//	<receipt>
+//	  <retailer>Target</retailer>
+//	  <purchaseDate>2022-01-01</purchaseDate>
+//	  <purchaseTime>13:01</purchaseTime>
+//	  <items>
+//	    <item><shortDescription>Mountain Dew 12PK</shortDescription><price>6.49</price></item>
+//	  </items>
+//	  <total>6.49</total>
+//	</receipt>
+func xmlReceipt(body []byte) ([]byte, *Problem) {
+	dec := xml.NewDecoder(bytes.NewReader(body))
+	var receipt Receipt
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, newProblem(http.StatusBadRequest, codeInvalidXML, "Invalid XML payload: expected a <receipt> element")
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			// The XML declaration, comments and white space before the root.
+			continue
+		}
+		if start.Name.Local != "receipt" {
+			return nil, newProblem(http.StatusBadRequest, codeInvalidXML, "Invalid XML payload: expected a <receipt> element, not <"+start.Name.Local+">")
+		}
+		if err := dec.DecodeElement(&receipt, &start); err != nil {
+			return nil, newProblem(http.StatusBadRequest, codeInvalidXML, "Invalid XML payload")
+		}
+		break
+	}
+	payload, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, newProblem(http.StatusBadRequest, codeInvalidXML, "Invalid XML payload")
+	}
+	return payload, nil
+}